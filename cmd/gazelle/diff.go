@@ -43,10 +43,22 @@ func diffFile(c *config.Config, file *bzl.File, path string) error {
 	if err := ioutil.WriteFile(f.Name(), newContents, 0666); err != nil {
 		return err
 	}
-	cmd := exec.Command("diff", "-u", "--new-file", path, f.Name())
+	return runDiff(path, f.Name())
+}
+
+// diffRemovedFile prints a diff that deletes the contents of path.
+func diffRemovedFile(c *config.Config, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return runDiff(path, os.DevNull)
+}
+
+func runDiff(oldPath, newPath string) error {
+	cmd := exec.Command("diff", "-u", "--new-file", oldPath, newPath)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err := cmd.Run()
 	if _, ok := err.(*exec.ExitError); ok {
 		// diff returns non-zero when files are different. This is not an error.
 		return nil
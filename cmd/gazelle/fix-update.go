@@ -21,7 +21,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	gzflag "github.com/bazelbuild/bazel-gazelle/internal/flag"
@@ -39,8 +42,25 @@ import (
 // includes some additional fields that aren't relevant to other packages.
 type updateConfig struct {
 	emit              emitFunc
+	remove            removeFunc
+	emptyFiles        string
 	outDir, outSuffix string
+	jsonOut           string
+	checkVisibility   bool
+	failOnDupImports  bool
+	foldImportCase    bool
+	pruneEmbedded     bool
+	validateDeps      string
+	incrementalMarker string
+	full              bool
+	workers           int
 	repos             []repos.Repo
+	knownImports      []string
+
+	// onlyAttrs lists the only attributes of existing rules that may be
+	// modified. When non-nil, rules and build files aren't added or deleted.
+	// Set with -only_attrs.
+	onlyAttrs []string
 }
 
 type emitFunc func(*config.Config, *bzl.File, string) error
@@ -51,6 +71,47 @@ var modeFromName = map[string]emitFunc{
 	"diff":  diffFile,
 }
 
+// removeFunc is called instead of emitFunc for build files that are deleted
+// because they're empty. See -empty_build_files.
+type removeFunc func(c *config.Config, path string) error
+
+var removeModeFromName = map[string]removeFunc{
+	"print": printRemovedFile,
+	"fix":   removeFile,
+	"diff":  diffRemovedFile,
+}
+
+// Values of -empty_build_files, which determines what happens to build files
+// that have no statements or comments after they're updated.
+const (
+	// keepEmptyFiles indicates empty build files are written, so the
+	// packages they define are preserved.
+	keepEmptyFiles = "keep"
+
+	// deleteEmptyFiles indicates empty build files are deleted.
+	deleteEmptyFiles = "delete"
+
+	// ignoreEmptyFiles indicates a # gazelle:ignore directive is written to
+	// empty build files, so they're preserved, and Gazelle doesn't update
+	// them again.
+	ignoreEmptyFiles = "ignore"
+)
+
+// Values of -validate_deps, which determines what happens when a resolved
+// dependency names a rule in the repository that Gazelle didn't index.
+const (
+	// ignoreMissingDeps indicates dependencies aren't validated.
+	ignoreMissingDeps = "off"
+
+	// warnMissingDeps indicates a warning is logged for each missing
+	// dependency.
+	warnMissingDeps = "warn"
+
+	// failOnMissingDeps indicates an error is logged for each missing
+	// dependency, and Gazelle fails without writing any build files.
+	failOnMissingDeps = "error"
+)
+
 const updateName = "_update"
 
 func getUpdateConfig(c *config.Config) *updateConfig {
@@ -59,6 +120,21 @@ func getUpdateConfig(c *config.Config) *updateConfig {
 
 type updateConfigurer struct {
 	mode string
+
+	// stats indicates that a summary of how imports were resolved is
+	// printed after rules are resolved. Set with -stats.
+	stats bool
+
+	// onlyAttrs is the comma-separated value of -only_attrs, which is split
+	// into updateConfig.onlyAttrs.
+	onlyAttrs string
+
+	// kinds, kindToResolver, and loads describe the kinds of rules that
+	// Gazelle can generate. Configure adds kinds introduced by
+	// # gazelle:map_kind directives.
+	kinds          map[string]rule.KindInfo
+	kindToResolver map[string]resolve.Resolver
+	loads          []rule.LoadInfo
 }
 
 func (ucr *updateConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
@@ -70,6 +146,20 @@ func (ucr *updateConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *conf
 	fs.StringVar(&ucr.mode, "mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff")
 	fs.StringVar(&uc.outDir, "experimental_out_dir", "", "write build files to an alternate directory tree")
 	fs.StringVar(&uc.outSuffix, "experimental_out_suffix", "", "extra suffix appended to build file names. Only used if -experimental_out_dir is also set.")
+	fs.StringVar(&uc.jsonOut, "json_out", "", "if set, a JSON description of generated rules is written to this file")
+	fs.StringVar(&uc.incrementalMarker, "incremental_marker", "", "if set, only directories with files modified since the time recorded in this\n\tfile are updated. The file is updated after each successful run in fix mode.\n\tRelative paths are relative to the repository root.")
+	fs.BoolVar(&c.CreateOnly, "create_only", false, "if true, build files are only created in directories that don't have one. Existing\n\tbuild files are not modified, but rules in them are still indexed.")
+	fs.BoolVar(&uc.full, "full", false, "if true, all directories are updated, even if -incremental_marker is set")
+	fs.IntVar(&uc.workers, "workers", 1, "maximum number of directories to generate rules for concurrently. If 1,\n\tdirectories are processed serially.")
+	fs.BoolVar(&uc.checkVisibility, "check_visibility", false, "if true, dependencies are not resolved to rules that aren't visible to the\n\timporting rule, unless no visible rule provides the import")
+	fs.BoolVar(&uc.foldImportCase, "case_insensitive_imports", false, "if true, imports are matched with rules that provide them without regard to\n\tcase, as on case-insensitive file systems")
+	fs.BoolVar(&uc.pruneEmbedded, "prune_embedded_deps", false, "if true, dependencies on rules embedded by other dependencies of the same\n\trule are removed")
+	fs.BoolVar(&c.AnnotateDeps, "annotate_deps", false, "if true, a comment explaining how each dependency was resolved is added to\n\tdeps, for example, \"# resolved via index\"")
+	fs.StringVar(&uc.emptyFiles, "empty_build_files", keepEmptyFiles, "what to do with build files that are empty after they're updated:\n\tkeep: write the empty file, preserving the package\n\tdelete: delete the file\n\tignore: write a # gazelle:ignore directive to the file")
+	fs.StringVar(&uc.validateDeps, "validate_deps", ignoreMissingDeps, "whether to check that resolved dependencies in the repository name indexed rules:\n\toff: don't check dependencies\n\twarn: print a warning for each missing dependency\n\terror: print an error for each missing dependency and fail without writing\n\tbuild files")
+	fs.BoolVar(&uc.failOnDupImports, "fail_on_duplicate_imports", false, "if true, Gazelle fails when more than one rule provides the same import,\n\tinstead of printing a warning")
+	fs.StringVar(&ucr.onlyAttrs, "only_attrs", "", "comma-separated list of the only attributes of existing rules that may be\n\tmodified, for example, \"deps\". Other attributes are left alone, and rules\n\tand build files aren't added or deleted. Loads are still fixed.")
+	fs.BoolVar(&ucr.stats, "stats", false, "if true, a summary of how imports were resolved, including the numbers of\n\tambiguous and unresolved imports, is printed to stderr")
 }
 
 func (ucr *updateConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
@@ -79,24 +169,47 @@ func (ucr *updateConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) erro
 	if !ok {
 		return fmt.Errorf("unrecognized emit mode: %q", ucr.mode)
 	}
+	uc.remove = removeModeFromName[ucr.mode]
+	switch uc.emptyFiles {
+	case keepEmptyFiles, deleteEmptyFiles, ignoreEmptyFiles:
+	default:
+		return fmt.Errorf("-empty_build_files: got %q; want %q, %q, or %q", uc.emptyFiles, keepEmptyFiles, deleteEmptyFiles, ignoreEmptyFiles)
+	}
+	switch uc.validateDeps {
+	case ignoreMissingDeps, warnMissingDeps, failOnMissingDeps:
+	default:
+		return fmt.Errorf("-validate_deps: got %q; want %q, %q, or %q", uc.validateDeps, ignoreMissingDeps, warnMissingDeps, failOnMissingDeps)
+	}
 
-	c.Dirs = fs.Args()
-	if len(c.Dirs) == 0 {
-		c.Dirs = []string{"."}
+	if err := setDirs(c, fs.Args()); err != nil {
+		return err
 	}
-	for i := range c.Dirs {
-		dir, err := filepath.Abs(c.Dirs[i])
-		if err != nil {
-			return fmt.Errorf("%s: failed to find absolute path: %v", c.Dirs[i], err)
+
+	if ucr.stats {
+		c.Stats = &config.ResolveStats{}
+	}
+
+	if ucr.onlyAttrs != "" {
+		uc.onlyAttrs = []string{}
+		for _, attr := range strings.Split(ucr.onlyAttrs, ",") {
+			if attr = strings.TrimSpace(attr); attr != "" {
+				uc.onlyAttrs = append(uc.onlyAttrs, attr)
+			}
 		}
-		dir, err = filepath.EvalSymlinks(dir)
-		if err != nil {
-			return fmt.Errorf("%s: failed to resolve symlinks: %v", c.Dirs[i], err)
+	}
+
+	if uc.incrementalMarker != "" {
+		if !filepath.IsAbs(uc.incrementalMarker) {
+			uc.incrementalMarker = filepath.Join(c.RepoRoot, uc.incrementalMarker)
 		}
-		if !isDescendingDir(dir, c.RepoRoot) {
-			return fmt.Errorf("dir %q is not a subdirectory of repo root %q", dir, c.RepoRoot)
+		c.IncrementalMarker = uc.incrementalMarker
+		if !uc.full {
+			since, err := readIncrementalMarker(uc.incrementalMarker)
+			if err != nil {
+				return err
+			}
+			c.ChangedSince = since
 		}
-		c.Dirs[i] = dir
 	}
 
 	return nil
@@ -104,7 +217,13 @@ func (ucr *updateConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) erro
 
 func (ucr *updateConfigurer) KnownDirectives() []string { return nil }
 
-func (ucr *updateConfigurer) Configure(c *config.Config, rel string, f *rule.File) {}
+func (ucr *updateConfigurer) Configure(c *config.Config, rel string, f *rule.File) {
+	// Kinds introduced by # gazelle:map_kind (or by language directives like
+	// # gazelle:proto_gateway) must be known before any rules are indexed or
+	// merged. Configure is called for every directory before rules are
+	// generated in parallel, so it's safe to update them here.
+	ucr.loads = addMappedKinds(c, ucr.kinds, ucr.kindToResolver, ucr.loads)
+}
 
 // visitRecord stores information about about a directory visited with
 // packages.Walk.
@@ -121,6 +240,14 @@ type visitRecord struct {
 
 	// file is the build file being processed.
 	file *rule.File
+
+	// header is the list of comment lines kept at the top of file, set with
+	// # gazelle:build_file_header.
+	header []string
+
+	// c is the configuration for the visited directory. Kinds mapped with
+	// # gazelle:map_kind are looked up in it when the file is merged.
+	c *config.Config
 }
 
 type byPkgRel []visitRecord
@@ -129,20 +256,57 @@ func (vs byPkgRel) Len() int           { return len(vs) }
 func (vs byPkgRel) Less(i, j int) bool { return vs[i].pkgRel < vs[j].pkgRel }
 func (vs byPkgRel) Swap(i, j int)      { vs[i], vs[j] = vs[j], vs[i] }
 
+// setDirs sets c.Dirs to the absolute, canonical paths of the directories
+// named by args, which must be within the repository. If args is empty,
+// the current directory is used.
+func setDirs(c *config.Config, args []string) error {
+	c.Dirs = args
+	if len(c.Dirs) == 0 {
+		c.Dirs = []string{"."}
+	}
+	for i := range c.Dirs {
+		dir, err := filepath.Abs(c.Dirs[i])
+		if err != nil {
+			return fmt.Errorf("%s: failed to find absolute path: %v", c.Dirs[i], err)
+		}
+		dir, err = filepath.EvalSymlinks(dir)
+		if err != nil {
+			return fmt.Errorf("%s: failed to resolve symlinks: %v", c.Dirs[i], err)
+		}
+		if !isDescendingDir(dir, c.RepoRoot) {
+			return fmt.Errorf("dir %q is not a subdirectory of repo root %q", dir, c.RepoRoot)
+		}
+		c.Dirs[i] = dir
+	}
+	return nil
+}
+
 func runFixUpdate(cmd command, args []string) error {
-	cexts := make([]config.Configurer, 0, len(languages)+2)
-	cexts = append(cexts, &config.CommonConfigurer{}, &updateConfigurer{})
 	kindToResolver := make(map[string]resolve.Resolver)
 	kinds := make(map[string]rule.KindInfo)
 	loads := []rule.LoadInfo{}
 	for _, lang := range languages {
-		cexts = append(cexts, lang)
 		for kind, info := range lang.Kinds() {
 			kindToResolver[kind] = lang
 			kinds[kind] = info
 		}
 		loads = append(loads, lang.Loads()...)
 	}
+	if _, ok := kinds["alias"]; !ok {
+		kinds["alias"] = merger.AliasKindInfo
+	}
+	ucr := &updateConfigurer{
+		kinds:          kinds,
+		kindToResolver: kindToResolver,
+		loads:          loads,
+	}
+	// ucr comes after the languages, since they may map kinds in Configure.
+	cexts := make([]config.Configurer, 0, len(languages)+2)
+	cexts = append(cexts, &config.CommonConfigurer{})
+	for _, lang := range languages {
+		cexts = append(cexts, lang)
+	}
+	cexts = append(cexts, ucr)
 	ruleIndex := resolve.NewRuleIndex(kindToResolver)
 
 	c, err := newFixUpdateConfiguration(cmd, args, cexts, loads)
@@ -150,6 +314,12 @@ func runFixUpdate(cmd command, args []string) error {
 		return err
 	}
 
+	uc := getUpdateConfig(c)
+	ruleIndex.CheckVisibility = uc.checkVisibility
+	ruleIndex.FailOnDuplicateImports = uc.failOnDupImports
+	ruleIndex.FoldImportCase = uc.foldImportCase
+	ruleIndex.Logger = c.Logger
+
 	if cmd == fixCmd {
 		// Only check the version when "fix" is run. Generated build files
 		// frequently work with older version of rules_go, and we don't want to
@@ -157,9 +327,23 @@ func runFixUpdate(cmd command, args []string) error {
 		checkRulesGoVersion(c.RepoRoot)
 	}
 
-	// Visit all directories in the repository.
+	// Visit all directories in the repository. Rules may be generated for
+	// several directories concurrently, so visits is guarded by mu. The
+	// index may be updated concurrently.
 	var visits []visitRecord
-	walk.Walk(c, cexts, func(dir, rel string, c *config.Config, update bool, f *rule.File, subdirs, regularFiles, genFiles []string) {
+	var mu sync.Mutex
+	walk.WalkParallel(c, cexts, uc.workers, func(dir, rel string, c *config.Config, update bool, f *rule.File, subdirs, regularFiles, genFiles []string) {
+		// Resolvers shouldn't guess labels in packages with targets that
+		// can't be indexed.
+		if f != nil && (c.DynamicTargets || f.HasDynamicRules()) {
+			ruleIndex.AddDynamicPackage(rel)
+		}
+		// Rules in excluded directories aren't indexed, so dependencies on
+		// them can't be validated.
+		for _, x := range walk.Excluded(c, rel) {
+			ruleIndex.AddExcludedDir(x)
+		}
+
 		// If this file is ignored or if Gazelle was not asked to update this
 		// directory, just index the build file and move on.
 		if !update {
@@ -173,77 +357,317 @@ func runFixUpdate(cmd command, args []string) error {
 
 		// Fix any problems in the file.
 		if f != nil {
-			for _, l := range languages {
-				l.Fix(c, f)
+			// Migrations rewrite whole rules, so they're skipped when only
+			// some attributes may be modified.
+			if uc.onlyAttrs == nil {
+				for _, l := range languages {
+					if c.IsLangEnabled(l.Name()) {
+						l.Fix(c, f)
+					}
+				}
 			}
+			mapRuleKinds(c, f.Rules)
+		}
+
+		// Update the package default_visibility before generating rules, since
+		// generated rules only have visibility attributes when there's no
+		// default. A new file is started if a default is needed, but it's
+		// only written if rules are generated.
+		newFile := f == nil
+		if newFile && uc.onlyAttrs != nil {
+			return
+		}
+		if newFile && len(c.DefaultVisibility) > 0 {
+			f = rule.EmptyFile(filepath.Join(dir, newBuildFileName(c, subdirs)))
+		}
+		if f != nil && uc.onlyAttrs == nil {
+			merger.SetDefaultVisibility(f, c.DefaultVisibility)
 		}
 
-		// Generate rules.
+		// Generate rules. Languages not enabled with # gazelle:lang are
+		// skipped, so they don't add or delete rules here.
 		var empty, gen []*rule.Rule
 		for _, l := range languages {
+			if !c.IsLangEnabled(l.Name()) {
+				continue
+			}
 			lempty, lgen := l.GenerateRules(c, dir, rel, f, subdirs, regularFiles, genFiles, gen)
 			empty = append(empty, lempty...)
 			gen = append(gen, lgen...)
 		}
-		if f == nil && len(gen) == 0 {
+		if newFile && len(gen) == 0 {
 			return
 		}
+		mapRuleKinds(c, empty)
+		mapRuleKinds(c, gen)
+		setPreservedAttrs(c, gen)
+		setOnlyAttrs(uc.onlyAttrs, empty)
+		setOnlyAttrs(uc.onlyAttrs, gen)
+		setLabelAttrs(rel, kinds, empty)
+		setLabelAttrs(rel, kinds, gen)
 
 		// Insert or merge rules into the build file.
-		if f == nil {
-			f = rule.EmptyFile(filepath.Join(dir, c.DefaultBuildFileName()))
+		if newFile {
+			if f == nil {
+				f = rule.EmptyFile(filepath.Join(dir, newBuildFileName(c, subdirs)))
+			}
 			for _, r := range gen {
 				r.Insert(f)
 			}
 		} else {
-			merger.MergeFile(f, empty, gen, merger.PreResolve, kinds)
+			if uc.onlyAttrs == nil {
+				merger.RenameRules(f, gen, kinds, c.RenameAliasGrace, time.Now())
+			}
+			merger.MergeFile(f, empty, gen, merger.PreResolve, kinds, c)
 		}
+		mu.Lock()
 		visits = append(visits, visitRecord{
 			pkgRel: rel,
 			rules:  gen,
 			empty:  empty,
 			file:   f,
+			header: c.BuildFileHeader,
+			c:      c,
 		})
+		mu.Unlock()
 
 		// Add library rules to the dependency resolution table.
 		for _, r := range f.Rules {
 			ruleIndex.AddRule(c, r, f)
 		}
 	})
+	loads = ucr.loads
 
-	uc := getUpdateConfig(c)
+	// Process visits in a consistent order, regardless of the order in which
+	// directories were visited.
+	sort.Stable(byPkgRel(visits))
 
 	// Finish building the index for dependency resolution.
-	ruleIndex.Finish()
+	if err := ruleIndex.Finish(); err != nil {
+		return err
+	}
 
 	// Resolve dependencies.
-	rc := repos.NewRemoteCache(uc.repos)
+	rc := newRemoteCache(c, uc)
+	missingDeps := 0
 	for _, v := range visits {
 		for _, r := range v.rules {
+			rslv, ok := kindToResolver[r.Kind()]
+			if !ok {
+				// Rules of other kinds, like genrules for //go:generate
+				// directives, have no dependencies to resolve.
+				continue
+			}
 			from := label.New("", v.pkgRel, r.Name())
-			kindToResolver[r.Kind()].Resolve(c, ruleIndex, rc, r, from)
+			rslv.Resolve(c, ruleIndex, rc, r, from)
+			if uc.pruneEmbedded {
+				resolve.PruneEmbeddedDeps(ruleIndex, r, from)
+			}
+			if uc.validateDeps != ignoreMissingDeps {
+				missingDeps += reportMissingDeps(c, ruleIndex, r, from, uc.validateDeps)
+			}
+			resolve.MapDepLabels(c, r, from)
+		}
+		merger.MergeFile(v.file, v.empty, v.rules, merger.PostResolve, kinds, v.c)
+	}
+	if c.Stats != nil {
+		if err := c.Stats.WriteSummary(os.Stderr); err != nil {
+			return err
 		}
-		merger.MergeFile(v.file, v.empty, v.rules, merger.PostResolve, kinds)
+	}
+
+	if missingDeps > 0 && uc.validateDeps == failOnMissingDeps {
+		return fmt.Errorf("found %d dependencies on missing rules", missingDeps)
 	}
 
 	// Emit merged files.
+	emitErr := false
 	for _, v := range visits {
 		merger.FixLoads(v.file, loads)
 		v.file.Sync()
-		bzl.Rewrite(v.file.File, nil) // have buildifier 'format' our rules.
+		if uc.onlyAttrs == nil {
+			// Buildifier would sort lists in attributes -only_attrs leaves alone.
+			bzl.Rewrite(v.file.File, nil) // have buildifier 'format' our rules.
+		}
 
 		path := v.file.Path
 		if uc.outDir != "" {
 			stem := filepath.Base(v.file.Path) + uc.outSuffix
 			path = filepath.Join(uc.outDir, v.pkgRel, stem)
 		}
+		if len(v.file.File.Stmt) == 0 {
+			switch uc.emptyFiles {
+			case deleteEmptyFiles:
+				if err := uc.remove(c, path); err != nil {
+					log.Print(err)
+					emitErr = true
+				}
+				continue
+			case ignoreEmptyFiles:
+				v.file.File.Stmt = append(v.file.File.Stmt, &bzl.CommentBlock{
+					Comments: bzl.Comments{After: []bzl.Comment{{Token: "# gazelle:ignore"}}},
+				})
+			}
+		}
+		merger.SetHeader(v.file, v.header)
 		if err := uc.emit(c, v.file.File, path); err != nil {
 			log.Print(err)
+			emitErr = true
+		}
+	}
+
+	// Record the end of this run, after build files were written, so the next
+	// incremental run only updates directories modified since then.
+	if uc.incrementalMarker != "" && ucr.mode == "fix" && !emitErr {
+		if err := writeIncrementalMarker(uc.incrementalMarker, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	// Describe generated rules for other tools. This doesn't affect the
+	// files written above.
+	if uc.jsonOut != "" {
+		if err := writeRulesJSONFile(uc.jsonOut, visits); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// newRemoteCache returns the cache used to resolve imports in external
+// repositories. Repositories are named with c.ExternalRepoName, if it's set. Imports
+// listed with -known_import are added as repository roots.
+func newRemoteCache(c *config.Config, uc *updateConfig) *repos.RemoteCache {
+	rc := repos.NewRemoteCache(uc.repos)
+	if c.ExternalRepoName != nil {
+		rc.RepoName = c.ExternalRepoName
+	}
+	for _, imp := range uc.knownImports {
+		rc.AddRoot(imp)
+	}
+	return rc
+}
+
+// reportMissingDeps logs a diagnostic for each dependency of r, which has the
+// label from, that names a rule in the repository that isn't in ix. It
+// returns the number of missing dependencies. Diagnostics are errors if mode
+// is failOnMissingDeps and warnings otherwise.
+func reportMissingDeps(c *config.Config, ix *resolve.RuleIndex, r *rule.Rule, from label.Label, mode string) int {
+	severity := config.Warning
+	if mode == failOnMissingDeps {
+		severity = config.Error
+	}
+	missing := resolve.MissingDeps(ix, r, from)
+	for _, l := range missing {
+		c.Log(config.Diagnostic{
+			Severity: severity,
+			From:     from,
+			Message:  fmt.Sprintf("%s: dependency %s does not name a known rule", from, l),
+		})
+	}
+	return len(missing)
+}
+
+// addMappedKinds registers kinds introduced by # gazelle:map_kind directives
+// in c, so they are merged, loaded, and resolved like the kinds they replace.
+// The updated list of loads is returned.
+func addMappedKinds(c *config.Config, kinds map[string]rule.KindInfo, kindToResolver map[string]resolve.Resolver, loads []rule.LoadInfo) []rule.LoadInfo {
+	fromKinds := make([]string, 0, len(c.KindMap))
+	for fromKind := range c.KindMap {
+		fromKinds = append(fromKinds, fromKind)
+	}
+	sort.Strings(fromKinds)
+
+	for _, fromKind := range fromKinds {
+		mk := c.KindMap[fromKind]
+		if _, ok := kinds[mk.KindName]; ok {
+			continue
+		}
+		info, ok := kinds[fromKind]
+		if !ok {
+			continue
+		}
+		kinds[mk.KindName] = info
+		if rslv, ok := kindToResolver[fromKind]; ok {
+			kindToResolver[mk.KindName] = rslv
+		}
+
+		added := false
+		for i := range loads {
+			if loads[i].Name == mk.KindLoad {
+				symbols := make([]string, 0, len(loads[i].Symbols)+1)
+				symbols = append(symbols, loads[i].Symbols...)
+				loads[i].Symbols = append(symbols, mk.KindName)
+				added = true
+				break
+			}
+		}
+		if !added {
+			loads = append(loads, rule.LoadInfo{Name: mk.KindLoad, Symbols: []string{mk.KindName}})
+		}
+	}
+	return loads
+}
+
+// mapRuleKinds replaces the kinds of rules according to # gazelle:map_kind
+// directives in c. Rules marked with "# keep" are not changed.
+func mapRuleKinds(c *config.Config, rules []*rule.Rule) {
+	for _, r := range rules {
+		if mk, ok := c.KindMap[r.Kind()]; ok && !r.ShouldKeep() {
+			r.SetKind(mk.KindName)
+		}
+	}
+}
+
+// setPreservedAttrs records attributes listed for the kinds of rules with
+// # gazelle:preserve_attrs, so the merger carries them over from existing
+// rules. Kinds are matched before and after # gazelle:map_kind is applied.
+func setPreservedAttrs(c *config.Config, rules []*rule.Rule) {
+	if len(c.PreservedAttrs) == 0 {
+		return
+	}
+	for _, r := range rules {
+		attrs := c.PreservedAttrs[r.Kind()]
+		if unmapped := c.UnmappedKind(r.Kind()); unmapped != r.Kind() {
+			attrs = append(append([]string(nil), attrs...), c.PreservedAttrs[unmapped]...)
+		}
+		if len(attrs) > 0 {
+			r.SetPrivateAttr(config.GazellePreservedAttrsKey, attrs)
+		}
+	}
+}
+
+// setOnlyAttrs records the attributes named with -only_attrs on rules, so
+// the merger doesn't modify other attributes. Nothing is recorded if
+// onlyAttrs is nil.
+func setOnlyAttrs(onlyAttrs []string, rules []*rule.Rule) {
+	if onlyAttrs == nil {
+		return
+	}
+	for _, r := range rules {
+		r.SetPrivateAttr(config.GazelleOnlyAttrsKey, onlyAttrs)
+	}
+}
+
+// setLabelAttrs records which attributes of rules hold labels, so the
+// merger compares them in canonical form, relative to the package rel.
+// Attributes that are resolved or substituted, according to kinds, hold
+// labels.
+func setLabelAttrs(rel string, kinds map[string]rule.KindInfo, rules []*rule.Rule) {
+	for _, r := range rules {
+		info := kinds[r.Kind()]
+		var attrs []string
+		for key := range info.ResolveAttrs {
+			attrs = append(attrs, key)
+		}
+		for key := range info.SubstituteAttrs {
+			attrs = append(attrs, key)
+		}
+		r.SetPrivateAttr(rule.LabelAttrsKey, attrs)
+		r.SetPrivateAttr(rule.LabelPkgKey, rel)
+	}
+}
+
 func newFixUpdateConfiguration(cmd command, args []string, cexts []config.Configurer, loads []rule.LoadInfo) (*config.Config, error) {
 	c := config.New()
 
@@ -285,22 +709,12 @@ func newFixUpdateConfiguration(cmd command, args []string, cexts []config.Config
 			return nil, err
 		}
 		c.RepoName = findWorkspaceName(workspace)
-		uc.repos = repos.ListRepositories(workspace)
-	}
-	repoPrefixes := make(map[string]bool)
-	for _, r := range uc.repos {
-		repoPrefixes[r.GoPrefix] = true
-	}
-	for _, imp := range knownImports {
-		if repoPrefixes[imp] {
-			continue
-		}
-		repo := repos.Repo{
-			Name:     label.ImportPathToBazelRepoName(imp),
-			GoPrefix: imp,
+		uc.repos, err = repos.ListRepositories(workspace)
+		if err != nil {
+			return nil, err
 		}
-		uc.repos = append(uc.repos, repo)
 	}
+	uc.knownImports = knownImports
 
 	return c, nil
 }
@@ -358,6 +772,28 @@ func fixWorkspace(c *config.Config, workspace *rule.File, loads []rule.LoadInfo)
 	return uc.emit(c, workspace.File, workspace.Path)
 }
 
+// newBuildFileName returns the base name of a build file to create in a
+// directory that doesn't have one. Existing build files are always updated
+// in place, so this is only used for new files. Names are tried in the
+// order given by c.ValidBuildFileNames. A name is skipped if a subdirectory
+// with the same name (ignoring case) is present, since the file could not
+// be created on a case-insensitive file system.
+func newBuildFileName(c *config.Config, subdirs []string) string {
+	for _, name := range c.ValidBuildFileNames {
+		conflict := false
+		for _, sub := range subdirs {
+			if strings.EqualFold(name, sub) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			return name
+		}
+	}
+	return c.DefaultBuildFileName()
+}
+
 func findWorkspaceName(f *rule.File) string {
 	for _, r := range f.Rules {
 		if r.Kind() == "workspace" {
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -28,7 +29,20 @@ func fixFile(c *config.Config, file *bzl.File, path string) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(path, bzl.Format(file), 0666); err != nil {
+	content := bzl.Format(file)
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		// Leave unchanged files alone, so their modification times don't make
+		// the next incremental run update them.
+		return nil
+	}
+	if err := ioutil.WriteFile(path, content, 0666); err != nil {
+		return err
+	}
+	return nil
+}
+
+func removeFile(c *config.Config, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
@@ -19,6 +19,7 @@ import (
 	"flag"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"testing"
 
@@ -134,3 +135,17 @@ func TestUpdateFile(t *testing.T) {
 		t.Errorf("BUILD.bazel should not exist")
 	}
 }
+
+func TestNewRemoteCacheExternalRepoName(t *testing.T) {
+	c := config.New()
+	c.ExternalRepoName = func(root string) string { return "custom_" + path.Base(root) }
+	uc := &updateConfig{knownImports: []string{"example.com/known"}}
+	rc := newRemoteCache(c, uc)
+	root, name, err := rc.Root("example.com/known/pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != "example.com/known" || name != "custom_known" {
+		t.Errorf("got %q, %q; want %q, %q", root, name, "example.com/known", "custom_known")
+	}
+}
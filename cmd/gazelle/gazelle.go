@@ -29,6 +29,7 @@ const (
 	updateCmd command = iota
 	fixCmd
 	updateReposCmd
+	unusedLoadsCmd
 	helpCmd
 )
 
@@ -37,6 +38,7 @@ var commandFromName = map[string]command{
 	"help":         helpCmd,
 	"update":       updateCmd,
 	"update-repos": updateReposCmd,
+	"unused-loads": unusedLoadsCmd,
 }
 
 var nameFromCommand = []string{
@@ -44,6 +46,7 @@ var nameFromCommand = []string{
 	"update",
 	"fix",
 	"update-repos",
+	"unused-loads",
 	"help",
 }
 
@@ -79,6 +82,8 @@ func run(args []string) error {
 		help()
 	case updateReposCmd:
 		return updateRepos(args)
+	case unusedLoadsCmd:
+		return unusedLoads(args)
 	default:
 		log.Panicf("unknown command: %v", cmd)
 	}
@@ -104,6 +109,8 @@ Gazelle defaults to "update".
       existing rules.
   update-repos - updates repository rules in the WORKSPACE file. Run with
       -h for details.
+  unused-loads - reports or removes symbols loaded in build files that aren't
+      used. Run with -h for details.
   help - show this message.
 
 For usage information for a specific command, run the command with the -h flag.
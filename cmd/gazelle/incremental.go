@@ -0,0 +1,47 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// readIncrementalMarker returns the time of the last successful run recorded
+// in the marker file at path. If the file doesn't exist, the zero time is
+// returned, and all directories will be updated.
+func readIncrementalMarker(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: invalid incremental marker: %v", path, err)
+	}
+	return t, nil
+}
+
+// writeIncrementalMarker records t as the time of the last successful run in
+// the marker file at path.
+func writeIncrementalMarker(path string, t time.Time) error {
+	return ioutil.WriteFile(path, []byte(t.Format(time.RFC3339Nano)+"\n"), 0666)
+}
@@ -21,14 +21,17 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
 	"github.com/bazelbuild/bazel-gazelle/internal/wspace"
 )
 
@@ -512,26 +515,23 @@ func TestBuildFileNameIgnoresBuild(t *testing.T) {
 	}
 }
 
-func TestExternalVendor(t *testing.T) {
+func TestUpdateExistingBuildFileName(t *testing.T) {
 	files := []fileSpec{
+		{path: "WORKSPACE"},
 		{
-			path:    "WORKSPACE",
-			content: `workspace(name = "banana")`,
+			path:    "old/BUILD",
+			content: "# existing",
 		}, {
-			path: "a.go",
-			content: `package foo
-
-import _ "golang.org/x/bar"
-`,
+			path:    "old/a.go",
+			content: "package a",
 		}, {
-			path: "vendor/golang.org/x/bar/bar.go",
-			content: `package bar
-
-import _ "golang.org/x/baz"
-`,
+			path:    "new/b.go",
+			content: "package b",
 		}, {
-			path:    "vendor/golang.org/x/baz/baz.go",
-			content: "package baz",
+			path: "conflict/build/",
+		}, {
+			path:    "conflict/c.go",
+			content: "package c",
 		},
 	}
 	dir, err := createFiles(files)
@@ -540,178 +540,251 @@ import _ "golang.org/x/baz"
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", "example.com/foo", "-external", "vendored"}
+	args := []string{"-go_prefix", "example.com/foo", "-build_file_name", "BUILD,BUILD.bazel"}
 	if err := runGazelle(dir, args); err != nil {
 		t.Fatal(err)
 	}
+	for _, f := range []string{"old/BUILD", "new/BUILD", "conflict/BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f))); err != nil {
+			t.Errorf("%s: expected build file: %v", f, err)
+		}
+	}
+	for _, f := range []string{"old/BUILD.bazel", "new/BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f))); err == nil {
+			t.Errorf("%s: unexpected build file was created", f)
+		}
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "old/BUILD",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-	checkFiles(t, dir, []fileSpec{
-		{
-			path: config.DefaultValidBuildFileNames[0],
-			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+# existing
 
 go_library(
     name = "go_default_library",
     srcs = ["a.go"],
-    importpath = "example.com/foo",
+    importpath = "example.com/foo/old",
     visibility = ["//visibility:public"],
-    deps = ["//vendor/golang.org/x/bar:go_default_library"],
 )
 `,
+	}})
+}
+
+func TestJSONOut(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "a/a.go",
+			content: "package a",
 		}, {
-			path: "vendor/golang.org/x/bar/" + config.DefaultValidBuildFileNames[0],
-			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+			path: "b/b.go",
+			content: `
+package b
 
-go_library(
-    name = "go_default_library",
-    srcs = ["bar.go"],
-    importmap = "example.com/foo/vendor/golang.org/x/bar",
-    importpath = "golang.org/x/bar",
-    visibility = ["//visibility:public"],
-    deps = ["//vendor/golang.org/x/baz:go_default_library"],
+import (
+	_ "example.com/foo/a"
+	_ "fmt"
 )
 `,
 		},
-	})
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := filepath.Join(dir, "rules.json")
+	args := []string{"-go_prefix", "example.com/foo", "-json_out", jsonPath}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"//a:go_default_library":{"kind":"go_library","name":"go_default_library","srcs":["a.go"]}}
+{"//b:go_default_library":{"kind":"go_library","name":"go_default_library","srcs":["b.go"],"deps":["//a:go_default_library"],"imports":["example.com/foo/a","fmt"]}}
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "BUILD.bazel")); err != nil {
+		t.Errorf("build file not written: %v", err)
+	}
 }
 
-func TestMigrateProtoRules(t *testing.T) {
+func TestFlatAttrStringsSorted(t *testing.T) {
+	f, err := rule.LoadData("BUILD.bazel", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        OTHER_SRC,
+        "a.go",
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := flatAttrStrings(f.Rules[0], "srcs")
+	want := []string{"a.go", "b.go"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestFailOnDuplicateImports(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
 		{
-			path: config.DefaultValidBuildFileNames[0],
-			content: `
-load("@io_bazel_rules_go//proto:go_proto_library.bzl", "go_proto_library")
-
-filegroup(
-    name = "go_default_library_protos",
-    srcs = ["foo.proto"],
-    visibility = ["//visibility:public"],
-)
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/dup",
+		}, {
+			path:    "a/a.go",
+			content: "package a",
+		}, {
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-go_proto_library(
+go_library(
     name = "go_default_library",
-    srcs = [":go_default_library_protos"],
+    srcs = ["b.go"],
+    importpath = "example.com/dup/a",  # keep
 )
 `,
 		}, {
-			path: "foo.proto",
-			content: `syntax = "proto3";
+			path:    "b/b.go",
+			content: "package a",
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
-option go_package = "example.com/repo";
+	want := `go "example.com/dup/a": //a:go_default_library, //b:go_default_library`
+	if err := runGazelle(dir, []string{"-fail_on_duplicate_imports"}); err == nil {
+		t.Fatalf("got success; want %q", want)
+	} else if !strings.Contains(err.Error(), want) {
+		t.Fatalf("got %q; want %q", err, want)
+	}
+}
+
+func TestParallelWorkers(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "a/a.go",
+			content: "package a",
+		}, {
+			path:    "a/a_test.go",
+			content: "package a",
+		}, {
+			path:    "a/testdata/data.txt",
+			content: "data",
+		}, {
+			path: "b/b.go",
+			content: `package b
+
+import _ "example.com/foo/a"
 `,
 		}, {
-			path:    "foo.pb.go",
-			content: `package repo`,
+			path:    "b/b_test.go",
+			content: "package b",
+		}, {
+			path:    "b/testdata/td.go",
+			content: "package testdata",
 		},
 	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
-	for _, tc := range []struct {
-		args []string
-		want string
-	}{
+	args := []string{"-go_prefix", "example.com/foo", "-workers", "4"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
 		{
-			args: []string{"update", "-go_prefix", "example.com/repo"},
-			want: `
-load("@io_bazel_rules_go//proto:go_proto_library.bzl", "go_proto_library")
+			path: "a/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
 
-filegroup(
-    name = "go_default_library_protos",
-    srcs = ["foo.proto"],
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/foo/a",
     visibility = ["//visibility:public"],
 )
 
-go_proto_library(
-    name = "go_default_library",
-    srcs = [":go_default_library_protos"],
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+    data = glob(["testdata/**"]),
+    embed = [":go_default_library"],
 )
 `,
 		}, {
-			args: []string{"fix", "-go_prefix", "example.com/repo"},
-			want: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
-load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
-
-proto_library(
-    name = "repo_proto",
-    srcs = ["foo.proto"],
-    visibility = ["//visibility:public"],
-)
-
-go_proto_library(
-    name = "repo_go_proto",
-    importpath = "example.com/repo",
-    proto = ":repo_proto",
-    visibility = ["//visibility:public"],
-)
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
 
 go_library(
     name = "go_default_library",
-    embed = [":repo_go_proto"],
-    importpath = "example.com/repo",
+    srcs = ["b.go"],
+    importpath = "example.com/foo/b",
     visibility = ["//visibility:public"],
+    deps = ["//a:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["b_test.go"],
+    embed = [":go_default_library"],
 )
 `,
 		},
-	} {
-		t.Run(tc.args[0], func(t *testing.T) {
-			dir, err := createFiles(files)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer os.RemoveAll(dir)
-
-			if err := runGazelle(dir, tc.args); err != nil {
-				t.Fatal(err)
-			}
-
-			checkFiles(t, dir, []fileSpec{{
-				path:    config.DefaultValidBuildFileNames[0],
-				content: tc.want,
-			}})
-		})
-	}
+	})
 }
 
-func TestRemoveProtoDeletesRules(t *testing.T) {
+func TestXDefsDirective(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
 		{
-			path: config.DefaultValidBuildFileNames[0],
-			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
-load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
-
-filegroup(
-    name = "go_default_library_protos",
-    srcs = ["foo.proto"],
-    visibility = ["//visibility:public"],
-)
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/xdefs",
+		}, {
+			path: "stamped/BUILD.bazel",
+			content: `# gazelle:go_x_defs example.com/xdefs/stamped.Version={STABLE_VERSION}
 
-proto_library(
-    name = "repo_proto",
-    srcs = ["foo.proto"],
-    visibility = ["//visibility:public"],
-)
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
 
-go_proto_library(
-    name = "repo_go_proto",
-    importpath = "example.com/repo",
-    proto = ":repo_proto",
-    visibility = ["//visibility:public"],
+go_binary(
+    name = "stamped",
+    srcs = ["main.go"],
+    x_defs = {"example.com/xdefs/stamped.Version": "old"},
 )
+`,
+		}, {
+			path:    "stamped/main.go",
+			content: "package main",
+		}, {
+			path: "manual/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_binary")
 
-go_library(
-    name = "go_default_library",
-    srcs = ["extra.go"],
-    embed = [":repo_go_proto"],
-    importpath = "example.com/repo",
-    visibility = ["//visibility:public"],
+go_binary(
+    name = "manual",
+    srcs = ["main.go"],
+    x_defs = {"example.com/xdefs/manual.Version": "manual"},
 )
 `,
 		}, {
-			path:    "extra.go",
-			content: `package repo`,
+			path:    "manual/main.go",
+			content: "package main",
 		},
 	}
 	dir, err := createFiles(files)
@@ -720,237 +793,380 @@ go_library(
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"fix", "-go_prefix", "example.com/repo"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
-	checkFiles(t, dir, []fileSpec{{
-		path: config.DefaultValidBuildFileNames[0],
-		content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "stamped/BUILD.bazel",
+			content: `# gazelle:go_x_defs example.com/xdefs/stamped.Version={STABLE_VERSION}
 
-go_library(
-    name = "go_default_library",
-    srcs = ["extra.go"],
-    importpath = "example.com/repo",
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_binary(
+    name = "stamped",
+    embed = [":go_default_library"],
     visibility = ["//visibility:public"],
+    x_defs = {
+        "example.com/xdefs/stamped.Version": "{STABLE_VERSION}",
+    },
 )
-`,
-	}})
-}
-
-func TestAddServiceConvertsToGrpc(t *testing.T) {
-	files := []fileSpec{
-		{path: "WORKSPACE"},
-		{
-			path: config.DefaultValidBuildFileNames[0],
-			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
-load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
 
-proto_library(
-    name = "repo_proto",
-    srcs = ["foo.proto"],
-    visibility = ["//visibility:public"],
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/xdefs/stamped",
+    visibility = ["//visibility:private"],
 )
+`,
+		}, {
+			path: "manual/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
 
-go_proto_library(
-    name = "repo_go_proto",
-    importpath = "example.com/repo",
-    proto = ":repo_proto",
+go_binary(
+    name = "manual",
+    embed = [":go_default_library"],
     visibility = ["//visibility:public"],
+    x_defs = {"example.com/xdefs/manual.Version": "manual"},
 )
 
 go_library(
     name = "go_default_library",
-    embed = [":repo_go_proto"],
-    importpath = "example.com/repo",
-    visibility = ["//visibility:public"],
+    srcs = ["main.go"],
+    importpath = "example.com/xdefs/manual",
+    visibility = ["//visibility:private"],
 )
+`,
+		},
+	})
+}
+
+func TestMapKind(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/mapkind
+# gazelle:map_kind go_library my_go_library //tools:go.bzl
 `,
 		}, {
-			path: "foo.proto",
-			content: `syntax = "proto3";
+			path:    "dep/dep.go",
+			content: "package dep",
+		}, {
+			path: "dep/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-option go_package = "example.com/repo";
+go_library(
+    name = "dep",
+    srcs = ["old.go"],
+    importpath = "example.com/mapkind/dep",
+)
+`,
+		}, {
+			path: "lib/lib.go",
+			content: `package lib
 
-service {}
+import _ "example.com/mapkind/dep"
 `,
+		}, {
+			path:    "lib/lib_test.go",
+			content: "package lib",
 		},
 	}
-
 	dir, err := createFiles(files)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", "example.com/repo"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
-	checkFiles(t, dir, []fileSpec{{
-		path: config.DefaultValidBuildFileNames[0],
-		content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
-load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "dep/BUILD.bazel",
+			content: `load("//tools:go.bzl", "my_go_library")
 
-proto_library(
-    name = "repo_proto",
-    srcs = ["foo.proto"],
+my_go_library(
+    name = "dep",
+    srcs = ["dep.go"],
+    importpath = "example.com/mapkind/dep",
     visibility = ["//visibility:public"],
 )
+`,
+		}, {
+			path: "lib/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+load("//tools:go.bzl", "my_go_library")
 
-go_proto_library(
-    name = "repo_go_proto",
-    compilers = ["@io_bazel_rules_go//proto:go_grpc"],
-    importpath = "example.com/repo",
-    proto = ":repo_proto",
+my_go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/mapkind/lib",
     visibility = ["//visibility:public"],
+    deps = ["//dep"],
 )
 
-go_library(
-    name = "go_default_library",
-    embed = [":repo_go_proto"],
-    importpath = "example.com/repo",
-    visibility = ["//visibility:public"],
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
 )
 `,
-	}})
+		},
+	})
 }
 
-func TestEmptyGoPrefix(t *testing.T) {
+func TestMapKindAllGoKinds(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
 		{
-			path:    "foo/foo.go",
-			content: "package foo",
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/mapkind
+# gazelle:map_kind go_binary my_go_binary //tools:go.bzl
+# gazelle:map_kind go_library my_go_library //tools:go.bzl
+# gazelle:map_kind go_proto_library my_go_proto_library //tools:proto.bzl
+# gazelle:map_kind go_test my_go_test //tools:go.bzl
+`,
 		}, {
-			path: "bar/bar.go",
-			content: `
-package bar
+			path: "api/api.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/mapkind/api";
+`,
+		}, {
+			path: "lib/lib.go",
+			content: `package lib
+
+import _ "example.com/mapkind/api"
+`,
+		}, {
+			path: "lib/lib_test.go",
+			content: `package lib_test
 
 import (
-	_ "fmt"
-	_ "foo"
+	_ "example.com/mapkind/api"
+	_ "example.com/mapkind/lib"
 )
+`,
+		}, {
+			path: "cmd/main.go",
+			content: `package main
+
+import _ "example.com/mapkind/lib"
 `,
 		},
 	}
-
 	dir, err := createFiles(files)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", ""}
-	if err := runGazelle(dir, args); err != nil {
-		t.Fatal(err)
-	}
+	want := []fileSpec{
+		{
+			path: "api/BUILD.bazel",
+			content: `
+load("//tools:go.bzl", "my_go_library")
+load("//tools:proto.bzl", "my_go_proto_library")
 
-	checkFiles(t, dir, []fileSpec{{
-		path: filepath.Join("bar", config.DefaultValidBuildFileNames[0]),
-		content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
+proto_library(
+    name = "api_proto",
+    srcs = ["api.proto"],
+    visibility = ["//visibility:public"],
+)
 
-go_library(
+my_go_proto_library(
+    name = "api_go_proto",
+    importpath = "example.com/mapkind/api",
+    proto = ":api_proto",
+    visibility = ["//visibility:public"],
+)
+
+my_go_library(
     name = "go_default_library",
-    srcs = ["bar.go"],
-    importpath = "bar",
+    embed = [":api_go_proto"],
+    importpath = "example.com/mapkind/api",
     visibility = ["//visibility:public"],
-    deps = ["//foo:go_default_library"],
 )
 `,
-	}})
-}
-
-// TestResolveKeptImportpath checks that Gazelle can resolve dependencies
-// against a library with a '# keep' comment on its importpath attribute
-// when the importpath doesn't match what Gazelle would infer.
-func TestResolveKeptImportpath(t *testing.T) {
-	files := []fileSpec{
-		{path: "WORKSPACE"},
-		{
-			path: "foo/foo.go",
+		}, {
+			path: "lib/BUILD.bazel",
 			content: `
-package foo
+load("//tools:go.bzl", "my_go_library", "my_go_test")
 
-import _ "example.com/alt/baz"
+my_go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/mapkind/lib",
+    visibility = ["//visibility:public"],
+    deps = ["//api:go_default_library"],
+)
+
+my_go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    embed = [":go_default_library"],
+    deps = ["//api:go_default_library"],
+)
 `,
 		}, {
-			path: "bar/BUILD.bazel",
-			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+			path: "cmd/BUILD.bazel",
+			content: `
+load("//tools:go.bzl", "my_go_binary", "my_go_library")
 
-go_library(
+my_go_library(
     name = "go_default_library",
-    srcs = ["bar.go"],
-    importpath = "example.com/alt/baz",  # keep
+    srcs = ["main.go"],
+    importpath = "example.com/mapkind/cmd",
+    visibility = ["//visibility:private"],
+    deps = ["//lib:go_default_library"],
+)
+
+my_go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
     visibility = ["//visibility:public"],
 )
 `,
-		}, {
-			path:    "bar/bar.go",
-			content: "package bar",
 		},
 	}
+	// Gazelle runs twice to check that rules with mapped kinds are matched
+	// when they're updated.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, dir, want)
+	}
+}
+
+func TestProtoGateway(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/gateway",
+		}, {
+			path: "server/server.go",
+			content: `package server
+
+import (
+	_ "example.com/gateway/api"
+	_ "example.com/gateway/api/gateway"
+)
+`,
+		}, {
+			path:    "api/BUILD.bazel",
+			content: "# gazelle:proto_gateway go_gateway_library @grpc_ecosystem_grpc_gateway//:def.bzl",
+		}, {
+			path: "api/api.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/gateway/api";
 
+service Echo {}
+`,
+		},
+	}
 	dir, err := createFiles(files)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", "example.com/repo"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
 	checkFiles(t, dir, []fileSpec{
 		{
-			path: "foo/BUILD.bazel",
-			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
+			path: "api/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+load("@grpc_ecosystem_grpc_gateway//:def.bzl", "go_gateway_library")
+
+# gazelle:proto_gateway go_gateway_library @grpc_ecosystem_grpc_gateway//:def.bzl
+
+proto_library(
+    name = "api_proto",
+    srcs = ["api.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "api_go_proto",
+    compilers = ["@io_bazel_rules_go//proto:go_grpc"],
+    importpath = "example.com/gateway/api",
+    proto = ":api_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_gateway_library(
+    name = "api_gateway",
+    importpath = "example.com/gateway/api/gateway",
+    proto = ":api_proto",
+    visibility = ["//visibility:public"],
+    deps = [":go_default_library"],
+)
 
 go_library(
     name = "go_default_library",
-    srcs = ["foo.go"],
-    importpath = "example.com/repo/foo",
+    embed = [":api_go_proto"],
+    importpath = "example.com/gateway/api",
     visibility = ["//visibility:public"],
-    deps = ["//bar:go_default_library"],
 )
 `,
 		}, {
-			path: "bar/BUILD.bazel",
+			path: "server/BUILD.bazel",
 			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
 go_library(
     name = "go_default_library",
-    srcs = ["bar.go"],
-    importpath = "example.com/alt/baz",  # keep
+    srcs = ["server.go"],
+    importpath = "example.com/gateway/server",
     visibility = ["//visibility:public"],
+    deps = [
+        "//api:api_gateway",
+        "//api:go_default_library",
+    ],
 )
 `,
 		},
 	})
 }
 
-// TestResolveVendorSubdirectory checks that Gazelle can resolve libraries
-// in a vendor directory which is not at the repository root.
-func TestResolveVendorSubdirectory(t *testing.T) {
+func TestProtoGatewayCleared(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
 		{
-			path:    "sub/vendor/example.com/foo/foo.go",
-			content: "package foo",
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/gateway
+# gazelle:proto_gateway go_gateway_library @grpc_ecosystem_grpc_gateway//:def.bzl
+`,
 		}, {
-			path: "sub/bar/bar.go",
-			content: `
-package bar
+			path: "api/BUILD.bazel",
+			content: `load("@grpc_ecosystem_grpc_gateway//:def.bzl", "go_gateway_library")
 
-import _ "example.com/foo"
+# gazelle:proto_gateway
+
+go_gateway_library(
+    name = "api_gateway",
+    importpath = "example.com/gateway/api/gateway",
+    proto = ":api_proto",
+    visibility = ["//visibility:public"],
+    deps = [":go_default_library"],
+)
+`,
+		}, {
+			path: "api/api.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/gateway/api";
+
+service Echo {}
 `,
 		},
 	}
@@ -960,87 +1176,72 @@ import _ "example.com/foo"
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", "example.com/repo"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
-	checkFiles(t, dir, []fileSpec{
-		{
-			path: "sub/vendor/example.com/foo/BUILD.bazel",
-			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
+	checkFiles(t, dir, []fileSpec{{
+		path: "api/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
 
-go_library(
-    name = "go_default_library",
-    srcs = ["foo.go"],
-    importmap = "example.com/repo/sub/vendor/example.com/foo",
-    importpath = "example.com/foo",
+# gazelle:proto_gateway
+
+proto_library(
+    name = "api_proto",
+    srcs = ["api.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "api_go_proto",
+    compilers = ["@io_bazel_rules_go//proto:go_grpc"],
+    importpath = "example.com/gateway/api",
+    proto = ":api_proto",
     visibility = ["//visibility:public"],
 )
-`,
-		}, {
-			path: "sub/bar/BUILD.bazel",
-			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
 go_library(
     name = "go_default_library",
-    srcs = ["bar.go"],
-    importpath = "example.com/repo/sub/bar",
+    embed = [":api_go_proto"],
+    importpath = "example.com/gateway/api",
     visibility = ["//visibility:public"],
-    deps = ["//sub/vendor/example.com/foo:go_default_library"],
 )
 `,
-		},
-	})
+	}})
 }
 
-// TestDeleteProtoWithDeps checks that Gazelle will delete proto rules with
-// dependencies after the proto sources are removed.
-func TestDeleteProtoWithDeps(t *testing.T) {
+func TestProtoStripImportPrefix(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
 		{
-			path: "foo/BUILD.bazel",
-			content: `
-load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
-load("@io_bazel_rules_go//go:def.bzl", "go_library")
-
-go_library(
-    name = "go_default_library",
-    srcs = ["extra.go"],
-    embed = [":scratch_go_proto"],
-    importpath = "example.com/repo/foo",
-    visibility = ["//visibility:public"],
-)
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo",
+		}, {
+			path:    "protos/BUILD.bazel",
+			content: "# gazelle:proto_strip_import_prefix /protos",
+		}, {
+			path: "protos/foo/foo.proto",
+			content: `syntax = "proto3";
 
-proto_library(
-    name = "foo_proto",
-    srcs = ["foo.proto"],
-    visibility = ["//visibility:public"],
-    deps = ["//foo/bar:bar_proto"],
-)
+option go_package = "example.com/repo/protos/foo";
 
-go_proto_library(
-    name = "foo_go_proto",
-    importpath = "example.com/repo/foo",
-    proto = ":foo_proto",
+import "bar/bar.proto";
+`,
+		}, {
+			path: "protos/bar/BUILD.bazel",
+			content: `proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    strip_import_prefix = "/old",
     visibility = ["//visibility:public"],
-    deps = ["//foo/bar:go_default_library"],
 )
 `,
 		}, {
-			path:    "foo/extra.go",
-			content: "package foo",
-		}, {
-			path: "foo/bar/bar.proto",
-			content: `
-syntax = "proto3";
-
-option go_package = "example.com/repo/foo/bar";
+			path: "protos/bar/bar.proto",
+			content: `syntax = "proto3";
 
-message Bar {};
+option go_package = "example.com/repo/protos/bar";
 `,
 		},
 	}
@@ -1050,21 +1251,64 @@ message Bar {};
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", "example.com/repo"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
 	checkFiles(t, dir, []fileSpec{
 		{
-			path: "foo/BUILD.bazel",
+			path: "protos/foo/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    strip_import_prefix = "/protos",
+    visibility = ["//visibility:public"],
+    deps = ["//protos/bar:bar_proto"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/protos/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+    deps = ["//protos/bar:go_default_library"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/protos/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "protos/bar/BUILD.bazel",
 			content: `
 load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    strip_import_prefix = "/protos",
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "bar_go_proto",
+    importpath = "example.com/repo/protos/bar",
+    proto = ":bar_proto",
+    visibility = ["//visibility:public"],
+)
 
 go_library(
     name = "go_default_library",
-    srcs = ["extra.go"],
-    importpath = "example.com/repo/foo",
+    embed = [":bar_go_proto"],
+    importpath = "example.com/repo/protos/bar",
     visibility = ["//visibility:public"],
 )
 `,
@@ -1072,23 +1316,31 @@ go_library(
 	})
 }
 
-func TestCustomRepoNames(t *testing.T) {
+func TestProtoStripImportPrefixCleared(t *testing.T) {
 	files := []fileSpec{
+		{path: "WORKSPACE"},
 		{
-			path: "WORKSPACE",
-			content: `
-go_repository(
-    name = "custom_repo",
-    importpath = "example.com/bar",
-    commit = "123456",
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo",
+		}, {
+			path:    "protos/BUILD.bazel",
+			content: "# gazelle:proto_strip_import_prefix /protos",
+		}, {
+			path: "protos/foo/BUILD.bazel",
+			content: `# gazelle:proto_strip_import_prefix
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    strip_import_prefix = "/protos",
+    visibility = ["//visibility:public"],
 )
 `,
 		}, {
-			path: "foo.go",
-			content: `
-package foo
+			path: "protos/foo/foo.proto",
+			content: `syntax = "proto3";
 
-import _ "example.com/bar"
+option go_package = "example.com/repo/protos/foo";
 `,
 		},
 	}
@@ -1098,105 +1350,78 @@ import _ "example.com/bar"
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix", "example.com/foo"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
 	checkFiles(t, dir, []fileSpec{
 		{
-			path: "BUILD.bazel",
+			path: "protos/foo/BUILD.bazel",
 			content: `
 load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+# gazelle:proto_strip_import_prefix
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/protos/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
 
 go_library(
     name = "go_default_library",
-    srcs = ["foo.go"],
-    importpath = "example.com/foo",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/protos/foo",
     visibility = ["//visibility:public"],
-    deps = ["@custom_repo//:go_default_library"],
 )
 `,
 		},
 	})
 }
 
-func TestImportReposFromDep(t *testing.T) {
+func TestProtoTestLibrary(t *testing.T) {
 	files := []fileSpec{
+		{path: "WORKSPACE"},
 		{
-			path: "WORKSPACE",
-			content: `
-http_archive(
-    name = "io_bazel_rules_go",
-    url = "https://github.com/bazelbuild/rules_go/releases/download/0.10.1/rules_go-0.10.1.tar.gz",
-    sha256 = "4b14d8dd31c6dbaf3ff871adcd03f28c3274e42abc855cb8fb4d01233c0154dc",
-)
-http_archive(
-    name = "bazel_gazelle",
-    url = "https://github.com/bazelbuild/bazel-gazelle/releases/download/0.10.0/bazel-gazelle-0.10.0.tar.gz",
-    sha256 = "6228d9618ab9536892aa69082c063207c91e777e51bd3c5544c9c060cafe1bd8",
-)
-load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains", "go_repository")
-go_rules_dependencies()
-go_register_toolchains()
-
-load("@bazel_gazelle//:deps.bzl", "gazelle_dependencies")
-gazelle_dependencies()
-
-go_repository(
-    name = "org_golang_x_net",
-    importpath = "golang.org/x/net",
-    tag = "1.2",
-)
-
-# keep
-go_repository(
-    name = "org_golang_x_sys",
-    importpath = "golang.org/x/sys",
-    remote = "https://github.com/golang/sys",
-)
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo",
+		}, {
+			path: "foo/foo.proto",
+			content: `syntax = "proto3";
 
-http_archive(
-    name = "com_github_go_yaml_yaml",
-    urls = ["https://example.com/yaml.tar.gz"],
-    sha256 = "1234",
-)
+option go_package = "example.com/repo/foo";
 `,
 		}, {
-			path: "Gopkg.lock",
-			content: `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
-
-
-[[projects]]
-  name = "github.com/pkg/errors"
-  packages = ["."]
-  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
-  version = "v0.8.0"
-
-[[projects]]
-  branch = "master"
-  name = "golang.org/x/net"
-  packages = ["context"]
-  revision = "66aacef3dd8a676686c7ae3716979581e8b03c47"
-
-[[projects]]
-  branch = "master"
-  name = "golang.org/x/sys"
-  packages = ["unix"]
-  revision = "bb24a47a89eac6c1227fbcb2ae37a8b9ed323366"
+			path: "foo/foo_test.proto",
+			content: `syntax = "proto3";
 
-[[projects]]
-  branch = "v2"
-  name = "github.com/go-yaml/yaml"
-  packages = ["."]
-  revision = "cd8b52f8269e0feb286dfeef29f8fe4d5b397e0b"
+import "foo/foo.proto";
+import "bar/bar_test.proto";
+`,
+		}, {
+			path: "bar/bar_test.proto",
+			content: `syntax = "proto3";
+`,
+		}, {
+			path: "bar/BUILD.bazel",
+			content: `proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    visibility = ["//visibility:public"],
+)
 
-[solve-meta]
-  analyzer-name = "dep"
-  analyzer-version = 1
-  inputs-digest = "05c1cd69be2c917c0cc4b32942830c2acfa044d8200fdc94716aae48a8083702"
-  solver-name = "gps-cdcl"
-  solver-version = 1
+proto_library(
+    name = "bar_test_proto",
+    srcs = ["old_test.proto"],
+)
 `,
 		},
 	}
@@ -1206,87 +1431,3186 @@ http_archive(
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"update-repos", "-from_file", "Gopkg.lock"}
-	if err := runGazelle(dir, args); err != nil {
+	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
 
 	checkFiles(t, dir, []fileSpec{
 		{
-			path: "WORKSPACE",
+			path: "foo/BUILD.bazel",
 			content: `
-http_archive(
-    name = "io_bazel_rules_go",
-    url = "https://github.com/bazelbuild/rules_go/releases/download/0.10.1/rules_go-0.10.1.tar.gz",
-    sha256 = "4b14d8dd31c6dbaf3ff871adcd03f28c3274e42abc855cb8fb4d01233c0154dc",
-)
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
 
-http_archive(
-    name = "bazel_gazelle",
-    url = "https://github.com/bazelbuild/bazel-gazelle/releases/download/0.10.0/bazel-gazelle-0.10.0.tar.gz",
-    sha256 = "6228d9618ab9536892aa69082c063207c91e777e51bd3c5544c9c060cafe1bd8",
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
 )
 
-load("@io_bazel_rules_go//go:def.bzl", "go_register_toolchains", "go_rules_dependencies")
-
-go_rules_dependencies()
-
-go_register_toolchains()
-
-load("@bazel_gazelle//:deps.bzl", "gazelle_dependencies", "go_repository")
-
-gazelle_dependencies()
-
-go_repository(
-    name = "org_golang_x_net",
-    commit = "66aacef3dd8a676686c7ae3716979581e8b03c47",
-    importpath = "golang.org/x/net",
+proto_library(
+    name = "foo_test_proto",
+    testonly = True,
+    srcs = ["foo_test.proto"],
+    visibility = ["//visibility:public"],
+    deps = [
+        ":foo_proto",
+        "//bar:bar_test_proto",
+    ],
 )
 
-# keep
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "bar/BUILD.bazel",
+			content: `
+proto_library(
+    name = "bar_test_proto",
+    testonly = True,
+    srcs = ["bar_test.proto"],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestExternalVendor(t *testing.T) {
+	files := []fileSpec{
+		{
+			path:    "WORKSPACE",
+			content: `workspace(name = "banana")`,
+		}, {
+			path: "a.go",
+			content: `package foo
+
+import _ "golang.org/x/bar"
+`,
+		}, {
+			path: "vendor/golang.org/x/bar/bar.go",
+			content: `package bar
+
+import _ "golang.org/x/baz"
+`,
+		}, {
+			path:    "vendor/golang.org/x/baz/baz.go",
+			content: "package baz",
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/foo", "-external", "vendored"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: config.DefaultValidBuildFileNames[0],
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+    deps = ["//vendor/golang.org/x/bar:go_default_library"],
+)
+`,
+		}, {
+			path: "vendor/golang.org/x/bar/" + config.DefaultValidBuildFileNames[0],
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importmap = "example.com/foo/vendor/golang.org/x/bar",
+    importpath = "golang.org/x/bar",
+    visibility = ["//visibility:public"],
+    deps = ["//vendor/golang.org/x/baz:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+func TestMigrateProtoRules(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: config.DefaultValidBuildFileNames[0],
+			content: `
+load("@io_bazel_rules_go//proto:go_proto_library.bzl", "go_proto_library")
+
+filegroup(
+    name = "go_default_library_protos",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "go_default_library",
+    srcs = [":go_default_library_protos"],
+)
+`,
+		}, {
+			path: "foo.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/repo";
+`,
+		}, {
+			path:    "foo.pb.go",
+			content: `package repo`,
+		},
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{
+			args: []string{"update", "-go_prefix", "example.com/repo"},
+			want: `
+load("@io_bazel_rules_go//proto:go_proto_library.bzl", "go_proto_library")
+
+filegroup(
+    name = "go_default_library_protos",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "go_default_library",
+    srcs = [":go_default_library_protos"],
+)
+`,
+		}, {
+			args: []string{"fix", "-go_prefix", "example.com/repo"},
+			want: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "repo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "repo_go_proto",
+    importpath = "example.com/repo",
+    proto = ":repo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":repo_go_proto"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	} {
+		t.Run(tc.args[0], func(t *testing.T) {
+			dir, err := createFiles(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := runGazelle(dir, tc.args); err != nil {
+				t.Fatal(err)
+			}
+
+			checkFiles(t, dir, []fileSpec{{
+				path:    config.DefaultValidBuildFileNames[0],
+				content: tc.want,
+			}})
+		})
+	}
+}
+
+func TestRemoveProtoDeletesRules(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: config.DefaultValidBuildFileNames[0],
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+filegroup(
+    name = "go_default_library_protos",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+proto_library(
+    name = "repo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "repo_go_proto",
+    importpath = "example.com/repo",
+    proto = ":repo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["extra.go"],
+    embed = [":repo_go_proto"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path:    "extra.go",
+			content: `package repo`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"fix", "-go_prefix", "example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{{
+		path: config.DefaultValidBuildFileNames[0],
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["extra.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestAddServiceConvertsToGrpc(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: config.DefaultValidBuildFileNames[0],
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "repo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "repo_go_proto",
+    importpath = "example.com/repo",
+    proto = ":repo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":repo_go_proto"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "foo.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/repo";
+
+service {}
+`,
+		},
+	}
+
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{{
+		path: config.DefaultValidBuildFileNames[0],
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "repo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "repo_go_proto",
+    compilers = ["@io_bazel_rules_go//proto:go_grpc"],
+    importpath = "example.com/repo",
+    proto = ":repo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":repo_go_proto"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestEmptyGoPrefix(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "foo/foo.go",
+			content: "package foo",
+		}, {
+			path: "bar/bar.go",
+			content: `
+package bar
+
+import (
+	_ "fmt"
+	_ "foo"
+)
+`,
+		},
+	}
+
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", ""}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{{
+		path: filepath.Join("bar", config.DefaultValidBuildFileNames[0]),
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "bar",
+    visibility = ["//visibility:public"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+	}})
+}
+
+// TestResolveKeptImportpath checks that Gazelle can resolve dependencies
+// against a library with a '# keep' comment on its importpath attribute
+// when the importpath doesn't match what Gazelle would infer.
+func TestResolveKeptImportpath(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "foo/foo.go",
+			content: `
+package foo
+
+import _ "example.com/alt/baz"
+`,
+		}, {
+			path: "bar/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/alt/baz",  # keep
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path:    "bar/bar.go",
+			content: "package bar",
+		},
+	}
+
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "foo/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+    deps = ["//bar:go_default_library"],
+)
+`,
+		}, {
+			path: "bar/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/alt/baz",  # keep
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+// TestResolveVendorSubdirectory checks that Gazelle can resolve libraries
+// in a vendor directory which is not at the repository root.
+func TestResolveVendorSubdirectory(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "sub/vendor/example.com/foo/foo.go",
+			content: "package foo",
+		}, {
+			path: "sub/bar/bar.go",
+			content: `
+package bar
+
+import _ "example.com/foo"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "sub/vendor/example.com/foo/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importmap = "example.com/repo/sub/vendor/example.com/foo",
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "sub/bar/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/repo/sub/bar",
+    visibility = ["//visibility:public"],
+    deps = ["//sub/vendor/example.com/foo:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+// TestDeleteProtoWithDeps checks that Gazelle will delete proto rules with
+// dependencies after the proto sources are removed.
+func TestDeleteProtoWithDeps(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "foo/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["extra.go"],
+    embed = [":scratch_go_proto"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+    deps = ["//foo/bar:bar_proto"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+    deps = ["//foo/bar:go_default_library"],
+)
+`,
+		}, {
+			path:    "foo/extra.go",
+			content: "package foo",
+		}, {
+			path: "foo/bar/bar.proto",
+			content: `
+syntax = "proto3";
+
+option go_package = "example.com/repo/foo/bar";
+
+message Bar {};
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "foo/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["extra.go"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestCustomRepoNames(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "WORKSPACE",
+			content: `
+go_repository(
+    name = "custom_repo",
+    importpath = "example.com/bar",
+    commit = "123456",
+)
+`,
+		}, {
+			path: "foo.go",
+			content: `
+package foo
+
+import _ "example.com/bar"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/foo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+    deps = ["@custom_repo//:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+func TestCustomRepoNamesFromMacro(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "WORKSPACE",
+			content: `
+# gazelle:repository_macro build/repositories.bzl%go_repositories
+`,
+		}, {
+			path: "build/repositories.bzl",
+			content: `
+load("@bazel_gazelle//:deps.bzl", "go_repository")
+
+def go_repositories():
+    go_repository(
+        name = "custom_repo",
+        importpath = "example.com/bar",
+        commit = "123456",
+    )
+`,
+		}, {
+			path: "foo.go",
+			content: `
+package foo
+
+import _ "example.com/bar/baz"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix", "example.com/foo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+    deps = ["@custom_repo//baz:go_default_library"],
+)
+`,
+		},
+	})
+}
+
+func TestImportReposFromDep(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "WORKSPACE",
+			content: `
+http_archive(
+    name = "io_bazel_rules_go",
+    url = "https://github.com/bazelbuild/rules_go/releases/download/0.10.1/rules_go-0.10.1.tar.gz",
+    sha256 = "4b14d8dd31c6dbaf3ff871adcd03f28c3274e42abc855cb8fb4d01233c0154dc",
+)
+http_archive(
+    name = "bazel_gazelle",
+    url = "https://github.com/bazelbuild/bazel-gazelle/releases/download/0.10.0/bazel-gazelle-0.10.0.tar.gz",
+    sha256 = "6228d9618ab9536892aa69082c063207c91e777e51bd3c5544c9c060cafe1bd8",
+)
+load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains", "go_repository")
+go_rules_dependencies()
+go_register_toolchains()
+
+load("@bazel_gazelle//:deps.bzl", "gazelle_dependencies")
+gazelle_dependencies()
+
+go_repository(
+    name = "org_golang_x_net",
+    importpath = "golang.org/x/net",
+    tag = "1.2",
+)
+
+# keep
+go_repository(
+    name = "org_golang_x_sys",
+    importpath = "golang.org/x/sys",
+    remote = "https://github.com/golang/sys",
+)
+
+http_archive(
+    name = "com_github_go_yaml_yaml",
+    urls = ["https://example.com/yaml.tar.gz"],
+    sha256 = "1234",
+)
+`,
+		}, {
+			path: "Gopkg.lock",
+			content: `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+
+[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "645ef00459ed84a119197bfb8d8205042c6df63d"
+  version = "v0.8.0"
+
+[[projects]]
+  branch = "master"
+  name = "golang.org/x/net"
+  packages = ["context"]
+  revision = "66aacef3dd8a676686c7ae3716979581e8b03c47"
+
+[[projects]]
+  branch = "master"
+  name = "golang.org/x/sys"
+  packages = ["unix"]
+  revision = "bb24a47a89eac6c1227fbcb2ae37a8b9ed323366"
+
+[[projects]]
+  branch = "v2"
+  name = "github.com/go-yaml/yaml"
+  packages = ["."]
+  revision = "cd8b52f8269e0feb286dfeef29f8fe4d5b397e0b"
+
+[solve-meta]
+  analyzer-name = "dep"
+  analyzer-version = 1
+  inputs-digest = "05c1cd69be2c917c0cc4b32942830c2acfa044d8200fdc94716aae48a8083702"
+  solver-name = "gps-cdcl"
+  solver-version = 1
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"update-repos", "-from_file", "Gopkg.lock"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "WORKSPACE",
+			content: `
+http_archive(
+    name = "io_bazel_rules_go",
+    url = "https://github.com/bazelbuild/rules_go/releases/download/0.10.1/rules_go-0.10.1.tar.gz",
+    sha256 = "4b14d8dd31c6dbaf3ff871adcd03f28c3274e42abc855cb8fb4d01233c0154dc",
+)
+
+http_archive(
+    name = "bazel_gazelle",
+    url = "https://github.com/bazelbuild/bazel-gazelle/releases/download/0.10.0/bazel-gazelle-0.10.0.tar.gz",
+    sha256 = "6228d9618ab9536892aa69082c063207c91e777e51bd3c5544c9c060cafe1bd8",
+)
+
+load("@io_bazel_rules_go//go:def.bzl", "go_register_toolchains", "go_rules_dependencies")
+
+go_rules_dependencies()
+
+go_register_toolchains()
+
+load("@bazel_gazelle//:deps.bzl", "gazelle_dependencies", "go_repository")
+
+gazelle_dependencies()
+
+go_repository(
+    name = "org_golang_x_net",
+    commit = "66aacef3dd8a676686c7ae3716979581e8b03c47",
+    importpath = "golang.org/x/net",
+)
+
+# keep
+go_repository(
+    name = "org_golang_x_sys",
+    importpath = "golang.org/x/sys",
+    remote = "https://github.com/golang/sys",
+)
+
+http_archive(
+    name = "com_github_go_yaml_yaml",
+    urls = ["https://example.com/yaml.tar.gz"],
+    sha256 = "1234",
+)
+
+go_repository(
+    name = "com_github_pkg_errors",
+    commit = "645ef00459ed84a119197bfb8d8205042c6df63d",
+    importpath = "github.com/pkg/errors",
+)
+`,
+		}})
+}
+
+func TestDeleteRulesInEmptyDir(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_binary")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "bar.go",
+        "foo.go",
+    ],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:private"],
+)
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-go_prefix=example.com/repo"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, []fileSpec{
+		{
+			path:    "BUILD.bazel",
+			content: "",
+		},
+	})
+}
+
+func TestEmptyBuildFiles(t *testing.T) {
+	for _, tc := range []struct {
+		mode, want string
+		wantGone   bool
+	}{
+		{mode: "keep", want: ""},
+		{mode: "delete", wantGone: true},
+		{mode: "ignore", want: "# gazelle:ignore\n"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			files := []fileSpec{
+				{path: "WORKSPACE"},
+				{
+					path:    "BUILD.bazel",
+					content: "# gazelle:prefix example.com/repo",
+				}, {
+					path: "lib/BUILD.bazel",
+					content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+)
+`,
+				},
+			}
+			dir, err := createFiles(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := runGazelle(dir, []string{"-empty_build_files=" + tc.mode}); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "lib", "BUILD.bazel")
+			if tc.wantGone {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("lib/BUILD.bazel: got error %v; want it to be deleted", err)
+				}
+				return
+			}
+			checkFiles(t, dir, []fileSpec{{path: "lib/BUILD.bazel", content: tc.want}})
+		})
+	}
+}
+
+func TestIgnoreDirective(t *testing.T) {
+	ignoredBuild := `# gazelle:ignore
+go_library(name="custom",srcs=["old.go"],importpath="example.com/repo/ignored")
+`
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo",
+		}, {
+			path:    "ignored/BUILD.bazel",
+			content: ignoredBuild,
+		}, {
+			path:    "ignored/new.go",
+			content: "package ignored",
+		}, {
+			path: "bin/main.go",
+			content: `
+package main
+
+import _ "example.com/repo/ignored"
+
+func main() {}
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path:    "ignored/BUILD.bazel",
+			content: ignoredBuild,
+		}, {
+			path: "bin/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/bin",
+    visibility = ["//visibility:private"],
+    deps = ["//ignored:custom"],
+)
+
+go_binary(
+    name = "bin",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestPruneEmbeddedDeps(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		args []string
+		want string
+	}{
+		{
+			desc: "default",
+			want: `[
+        "//inner:inner_lib",
+        "//outer:outer_lib",
+    ]`,
+		}, {
+			desc: "prune",
+			args: []string{"-prune_embedded_deps"},
+			want: `["//outer:outer_lib"]`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			files := []fileSpec{
+				{path: "WORKSPACE"},
+				{
+					path:    "BUILD.bazel",
+					content: "# gazelle:prefix example.com/repo",
+				}, {
+					path: "inner/BUILD.bazel",
+					content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "inner_lib",
+    srcs = ["inner.go"],
+    importpath = "example.com/repo/inner",
+    visibility = ["//visibility:public"],
+)
+`,
+				}, {
+					path: "outer/BUILD.bazel",
+					content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "outer_lib",
+    srcs = ["outer.go"],
+    embed = ["//inner:inner_lib"],
+    importpath = "example.com/repo/outer",
+    visibility = ["//visibility:public"],
+)
+`,
+				}, {
+					path:    "lib/BUILD.bazel",
+					content: "# gazelle:go_extra_deps //inner:inner_lib",
+				}, {
+					path: "lib/lib.go",
+					content: `
+package lib
+
+import _ "example.com/repo/outer"
+`,
+				},
+			}
+			dir, err := createFiles(files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := runGazelle(dir, append(tc.args, "lib")); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, dir, []fileSpec{{
+				path: "lib/BUILD.bazel",
+				content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_extra_deps //inner:inner_lib
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = ` + tc.want + `,
+)
+`,
+			}})
+		})
+	}
+}
+
+func TestAnnotateDeps(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo",
+		}, {
+			path: "lib/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "indexed_lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path:    "lib/lib.go",
+			content: "package lib",
+		}, {
+			path: "bin/main.go",
+			content: `
+package main
+
+import (
+	_ "example.com/repo/lib"
+	_ "example.com/repo/missing"
+	_ "github.com/pkg/errors"
+)
+
+func main() {}
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	annotated := `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/bin",
+    visibility = ["//visibility:private"],
+    deps = [
+        "//lib:indexed_lib",  # resolved via index
+        "//missing:go_default_library",  # resolved via prefix
+        "@com_github_pkg_errors//:go_default_library",  # resolved via remote cache
+    ],
+)
+
+go_binary(
+    name = "bin",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`
+	// Annotations are replaced on each run, so they don't accumulate.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, []string{"-annotate_deps", "-external=external"}); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, dir, []fileSpec{{path: "bin/BUILD.bazel", content: annotated}})
+	}
+
+	// Annotations are removed when the flag isn't set.
+	if err := runGazelle(dir, []string{"-external=external"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "bin/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/bin",
+    visibility = ["//visibility:private"],
+    deps = [
+        "//lib:indexed_lib",
+        "//missing:go_default_library",
+        "@com_github_pkg_errors//:go_default_library",
+    ],
+)
+
+go_binary(
+    name = "bin",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestFixWorkspaceWithoutGazelle(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "WORKSPACE",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+
 go_repository(
-    name = "org_golang_x_sys",
-    importpath = "golang.org/x/sys",
-    remote = "https://github.com/golang/sys",
+    name = "com_example_repo",
+    importpath = "example.com/repo",
+    tag = "1.2.3",
+)
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"fix", "-go_prefix="}); err == nil {
+		t.Error("got success; want error")
+	} else if want := "bazel_gazelle is not declared"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v; want error containing %q", err, want)
+	}
+}
+
+// TestKeepDeps checks rules with keep comments on the rule or on the deps
+// attribute will not be modified during dependency resolution. Verifies #212.
+func TestKeepDeps(t *testing.T) {
+	files := []fileSpec{
+		{
+			path: "WORKSPACE",
+		}, {
+			path: "BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:prefix example.com/repo
+
+# keep
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo",
+    deps = [":dont_remove"],
+)
+
+go_test(
+    name = "go_default_test",
+    # keep
+    srcs = ["lib_test.go"],
+    # keep
+    embed = [":go_default_library"],
+    # keep
+    deps = [":dont_remove"],
+)
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, dir, files)
+}
+
+func TestKeepSrcs(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "gen.go",  # keep
+        "lib.go",  # keep
+        "old.go",
+    ],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+		{path: "lib.go", content: "package repo\n"},
+		{path: "new.go", content: "package repo\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// gen.go doesn't exist, but it's kept. lib.go is also generated, but it's
+	// only listed once, with its comment.
+	checkFiles(t, dir, []fileSpec{{
+		path: "BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "gen.go",  # keep
+        "lib.go",  # keep
+        "new.go",
+    ],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestProtoDefaultLanguageDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:proto_default_language none
+`,
+		},
+		{
+			path: "foo/foo.proto",
+			content: `syntax = "proto3";
+
+package foo;
+
+option go_package = "example.com/repo/foo";
+`,
+		},
+		{path: "foo/foo.pb.go", content: "package foo\n"},
+		{
+			path: "bar/BUILD.bazel",
+			content: `# gazelle:proto_default_language
+`,
+		},
+		{
+			path: "bar/bar.proto",
+			content: `syntax = "proto3";
+
+package bar;
+
+option go_package = "example.com/repo/bar";
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only proto_library is generated in foo, and foo.pb.go is built as a
+	// normal source. An empty value in bar restores the default.
+	checkFiles(t, dir, []fileSpec{{
+		path: "foo/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.pb.go"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}, {
+		path: "bar/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+# gazelle:proto_default_language
+
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "bar_go_proto",
+    importpath = "example.com/repo/bar",
+    proto = ":bar_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":bar_go_proto"],
+    importpath = "example.com/repo/bar",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestProtoDefaultLanguageNoneExisting(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:proto_default_language none
+`,
+		}, {
+			path: "foo/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    embed = [":foo_go_proto"],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "foo/foo.proto",
+			content: `syntax = "proto3";
+
+package foo;
+
+option go_package = "example.com/repo/foo";
+`,
+		},
+		{path: "foo/foo.go", content: "package foo\n"},
+		{path: "foo/foo.pb.go", content: "package foo\n"},
+		{
+			path: "bar/bar.go",
+			content: `package bar
+
+import _ "example.com/repo/foo"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The go_proto_library generated before the directive was set is deleted,
+	// so only the library provides example.com/repo/foo.
+	checkFiles(t, dir, []fileSpec{{
+		path: "foo/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "foo.go",
+        "foo.pb.go",
+    ],
+    importpath = "example.com/repo/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}, {
+		path: "bar/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/repo/bar",
+    visibility = ["//visibility:public"],
+    deps = ["//foo:go_default_library"],
+)
+`,
+	}})
+}
+
+func TestOnlyAttrs(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        "a.go",
+    ],
+    importpath = "example.com/repo",
+    deps = ["//old:go_default_library"],
+)
+`,
+		},
+		{path: "a.go", content: "package repo\n"},
+		{path: "b.go", content: "package repo\n\nimport _ \"example.com/repo/dep\"\n"},
+		{path: "c.go", content: "package repo\n"},
+		{path: "dep/dep.go", content: "package dep\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"-only_attrs=deps"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only deps is updated. c.go isn't added to srcs, visibility isn't added,
+	// and no build file is created in dep.
+	checkFiles(t, dir, []fileSpec{{
+		path: "BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        "a.go",
+    ],
+    importpath = "example.com/repo",
+    deps = ["//dep:go_default_library"],
+)
+`,
+	}})
+	if _, err := os.Stat(filepath.Join(dir, "dep", "BUILD.bazel")); err == nil {
+		t.Errorf("dep/BUILD.bazel was created")
+	}
+}
+
+func TestGoProtoLibrarySuffixDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:go_proto_library_suffix _pb
+# gazelle:go_grpc_library_suffix _grpc
+`,
+		},
+		{
+			path: "svc/svc.proto",
+			content: `syntax = "proto3";
+
+package svc;
+
+option go_package = "example.com/repo/svc";
+
+service Svc {}
+`,
+		},
+		{
+			path: "msg/msg.proto",
+			content: `syntax = "proto3";
+
+package msg;
+
+option go_package = "example.com/repo/msg";
+
+import "svc/svc.proto";
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The second run indexes the renamed rules, so the deps on them must not
+	// change.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		checkFiles(t, dir, []fileSpec{{
+			path: "svc/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "svc_proto",
+    srcs = ["svc.proto"],
+    visibility = ["//visibility:public"],
+)
+
+go_proto_library(
+    name = "svc_grpc",
+    compilers = ["@io_bazel_rules_go//proto:go_grpc"],
+    importpath = "example.com/repo/svc",
+    proto = ":svc_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":svc_grpc"],
+    importpath = "example.com/repo/svc",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "msg/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "msg_proto",
+    srcs = ["msg.proto"],
+    visibility = ["//visibility:public"],
+    deps = ["//svc:svc_proto"],
+)
+
+go_proto_library(
+    name = "msg_pb",
+    importpath = "example.com/repo/msg",
+    proto = ":msg_proto",
+    visibility = ["//visibility:public"],
+    deps = ["//svc:go_default_library"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":msg_pb"],
+    importpath = "example.com/repo/msg",
+    visibility = ["//visibility:public"],
+)
+`,
+		}})
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: ".gazelle",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:go_testonly true
+`,
+		},
+		{path: "a/a.go", content: "package a\n"},
+		{
+			path: "b/BUILD.bazel",
+			content: `# gazelle:go_testonly
+`,
+		},
+		{path: "b/b.go", content: "package b\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directives in .gazelle apply everywhere, even without a root build
+	// file. The directive in b/BUILD.bazel overrides go_testonly there.
+	checkFiles(t, dir, []fileSpec{{
+		path: "a/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+)
+`,
+	}, {
+		path: "b/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_testonly
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestGoGenerateGenruleLeavesOtherGenrules(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:go_generate_genrule true
+
+genrule(
+    name = "docs",
+    outs = ["docs.txt"],
+    cmd = "touch $@",
+)
+
+genrule(
+    name = "pill_string",
+    srcs = ["old.go"],
+    outs = ["pill_string.go"],
+    cmd = "stringer -type=Pill",
+    visibility = ["//visibility:private"],
+)
+`,
+		}, {
+			path: "pill.go",
+			content: `package pill
+
+//go:generate stringer -type=Pill
+
+type Pill int
+`,
+		}, {
+			path:    "pill_string.go",
+			content: "package pill\n",
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hand-written genrule is left alone. The generated genrule is
+	// updated, and its output replaces the checked-in copy in the library.
+	checkFiles(t, dir, []fileSpec{{
+		path: "BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+# gazelle:go_generate_genrule true
+
+genrule(
+    name = "docs",
+    outs = ["docs.txt"],
+    cmd = "touch $@",
+)
+
+genrule(
+    name = "pill_string",
+    srcs = ["pill.go"],
+    outs = ["pill_string.go"],
+    cmd = "$(location @org_golang_x_tools//cmd/stringer) -type=Pill -output=$@ $(SRCS)",
+    tools = ["@org_golang_x_tools//cmd/stringer"],
+    visibility = ["//visibility:private"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "pill.go",
+        ":pill_string.go",
+    ],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestDontCreateBuildFileInEmptyDir(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{path: "sub/"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := runGazelle(dir, nil); err != nil {
+		t.Error(err)
+	}
+	for _, f := range []string{"BUILD.bazel", "sub/BUILD.bazel"} {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		_, err := os.Stat(path)
+		if err == nil {
+			t.Errorf("%s: build file was created", f)
+		}
+	}
+}
+
+// TODO(jayconrod): more tests
+//   run in fix mode in testdata directories to create new files
+//   run in diff mode in testdata directories to update existing files (no change)
+
+func TestIncrementalMarker(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/incr",
+		},
+		{path: "a/a.go", content: "package a"},
+		{path: "b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-incremental_marker", ".gazelle_marker"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gazelle_marker")); err != nil {
+		t.Fatalf("marker not written: %v", err)
+	}
+
+	// Replace a's build file with an empty, stale one that looks older than
+	// the marker. Add a file to b, so it looks newer.
+	stale := ""
+	aBuild := filepath.Join(dir, "a", "BUILD.bazel")
+	if err := ioutil.WriteFile(aBuild, []byte(stale), 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, p := range []string{"a", "a/a.go", "a/BUILD.bazel"} {
+		if err := os.Chtimes(filepath.Join(dir, p), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b", "c.go"), []byte("package b"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	newer := time.Now().Add(time.Hour)
+	for _, p := range []string{"b", "b/c.go"} {
+		if err := os.Chtimes(filepath.Join(dir, p), newer, newer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{path: "a/BUILD.bazel", content: stale},
+		{
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        "c.go",
+    ],
+    importpath = "example.com/incr/b",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+
+	// With -full, every directory is updated.
+	if err := runGazelle(dir, append(args, "-full")); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "a/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/incr/a",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestIncrementalMarkerNoChanges(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/incr\n",
+		},
+		{path: "a/a.go", content: "package a"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The first run visits every directory. The root build file is already
+	// formatted, so it isn't rewritten.
+	rootBuild := filepath.Join(dir, "BUILD.bazel")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(rootBuild, old, old); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-incremental_marker", ".gazelle_marker"}
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(rootBuild); err != nil {
+		t.Fatal(err)
+	} else if !st.ModTime().Equal(old) {
+		t.Errorf("BUILD.bazel was rewritten")
+	}
+
+	// Replace a's build file with a stale one that looks older than the
+	// marker. Nothing changed since the first run, so the second run shouldn't
+	// visit any directory, and the stale file is kept.
+	stale := "# stale\n"
+	aBuild := filepath.Join(dir, "a", "BUILD.bazel")
+	if err := ioutil.WriteFile(aBuild, []byte(stale), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "a/a.go", "a/BUILD.bazel"} {
+		if err := os.Chtimes(filepath.Join(dir, p), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runGazelle(dir, args); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{path: "a/BUILD.bazel", content: stale}})
+}
+
+func TestTestTagsDirectiveRemoved(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:go_test_tags integration
+`,
+		},
+		{path: "lib.go", content: "package repo\n"},
+		{
+			path: "integration_test.go",
+			content: `// +build integration
+
+package repo
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:prefix example.com/repo
+# gazelle:go_test_tags integration
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test_integration",
+    srcs = ["integration_test.go"],
+    embed = [":go_default_library"],
+    tags = [
+        "integration",
+        "manual",
+    ],
+)
+`,
+	}})
+
+	// When the tag is removed, the tagged test is deleted.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte(`load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+
+go_test(
+    name = "go_default_test_integration",
+    srcs = ["integration_test.go"],
+    embed = [":go_default_library"],
+    tags = [
+        "integration",
+        "manual",
+    ],
+)
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestCreateOnly(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/create",
+		},
+		{
+			path: "old/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "old_lib",
+    srcs = ["a.go"],
+    importpath = "example.com/create/old",
+)
+`,
+		},
+		{path: "old/a.go", content: "package old"},
+		{path: "old/b.go", content: "package old"},
+		{
+			path: "new/new.go",
+			content: `package new
+
+import _ "example.com/create/old"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, []string{"-create_only"}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		files[1],
+		files[2],
+		{
+			path: "new/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["new.go"],
+    importpath = "example.com/create/new",
+    visibility = ["//visibility:public"],
+    deps = ["//old:old_lib"],
+)
+`,
+		},
+	})
+}
+
+func TestDefaultVisibilityDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/vis
+# gazelle:default_visibility //:__subpackages__
+`,
+		},
+		{path: "a/a.go", content: "package a"},
+		{
+			path: "b/BUILD.bazel",
+			content: `package(features = ["-layering_check"])
+`,
+		},
+		{path: "b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "a/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(
+    default_visibility = ["//:__subpackages__"],  # managed by gazelle
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/vis/a",
+)
+`,
+		}, {
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(
+    default_visibility = ["//:__subpackages__"],  # managed by gazelle
+    features = ["-layering_check"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/vis/b",
+)
+`,
+		},
+	})
+
+	// Changing the directive updates the managed attribute.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte(`# gazelle:prefix example.com/vis
+# gazelle:default_visibility //:__subpackages__,//other:__pkg__
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "a/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(
+    default_visibility = [
+        "//:__subpackages__",
+        "//other:__pkg__",
+    ],  # managed by gazelle
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/vis/a",
+)
+`,
+	}})
+
+	// Removing the directive removes the managed attribute. Rules get their
+	// own visibility again, and hand-written attributes are preserved.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte("# gazelle:prefix example.com/vis\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "a/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/vis/a",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(features = ["-layering_check"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/vis/b",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestGoExtraDeps(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/extra
+# gazelle:go_extra_deps //tools:plugin
+`,
+		},
+		{
+			path: "lib/lib.go",
+			content: `package lib
+
+import _ "example.com/extra/dep"
+`,
+		},
+		{path: "dep/dep.go", content: "package dep"},
+		{path: "tools/plugin.go", content: "package plugin"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []fileSpec{{
+		path: "lib/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/extra/lib",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//dep:go_default_library",
+        "//tools:plugin",
+    ],
+)
+`,
+	}}
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, dir, want)
+	}
+}
+
+func TestInstrumentedTestDirectives(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:go_test_race true
+`,
+		},
+		{
+			path: "lib/lib_test.go",
+			content: `package lib
+
+import (
+	"testing"
+
+	_ "example.com/repo/dep"
+)
+`,
+		},
+		{path: "dep/dep.go", content: "package dep"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "lib/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = ["//dep:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test_race",
+    srcs = ["lib_test.go"],
+    race = "on",
+    deps = ["//dep:go_default_library"],
+)
+`,
+	}})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte("# gazelle:prefix example.com/repo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "lib/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    deps = ["//dep:go_default_library"],
+)
+`,
+	}})
+}
+
+func TestLangDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo",
+		}, {
+			path:    "goonly/BUILD.bazel",
+			content: "# gazelle:lang go",
+		}, {
+			path: "goonly/foo.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/repo/goonly";
+`,
+		}, {
+			path:    "goonly/lib.go",
+			content: "package goonly",
+		}, {
+			path: "goonly/protos/BUILD.bazel",
+			content: `# gazelle:lang proto
+
+go_library(
+    name = "hand_written",
+    srcs = ["missing.go"],
+)
+`,
+		}, {
+			path:    "goonly/protos/bar.proto",
+			content: `syntax = "proto3";`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "goonly/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:lang go
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/goonly",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "goonly/protos/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:lang proto
+
+go_library(
+    name = "hand_written",
+    srcs = ["missing.go"],
+)
+
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
+}
+
+func TestRenameAliasesDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/ren
+# gazelle:rename_aliases 30
+`,
+		},
+		{
+			path: "a/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "a",
+    srcs = ["a.go"],
+    importpath = "example.com/ren/a",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+		{path: "a/a.go", content: "package a"},
+		{
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/ren/b",
+    visibility = ["//visibility:public"],
+    deps = ["//a"],
+)
+`,
+		},
+		{
+			path: "b/b.go",
+			content: `package b
+
+import _ "example.com/ren/a"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(30 * 24 * time.Hour).Format("2006-01-02")
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "a/BUILD.bazel",
+			content: fmt.Sprintf(`load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/ren/a",
+    visibility = ["//visibility:public"],
+)
+
+alias(
+    name = "a",
+    actual = ":go_default_library",  # managed by gazelle until %[1]s
+    deprecation = "renamed to :go_default_library; this alias will be removed after %[1]s",
+)
+`, until),
+		}, {
+			path: "b/BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/ren/b",
+    visibility = ["//visibility:public"],
+    deps = ["//a:go_default_library"],
+)
+`,
+		},
+	})
+
+	// Turning the directive off deletes the alias.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte("# gazelle:prefix example.com/ren\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "a/BUILD.bazel",
+		content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/ren/a",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
+}
+
+func TestPreserveAttrsDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:prefix example.com/preserve
+# gazelle:preserve_attrs go_library copts
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    copts = ["-O2"],
+    importpath = "example.com/preserve",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+		{path: "lib.go", content: "package preserve"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path:    "BUILD.bazel",
+		content: files[1].content,
+	}})
+}
+
+func TestValidateDeps(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `
+# gazelle:prefix example.com/repo
+# gazelle:resolve go example.com/ext //dyn:ext
+# gazelle:resolve go example.com/gen //third_party/gen/sub:lib
+`,
+		}, {
+			path: "dyn/BUILD.bazel",
+			content: `
+[filegroup(name = n) for n in ["ext"]]
+`,
+		}, {
+			path: "lib/lib.go",
+			content: `
+package lib
+
+import (
+	_ "example.com/ext"
+	_ "example.com/gen"
+	_ "example.com/repo/missing"
+	_ "example.com/repo/present"
+)
+`,
+		}, {
+			path: "present/BUILD.bazel",
+			content: `
+filegroup(
+    name = "go_default_library",
+)
+`,
+		}, {
+			path:    "third_party/BUILD.bazel",
+			content: "# gazelle:exclude gen",
+		}, {
+			path: "third_party/gen/sub/BUILD.bazel",
+			content: `
+filegroup(
+    name = "lib",
+)
+`,
+		},
+	}
+	wantBuild := `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//dyn:ext",
+        "//missing:go_default_library",
+        "//present:go_default_library",
+        "//third_party/gen/sub:lib",
+    ],
+)
+`
+
+	t.Run("warn", func(t *testing.T) {
+		dir, err := createFiles(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := runGazelle(dir, []string{"-validate_deps=warn"}); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, dir, []fileSpec{{path: "lib/BUILD.bazel", content: wantBuild}})
+	})
+
+	t.Run("error", func(t *testing.T) {
+		dir, err := createFiles(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := runGazelle(dir, []string{"-validate_deps=error"}); err == nil {
+			t.Fatal("got success; want error")
+		} else if !strings.Contains(err.Error(), "1 dependencies on missing rules") {
+			t.Errorf("got error %q; want error about 1 missing dependency", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "lib", "BUILD.bazel")); !os.IsNotExist(err) {
+			t.Errorf("lib/BUILD.bazel was written; want no build files written")
+		}
+	})
+}
+
+func TestGrpcCompilersDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `
+# gazelle:prefix example.com/repo
+# gazelle:go_grpc_compilers //compilers:b,//compilers:a,//compilers:b
+`,
+		}, {
+			path: "svc/svc.proto",
+			content: `syntax = "proto3";
+
+option go_package = "example.com/repo/svc";
+
+service Echo {}
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc, directive, compilers string
+	}{
+		{
+			desc: "set",
+			compilers: `compilers = [
+        "//compilers:a",
+        "//compilers:b",
+    ],`,
+		}, {
+			desc:      "changed",
+			directive: "# gazelle:go_grpc_compilers //compilers:c",
+			compilers: `compilers = ["//compilers:c"],`,
+		}, {
+			desc:      "cleared",
+			directive: "# gazelle:go_grpc_compilers",
+			compilers: `compilers = ["@io_bazel_rules_go//proto:go_grpc"],`,
+		}, {
+			desc:      "removed",
+			compilers: `compilers = ["@io_bazel_rules_go//proto:go_grpc"],`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.desc != "set" {
+				root := "# gazelle:prefix example.com/repo\n" + tc.directive + "\n"
+				if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte(root), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := runGazelle(dir, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, dir, []fileSpec{{
+				path: "svc/BUILD.bazel",
+				content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load("@io_bazel_rules_go//proto:def.bzl", "go_proto_library")
+
+proto_library(
+    name = "svc_proto",
+    srcs = ["svc.proto"],
+    visibility = ["//visibility:public"],
 )
 
-http_archive(
-    name = "com_github_go_yaml_yaml",
-    urls = ["https://example.com/yaml.tar.gz"],
-    sha256 = "1234",
+go_proto_library(
+    name = "svc_go_proto",
+    ` + tc.compilers + `
+    importpath = "example.com/repo/svc",
+    proto = ":svc_proto",
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":svc_go_proto"],
+    importpath = "example.com/repo/svc",
+    visibility = ["//visibility:public"],
+)
+`,
+			}})
+		})
+	}
+}
+
+func TestTestonlyDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo\n",
+		}, {
+			path:    "testutil/util.go",
+			content: "package testutil\n",
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		desc, build, want string
+	}{
+		{
+			desc:  "set",
+			build: "# gazelle:go_testonly true\n",
+			want: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_testonly true
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			desc: "preserved",
+			want: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_testonly true
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			desc: "false",
+			build: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_testonly false
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+`,
+			want: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:go_testonly false
+
+go_library(
+    name = "go_default_library",
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			desc: "unset",
+			build: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+`,
+			want: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    testonly = True,
+    srcs = ["util.go"],
+    importpath = "example.com/repo/testutil",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.build != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, "testutil", "BUILD.bazel"), []byte(tc.build), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := runGazelle(dir, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, dir, []fileSpec{{path: "testutil/BUILD.bazel", content: tc.want}})
+		})
+	}
+}
+
+func TestDynamicTargets(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo\n",
+		}, {
+			path: "gen/BUILD.bazel",
+			content: `load("//:defs.bzl", "gen_library")
+
+[gen_library(name = n) for n in ["a", "b"]]
+`,
+		}, {
+			path: "macro/BUILD.bazel",
+			content: `load("//:defs.bzl", "macro_library")
+
+# gazelle:dynamic_targets
+
+macro_library(name = "macro")
+`,
+		}, {
+			path: "lib/lib.go",
+			content: `package lib
+
+import (
+	_ "example.com/repo/gen"
+	_ "example.com/repo/macro"
+	_ "example.com/repo/macro/sub"
+	_ "example.com/repo/plain"
+)
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "lib/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = [
+        "//macro/sub:go_default_library",
+        "//plain:go_default_library",
+    ],
+)
+`,
+	}})
+}
+
+func TestPlatformMappingDirective(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:prefix example.com/repo
+# gazelle:go_platform_mapping linux_amd64=//platforms:linux_x86_64
+`,
+		}, {
+			path:    "lib/lib.go",
+			content: "package lib\n",
+		}, {
+			path: "lib/lib_linux_amd64.go",
+			content: `package lib
+
+import _ "example.com/repo/dep"
+`,
+		}, {
+			path: "lib/lib_windows_amd64.go",
+			content: `package lib
+
+import _ "example.com/repo/dep"
+`,
+		},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The second run checks that the mapped labels are merged.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, dir, []fileSpec{{
+			path: "lib/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "lib.go",
+        "lib_linux_amd64.go",
+        "lib_windows_amd64.go",
+    ],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = select({
+        "//platforms:linux_x86_64": [
+            "//dep:go_default_library",
+        ],
+        "@io_bazel_rules_go//go/platform:windows_amd64": [
+            "//dep:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+		}})
+	}
+
+	// When the mapping is changed, the select with the old label is replaced,
+	// and deps are still updated.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte(`# gazelle:prefix example.com/repo
+# gazelle:go_platform_mapping linux_amd64=//platforms:lx
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib", "lib_linux_amd64.go"), []byte(`package lib
+
+import (
+	_ "example.com/repo/dep"
+	_ "example.com/repo/dep2"
+)
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "lib/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "lib.go",
+        "lib_linux_amd64.go",
+        "lib_windows_amd64.go",
+    ],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = select({
+        "//platforms:lx": [
+            "//dep:go_default_library",
+            "//dep2:go_default_library",
+        ],
+        "@io_bazel_rules_go//go/platform:windows_amd64": [
+            "//dep:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
 )
+`,
+	}})
+
+	// When the mapping is removed, the default conditions are used again.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte("# gazelle:prefix example.com/repo\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "lib/BUILD.bazel",
+		content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-go_repository(
-    name = "com_github_pkg_errors",
-    commit = "645ef00459ed84a119197bfb8d8205042c6df63d",
-    importpath = "github.com/pkg/errors",
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "lib.go",
+        "lib_linux_amd64.go",
+        "lib_windows_amd64.go",
+    ],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+    deps = select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "//dep:go_default_library",
+            "//dep2:go_default_library",
+        ],
+        "@io_bazel_rules_go//go/platform:windows_amd64": [
+            "//dep:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
 )
 `,
-		}})
+	}})
 }
 
-func TestDeleteRulesInEmptyDir(t *testing.T) {
+func TestResolveStats(t *testing.T) {
 	files := []fileSpec{
 		{path: "WORKSPACE"},
 		{
-			path: "BUILD.bazel",
-			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_binary")
+			path:    "BUILD.bazel",
+			content: "# gazelle:prefix example.com/repo\n",
+		}, {
+			path: "lib/lib.go",
+			content: `package lib
 
-go_library(
+import (
+	_ "../../outside"
+	_ "example.com/ext"
+	_ "example.com/repo/a"
+	_ "example.com/repo/b"
+	_ "example.com/repo/c"
+	_ "fmt"
+)
+`,
+		},
+		{
+			path:    "lib/lib_linux.go",
+			content: "package lib\n\nimport _ \"example.com/repo/a\"\n",
+		}, {
+			path:    "lib/lib_windows.go",
+			content: "package lib\n\nimport _ \"example.com/repo/a\"\n",
+		}, {
+			path:    "lib/lib_test.go",
+			content: "package lib_test\n\nimport _ \"example.com/repo/lib\"\n",
+		},
+		{path: "a/a.go", content: "package a\n"},
+		{path: "c1/c.go", content: "package c\n"},
+		{path: "c2/c.go", content: "package c\n"},
+		{
+			path: "c1/BUILD.bazel",
+			content: `go_library(
     name = "go_default_library",
-    srcs = [
-        "bar.go",
-        "foo.go",
-    ],
-    importpath = "example.com/repo",
-    visibility = ["//visibility:private"],
+    srcs = ["c.go"],
+    importpath = "example.com/repo/c",  # keep
 )
-
-go_binary(
-    name = "cmd",
-    embed = [":go_default_library"],
-    visibility = ["//visibility:public"],
+`,
+		}, {
+			path: "c2/BUILD.bazel",
+			content: `go_library(
+    name = "go_default_library",
+    srcs = ["c.go"],
+    importpath = "example.com/repo/c",  # keep
 )
 `,
 		},
@@ -1297,30 +4621,58 @@ go_binary(
 	}
 	defer os.RemoveAll(dir)
 
-	args := []string{"-go_prefix=example.com/repo"}
-	if err := runGazelle(dir, args); err != nil {
+	oldStderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	checkFiles(t, dir, []fileSpec{
-		{
-			path:    "BUILD.bazel",
-			content: "",
-		},
-	})
+	os.Stderr = w
+	err = runGazelle(dir, []string{"-stats", "-external=vendored"})
+	os.Stderr = oldStderr
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `resolved imports: 3
+  via index: 1
+  via prefix: 1
+  via vendor fallback: 1
+ambiguous imports: 1
+unresolved imports: 1
+`
+	if string(out) != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", out, want)
+	}
 }
 
-func TestFixWorkspaceWithoutGazelle(t *testing.T) {
+func TestLocalReplaceImportpath(t *testing.T) {
 	files := []fileSpec{
+		{path: "WORKSPACE"},
 		{
-			path: "WORKSPACE",
+			path: "go.mod",
 			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_repository")
+module example.com/repo
 
-go_repository(
-    name = "com_example_repo",
-    importpath = "example.com/repo",
-    tag = "1.2.3",
+replace example.com/foo => ./local/foo
+`,
+		}, {
+			path:    "local/foo/foo.go",
+			content: "package foo",
+		}, {
+			path:    "local/foo/bar/bar.go",
+			content: "package bar",
+		}, {
+			path: "cmd/main.go",
+			content: `
+package main
+
+import (
+	_ "example.com/foo"
+	_ "example.com/foo/bar"
 )
 `,
 		},
@@ -1331,44 +4683,91 @@ go_repository(
 	}
 	defer os.RemoveAll(dir)
 
-	if err := runGazelle(dir, []string{"fix", "-go_prefix="}); err == nil {
-		t.Error("got success; want error")
-	} else if want := "bazel_gazelle is not declared"; !strings.Contains(err.Error(), want) {
-		t.Errorf("got error %v; want error containing %q", err, want)
+	if err := runGazelle(dir, nil); err != nil {
+		t.Fatal(err)
 	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path: "local/foo/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/foo",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "local/foo/bar/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["bar.go"],
+    importpath = "example.com/foo/bar",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "cmd/BUILD.bazel",
+			content: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["main.go"],
+    importpath = "example.com/repo/cmd",
+    visibility = ["//visibility:private"],
+    deps = [
+        "//local/foo:go_default_library",
+        "//local/foo/bar:go_default_library",
+    ],
+)
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	})
 }
 
-// TestKeepDeps checks rules with keep comments on the rule or on the deps
-// attribute will not be modified during dependency resolution. Verifies #212.
-func TestKeepDeps(t *testing.T) {
+func TestBuildFileHeaderDirective(t *testing.T) {
 	files := []fileSpec{
+		{path: "WORKSPACE"},
 		{
-			path: "WORKSPACE",
+			path:    "header.txt",
+			content: "Copyright 2018 Example Authors.\n\n# DO NOT EDIT except with gazelle.\n",
 		}, {
 			path: "BUILD.bazel",
 			content: `
-load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
-
 # gazelle:prefix example.com/repo
+# gazelle:build_file_header header.txt
+`,
+		}, {
+			path:    "a/a.go",
+			content: "package a",
+		}, {
+			path: "b/BUILD.bazel",
+			content: `# Old header.
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-# keep
 go_library(
     name = "go_default_library",
-    srcs = ["lib.go"],
-    importpath = "example.com/repo",
-    deps = [":dont_remove"],
-)
-
-go_test(
-    name = "go_default_test",
-    # keep
-    srcs = ["lib_test.go"],
-    # keep
-    embed = [":go_default_library"],
-    # keep
-    deps = [":dont_remove"],
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+    visibility = ["//visibility:public"],
 )
 `,
+		}, {
+			path:    "b/b.go",
+			content: "package b",
 		},
 	}
 	dir, err := createFiles(files)
@@ -1377,35 +4776,147 @@ go_test(
 	}
 	defer os.RemoveAll(dir)
 
+	header := `# Copyright 2018 Example Authors.
+#
+# DO NOT EDIT except with gazelle.
+# The header above is set with # gazelle:build_file_header.
+`
+	want := []fileSpec{
+		{
+			path: "BUILD.bazel",
+			content: header + `
+# gazelle:prefix example.com/repo
+# gazelle:build_file_header header.txt
+`,
+		}, {
+			path: "a/BUILD.bazel",
+			content: header + `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+)
+`,
+		}, {
+			path: "b/BUILD.bazel",
+			content: header + `
+# Old header.
+
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/repo/b",
+    visibility = ["//visibility:public"],
+)
+`,
+		},
+	}
+	// The header is inserted above directives and other comments. Running
+	// again doesn't duplicate it.
+	for i := 0; i < 2; i++ {
+		if err := runGazelle(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, dir, want)
+	}
+
+	// An outdated header is replaced.
+	if err := ioutil.WriteFile(filepath.Join(dir, "header.txt"), []byte("# Copyright 2019 Example Authors.\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
 	if err := runGazelle(dir, nil); err != nil {
 		t.Fatal(err)
 	}
+	checkFiles(t, dir, []fileSpec{{
+		path: "a/BUILD.bazel",
+		content: `
+# Copyright 2019 Example Authors.
+# The header above is set with # gazelle:build_file_header.
 
-	checkFiles(t, dir, files)
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+    importpath = "example.com/repo/a",
+    visibility = ["//visibility:public"],
+)
+`,
+	}})
 }
 
-func TestDontCreateBuildFileInEmptyDir(t *testing.T) {
+func TestUnusedLoadsCommand(t *testing.T) {
+	build := `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+# gazelle:prefix example.com/repo
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+`
 	files := []fileSpec{
 		{path: "WORKSPACE"},
-		{path: "sub/"},
+		{path: "BUILD.bazel", content: build},
+		{
+			path:    "sub/BUILD.bazel",
+			content: `load("//:defs.bzl", "unused")`,
+		},
 	}
 	dir, err := createFiles(files)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
-	if err := runGazelle(dir, nil); err != nil {
-		t.Error(err)
+
+	// Check mode only reports unused symbols.
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, f := range []string{"BUILD.bazel", "sub/BUILD.bazel"} {
-		path := filepath.Join(dir, filepath.FromSlash(f))
-		_, err := os.Stat(path)
-		if err == nil {
-			t.Errorf("%s: build file was created", f)
-		}
+	os.Stdout = w
+	err = runGazelle(dir, []string{"unused-loads"})
+	os.Stdout = oldStdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
 	}
-}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `sub/BUILD.bazel: unused loaded from "//:defs.bzl" is unused
+BUILD.bazel: go_test loaded from "@io_bazel_rules_go//go:def.bzl" is unused
+`
+	if string(out) != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", out, want)
+	}
+	checkFiles(t, dir, files[1:])
 
-// TODO(jayconrod): more tests
-//   run in fix mode in testdata directories to create new files
-//   run in diff mode in testdata directories to update existing files (no change)
+	// Fix mode removes them.
+	os.Stdout, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runGazelle(dir, []string{"unused-loads", "-mode=fix"})
+	os.Stdout.Close()
+	os.Stdout = oldStdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, []fileSpec{
+		{
+			path:    "BUILD.bazel",
+			content: strings.Replace(build, `, "go_test"`, "", 1),
+		}, {
+			path:    "sub/BUILD.bazel",
+			content: "",
+		},
+	})
+}
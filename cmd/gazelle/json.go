@@ -0,0 +1,114 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// ruleJSON is a machine-readable description of a generated rule. A stream
+// of these, keyed by label, is written when -json_out is set.
+type ruleJSON struct {
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Srcs    []string `json:"srcs,omitempty"`
+	Deps    []string `json:"deps,omitempty"`
+	Imports []string `json:"imports,omitempty"`
+}
+
+// writeRulesJSONFile writes descriptions of the rules generated in each
+// visited directory to the file at path. Rules must have been resolved
+// before this is called.
+func writeRulesJSONFile(path string, visits []visitRecord) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return writeRulesJSON(f, visits)
+}
+
+// writeRulesJSON writes a stream of JSON objects to w, one per generated
+// rule. Each object has a single key, the label of the rule, which maps
+// to a ruleJSON.
+func writeRulesJSON(w io.Writer, visits []visitRecord) error {
+	enc := json.NewEncoder(w)
+	for _, v := range visits {
+		for _, r := range v.rules {
+			l := label.New("", v.pkgRel, r.Name())
+			desc := ruleJSON{
+				Kind:    r.Kind(),
+				Name:    r.Name(),
+				Srcs:    flatAttrStrings(r, "srcs"),
+				Deps:    flatAttrStrings(r, "deps"),
+				Imports: ruleImports(r),
+			}
+			if err := enc.Encode(map[string]ruleJSON{l.String(): desc}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flatAttrStrings returns the strings in the named attribute of r as a flat,
+// sorted list. Platform-specific values in select expressions are included.
+// Expressions that FlattenExpr can't flatten are returned unmodified, so the
+// strings are sorted here.
+func flatAttrStrings(r *rule.Rule, key string) []string {
+	e := r.Attr(key)
+	if e == nil {
+		return nil
+	}
+	list, ok := rule.FlattenExpr(e).(*bzl.ListExpr)
+	if !ok {
+		return nil
+	}
+	var strs []string
+	for _, elem := range list.List {
+		if s, ok := elem.(*bzl.StringExpr); ok {
+			strs = append(strs, s.Value)
+		}
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// ruleImports returns the imports recorded on r by the language that
+// generated it. Go rules store imports as rule.PlatformStrings; other
+// languages store a []string.
+func ruleImports(r *rule.Rule) []string {
+	switch imports := r.PrivateAttr(config.GazelleImportsKey).(type) {
+	case rule.PlatformStrings:
+		return imports.Flat()
+	case []string:
+		return imports
+	default:
+		return nil
+	}
+}
@@ -26,3 +26,9 @@ func printFile(c *config.Config, f *bzl.File, _ string) error {
 	_, err := os.Stdout.Write(bzl.Format(f))
 	return err
 }
+
+// printRemovedFile prints nothing, since there's nothing left in a build file
+// that's deleted.
+func printRemovedFile(c *config.Config, _ string) error {
+	return nil
+}
@@ -0,0 +1,147 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/merger"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	"github.com/bazelbuild/bazel-gazelle/internal/walk"
+)
+
+type unusedLoadsConfig struct {
+	mode string
+}
+
+const unusedLoadsName = "_unused-loads"
+
+func getUnusedLoadsConfig(c *config.Config) *unusedLoadsConfig {
+	return c.Exts[unusedLoadsName].(*unusedLoadsConfig)
+}
+
+type unusedLoadsConfigurer struct{}
+
+func (_ *unusedLoadsConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
+	ulc := &unusedLoadsConfig{}
+	c.Exts[unusedLoadsName] = ulc
+	fs.StringVar(&ulc.mode, "mode", "check", "check: print unused loaded symbols; fix: remove them from build files")
+}
+
+func (_ *unusedLoadsConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
+	ulc := getUnusedLoadsConfig(c)
+	if ulc.mode != "check" && ulc.mode != "fix" {
+		return fmt.Errorf("-mode: got %q; want %q or %q", ulc.mode, "check", "fix")
+	}
+	return setDirs(c, fs.Args())
+}
+
+// KnownDirectives returns the directives of all languages, so they aren't
+// reported as unknown. They're ignored, since no rules are generated.
+func (_ *unusedLoadsConfigurer) KnownDirectives() []string {
+	var directives []string
+	for _, lang := range languages {
+		directives = append(directives, lang.KnownDirectives()...)
+	}
+	return directives
+}
+
+func (_ *unusedLoadsConfigurer) Configure(c *config.Config, rel string, f *rule.File) {}
+
+// unusedLoads reports or removes symbols loaded in build files that nothing
+// in those files uses. Only build files are read; rules aren't generated,
+// so this works in repositories where Gazelle doesn't manage build files.
+func unusedLoads(args []string) error {
+	cexts := []config.Configurer{&config.CommonConfigurer{}, &unusedLoadsConfigurer{}}
+	c, err := newUnusedLoadsConfiguration(args, cexts)
+	if err != nil {
+		return err
+	}
+	fix := getUnusedLoadsConfig(c).mode == "fix"
+
+	var saveErr error
+	walk.Walk(c, cexts, func(dir, rel string, c *config.Config, update bool, f *rule.File, subdirs, regularFiles, genFiles []string) {
+		if f == nil || !update {
+			return
+		}
+		var unused []merger.UnusedSymbol
+		if fix {
+			unused = merger.RemoveUnusedLoads(f)
+		} else {
+			unused = merger.FindUnusedLoads(f)
+		}
+		path := filepath.Join(rel, filepath.Base(f.Path))
+		for _, u := range unused {
+			fmt.Printf("%s: %s loaded from %q is unused\n", path, u.Symbol, u.Load)
+		}
+		if fix && len(unused) > 0 {
+			if err := f.Save(); err != nil {
+				log.Print(err)
+				saveErr = errors.New("failed to write some build files")
+			}
+		}
+	})
+	return saveErr
+}
+
+func newUnusedLoadsConfiguration(args []string, cexts []config.Configurer) (*config.Config, error) {
+	c := config.New()
+	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+	// Flag will call this on any parse error. Don't print usage unless
+	// -h or -help were passed explicitly.
+	fs.Usage = func() {}
+	for _, cext := range cexts {
+		cext.RegisterFlags(fs, "unused-loads", c)
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			unusedLoadsUsage(fs)
+			os.Exit(0)
+		}
+		// flag already prints the error; don't print it again.
+		return nil, errors.New("Try -help for more information")
+	}
+	for _, cext := range cexts {
+		if err := cext.CheckFlags(fs, c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func unusedLoadsUsage(fs *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, `usage: gazelle unused-loads [flags...] [package-dirs...]
+
+The unused-loads command reports symbols loaded with load statements in build
+files that aren't used anywhere else in those files. With -mode=fix, the
+symbols are removed, along with load statements left empty. Build files are
+not otherwise changed, and rules are not generated, so this command may be
+used in repositories where Gazelle doesn't manage build files.
+
+Build files in package-dirs and their subdirectories are checked. If no
+directories are given, the current directory is used.
+
+FLAGS:
+
+`)
+	fs.PrintDefaults()
+}
@@ -157,7 +157,10 @@ FLAGS:
 }
 
 func updateImportPaths(c *updateReposConfig, f *rule.File, kinds map[string]rule.KindInfo) error {
-	rs := repos.ListRepositories(f)
+	rs, err := repos.ListRepositories(f)
+	if err != nil {
+		return err
+	}
 	rc := repos.NewRemoteCache(rs)
 
 	genRules := make([]*rule.Rule, len(c.importPaths))
@@ -185,16 +188,16 @@ func updateImportPaths(c *updateReposConfig, f *rule.File, kinds map[string]rule
 			return err
 		}
 	}
-	merger.MergeFile(f, nil, genRules, merger.PreResolve, kinds)
+	merger.MergeFile(f, nil, genRules, merger.PreResolve, kinds, nil)
 	return nil
 }
 
 func importFromLockFile(c *updateReposConfig, f *rule.File, kinds map[string]rule.KindInfo) error {
-	genRules, err := repos.ImportRepoRules(c.lockFilename)
+	genRules, err := repos.ImportRepoRules(c.lockFilename, repos.NewRemoteCache(nil))
 	if err != nil {
 		return err
 	}
 
-	merger.MergeFile(f, nil, genRules, merger.PreResolve, kinds)
+	merger.MergeFile(f, nil, genRules, merger.PreResolve, kinds, nil)
 	return nil
 }
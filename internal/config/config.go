@@ -19,9 +19,15 @@ import (
 	"flag"
 	"fmt"
 	"go/build"
+	"io/ioutil"
+	"log"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
 	"github.com/bazelbuild/bazel-gazelle/internal/wspace"
 )
@@ -52,6 +58,109 @@ type Config struct {
 	// used by Bazel and should be ignored. Must contain at least one string.
 	ValidBuildFileNames []string
 
+	// KindMap maps from the kinds of rules generated by Gazelle to kinds that
+	// should be used instead, for example, macros that wrap those rules. Set
+	// with # gazelle:map_kind. This map may be shared with other Configs and
+	// must not be modified; it's replaced when a directive changes it.
+	KindMap map[string]MappedKind
+
+	// mappedKinds lists the keys of KindMap in the order they were mapped
+	// with MapKind, so UnmappedKind prefers the latest mapping when several
+	// kinds are mapped to the same kind. Like KindMap, it's replaced rather
+	// than modified.
+	mappedKinds []string
+
+	// DefaultVisibility is a list of labels set with
+	// # gazelle:default_visibility. When non-empty, Gazelle maintains a
+	// package rule with this default_visibility in each build file it updates.
+	DefaultVisibility []string
+
+	// BuildFileHeader is a list of comment lines, each starting with "#",
+	// that Gazelle keeps at the top of each build file it writes. It's read
+	// from the file named with # gazelle:build_file_header.
+	BuildFileHeader []string
+
+	// DynamicTargets indicates that the build file in the current directory
+	// declares targets Gazelle can't index, for example, with macros. No
+	// labels in this package are guessed for imports that aren't provided by
+	// indexed rules. Set with # gazelle:dynamic_targets. Unlike most values
+	// set with directives, it's not inherited by subdirectories.
+	DynamicTargets bool
+
+	// Langs is a list of names of languages that generate rules, set with
+	// # gazelle:lang. When empty, all languages generate rules. Other
+	// languages don't touch build files in directories where this is set,
+	// though rules in those files are still indexed.
+	Langs []string
+
+	// RenameAliasGrace is how long aliases are kept for rules renamed to
+	// match generated names, set in days with # gazelle:rename_aliases. When
+	// zero, existing rules keep their names, and such aliases are deleted.
+	RenameAliasGrace time.Duration
+
+	// PreservedAttrs maps rule kinds to attributes that should be carried over
+	// from existing rules to generated rules of those kinds, in addition to
+	// those listed in rule.KindInfo.PreservedAttrs. Set with
+	// # gazelle:preserve_attrs. This map may be shared with other Configs and
+	// must not be modified; it's replaced when a directive changes it.
+	PreservedAttrs map[string][]string
+
+	// MapDepLabel, if non-nil, is called with each dependency label after
+	// rules are resolved and before they are merged into build files. from is
+	// the label of the rule with the dependency. The returned label replaces
+	// l. This may be set by programs that embed Gazelle (for example, in a
+	// Configurer) to redirect dependencies, e.g., to mirrors of external
+	// repositories. It can't be set with flags or directives.
+	MapDepLabel func(l, from label.Label) label.Label
+
+	// RuleNamer, if non-nil, is called with the kind of each rule Gazelle
+	// generates, the slash-separated path of its package relative to the
+	// repository root, and the name the rule would have by default. The
+	// returned name is used instead, unless it's empty. Resolvers also call
+	// it when they guess labels of libraries that aren't indexed, so it
+	// should depend only on its arguments. Like MapDepLabel, this may be set
+	// by programs that embed Gazelle. It can't be set with flags or
+	// directives.
+	RuleNamer func(kind, rel, name string) string
+
+	// ExternalRepoName, if non-nil, returns the name of the external repository with
+	// the given root import path, for repositories that aren't declared in
+	// WORKSPACE. It replaces repos.RemoteCache.RepoName, which converts
+	// "example.com/repo" to "com_example_repo". Like MapDepLabel, this may be
+	// set by programs that embed Gazelle to match their naming schemes. It
+	// can't be set with flags or directives.
+	ExternalRepoName func(root string) string
+
+	// Logger receives diagnostics reported while rules are generated and
+	// resolved, for example, imports that can't be resolved. If nil,
+	// DefaultLogger is used. Like MapDepLabel, this may be set by programs
+	// that embed Gazelle to collect or filter diagnostics.
+	Logger Logger
+
+	// Stats, if non-nil, counts the outcomes of import resolution. Set with
+	// -stats.
+	Stats *ResolveStats
+
+	// ChangedSince, if non-zero, enables incremental updates. Directories
+	// where no file was modified after this time are not updated, though
+	// rules in their build files are still indexed.
+	ChangedSince time.Time
+
+	// IncrementalMarker is the absolute path of the file ChangedSince was
+	// read from, if any. Gazelle rewrites it after each run, so changes to it
+	// don't cause its directory to be updated.
+	IncrementalMarker string
+
+	// CreateOnly indicates that only directories without build files are
+	// updated. Existing build files are left untouched, though rules in them
+	// are still indexed. Set with -create_only.
+	CreateOnly bool
+
+	// AnnotateDeps indicates that resolvers should add a comment to each
+	// dependency they resolve explaining how it was resolved, for example,
+	// "# resolved via index". Set with -annotate_deps.
+	AnnotateDeps bool
+
 	// TODO(jayconrod): move language-specific values below this point into
 	// extensions.
 
@@ -134,6 +243,127 @@ func (c *Config) DefaultBuildFileName() string {
 	return c.ValidBuildFileNames[0]
 }
 
+// MappedKind describes a replacement to use for a kind of rule generated
+// by Gazelle.
+type MappedKind struct {
+	// FromKind is the kind of rule Gazelle generates, e.g., "go_library".
+	FromKind string
+
+	// KindName is the kind to use instead, e.g., "my_go_library".
+	KindName string
+
+	// KindLoad is the label of the .bzl file that KindName should be loaded
+	// from, e.g., "//tools:defs.bzl".
+	KindLoad string
+}
+
+// MapKind records that rules of the kind mk.FromKind should be written with
+// the kind mk.KindName instead. KindMap is replaced, since it may be shared
+// with other Configs.
+func (c *Config) MapKind(mk MappedKind) {
+	kindMap := make(map[string]MappedKind, len(c.KindMap)+1)
+	for k, v := range c.KindMap {
+		kindMap[k] = v
+	}
+	kindMap[mk.FromKind] = mk
+	c.KindMap = kindMap
+
+	mappedKinds := make([]string, 0, len(c.mappedKinds)+1)
+	for _, k := range c.mappedKinds {
+		if k != mk.FromKind {
+			mappedKinds = append(mappedKinds, k)
+		}
+	}
+	c.mappedKinds = append(mappedKinds, mk.FromKind)
+}
+
+// UnmappedKind returns the kind of rule that Gazelle generates that was
+// replaced by kind using # gazelle:map_kind. If several kinds were replaced
+// by kind, the one mapped last is returned. If kind is not the result of
+// a mapping, kind is returned unchanged.
+func (c *Config) UnmappedKind(kind string) string {
+	for i := len(c.mappedKinds) - 1; i >= 0; i-- {
+		if mk, ok := c.KindMap[c.mappedKinds[i]]; ok && mk.KindName == kind {
+			return mk.FromKind
+		}
+	}
+	if len(c.mappedKinds) == len(c.KindMap) {
+		return kind
+	}
+
+	// KindMap was set without MapKind. Check its keys in a stable order.
+	fromKinds := make([]string, 0, len(c.KindMap))
+	for k := range c.KindMap {
+		fromKinds = append(fromKinds, k)
+	}
+	sort.Strings(fromKinds)
+	for _, k := range fromKinds {
+		if mk := c.KindMap[k]; mk.KindName == kind {
+			return mk.FromKind
+		}
+	}
+	return kind
+}
+
+// RuleName returns the name of a generated rule of the given kind in the
+// package rel, as chosen by c.RuleNamer. name, the default name, is returned
+// if RuleNamer is nil or returns an empty string.
+func (c *Config) RuleName(kind, rel, name string) string {
+	if c.RuleNamer == nil {
+		return name
+	}
+	if n := c.RuleNamer(kind, rel, name); n != "" {
+		return n
+	}
+	return name
+}
+
+// IsLangEnabled returns whether rules may be generated for the language
+// named lang. All languages are enabled unless # gazelle:lang is set.
+func (c *Config) IsLangEnabled(lang string) bool {
+	if len(c.Langs) == 0 {
+		return true
+	}
+	for _, l := range c.Langs {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// readBuildFileHeader reads the text of a build file header from path and
+// returns it as a list of comment lines. Lines that don't start with "#" are
+// commented out, blank lines within the text become "#" lines, so the header
+// is a single block, and trailing blank lines are dropped. An error is
+// returned if the text contains a directive, since it would be applied to
+// each file with the header.
+func readBuildFileHeader(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimRight(string(data), " \t\r\n")
+	if text == "" {
+		return nil, nil
+	}
+	var header []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		switch {
+		case line == "":
+			line = "#"
+		case !strings.HasPrefix(line, "#"):
+			line = "# " + line
+		}
+		if strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(line, "#")), "gazelle:") {
+			return nil, fmt.Errorf("%s: header must not contain directives: %q", path, line)
+		}
+		header = append(header, line)
+	}
+	return header, nil
+}
+
 // BuildTags is a set of build constraints.
 type BuildTags map[string]bool
 
@@ -229,16 +459,90 @@ func (cc *CommonConfigurer) CheckFlags(fs *flag.FlagSet, c *Config) error {
 }
 
 func (cc *CommonConfigurer) KnownDirectives() []string {
-	return []string{"build_file_name"}
+	return []string{"build_file_header", "build_file_name", "default_visibility", "dynamic_targets", "lang", "map_kind", "preserve_attrs", "rename_aliases"}
 }
 
 func (cc *CommonConfigurer) Configure(c *Config, rel string, f *rule.File) {
+	c.DynamicTargets = false
 	if f == nil {
 		return
 	}
 	for _, d := range f.Directives {
-		if d.Key == "build_file_name" {
+		switch d.Key {
+		case "build_file_header":
+			if d.Value == "" {
+				c.BuildFileHeader = nil
+				continue
+			}
+			header, err := readBuildFileHeader(filepath.Join(c.RepoRoot, filepath.FromSlash(d.Value)))
+			if err != nil {
+				log.Printf("%s: invalid value for gazelle:build_file_header: %v", f.Path, err)
+				continue
+			}
+			c.BuildFileHeader = header
+		case "build_file_name":
 			c.ValidBuildFileNames = strings.Split(d.Value, ",")
+		case "default_visibility":
+			c.DefaultVisibility = nil
+			for _, v := range strings.Split(d.Value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					c.DefaultVisibility = append(c.DefaultVisibility, v)
+				}
+			}
+		case "dynamic_targets":
+			if d.Value == "" {
+				c.DynamicTargets = true
+				continue
+			}
+			dynamic, err := strconv.ParseBool(d.Value)
+			if err != nil {
+				log.Printf("%s: invalid value for gazelle:dynamic_targets: %q", f.Path, d.Value)
+				continue
+			}
+			c.DynamicTargets = dynamic
+		case "lang":
+			c.Langs = nil
+			for _, l := range strings.Split(d.Value, ",") {
+				if l = strings.TrimSpace(l); l != "" {
+					c.Langs = append(c.Langs, l)
+				}
+			}
+		case "map_kind":
+			vals := strings.Fields(d.Value)
+			if len(vals) != 3 {
+				log.Printf("%s: gazelle:map_kind expects three arguments (from_kind to_kind load_file), got %q", f.Path, d.Value)
+				continue
+			}
+			c.MapKind(MappedKind{
+				FromKind: vals[0],
+				KindName: vals[1],
+				KindLoad: vals[2],
+			})
+		case "preserve_attrs":
+			vals := strings.Fields(d.Value)
+			if len(vals) != 2 {
+				log.Printf("%s: gazelle:preserve_attrs expects two arguments (kind attrs), got %q", f.Path, d.Value)
+				continue
+			}
+			preserved := make(map[string][]string, len(c.PreservedAttrs)+1)
+			for k, v := range c.PreservedAttrs {
+				preserved[k] = v
+			}
+			attrs := append([]string(nil), preserved[vals[0]]...)
+			for _, a := range strings.Split(vals[1], ",") {
+				if a = strings.TrimSpace(a); a != "" {
+					attrs = append(attrs, a)
+				}
+			}
+			preserved[vals[0]] = attrs
+			c.PreservedAttrs = preserved
+		case "rename_aliases":
+			days, err := strconv.Atoi(d.Value)
+			if err != nil || days < 0 {
+				log.Printf("%s: invalid value for gazelle:rename_aliases: %q", f.Path, d.Value)
+				continue
+			}
+			c.RenameAliasGrace = time.Duration(days) * 24 * time.Hour
 		}
 	}
 }
@@ -95,3 +95,103 @@ func TestCommonConfigurerDirectives(t *testing.T) {
 		t.Errorf("for ValidBuildFileNames, got %#v, want %#v", c.ValidBuildFileNames, want)
 	}
 }
+
+func TestLangDirective(t *testing.T) {
+	c := New()
+	cc := &CommonConfigurer{}
+	f, err := rule.LoadData("test", []byte(`# gazelle:lang go, proto`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Configure(c, "", f)
+	if want := []string{"go", "proto"}; !reflect.DeepEqual(c.Langs, want) {
+		t.Errorf("for Langs, got %#v, want %#v", c.Langs, want)
+	}
+	for lang, want := range map[string]bool{"go": true, "proto": true, "py": false} {
+		if got := c.IsLangEnabled(lang); got != want {
+			t.Errorf("IsLangEnabled(%q): got %v, want %v", lang, got, want)
+		}
+	}
+
+	sub := c.Clone()
+	f, err = rule.LoadData("sub/test", []byte(`# gazelle:lang`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Configure(sub, "sub", f)
+	if sub.Langs != nil || !sub.IsLangEnabled("py") {
+		t.Errorf("after clearing, got Langs %#v; want all languages enabled", sub.Langs)
+	}
+}
+
+func TestMapKindDirective(t *testing.T) {
+	c := New()
+	cc := &CommonConfigurer{}
+	buildData := []byte(`# gazelle:map_kind go_library my_go_library //tools:defs.bzl`)
+	f, err := rule.LoadData("test", buildData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := c.Clone()
+	cc.Configure(c, "", f)
+	want := map[string]MappedKind{
+		"go_library": {
+			FromKind: "go_library",
+			KindName: "my_go_library",
+			KindLoad: "//tools:defs.bzl",
+		},
+	}
+	if !reflect.DeepEqual(c.KindMap, want) {
+		t.Errorf("for KindMap, got %#v, want %#v", c.KindMap, want)
+	}
+	if parent.KindMap != nil {
+		t.Errorf("parent KindMap was modified: %#v", parent.KindMap)
+	}
+	if got := c.UnmappedKind("my_go_library"); got != "go_library" {
+		t.Errorf("UnmappedKind(%q): got %q, want %q", "my_go_library", got, "go_library")
+	}
+	if got := c.UnmappedKind("go_test"); got != "go_test" {
+		t.Errorf("UnmappedKind(%q): got %q, want %q", "go_test", got, "go_test")
+	}
+}
+
+func TestUnmappedKindOrder(t *testing.T) {
+	c := New()
+	cc := &CommonConfigurer{}
+	f, err := rule.LoadData("test", []byte(`
+# gazelle:map_kind go_library my_go_rule //tools:defs.bzl
+# gazelle:map_kind go_binary my_go_rule //tools:defs.bzl
+# gazelle:map_kind go_test my_go_test //tools:defs.bzl
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Configure(c, "", f)
+	sub := c.Clone()
+	f, err = rule.LoadData("sub/test", []byte(`
+# gazelle:map_kind go_library my_go_rule //tools:defs.bzl
+# gazelle:map_kind go_binary my_go_binary //tools:defs.bzl
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Configure(sub, "sub", f)
+
+	for _, tc := range []struct {
+		c          *Config
+		kind, want string
+	}{
+		{c, "my_go_rule", "go_binary"},
+		{c, "my_go_test", "go_test"},
+		{sub, "my_go_rule", "go_library"},
+		{sub, "my_go_binary", "go_binary"},
+		{sub, "my_go_test", "go_test"},
+	} {
+		// Repeat, since map iteration order varies.
+		for i := 0; i < 10; i++ {
+			if got := tc.c.UnmappedKind(tc.kind); got != tc.want {
+				t.Fatalf("UnmappedKind(%q): got %q, want %q", tc.kind, got, tc.want)
+			}
+		}
+	}
+}
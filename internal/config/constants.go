@@ -54,6 +54,24 @@ const (
 	// GazelleImportsKey is an internal attribute that lists imported packages
 	// on generated rules. It is replaced with "deps" during import resolution.
 	GazelleImportsKey = "_gazelle_imports"
+
+	// GazelleManagedAttrsKey is an internal attribute that lists additional
+	// attributes on a generated rule that should be merged into an existing
+	// rule, even though they are not mergeable for the rule's kind. The value
+	// is a []string.
+	GazelleManagedAttrsKey = "_gazelle_managed_attrs"
+
+	// GazellePreservedAttrsKey is an internal attribute that lists additional
+	// attributes that should be carried over from an existing rule to a
+	// generated rule, like rule.KindInfo.PreservedAttrs. The value is a
+	// []string.
+	GazellePreservedAttrsKey = "_gazelle_preserved_attrs"
+
+	// GazelleOnlyAttrsKey is an internal attribute that lists the only
+	// attributes of an existing rule that may be modified when a generated
+	// rule is merged into it. Rules with this attribute are not added to or
+	// deleted from build files. The value is a []string.
+	GazelleOnlyAttrsKey = "_gazelle_only_attrs"
 )
 
 // Language is the name of a programming langauge that Gazelle knows about.
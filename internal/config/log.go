@@ -0,0 +1,86 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"log"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+)
+
+// Severity indicates how serious a Diagnostic is.
+type Severity int
+
+const (
+	// Warning indicates Gazelle made a choice that may not be what the user
+	// intended, for example, when several rules could satisfy an import.
+	Warning Severity = iota
+
+	// Error indicates Gazelle could not do what was asked, for example, when
+	// an import can't be resolved. The affected dependency is omitted.
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Diagnostic is a message reported while generating or resolving rules.
+type Diagnostic struct {
+	Severity Severity
+
+	// From is the label of the rule the diagnostic is about. It's
+	// label.NoLabel if the diagnostic isn't about a specific rule.
+	From label.Label
+
+	// Imp is the import string the diagnostic is about. It's empty if the
+	// diagnostic isn't about a specific import.
+	Imp string
+
+	// Message is a complete, human-readable description. It includes From and
+	// Imp where they're relevant.
+	Message string
+}
+
+// Logger receives diagnostics. Implementations may be called concurrently
+// from multiple goroutines.
+type Logger interface {
+	Log(d Diagnostic)
+}
+
+// DefaultLogger prints the message of each diagnostic with log.Print.
+type DefaultLogger struct{}
+
+func (DefaultLogger) Log(d Diagnostic) {
+	log.Print(d.Message)
+}
+
+// Log reports a diagnostic to c.Logger or to DefaultLogger if c.Logger
+// is nil.
+func (c *Config) Log(d Diagnostic) {
+	if c.Logger == nil {
+		DefaultLogger{}.Log(d)
+		return
+	}
+	c.Logger.Log(d)
+}
@@ -0,0 +1,91 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ResolveStats counts the outcomes of import resolution across a run.
+// Resolvers report each import they resolve with Resolved, and each import
+// they can't resolve with Unresolved. Imports that don't need dependencies,
+// like standard library imports, aren't counted.
+//
+// Methods may be called concurrently. They do nothing if the receiver is
+// nil, so resolvers can call them without checking whether statistics are
+// collected.
+type ResolveStats struct {
+	mu                    sync.Mutex
+	resolved              map[string]int
+	ambiguous, unresolved int
+}
+
+// Resolved records an import resolved to a dependency. via describes how it
+// was resolved, like the comments written with -annotate_deps, for example,
+// "index" or "vendor fallback".
+func (s *ResolveStats) Resolved(via string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resolved == nil {
+		s.resolved = make(map[string]int)
+	}
+	s.resolved[via]++
+}
+
+// Unresolved records an import that couldn't be resolved. ambiguous
+// indicates that more than one rule provides the import.
+func (s *ResolveStats) Unresolved(ambiguous bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ambiguous {
+		s.ambiguous++
+	} else {
+		s.unresolved++
+	}
+}
+
+// WriteSummary writes the number of imports resolved in each way, sorted by
+// description, followed by the numbers of ambiguous and unresolved imports.
+func (s *ResolveStats) WriteSummary(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vias := make([]string, 0, len(s.resolved))
+	total := 0
+	for via, n := range s.resolved {
+		vias = append(vias, via)
+		total += n
+	}
+	sort.Strings(vias)
+	if _, err := fmt.Fprintf(w, "resolved imports: %d\n", total); err != nil {
+		return err
+	}
+	for _, via := range vias {
+		if _, err := fmt.Fprintf(w, "  via %s: %d\n", via, s.resolved[via]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "ambiguous imports: %d\nunresolved imports: %d\n", s.ambiguous, s.unresolved)
+	return err
+}
@@ -134,6 +134,10 @@ func (l Label) Rel(repo, pkg string) Label {
 	return l
 }
 
+// Equal returns whether l and other name the same target. Labels are stored
+// in canonical form: Parse fills in the name of a shorthand label like
+// "//foo" from the last component of its package, so it's equal to
+// "//foo:foo". String writes such labels in shorthand form.
 func (l Label) Equal(other Label) bool {
 	return l.Repo == other.Repo &&
 		l.Pkg == other.Pkg &&
@@ -150,8 +154,7 @@ func (l Label) Contains(other Label) bool {
 	if other.Relative {
 		log.Panicf("other must not be relative: %s", other)
 	}
-	result := l.Repo == other.Repo && pathtools.HasPrefix(other.Pkg, l.Pkg)
-	return result
+	return l.Repo == other.Repo && pathtools.Contains(l.Pkg, other.Pkg)
 }
 
 // ImportPathToBazelRepoName converts a Go import path into a bazel repo name
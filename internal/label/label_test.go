@@ -85,3 +85,26 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestEqualShorthand(t *testing.T) {
+	for _, pair := range [][2]string{
+		{"//foo", "//foo:foo"},
+		{"//vendor/b/vendor/a", "//vendor/b/vendor/a:a"},
+		{"@r//foo/bar", "@r//foo/bar:bar"},
+	} {
+		a, err := Parse(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.Equal(b) {
+			t.Errorf("%s and %s: got not equal; want equal", pair[0], pair[1])
+		}
+		if a.String() != pair[0] || b.String() != pair[0] {
+			t.Errorf("%s and %s: got strings %s and %s; want %s", pair[0], pair[1], a, b, pair[0])
+		}
+	}
+}
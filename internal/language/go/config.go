@@ -21,11 +21,17 @@ import (
 	"go/build"
 	"log"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	gzflag "github.com/bazelbuild/bazel-gazelle/internal/flag"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	"github.com/bazelbuild/bazel-gazelle/internal/language/proto"
+	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
 	bzl "github.com/bazelbuild/buildtools/build"
 )
@@ -59,10 +65,227 @@ type goConfig struct {
 	// depMode determines how imports that are not standard, indexed, or local
 	// (under the current prefix) should be resolved.
 	depMode dependencyMode
+
+	// defaultRepo is the name of the repository that provides external
+	// imports that aren't provided by a known repository, set with
+	// # gazelle:go_repository_default_repo. Imports are resolved to packages
+	// in this repository named after their import paths. When empty, a
+	// repository name is derived from each import path's root.
+	defaultRepo string
+
+	// defaultRepoNaming is the build naming convention of defaultRepo:
+	// "import", "import_alias", or "go_default_library" (the default).
+	defaultRepoNaming string
+
+	// importIndex maps import paths to labels of the rules that provide them.
+	// It's read from the file set with -go_import_index. Imports in the index
+	// are resolved without looking up their repositories in the remote cache.
+	importIndex map[string]label.Label
+
+	// importIndexPath is the path to the file importIndex is read from.
+	importIndexPath string
+
+	// importIndexStrict indicates whether external imports that aren't in
+	// importIndex are errors, rather than being looked up in the remote cache.
+	// Set with -go_import_index_strict.
+	importIndexStrict bool
+
+	// checkDepCycles indicates whether resolved dependencies are checked for
+	// import cycles through dependencies of indexed rules. Each check may
+	// walk much of the dependency graph, so it's off by default. Set with
+	// -go_check_dep_cycles.
+	checkDepCycles bool
+
+	// extraDeps is a list of labels added to the deps attribute of generated
+	// go_library, go_binary, and go_test rules, in addition to resolved
+	// dependencies. Set with # gazelle:go_extra_deps.
+	extraDeps []string
+
+	// ignoredImports is a list of import paths that aren't resolved to
+	// dependencies. A path ending with "/..." matches imports with the rest
+	// of the path as a prefix. Set with # gazelle:go_ignore_import; each
+	// directive adds a path. This slice may be shared with other configs and
+	// must not be modified in place.
+	ignoredImports []string
+
+	// vendorDir is the slash-separated path, relative to the repository root,
+	// of the directory where imports that aren't indexed are assumed to be
+	// vendored in vendored mode. Set with # gazelle:go_vendor_dir. "vendor" by
+	// default.
+	vendorDir string
+
+	// vendorFallback indicates whether imports that aren't indexed are
+	// resolved to libraries in vendorDir in vendored mode. When false, an
+	// error is reported for these imports instead. Set with
+	// # gazelle:go_vendor_fallback. True by default.
+	vendorFallback bool
+
+	// visibility is a list of labels used as the visibility attribute of
+	// generated go_library and go_proto_library rules. Set with
+	// # gazelle:go_visibility. When empty, visibility is inferred, and
+	// existing visibility attributes are not modified.
+	visibility []string
+
+	// preferAlias indicates whether imports should be resolved to alias rules
+	// that point to the libraries that provide them, when exactly one such
+	// alias exists. Set with # gazelle:prefer_alias.
+	preferAlias bool
+
+	// platforms is the list of platforms considered when evaluating build
+	// constraints on source files. Files that can't be built on any of these
+	// platforms are excluded. Set with # gazelle:go_platforms. By default,
+	// this is rule.KnownPlatforms.
+	platforms []rule.Platform
+
+	// platformOSs and platformArchs are the sorted, de-duplicated operating
+	// systems and architectures in platforms.
+	platformOSs, platformArchs []string
+
+	// platformLabels maps names of platform conditions in
+	// @io_bazel_rules_go//go/platform, like "linux_amd64", to labels used
+	// instead as select keys in generated rules. Set with
+	// # gazelle:go_platform_mapping. Like xDefs, this map may be shared with
+	// other configs and must not be modified.
+	platformLabels map[string]string
+
+	// pureMode determines whether the pure attribute is set on generated
+	// go_binary and go_test rules. Set with # gazelle:go_pure.
+	pureMode pureMode
+
+	// prefixMap maps secondary import path prefixes to the slash-separated
+	// directories, relative to the repository root, that contain the
+	// packages with those prefixes. Set with # gazelle:go_prefix_map. Like
+	// xDefs, this map may be shared with other configs and must not be
+	// modified.
+	prefixMap map[string]string
+
+	// localRepos lists repositories declared with local_repository, usually
+	// sibling workspaces in a monorepo. Imports under their prefixes are
+	// resolved to labels in those repositories. Set with
+	// # gazelle:go_local_repository. Like prefixMap, this slice may be shared
+	// with other configs and must not be modified.
+	localRepos []*localRepo
+
+	// resolveOverrides maps import paths to the labels they're resolved to,
+	// before any other resolution. Keys ending with "/..." match all imports
+	// under a prefix; exact keys win over these, and longer prefixes win
+	// over shorter ones. Set with # gazelle:resolve. Like prefixMap, this map
+	// may be shared with other configs and must not be modified.
+	resolveOverrides map[string]label.Label
+
+	// xDefs maps names of string variables (qualified with package import
+	// paths) to values that are set with the x_defs attribute of generated
+	// go_binary rules. Set with # gazelle:go_x_defs. When empty, x_defs is
+	// not managed. This map may be shared with other configs and must not be
+	// modified; it's replaced when a directive changes it.
+	xDefs map[string]string
+
+	// testTags is a list of build tags, like "integration", that gate tests
+	// which shouldn't run by default. Test files that require one of these
+	// tags are built by a separate go_test rule for each tag, tagged with the
+	// build tag and "manual". Set with # gazelle:go_test_tags.
+	testTags []string
+
+	// testRace and testMsan indicate whether go_test rules instrumented with
+	// the race detector and the memory sanitizer are generated next to each
+	// go_test rule. Set with # gazelle:go_test_race and
+	// # gazelle:go_test_msan.
+	testRace, testMsan bool
+
+	// testonly indicates whether testonly = True is set on generated
+	// go_library rules and on go_binary rules that embed them. testonlySet
+	// indicates whether Gazelle manages the attribute; it's false until a
+	// value is given. Set with # gazelle:go_testonly.
+	testonly, testonlySet bool
+
+	// goGenerateGenrule indicates whether genrules should be generated for
+	// //go:generate directives that invoke recognized tools. Set with
+	// # gazelle:go_generate_genrule.
+	goGenerateGenrule bool
+
+	// mockgen indicates whether genrules should be generated for
+	// //go:generate directives that invoke mockgen. The generated mocks are
+	// added to the srcs of go_default_test. Set with # gazelle:go_mockgen.
+	mockgen bool
+
+	// mockgenTool is the label of the mockgen binary run by genrules
+	// generated for mockgen directives. Set with # gazelle:go_mockgen_tool.
+	mockgenTool string
+
+	// splitMain indicates whether files in package main are built by a
+	// go_binary with its own srcs. In directories that also have a library
+	// package, the library files are built by a go_library, and the main
+	// files by a go_binary. In directories with only package main and no
+	// tests, no go_library is generated. Set with # gazelle:go_split_main.
+	splitMain bool
+
+	// stdOverrides changes which import paths are treated as standard
+	// library packages, for toolchains whose standard library differs from
+	// the one Gazelle's list was generated from. Paths mapped to true are
+	// standard; paths mapped to false aren't. Set with
+	// # gazelle:go_stdlib_packages. This map may be shared with other
+	// configs and must not be modified.
+	stdOverrides map[string]bool
+
+	// goGenerateGlob indicates whether the srcs of generated rules should be
+	// glob expressions instead of lists of files. Set with
+	// # gazelle:go_generate_glob.
+	goGenerateGlob bool
+
+	// grpcCompilers is a sorted list of labels of compilers used by
+	// go_proto_library rules generated for protos with services. When empty,
+	// the default grpc compiler from rules_go is used. Set with
+	// # gazelle:go_grpc_compilers.
+	grpcCompilers []string
+
+	// goProtoSuffix is appended to the names of proto_library rules, without
+	// their "_proto" suffix, to name the go_proto_library rules generated for
+	// them. Set with # gazelle:go_proto_library_suffix.
+	goProtoSuffix string
+
+	// grpcSuffix is used instead of goProtoSuffix for go_proto_library rules
+	// generated for protos with services. When empty, goProtoSuffix is used.
+	// Set with # gazelle:go_grpc_library_suffix.
+	grpcSuffix string
+
+	// protoGateway indicates whether a grpc-gateway library is generated
+	// next to each go_proto_library with services. Set with
+	// # gazelle:proto_gateway, which also maps gatewayKind to the kind of
+	// rule that builds the gateway.
+	protoGateway bool
+
+	// nestedModules maps slash-separated paths of subdirectories containing
+	// go.mod files to the paths of the modules they declare. Packages in
+	// these directories get import paths from their modules, and imports of
+	// packages in other modules are resolved as external. The map is shared
+	// by all configs, since dependencies are resolved with the root config.
+	// Modules are added by Configure, which visits every directory before
+	// dependencies are resolved.
+	nestedModules map[string]string
+
+	// moduleReplaces is the list of replace directives in the go.mod file
+	// in the repository root, if there is one. Paths of local replacements
+	// are relative to the repository root.
+	moduleReplaces []moduleReplace
+
+	// internalVisibility indicates whether libraries in internal directories
+	// should only be visible to packages under the parent of the internal
+	// directory. Set with -go_internal_visibility. True by default.
+	internalVisibility bool
 }
 
 func newGoConfig() *goConfig {
-	gc := &goConfig{}
+	gc := &goConfig{
+		platforms:          rule.KnownPlatforms,
+		platformOSs:        rule.KnownOSs,
+		platformArchs:      rule.KnownArchs,
+		internalVisibility: true,
+		vendorDir:          "vendor",
+		vendorFallback:     true,
+		nestedModules:      make(map[string]string),
+		mockgenTool:        defaultMockgenTool,
+		goProtoSuffix:      defaultGoProtoSuffix,
+	}
 	gc.preprocessTags()
 	return gc
 }
@@ -80,6 +303,275 @@ func (gc *goConfig) clone() *goConfig {
 	return &gcCopy
 }
 
+// setXDef adds a variable definition of the form "name=value" to xDefs.
+// If value is empty, all definitions are cleared.
+func (gc *goConfig) setXDef(value string) error {
+	if value == "" {
+		gc.xDefs = nil
+		return nil
+	}
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("want name=value, got %q", value)
+	}
+	xDefs := make(map[string]string, len(gc.xDefs)+1)
+	for k, v := range gc.xDefs {
+		xDefs[k] = v
+	}
+	xDefs[value[:i]] = value[i+1:]
+	gc.xDefs = xDefs
+	return nil
+}
+
+// setPlatformLabel adds a mapping of the form "condition=label" to
+// platformLabels. The condition is an operating system, an architecture, or
+// a platform named like "linux_amd64". If value is empty, all mappings are
+// cleared.
+func (gc *goConfig) setPlatformLabel(value string) error {
+	if value == "" {
+		gc.platformLabels = nil
+		return nil
+	}
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("want condition=label, got %q", value)
+	}
+	name, l := value[:i], value[i+1:]
+	if !isPlatformCondition(name) {
+		return fmt.Errorf("unknown platform condition %q", name)
+	}
+	if _, err := label.Parse(l); err != nil {
+		return err
+	}
+	platformLabels := make(map[string]string, len(gc.platformLabels)+1)
+	for k, v := range gc.platformLabels {
+		platformLabels[k] = v
+	}
+	platformLabels[name] = l
+	gc.platformLabels = platformLabels
+	return nil
+}
+
+// isPlatformCondition returns whether name is the name of a condition in
+// @io_bazel_rules_go//go/platform: a known operating system, architecture,
+// or platform.
+func isPlatformCondition(name string) bool {
+	if rule.KnownOSSet[name] || rule.KnownArchSet[name] {
+		return true
+	}
+	for _, p := range rule.KnownPlatforms {
+		if p.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// localRepo describes a repository declared with local_repository that
+// provides packages with an import path prefix.
+type localRepo struct {
+	name, prefix string
+
+	// dir is the absolute path of the repository on disk. It's empty if
+	// unknown. When set, build files there are read to find library names.
+	dir string
+
+	// mu guards libNames, which caches names of libraries found in dir by
+	// import path.
+	mu       sync.Mutex
+	libNames map[string]string
+}
+
+// addLocalRepo adds a repository described by attributes of the form
+// key=value to localRepos. The name and prefix attributes are required.
+// path is the repository's directory, relative to repoRoot if it's not
+// absolute. If value is empty, all repositories are cleared.
+func (gc *goConfig) addLocalRepo(value, repoRoot string) error {
+	if value == "" {
+		gc.localRepos = nil
+		return nil
+	}
+	r := &localRepo{}
+	for _, f := range strings.Fields(value) {
+		i := strings.IndexByte(f, '=')
+		if i <= 0 {
+			return fmt.Errorf("attribute %q is not of the form key=value", f)
+		}
+		key, val := f[:i], f[i+1:]
+		switch key {
+		case "name":
+			r.name = val
+		case "prefix":
+			r.prefix = pathtools.CleanImport(val)
+		case "path":
+			if !filepath.IsAbs(val) {
+				val = filepath.Join(repoRoot, filepath.FromSlash(val))
+			}
+			r.dir = val
+		default:
+			return fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	if r.name == "" || r.prefix == "" {
+		return fmt.Errorf("want name=... prefix=... [path=...]")
+	}
+	gc.localRepos = append(gc.localRepos[:len(gc.localRepos):len(gc.localRepos)], r)
+	return nil
+}
+
+// setPrefixMap adds a mapping of the form "importprefix=reldir" to
+// prefixMap. If value is empty, all mappings are cleared.
+func (gc *goConfig) setPrefixMap(value string) error {
+	if value == "" {
+		gc.prefixMap = nil
+		return nil
+	}
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("want importprefix=reldir, got %q", value)
+	}
+	prefix := pathtools.CleanImport(value[:i])
+	rel := value[i+1:]
+	if rel != "" {
+		rel = path.Clean(rel)
+		if path.IsAbs(rel) || build.IsLocalImport(rel) {
+			return fmt.Errorf("directory %q must be relative to the repository root", value[i+1:])
+		}
+	}
+	prefixMap := make(map[string]string, len(gc.prefixMap)+1)
+	for k, v := range gc.prefixMap {
+		prefixMap[k] = v
+	}
+	prefixMap[prefix] = rel
+	gc.prefixMap = prefixMap
+	return nil
+}
+
+// mapPrefix returns the local package for imp according to prefixMap. The
+// longest matching prefix is used. Mappings only apply when they're more
+// specific than the main prefix.
+func (gc *goConfig) mapPrefix(imp string) (pkg string, ok bool) {
+	best := -1
+	if gc.prefix != "" && pathtools.HasPrefix(imp, gc.prefix) {
+		best = len(gc.prefix)
+	}
+	for prefix, rel := range gc.prefixMap {
+		if len(prefix) > best && pathtools.HasPrefix(imp, prefix) {
+			best = len(prefix)
+			pkg = path.Join(rel, pathtools.TrimPrefix(imp, prefix))
+			ok = true
+		}
+	}
+	return pkg, ok
+}
+
+// checkRuleNameSuffix returns an error if suffix can't be part of a rule
+// name.
+func checkRuleNameSuffix(suffix string) error {
+	if strings.ContainsAny(suffix, ":/@ \t") {
+		return fmt.Errorf("%q can't be part of a rule name", suffix)
+	}
+	return nil
+}
+
+// goProtoLibraryName returns the name of the go_proto_library generated for
+// the proto_library protoName. hasServices indicates whether the protos
+// define services, in which case grpcSuffix is used if set.
+func (gc *goConfig) goProtoLibraryName(protoName string, hasServices bool) string {
+	suffix := gc.goProtoSuffix
+	if hasServices && gc.grpcSuffix != "" {
+		suffix = gc.grpcSuffix
+	}
+	return strings.TrimSuffix(protoName, "_proto") + suffix
+}
+
+// addResolveOverride adds an override of the form "go import-path label" to
+// resolveOverrides. The import path may end with "/..." to match all
+// imports under a prefix. Overrides for other languages are ignored, since
+// they're handled by other extensions.
+func (gc *goConfig) addResolveOverride(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return fmt.Errorf("want language, import path, and label; got %q", value)
+	}
+	if fields[0] != "go" {
+		return nil
+	}
+	imp := fields[1]
+	if prefix := strings.TrimSuffix(imp, "/..."); prefix != imp {
+		if prefix == "" {
+			return fmt.Errorf("empty import path prefix in %q", imp)
+		}
+		imp = pathtools.CleanImport(prefix) + "/..."
+	} else {
+		imp = pathtools.CleanImport(imp)
+	}
+	l, err := label.Parse(fields[2])
+	if err != nil {
+		return err
+	}
+	resolveOverrides := make(map[string]label.Label, len(gc.resolveOverrides)+1)
+	for k, v := range gc.resolveOverrides {
+		resolveOverrides[k] = v
+	}
+	resolveOverrides[imp] = l
+	gc.resolveOverrides = resolveOverrides
+	return nil
+}
+
+// findResolveOverride returns the label imp is resolved to according to
+// resolveOverrides. An exact match is preferred; otherwise, the longest
+// matching wildcard prefix is used.
+func (gc *goConfig) findResolveOverride(imp string) (label.Label, bool) {
+	if l, ok := gc.resolveOverrides[imp]; ok {
+		return l, true
+	}
+	best := -1
+	var bestLabel label.Label
+	for pattern, l := range gc.resolveOverrides {
+		prefix := strings.TrimSuffix(pattern, "/...")
+		if prefix != pattern && len(prefix) > best && pathtools.HasPrefix(imp, prefix) {
+			best = len(prefix)
+			bestLabel = l
+		}
+	}
+	return bestLabel, best >= 0
+}
+
+// setStdOverrides adds the comma-separated import paths in value to
+// stdOverrides. Paths starting with "-" are removed from the standard
+// library; others are added. If value is empty, all overrides are cleared.
+func (gc *goConfig) setStdOverrides(value string) error {
+	if value == "" {
+		gc.stdOverrides = nil
+		return nil
+	}
+	stdOverrides := make(map[string]bool, len(gc.stdOverrides))
+	for k, v := range gc.stdOverrides {
+		stdOverrides[k] = v
+	}
+	for _, imp := range strings.Split(value, ",") {
+		imp = strings.TrimSpace(imp)
+		isStd := !strings.HasPrefix(imp, "-")
+		imp = pathtools.CleanImport(strings.TrimPrefix(imp, "-"))
+		if imp == "" || imp == "." || build.IsLocalImport(imp) {
+			return fmt.Errorf("invalid import path in %q", value)
+		}
+		stdOverrides[imp] = isStd
+	}
+	gc.stdOverrides = stdOverrides
+	return nil
+}
+
+// isStandard returns whether imp is a package in the standard library,
+// according to the built-in list and # gazelle:go_stdlib_packages.
+func (gc *goConfig) isStandard(imp string) bool {
+	if isStd, ok := gc.stdOverrides[imp]; ok {
+		return isStd
+	}
+	return stdPackages[imp]
+}
+
 // preprocessTags adds some tags which are on by default before they are
 // used to match files.
 func (gc *goConfig) preprocessTags() {
@@ -105,6 +597,165 @@ func (gc *goConfig) setBuildTags(tags string) error {
 	return nil
 }
 
+// setTestTags sets testTags by parsing a comma separated list. An empty
+// string clears the list.
+func (gc *goConfig) setTestTags(value string) error {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if strings.HasPrefix(t, "!") {
+			return fmt.Errorf("test tags can't be negated: %s", t)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	gc.testTags = tags
+	return nil
+}
+
+// setPlatforms sets the platforms considered when evaluating build
+// constraints by parsing a comma separated list of os_arch pairs. An empty
+// string restores the default set of platforms. An error is returned for
+// platforms that aren't in rule.KnownPlatforms.
+func (gc *goConfig) setPlatforms(value string) error {
+	if value == "" {
+		gc.platforms = rule.KnownPlatforms
+		gc.platformOSs = rule.KnownOSs
+		gc.platformArchs = rule.KnownArchs
+		return nil
+	}
+
+	known := make(map[rule.Platform]bool)
+	for _, p := range rule.KnownPlatforms {
+		known[p] = true
+	}
+	var platforms []rule.Platform
+	seen := make(map[rule.Platform]bool)
+	osSet := make(map[string]bool)
+	archSet := make(map[string]bool)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		i := strings.IndexByte(s, '_')
+		if i < 0 {
+			return fmt.Errorf("invalid platform %q: must be of the form os_arch", s)
+		}
+		p := rule.Platform{OS: s[:i], Arch: s[i+1:]}
+		if !known[p] {
+			return fmt.Errorf("unknown platform %q", s)
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		platforms = append(platforms, p)
+		osSet[p.OS] = true
+		archSet[p.Arch] = true
+	}
+
+	gc.platforms = platforms
+	gc.platformOSs = sortedKeys(osSet)
+	gc.platformArchs = sortedKeys(archSet)
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseGrpcCompilers parses a comma-separated list of compiler labels, as
+// given with # gazelle:go_grpc_compilers. The returned list is sorted and
+// has no duplicates. An empty value yields a nil list.
+func parseGrpcCompilers(value string) ([]string, error) {
+	seen := make(map[string]bool)
+	var compilers []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, err := label.Parse(s); err != nil {
+			return nil, fmt.Errorf("%q is not a valid label", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			compilers = append(compilers, s)
+		}
+	}
+	sort.Strings(compilers)
+	return compilers, nil
+}
+
+// pureMode determines whether the pure attribute is set on generated
+// go_binary and go_test rules.
+type pureMode int
+
+const (
+	// pureUnset indicates Gazelle doesn't manage the pure attribute.
+	pureUnset pureMode = iota
+
+	// pureAuto indicates pure = "on" is set on rules that don't use cgo,
+	// either directly or through an embedded library. The attribute is
+	// removed from rules that use cgo.
+	pureAuto
+
+	// pureOn indicates pure = "on" is always set.
+	pureOn
+
+	// pureOff indicates pure = "off" is always set.
+	pureOff
+)
+
+func pureModeFromString(s string) (pureMode, error) {
+	switch s {
+	case "":
+		return pureUnset, nil
+	case "auto":
+		return pureAuto, nil
+	case "on":
+		return pureOn, nil
+	case "off":
+		return pureOff, nil
+	default:
+		return pureUnset, fmt.Errorf("unrecognized pure mode: %q", s)
+	}
+}
+
+// parseDefaultRepo parses the value of a # gazelle:go_repository_default_repo
+// directive, which is a repository name, optionally followed by a build
+// naming convention. An empty value clears the default repository.
+func parseDefaultRepo(value string) (repo, naming string, err error) {
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 0:
+		return "", "", nil
+	case 1, 2:
+		repo = strings.TrimPrefix(fields[0], "@")
+		if _, err := label.Parse("@" + repo + "//:x"); err != nil || repo == "" {
+			return "", "", fmt.Errorf("invalid repository name: %q", fields[0])
+		}
+	default:
+		return "", "", fmt.Errorf("want repository name and optional naming convention; got %q", value)
+	}
+	if len(fields) == 2 {
+		naming = fields[1]
+		switch naming {
+		case "import", "import_alias", "go_default_library":
+		default:
+			return "", "", fmt.Errorf("unrecognized naming convention: %q", naming)
+		}
+	}
+	return repo, naming, nil
+}
+
 // dependencyMode determines how imports of packages outside of the prefix
 // are resolved.
 type dependencyMode int
@@ -163,8 +814,36 @@ func (f tagsFlag) String() string {
 func (_ *goLang) KnownDirectives() []string {
 	return []string{
 		"build_tags",
+		"go_extra_deps",
+		"go_generate_genrule",
+		"go_generate_glob",
+		"go_grpc_compilers",
+		"go_grpc_library_suffix",
+		"go_ignore_import",
+		"go_local_repository",
+		"go_mockgen",
+		"go_mockgen_tool",
+		"go_platform_mapping",
+		"go_platforms",
+		"go_prefix_map",
+		"go_proto_library_suffix",
+		"go_pure",
+		"go_repository_default_repo",
+		"go_split_main",
+		"go_stdlib_packages",
+		"go_test_msan",
+		"go_test_race",
+		"go_test_tags",
+		"go_testonly",
+		"go_vendor_dir",
+		"go_vendor_fallback",
+		"go_visibility",
+		"go_x_defs",
 		"importmap_prefix",
+		"prefer_alias",
 		"prefix",
+		"proto_gateway",
+		"resolve",
 	}
 }
 
@@ -184,6 +863,26 @@ func (_ *goLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
 			&externalFlag{&gc.depMode},
 			"external",
 			"external: resolve external packages with go_repository\n\tvendored: resolve external packages as packages in vendor/")
+		fs.StringVar(
+			&gc.importIndexPath,
+			"go_import_index",
+			"",
+			"file mapping import paths to labels, one per line, separated by a tab. Imports in\n\tthe file are resolved without looking up repositories in the remote cache.\n\tRelative paths are relative to the repository root.")
+		fs.BoolVar(
+			&gc.importIndexStrict,
+			"go_import_index_strict",
+			false,
+			"if true, external imports that aren't in the -go_import_index file are errors\n\tinstead of being looked up in the remote cache")
+		fs.BoolVar(
+			&gc.checkDepCycles,
+			"go_check_dep_cycles",
+			false,
+			"if true, a warning is logged for each resolved dependency that creates an\n\timport cycle through dependencies of rules in the repository")
+		fs.BoolVar(
+			&gc.internalVisibility,
+			"go_internal_visibility",
+			true,
+			"if true, libraries in internal directories are only visible to packages\n\tunder the parent of the internal directory")
 	}
 	c.Exts[goName] = gc
 }
@@ -196,6 +895,19 @@ func (_ *goLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
 	gc := getGoConfig(c)
 	pc := proto.GetProtoConfig(c)
 	pc.GoPrefix = gc.prefix
+
+	if gc.importIndexPath != "" {
+		if !filepath.IsAbs(gc.importIndexPath) {
+			gc.importIndexPath = filepath.Join(c.RepoRoot, gc.importIndexPath)
+		}
+		index, err := readImportIndex(gc.importIndexPath)
+		if err != nil {
+			return err
+		}
+		gc.importIndex = index
+	} else if gc.importIndexStrict {
+		return fmt.Errorf("-go_import_index_strict requires -go_import_index")
+	}
 	return nil
 }
 
@@ -208,7 +920,41 @@ func (_ *goLang) Configure(c *config.Config, rel string, f *rule.File) {
 	}
 	c.Exts[goName] = gc
 
-	if path.Base(rel) == "vendor" {
+	var modulePath string
+	if rel == "" {
+		var replaces []moduleReplace
+		var err error
+		modulePath, replaces, err = readModFile(filepath.Join(c.RepoRoot, "go.mod"))
+		if err != nil {
+			log.Print(err)
+		}
+		for i := range replaces {
+			if r := &replaces[i]; r.isLocal() && filepath.IsAbs(r.newPath) {
+				if newPath, err := filepath.Rel(c.RepoRoot, r.newPath); err == nil {
+					r.newPath = filepath.ToSlash(newPath)
+				}
+			}
+		}
+		gc.moduleReplaces = replaces
+	}
+
+	if rel != "" && !isVendorPath(gc, rel) {
+		modulePath, _, err := readModFile(filepath.Join(c.RepoRoot, filepath.FromSlash(rel), "go.mod"))
+		if err != nil {
+			log.Print(err)
+		} else if modulePath != "" {
+			if err := checkPrefix(modulePath); err != nil {
+				log.Print(err)
+			} else {
+				gc.prefix = modulePath
+				gc.prefixSet = true
+				gc.prefixRel = rel
+				gc.nestedModules[rel] = modulePath
+			}
+		}
+	}
+
+	if path.Base(rel) == "vendor" || rel == gc.vendorDir {
 		gc.importMapPrefix = inferImportPath(gc, rel)
 		gc.importMapPrefixRel = rel
 		gc.prefix = ""
@@ -225,9 +971,190 @@ func (_ *goLang) Configure(c *config.Config, rel string, f *rule.File) {
 				}
 				gc.preprocessTags()
 				gc.setBuildTags(d.Value)
+			case "go_extra_deps":
+				gc.extraDeps = nil
+				for _, dep := range strings.Split(d.Value, ",") {
+					dep = strings.TrimSpace(dep)
+					if dep == "" {
+						continue
+					}
+					if _, err := label.Parse(dep); err != nil {
+						log.Printf("%s: invalid value for gazelle:go_extra_deps: %v", f.Path, err)
+						continue
+					}
+					gc.extraDeps = append(gc.extraDeps, dep)
+				}
+			case "go_generate_genrule":
+				goGenerateGenrule, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_generate_genrule: %q", f.Path, d.Value)
+					continue
+				}
+				gc.goGenerateGenrule = goGenerateGenrule
+			case "go_generate_glob":
+				goGenerateGlob, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_generate_glob: %q", f.Path, d.Value)
+					continue
+				}
+				gc.goGenerateGlob = goGenerateGlob
+			case "go_grpc_compilers":
+				compilers, err := parseGrpcCompilers(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_grpc_compilers: %v", f.Path, err)
+					continue
+				}
+				gc.grpcCompilers = compilers
+			case "go_grpc_library_suffix":
+				if err := checkRuleNameSuffix(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_grpc_library_suffix: %v", f.Path, err)
+					continue
+				}
+				gc.grpcSuffix = d.Value
+			case "go_local_repository":
+				if err := gc.addLocalRepo(d.Value, c.RepoRoot); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_local_repository: %v", f.Path, err)
+				}
+			case "go_mockgen":
+				mockgen, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_mockgen: %q", f.Path, d.Value)
+					continue
+				}
+				gc.mockgen = mockgen
+			case "go_mockgen_tool":
+				if d.Value == "" {
+					gc.mockgenTool = defaultMockgenTool
+					continue
+				}
+				if _, err := label.Parse(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_mockgen_tool: %q", f.Path, d.Value)
+					continue
+				}
+				gc.mockgenTool = d.Value
+			case "go_ignore_import":
+				if d.Value == "" {
+					gc.ignoredImports = nil
+					continue
+				}
+				imp := strings.TrimSuffix(d.Value, "/...")
+				if imp == "" || path.Clean(imp) != imp || path.IsAbs(imp) || imp == "." || imp == ".." || strings.HasPrefix(imp, "../") {
+					log.Printf("%s: invalid value for gazelle:go_ignore_import: %q", f.Path, d.Value)
+					continue
+				}
+				gc.ignoredImports = append(gc.ignoredImports[:len(gc.ignoredImports):len(gc.ignoredImports)], d.Value)
+			case "go_platform_mapping":
+				if err := gc.setPlatformLabel(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_platform_mapping: %v", f.Path, err)
+				}
+			case "go_platforms":
+				if err := gc.setPlatforms(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_platforms: %v", f.Path, err)
+				}
+			case "go_pure":
+				mode, err := pureModeFromString(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_pure: %v", f.Path, err)
+					continue
+				}
+				gc.pureMode = mode
+			case "go_repository_default_repo":
+				repo, naming, err := parseDefaultRepo(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_repository_default_repo: %v", f.Path, err)
+					continue
+				}
+				gc.defaultRepo, gc.defaultRepoNaming = repo, naming
+			case "go_split_main":
+				splitMain, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_split_main: %q", f.Path, d.Value)
+					continue
+				}
+				gc.splitMain = splitMain
+			case "go_stdlib_packages":
+				if err := gc.setStdOverrides(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_stdlib_packages: %v", f.Path, err)
+				}
+			case "go_test_msan":
+				testMsan, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_test_msan: %q", f.Path, d.Value)
+					continue
+				}
+				gc.testMsan = testMsan
+			case "go_test_race":
+				testRace, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_test_race: %q", f.Path, d.Value)
+					continue
+				}
+				gc.testRace = testRace
+			case "go_test_tags":
+				if err := gc.setTestTags(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_test_tags: %v", f.Path, err)
+				}
+			case "go_testonly":
+				if d.Value == "" {
+					gc.testonly, gc.testonlySet = false, false
+					continue
+				}
+				testonly, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_testonly: %q", f.Path, d.Value)
+					continue
+				}
+				gc.testonly, gc.testonlySet = testonly, true
+			case "go_vendor_dir":
+				dir := path.Clean(d.Value)
+				if d.Value == "" || dir == "." || path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+					log.Printf("%s: invalid value for gazelle:go_vendor_dir: %q", f.Path, d.Value)
+					continue
+				}
+				gc.vendorDir = dir
+			case "go_vendor_fallback":
+				vendorFallback, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:go_vendor_fallback: %q", f.Path, d.Value)
+					continue
+				}
+				gc.vendorFallback = vendorFallback
+			case "go_visibility":
+				// Labels accumulate with those inherited from parent
+				// directories. An empty value clears them. The parent's list
+				// is copied, since it's shared with other directories.
+				if d.Value == "" {
+					gc.visibility = nil
+					continue
+				}
+				gc.visibility = append(gc.visibility[:len(gc.visibility):len(gc.visibility)], d.Value)
+			case "go_prefix_map":
+				if err := gc.setPrefixMap(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_prefix_map: %v", f.Path, err)
+				}
+			case "go_proto_library_suffix":
+				if err := checkRuleNameSuffix(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_proto_library_suffix: %v", f.Path, err)
+					continue
+				}
+				gc.goProtoSuffix = d.Value
+				if gc.goProtoSuffix == "" {
+					gc.goProtoSuffix = defaultGoProtoSuffix
+				}
+			case "go_x_defs":
+				if err := gc.setXDef(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:go_x_defs: %v", f.Path, err)
+				}
 			case "importmap_prefix":
 				gc.importMapPrefix = d.Value
 				gc.importMapPrefixRel = rel
+			case "prefer_alias":
+				preferAlias, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:prefer_alias: %q", f.Path, d.Value)
+					continue
+				}
+				gc.preferAlias = preferAlias
 			case "prefix":
 				if err := checkPrefix(d.Value); err != nil {
 					log.Print(err)
@@ -236,6 +1163,22 @@ func (_ *goLang) Configure(c *config.Config, rel string, f *rule.File) {
 				gc.prefix = d.Value
 				gc.prefixSet = true
 				gc.prefixRel = rel
+			case "proto_gateway":
+				if d.Value == "" {
+					gc.protoGateway = false
+					continue
+				}
+				vals := strings.Fields(d.Value)
+				if len(vals) != 2 {
+					log.Printf("%s: invalid value for gazelle:proto_gateway: want kind and load file, got %q", f.Path, d.Value)
+					continue
+				}
+				gc.protoGateway = true
+				setGatewayKind(c, vals[0], vals[1])
+			case "resolve":
+				if err := gc.addResolveOverride(d.Value); err != nil {
+					log.Printf("%s: invalid value for gazelle:resolve: %v", f.Path, err)
+				}
 			}
 		}
 		if !gc.prefixSet {
@@ -261,6 +1204,18 @@ func (_ *goLang) Configure(c *config.Config, rel string, f *rule.File) {
 			}
 		}
 	}
+
+	// If the prefix wasn't set with a flag, directive, or go_prefix rule,
+	// the module path in go.mod is used.
+	if rel == "" && !gc.prefixSet && modulePath != "" {
+		if err := checkPrefix(modulePath); err != nil {
+			log.Print(err)
+			return
+		}
+		gc.prefix = modulePath
+		gc.prefixSet = true
+		gc.prefixRel = ""
+	}
 }
 
 // checkPrefix checks that a string may be used as a prefix. We forbid local
@@ -19,6 +19,7 @@ import (
 	"flag"
 	"path"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
@@ -96,6 +97,106 @@ func TestDirectives(t *testing.T) {
 	}
 }
 
+func TestVisibilityDirective(t *testing.T) {
+	c, _, langs := testConfig()
+	parent, err := rule.LoadData(filepath.FromSlash("BUILD.bazel"), []byte(`
+# gazelle:go_visibility //a:__pkg__
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := rule.LoadData(filepath.FromSlash("sub/BUILD.bazel"), []byte(`
+# gazelle:go_visibility //b:__pkg__
+# gazelle:go_visibility //c:__subpackages__
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range langs {
+		lang.Configure(c, "", parent)
+	}
+	if got, want := getGoConfig(c).visibility, []string{"//a:__pkg__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parent visibility: got %#v; want %#v", got, want)
+	}
+	cc := c.Clone()
+	for _, lang := range langs {
+		lang.Configure(cc, "sub", child)
+	}
+	if got, want := getGoConfig(cc).visibility, []string{"//a:__pkg__", "//b:__pkg__", "//c:__subpackages__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("child visibility: got %#v; want %#v", got, want)
+	}
+	if got, want := getGoConfig(c).visibility, []string{"//a:__pkg__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parent visibility after child: got %#v; want %#v", got, want)
+	}
+
+	sibling, err := rule.LoadData(filepath.FromSlash("other/BUILD.bazel"), []byte(`
+# gazelle:go_visibility //d:__pkg__
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := c.Clone()
+	for _, lang := range langs {
+		lang.Configure(sc, "other", sibling)
+	}
+	if got, want := getGoConfig(sc).visibility, []string{"//a:__pkg__", "//d:__pkg__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sibling visibility: got %#v; want %#v", got, want)
+	}
+	if got, want := getGoConfig(cc).visibility, []string{"//a:__pkg__", "//b:__pkg__", "//c:__subpackages__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("child visibility after sibling: got %#v; want %#v", got, want)
+	}
+
+	cleared, err := rule.LoadData(filepath.FromSlash("sub/x/BUILD.bazel"), []byte(`
+# gazelle:go_visibility
+# gazelle:go_visibility //e:__pkg__
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xc := cc.Clone()
+	for _, lang := range langs {
+		lang.Configure(xc, "sub/x", cleared)
+	}
+	if got, want := getGoConfig(xc).visibility, []string{"//e:__pkg__"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cleared visibility: got %#v; want %#v", got, want)
+	}
+}
+
+func TestIgnoreImportDirective(t *testing.T) {
+	c, _, langs := testConfig()
+	parent, err := rule.LoadData(filepath.FromSlash("BUILD.bazel"), []byte(`
+# gazelle:go_ignore_import example.com/a
+# gazelle:go_ignore_import example.com/b/...
+# gazelle:go_ignore_import ../bad
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := rule.LoadData(filepath.FromSlash("sub/BUILD.bazel"), []byte(`
+# gazelle:go_ignore_import example.com/c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range langs {
+		lang.Configure(c, "", parent)
+	}
+	parentWant := []string{"example.com/a", "example.com/b/..."}
+	if got := getGoConfig(c).ignoredImports; !reflect.DeepEqual(got, parentWant) {
+		t.Errorf("parent: got %#v; want %#v", got, parentWant)
+	}
+	cc := c.Clone()
+	for _, lang := range langs {
+		lang.Configure(cc, "sub", child)
+	}
+	if got, want := getGoConfig(cc).ignoredImports, []string{"example.com/a", "example.com/b/...", "example.com/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("child: got %#v; want %#v", got, want)
+	}
+	if got := getGoConfig(c).ignoredImports; !reflect.DeepEqual(got, parentWant) {
+		t.Errorf("parent after child: got %#v; want %#v", got, parentWant)
+	}
+}
+
 func TestVendorConfig(t *testing.T) {
 	c, _, langs := testConfig()
 	gc := getGoConfig(c)
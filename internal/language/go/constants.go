@@ -19,4 +19,25 @@ const (
 	// legacyProtoFilegroupName is the anme of a filegroup created in legacy
 	// mode for libraries that contained .pb.go files and .proto files.
 	legacyProtoFilegroupName = "go_default_library_protos"
+
+	// defaultGoProtoSuffix replaces the "_proto" suffix of a proto_library
+	// name to form the name of its go_proto_library, unless another suffix is
+	// set with # gazelle:go_proto_library_suffix.
+	defaultGoProtoSuffix = "_go_proto"
+
+	// extraDepsKey is a private attribute of generated rules with the labels
+	// listed with # gazelle:go_extra_deps. They're added to the resolved
+	// dependencies.
+	extraDepsKey = "_go_extra_deps"
+
+	// ignoredImportsKey is a private attribute of generated rules with the
+	// import patterns listed with # gazelle:go_ignore_import. Matching imports
+	// are skipped during resolution.
+	ignoredImportsKey = "_go_ignored_imports"
+
+	// platformsKey is a private attribute of generated rules with the
+	// platforms considered in their directory, set with
+	// # gazelle:go_platforms. Resolved dependencies that apply to all of
+	// them are generic.
+	platformsKey = "_go_platforms"
 )
@@ -73,13 +73,18 @@ type fileInfo struct {
 	goos, goarch string
 
 	// tags is a list of build tag lines. Each entry is the trimmed text of
-	// a line after a "+build" prefix.
+	// a line after a "+build" prefix, or a //go:build expression converted
+	// to the same form.
 	tags []tagLine
 
 	// copts and clinkopts contain flags that are part of CFLAGS, CPPFLAGS,
 	// CXXFLAGS, and LDFLAGS directives in cgo comments.
 	copts, clinkopts []taggedOpts
 
+	// embeds is a list of patterns from //go:embed directives in a .go file.
+	// Files matching these patterns are embedded in the package.
+	embeds []string
+
 	// hasServices indicates whether a .proto file has service definitions.
 	hasServices bool
 }
@@ -320,6 +325,20 @@ func goFileInfo(path, rel string) fileInfo {
 		}
 	}
 
+	// //go:embed directives are only allowed in files that import "embed".
+	// They appear after the imports, so the whole file must be parsed.
+	for _, imp := range info.imports {
+		if imp != "embed" {
+			continue
+		}
+		embeds, err := readEmbeds(fset, info.path)
+		if err != nil {
+			log.Printf("%s: error reading go file: %v", info.path, err)
+		}
+		info.embeds = embeds
+		break
+	}
+
 	tags, err := readTags(info.path)
 	if err != nil {
 		log.Printf("%s: error reading go file: %v", info.path, err)
@@ -330,6 +349,75 @@ func goFileInfo(path, rel string) fileInfo {
 	return info
 }
 
+// readEmbeds returns the patterns in //go:embed directives in the Go file
+// at path.
+func readEmbeds(fset *token.FileSet, path string) ([]string, error) {
+	pf, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var embeds []string
+	for _, cg := range pf.Comments {
+		for _, c := range cg.List {
+			if !strings.HasPrefix(c.Text, "//go:embed") {
+				continue
+			}
+			args := c.Text[len("//go:embed"):]
+			if args != "" && args[0] != ' ' && args[0] != '\t' {
+				continue
+			}
+			patterns, err := parseGoEmbed(args)
+			if err != nil {
+				return embeds, fmt.Errorf("%s: invalid //go:embed directive: %v", fset.Position(c.Pos()), err)
+			}
+			embeds = append(embeds, patterns...)
+		}
+	}
+	return embeds, nil
+}
+
+// parseGoEmbed splits the arguments of a //go:embed directive into patterns.
+// Patterns are separated by spaces and may be quoted with double quotes or
+// back quotes. Based on go/build.parseGoEmbed.
+func parseGoEmbed(args string) ([]string, error) {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		var pattern string
+		switch args[0] {
+		case '"', '`':
+			quote := args[0]
+			i := 1
+			for ; i < len(args) && args[i] != quote; i++ {
+				if quote == '"' && args[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(args) {
+				return nil, fmt.Errorf("unterminated quoted pattern: %s", args)
+			}
+			p, err := strconv.Unquote(args[:i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted pattern: %s", args[:i+1])
+			}
+			pattern, args = p, args[i+1:]
+		default:
+			i := strings.IndexAny(args, " \t")
+			if i < 0 {
+				i = len(args)
+			}
+			pattern, args = args[:i], args[i:]
+		}
+		if args != "" && args[0] != ' ' && args[0] != '\t' {
+			return nil, fmt.Errorf("invalid pattern: %s", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("no patterns")
+	}
+	return patterns, nil
+}
+
 // saveCgo extracts CFLAGS, CPPFLAGS, CXXFLAGS, and LDFLAGS directives
 // from a comment above a "C" import. This is intended to match logic in
 // go/build.Context.saveCgo.
@@ -538,9 +626,19 @@ func readTags(path string) ([]tagLine, error) {
 	}
 	lines = lines[:end]
 
-	// Pass 2: Process each line in the run.
+	// Pass 2: Process each line in the run. Legacy +build lines and
+	// //go:build expressions are both converted to tag lines. If a file
+	// has both, all lines must be satisfied.
 	var tagLines []tagLine
 	for _, line := range lines {
+		if isGoBuildLine(line) {
+			l, err := parseGoBuildExpr(line[len("go:build"):])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid //go:build line: %v", path, err)
+			}
+			tagLines = append(tagLines, l)
+			continue
+		}
 		fields := strings.Fields(line)
 		if len(fields) > 0 && fields[0] == "+build" {
 			tagLines = append(tagLines, parseTagsInGroups(fields[1:]))
@@ -549,6 +647,163 @@ func readTags(path string) ([]tagLine, error) {
 	return tagLines, nil
 }
 
+// isGoBuildLine returns whether line (with the leading "//" removed) is a
+// //go:build constraint. As with the go command, there must be no space
+// between "//" and "go:build".
+func isGoBuildLine(line string) bool {
+	if !strings.HasPrefix(line, "go:build") {
+		return false
+	}
+	rest := line[len("go:build"):]
+	return rest == "" || rest[0] == ' ' || rest[0] == '\t'
+}
+
+// parseGoBuildExpr parses the boolean expression in a //go:build line and
+// converts it to a tagLine in disjunctive normal form, so that it may be
+// evaluated and inspected like a legacy +build line. Negation of
+// parenthesized expressions is pushed down to individual tags.
+func parseGoBuildExpr(expr string) (tagLine, error) {
+	p := &buildExprParser{s: expr}
+	p.next()
+	l, err := p.or(false)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %q", p.tok)
+	}
+	return l, nil
+}
+
+// buildExprParser is a recursive descent parser for //go:build expressions.
+// Each production takes a "not" argument, which is true when the expression
+// being parsed is negated.
+type buildExprParser struct {
+	s   string
+	tok string
+}
+
+// next advances to the next token. tok is set to "" at the end of input.
+func (p *buildExprParser) next() {
+	p.s = strings.TrimLeftFunc(p.s, unicode.IsSpace)
+	if p.s == "" {
+		p.tok = ""
+		return
+	}
+	switch {
+	case strings.HasPrefix(p.s, "&&"), strings.HasPrefix(p.s, "||"):
+		p.tok = p.s[:2]
+	case p.s[0] == '!' || p.s[0] == '(' || p.s[0] == ')':
+		p.tok = p.s[:1]
+	default:
+		n := strings.IndexFunc(p.s, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+		})
+		if n == 0 {
+			// Not a valid tag character; return it so the caller reports it.
+			_, n = utf8.DecodeRuneInString(p.s)
+		} else if n < 0 {
+			n = len(p.s)
+		}
+		p.tok = p.s[:n]
+	}
+	p.s = p.s[len(p.tok):]
+}
+
+func (p *buildExprParser) or(not bool) (tagLine, error) {
+	x, err := p.and(not)
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "||" {
+		p.next()
+		y, err := p.and(not)
+		if err != nil {
+			return nil, err
+		}
+		if not {
+			x = andTagLines(x, y)
+		} else {
+			x = append(x, y...)
+		}
+	}
+	return x, nil
+}
+
+func (p *buildExprParser) and(not bool) (tagLine, error) {
+	x, err := p.not(not)
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == "&&" {
+		p.next()
+		y, err := p.not(not)
+		if err != nil {
+			return nil, err
+		}
+		if not {
+			x = append(x, y...)
+		} else {
+			x = andTagLines(x, y)
+		}
+	}
+	return x, nil
+}
+
+func (p *buildExprParser) not(not bool) (tagLine, error) {
+	switch tok := p.tok; {
+	case tok == "!":
+		p.next()
+		return p.not(!not)
+	case tok == "(":
+		p.next()
+		x, err := p.or(not)
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.next()
+		return x, nil
+	case tok == "":
+		return nil, errors.New("unexpected end of expression")
+	case tok == "&&" || tok == "||" || tok == ")" || !isBuildTag(tok):
+		return nil, fmt.Errorf("unexpected %q", tok)
+	default:
+		p.next()
+		if not {
+			tok = "!" + tok
+		}
+		return tagLine{{tok}}, nil
+	}
+}
+
+// isBuildTag returns whether tok is a valid build tag name.
+func isBuildTag(tok string) bool {
+	for _, r := range tok {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' {
+			return false
+		}
+	}
+	return tok != ""
+}
+
+// andTagLines returns the conjunction of two tag lines in disjunctive
+// normal form.
+func andTagLines(x, y tagLine) tagLine {
+	l := make(tagLine, 0, len(x)*len(y))
+	for _, gx := range x {
+		for _, gy := range y {
+			g := make(tagGroup, 0, len(gx)+len(gy))
+			g = append(g, gx...)
+			g = append(g, gy...)
+			l = append(l, g)
+		}
+	}
+	return l
+}
+
 func parseTagsInGroups(groups []string) tagLine {
 	var l tagLine
 	for _, g := range groups {
@@ -599,8 +854,8 @@ func isOSArchSpecific(info fileInfo, cgoTags tagLine) (osSpecific, archSpecific
 //
 // The remaining arguments describe the file being tested. All of these may
 // be empty or nil. osSuffix and archSuffix are filename suffixes. fileTags
-// is a list tags from +build comments found near the top of the file. cgoTags
-// is an extra set of tags in a #cgo directive.
+// is a list tags from +build and //go:build comments found near the top of
+// the file. cgoTags is an extra set of tags in a #cgo directive.
 func checkConstraints(c *config.Config, os, arch, osSuffix, archSuffix string, fileTags []tagLine, cgoTags tagLine) bool {
 	if osSuffix != "" && osSuffix != os || archSuffix != "" && archSuffix != arch {
 		return false
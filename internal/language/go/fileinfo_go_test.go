@@ -37,6 +37,25 @@ func TestGoFileInfo(t *testing.T) {
 				packageName: "foo",
 			},
 		},
+		{
+			"embed",
+			"foo.go",
+			`package foo
+
+import "embed"
+
+//go:embed a.txt "b c.txt"
+//go:embed ` + "`d/*`" + `
+var fs embed.FS
+
+//go:embedded not_a_pattern
+`,
+			fileInfo{
+				packageName: "foo",
+				imports:     []string{"embed"},
+				embeds:      []string{"a.txt", "b c.txt", "d/*"},
+			},
+		},
 		{
 			"xtest file",
 			"foo_test.go",
@@ -156,6 +175,7 @@ package route
 				imports:     got.imports,
 				isCgo:       got.isCgo,
 				tags:        got.tags,
+				embeds:      got.embeds,
 			}
 
 			if !reflect.DeepEqual(got, tc.want) {
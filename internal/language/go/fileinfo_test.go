@@ -309,6 +309,35 @@ package main`,
 			"/* +build foo */\n\n",
 			nil,
 		},
+		{
+			"go:build single tag",
+			"//go:build foo\n\npackage main",
+			[]tagLine{{{"foo"}}},
+		},
+		{
+			"go:build with space is not a constraint",
+			"// go:build foo\n\npackage main",
+			nil,
+		},
+		{
+			"go:build and or",
+			"//go:build (foo || bar) && baz\n\npackage main",
+			[]tagLine{{{"foo", "baz"}, {"bar", "baz"}}},
+		},
+		{
+			"go:build negated group",
+			"//go:build !(foo && !bar)\n\npackage main",
+			[]tagLine{{{"!foo"}, {"bar"}}},
+		},
+		{
+			"go:build and +build",
+			`//go:build foo
+
+// +build bar
+
+package main`,
+			[]tagLine{{{"foo"}}, {{"bar"}}},
+		},
 	} {
 		f, err := ioutil.TempFile(".", "TestReadTags")
 		if err != nil {
@@ -444,6 +473,37 @@ package foo`,
 
 package foo`,
 			want: false,
+		}, {
+			desc:     "go:build negated os satisfied",
+			os:       "linux",
+			arch:     "amd64",
+			filename: "foo.go",
+			content:  "//go:build !windows\n\npackage foo",
+			want:     true,
+		}, {
+			desc:     "go:build negated os unsatisfied",
+			os:       "windows",
+			arch:     "amd64",
+			filename: "foo.go",
+			content:  "//go:build !windows\n\npackage foo",
+			want:     false,
+		}, {
+			desc:        "go:build expression satisfied",
+			os:          "linux",
+			genericTags: map[string]bool{"foo": true},
+			content:     "//go:build (darwin || linux) && foo\n\npackage foo",
+			want:        true,
+		}, {
+			desc:        "go:build expression unsatisfied",
+			os:          "windows",
+			genericTags: map[string]bool{"foo": true},
+			content:     "//go:build (darwin || linux) && foo\n\npackage foo",
+			want:        false,
+		}, {
+			desc:        "go:build and +build both required",
+			genericTags: map[string]bool{"foo": true},
+			content:     "//go:build foo\n// +build bar\n\npackage foo",
+			want:        false,
 		}, {
 			desc:        "cgo tags satisfied",
 			os:          "linux",
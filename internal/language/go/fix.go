@@ -38,7 +38,7 @@ func (_ *goLang) Fix(c *config.Config, f *rule.File) {
 // no keep comment on "library" and no existing "embed" attribute.
 func migrateLibraryEmbed(c *config.Config, f *rule.File) {
 	for _, r := range f.Rules {
-		if !isGoRule(r.Kind()) {
+		if !isGoRule(c.UnmappedKind(r.Kind())) {
 			continue
 		}
 		libExpr := r.Attr("library")
@@ -165,7 +165,7 @@ func squashXtest(c *config.Config, f *rule.File) {
 // duplicate expressions.
 func flattenSrcs(c *config.Config, f *rule.File) {
 	for _, r := range f.Rules {
-		if !isGoRule(r.Kind()) {
+		if !isGoRule(c.UnmappedKind(r.Kind())) {
 			continue
 		}
 		oldSrcs := r.Attr("srcs")
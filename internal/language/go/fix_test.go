@@ -611,7 +611,7 @@ go_register_toolchains()
 go_repository(name = "foo")
 `,
 			want: `
-load("@io_bazel_rules_go//go:def.bzl", "go_rules_dependencies", "go_register_toolchains")
+load("@io_bazel_rules_go//go:def.bzl", "go_register_toolchains", "go_rules_dependencies")
 
 go_rules_dependencies()
 
@@ -620,6 +620,32 @@ go_register_toolchains()
 load("@bazel_gazelle//:deps.bzl", "go_repository")
 
 go_repository(name = "foo")
+`,
+		}, {
+			desc: "consolidate loads",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_embed_data")
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", bin = "go_binary")
+
+go_library(name = "go_default_library")
+
+go_test(name = "go_default_test")
+
+bin(name = "cmd")
+`,
+			want: `load(
+    "@io_bazel_rules_go//go:def.bzl",
+    "go_embed_data",
+    "go_library",
+    "go_test",
+    bin = "go_binary",
+)
+
+go_library(name = "go_default_library")
+
+go_test(name = "go_default_test")
+
+bin(name = "cmd")
 `,
 		},
 	} {
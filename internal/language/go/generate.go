@@ -18,9 +18,12 @@ package golang
 import (
 	"fmt"
 	"go/build"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -28,18 +31,19 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/internal/language/proto"
 	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func (gl *goLang) GenerateRules(c *config.Config, dir, rel string, f *rule.File, subdirs, regularFiles, genFiles []string, other []*rule.Rule) (empty, gen []*rule.Rule) {
 	// Extract information about proto files. We need this to exclude .pb.go
 	// files and generate go_proto_library rules.
-	pc := proto.GetProtoConfig(c)
+	protoMode := getProtoMode(c)
 	var protoName string
 	var protoFileInfo map[string]proto.FileInfo
-	if pc.Mode != proto.DisableMode {
+	if protoMode != proto.DisableMode || deletesProtoRules(c) {
 		protoFileInfo = make(map[string]proto.FileInfo)
 		for _, r := range other {
-			if r.Kind() != "proto_library" {
+			if r.Kind() != "proto_library" || proto.IsTestLibrary(r) {
 				continue
 			}
 			if protoName != "" {
@@ -57,7 +61,7 @@ func (gl *goLang) GenerateRules(c *config.Config, dir, rel string, f *rule.File,
 
 	// If proto rule generation is enabled, exclude .pb.go files that correspond
 	// to any .proto files present.
-	if pc.Mode != proto.DisableMode {
+	if protoMode != proto.DisableMode {
 		keep := func(f string) bool {
 			if strings.HasSuffix(f, ".pb.go") {
 				_, ok := protoFileInfo[strings.TrimSuffix(f, ".pb.go")+".proto"]
@@ -73,8 +77,13 @@ func (gl *goLang) GenerateRules(c *config.Config, dir, rel string, f *rule.File,
 	// import path and other files.
 	var pkgFiles, otherFiles []string
 	for _, f := range regularFiles {
+		if protoMode == proto.DefaultMode && proto.IsTestFile(f) {
+			// Test protos are built in a separate proto_library, and no Go
+			// rules are generated for them.
+			continue
+		}
 		if strings.HasSuffix(f, ".go") ||
-			pc.Mode != proto.DisableMode && strings.HasSuffix(f, ".proto") {
+			protoMode != proto.DisableMode && strings.HasSuffix(f, ".proto") {
 			pkgFiles = append(pkgFiles, f)
 		} else {
 			otherFiles = append(otherFiles, f)
@@ -86,7 +95,9 @@ func (gl *goLang) GenerateRules(c *config.Config, dir, rel string, f *rule.File,
 	var hasTestdata bool
 	for _, sub := range subdirs {
 		if sub == "testdata" {
+			gl.mu.Lock()
 			isPkg, ok := gl.testdataPkgs[path.Join(rel, sub)]
+			gl.mu.Unlock()
 			hasTestdata = !ok || !isPkg
 			break
 		}
@@ -95,13 +106,19 @@ func (gl *goLang) GenerateRules(c *config.Config, dir, rel string, f *rule.File,
 	// Build a package from files in this directory.
 	pkg := buildPackage(c, dir, rel, pkgFiles, otherFiles, genFiles, hasTestdata, protoName, protoFileInfo)
 	if pkg != nil && path.Base(rel) == "testdata" {
+		gl.mu.Lock()
 		gl.testdataPkgs[rel] = true
+		gl.mu.Unlock()
 	}
 	if pkg == nil {
 		pkg = emptyPackage(c, dir, rel)
+		pkg.proto.name = protoName
 	}
 
 	g := newGenerator(c, f, rel)
+	if getGoConfig(c).goGenerateGlob {
+		g.dirGoFiles = listGoFiles(c, dir)
+	}
 	return g.generateRules(pkg)
 }
 
@@ -158,7 +175,20 @@ func buildPackage(c *config.Config, dir, rel string, pkgFiles, otherFiles, genFi
 			}
 		}
 		if err := packageMap[info.packageName].addFile(c, info, false); err != nil {
-			log.Print(err)
+			c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
+		}
+	}
+
+	// With # gazelle:go_split_main, main files are set aside for a binary
+	// when there's also a library package.
+	var mainPkg *goPackage
+	if pkg, ok := packageMap["main"]; ok && getGoConfig(c).splitMain && pkg.isBuildable(c) {
+		for name, other := range packageMap {
+			if name != "main" && other.isBuildable(c) {
+				mainPkg = pkg
+				delete(packageMap, "main")
+				break
+			}
 		}
 	}
 
@@ -166,17 +196,22 @@ func buildPackage(c *config.Config, dir, rel string, pkgFiles, otherFiles, genFi
 	pkg, err := selectPackage(c, dir, packageMap)
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); !ok {
-			log.Print(err)
+			c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
 		}
 		return nil
 	}
+	if mainPkg != nil {
+		// Tests in package main are dropped, since they'd need to embed the
+		// binary's sources.
+		pkg.binary = mainPkg.library
+	}
 
 	// Add files with unknown packages. This happens when there are parse
 	// or I/O errors. We should keep the file in the srcs list and let the
 	// compiler deal with the error.
 	for _, info := range pkgFilesWithUnknownPackage {
 		if err := pkg.addFile(c, info, cgo); err != nil {
-			log.Print(err)
+			c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
 		}
 	}
 
@@ -184,7 +219,7 @@ func buildPackage(c *config.Config, dir, rel string, pkgFiles, otherFiles, genFi
 	for _, file := range otherFiles {
 		info := otherFileInfo(filepath.Join(dir, file))
 		if err := pkg.addFile(c, info, cgo); err != nil {
-			log.Print(err)
+			c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
 		}
 	}
 
@@ -204,13 +239,15 @@ func buildPackage(c *config.Config, dir, rel string, pkgFiles, otherFiles, genFi
 		}
 		info := fileNameInfo(filepath.Join(dir, f))
 		if err := pkg.addFile(c, info, cgo); err != nil {
-			log.Print(err)
+			c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
 		}
 	}
 
 	if pkg.importPath == "" {
 		if err := pkg.inferImportPath(c); err != nil {
-			inferImportPathErrorOnce.Do(func() { log.Print(err) })
+			inferImportPathErrorOnce.Do(func() {
+				c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
+			})
 			return nil
 		}
 	}
@@ -285,8 +322,11 @@ func hasDefaultVisibility(oldFile *rule.File) bool {
 }
 
 // checkInternalVisibility overrides the given visibility if the package is
-// internal.
-func checkInternalVisibility(rel, visibility string) string {
+// internal and internal visibility is enabled.
+func (g *generator) checkInternalVisibility(rel, visibility string) string {
+	if !getGoConfig(g.c).internalVisibility {
+		return visibility
+	}
 	if i := strings.LastIndex(rel, "/internal/"); i >= 0 {
 		visibility = fmt.Sprintf("//%s:__subpackages__", rel[:i])
 	} else if strings.HasPrefix(rel, "internal/") {
@@ -297,18 +337,33 @@ func checkInternalVisibility(rel, visibility string) string {
 
 type generator struct {
 	c                   *config.Config
+	f                   *rule.File
 	rel                 string
 	shouldSetVisibility bool
+
+	// dirGoFiles is the set of .go files in the directory, including
+	// excluded files, that glob expressions in srcs would match. It's only
+	// set with # gazelle:go_generate_glob.
+	dirGoFiles map[string]bool
 }
 
 func newGenerator(c *config.Config, f *rule.File, rel string) *generator {
 	shouldSetVisibility := f == nil || !hasDefaultVisibility(f)
-	return &generator{c: c, rel: rel, shouldSetVisibility: shouldSetVisibility}
+	return &generator{c: c, f: f, rel: rel, shouldSetVisibility: shouldSetVisibility}
 }
 
 func (g *generator) generateRules(pkg *goPackage) (empty, gen []*rule.Rule) {
-	protoMode := proto.GetProtoConfig(g.c).Mode
-	protoEmbed, rules := g.generateProto(protoMode, pkg)
+	protoEmbed, rules := g.generateProto(getProtoMode(g.c), pkg)
+	if getGoConfig(g.c).splitMain && pkg.isCommand() && protoEmbed == "" && !pkg.hasTests() {
+		// The binary doesn't need a library, since nothing else embeds it.
+		pkg.binary, pkg.library = pkg.library, goTarget{}
+	}
+	// Rules for //go:generate directives are generated first, since mocks
+	// may be added to the test sources.
+	var genRules []*rule.Rule
+	if gc := getGoConfig(g.c); gc.goGenerateGenrule || gc.mockgen {
+		genRules = g.generateGoGenerateRules(pkg)
+	}
 	var libName string
 	lib := g.generateLib(pkg, protoEmbed)
 	rules = append(rules, lib)
@@ -318,7 +373,17 @@ func (g *generator) generateRules(pkg *goPackage) (empty, gen []*rule.Rule) {
 	rules = append(rules,
 		g.generateBin(pkg, libName),
 		g.generateTest(pkg, libName))
+	rules = append(rules,
+		g.generateInstrumentedTest(pkg, "race", getGoConfig(g.c).testRace, libName),
+		g.generateInstrumentedTest(pkg, "msan", getGoConfig(g.c).testMsan, libName))
+	for _, tag := range getGoConfig(g.c).testTags {
+		rules = append(rules, g.generateTaggedTest(pkg, tag, libName))
+	}
+	rules = append(rules, g.staleTaggedTests()...)
+	rules = append(rules, genRules...)
 	for _, r := range rules {
+		r.SetPlatformLabels(getGoConfig(g.c).platformLabels)
+		r.SetPrivateAttr(rule.GlobPatternsKey, goGlobPatterns)
 		if !r.IsEmpty(goKinds[r.Kind()]) {
 			gen = append(gen, r)
 		} else {
@@ -328,8 +393,36 @@ func (g *generator) generateRules(pkg *goPackage) (empty, gen []*rule.Rule) {
 	return empty, gen
 }
 
+// getProtoMode returns the mode in which Go rules for .proto files are
+// generated. When the proto language isn't enabled with # gazelle:lang,
+// Go rules for .proto files are neither created nor deleted, since there
+// are no generated proto_library rules to embed.
+//
+// When proto_library rules are generated for another language only, with
+// # gazelle:proto_default_language, the mode is also DisableMode, but
+// deletesProtoRules returns true: Go rules generated for .proto files earlier
+// are deleted, so they don't provide the same import path as the library.
+func getProtoMode(c *config.Config) proto.Mode {
+	if !c.IsLangEnabled("proto") {
+		return proto.DisableMode
+	}
+	pc := proto.GetProtoConfig(c)
+	if !pc.GeneratesLanguage("go") {
+		// Only proto_library rules are generated. Go rules for protos aren't
+		// created, and .pb.go files are normal sources.
+		return proto.DisableMode
+	}
+	return pc.Mode
+}
+
+// deletesProtoRules returns whether Go rules for .proto files should be
+// deleted, since proto_library rules are generated, but not for Go.
+func deletesProtoRules(c *config.Config) bool {
+	return c.IsLangEnabled("proto") && !proto.GetProtoConfig(c).GeneratesLanguage("go")
+}
+
 func (g *generator) generateProto(mode proto.Mode, pkg *goPackage) (string, []*rule.Rule) {
-	if mode == proto.DisableMode {
+	if mode == proto.DisableMode && !deletesProtoRules(g.c) {
 		// Don't create or delete proto rules in this mode. Any existing rules
 		// are likely hand-written.
 		return "", nil
@@ -338,10 +431,11 @@ func (g *generator) generateProto(mode proto.Mode, pkg *goPackage) (string, []*r
 	filegroupName := config.DefaultProtosName
 	protoName := pkg.proto.name
 	if protoName == "" {
-		protoName = proto.RuleName("", g.rel, getGoConfig(g.c).prefix)
+		protoName = g.ruleName("proto_library", proto.RuleName("", g.rel, getGoConfig(g.c).prefix))
 	}
-	goProtoName := strings.TrimSuffix(protoName, "_proto") + "_go_proto"
-	visibility := []string{checkInternalVisibility(pkg.rel, "//visibility:public")}
+	gc := getGoConfig(g.c)
+	goProtoName := g.ruleName("go_proto_library", gc.goProtoLibraryName(protoName, pkg.proto.hasServices))
+	visibility := []string{g.checkInternalVisibility(pkg.rel, "//visibility:public")}
 
 	if mode == proto.LegacyMode {
 		filegroup := rule.NewRule("filegroup", filegroupName)
@@ -355,28 +449,66 @@ func (g *generator) generateProto(mode proto.Mode, pkg *goPackage) (string, []*r
 		return "", []*rule.Rule{filegroup}
 	}
 
-	if pkg.proto.sources.isEmpty() {
-		return "", []*rule.Rule{
+	gatewayName := g.ruleName(gatewayKind, strings.TrimSuffix(protoName, "_proto")+"_gateway")
+	if mode == proto.DisableMode || pkg.proto.sources.isEmpty() {
+		rules := []*rule.Rule{
 			rule.NewRule("filegroup", filegroupName),
 			rule.NewRule("go_proto_library", goProtoName),
 		}
+		if grpcName := g.ruleName("go_proto_library", gc.goProtoLibraryName(protoName, true)); grpcName != goProtoName {
+			rules = append(rules, rule.NewRule("go_proto_library", grpcName))
+		}
+		rules = append(rules, rule.NewRule(gatewayKind, gatewayName))
+		return "", rules
 	}
 
 	goProtoLibrary := rule.NewRule("go_proto_library", goProtoName)
 	goProtoLibrary.SetAttr("proto", ":"+protoName)
 	g.setImportAttrs(goProtoLibrary, pkg)
 	if pkg.proto.hasServices {
-		goProtoLibrary.SetAttr("compilers", []string{"@io_bazel_rules_go//proto:go_grpc"})
+		g.setGrpcCompilers(goProtoLibrary)
 	}
 	if g.shouldSetVisibility {
 		goProtoLibrary.SetAttr("visibility", visibility)
 	}
+	g.setManagedVisibility(goProtoLibrary)
 	goProtoLibrary.SetPrivateAttr(config.GazelleImportsKey, pkg.proto.imports.build())
-	return goProtoName, []*rule.Rule{goProtoLibrary}
+	rules := []*rule.Rule{goProtoLibrary}
+	if gc.protoGateway {
+		rules = append(rules, g.generateGateway(pkg, gatewayName, protoName, visibility))
+	} else {
+		// An empty rule deletes a gateway generated before the directive was
+		// cleared, as long as the kind is still mapped.
+		rules = append(rules, rule.NewRule(gatewayKind, gatewayName))
+	}
+	return goProtoName, rules
+}
+
+// generateGateway generates a grpc-gateway library for the services in
+// pkg's .proto files. The gateway is a separate Go package, nested in pkg's
+// import path, that depends on pkg. An empty rule is returned if there are
+// no services.
+func (g *generator) generateGateway(pkg *goPackage, name, protoName string, visibility []string) *rule.Rule {
+	gateway := rule.NewRule(gatewayKind, name)
+	if !pkg.proto.hasServices {
+		return gateway
+	}
+	gateway.SetAttr("proto", ":"+protoName)
+	g.setImportAttrs(gateway, pkg)
+	gateway.SetAttr("importpath", path.Join(pkg.importPath, "gateway"))
+	if importMap := gateway.AttrString("importmap"); importMap != "" {
+		gateway.SetAttr("importmap", path.Join(importMap, "gateway"))
+	}
+	if g.shouldSetVisibility {
+		gateway.SetAttr("visibility", visibility)
+	}
+	g.setManagedVisibility(gateway)
+	gateway.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{pkg.importPath}})
+	return gateway
 }
 
 func (g *generator) generateLib(pkg *goPackage, embed string) *rule.Rule {
-	goLibrary := rule.NewRule("go_library", config.DefaultLibName)
+	goLibrary := rule.NewRule("go_library", g.ruleName("go_library", config.DefaultLibName))
 	if !pkg.library.sources.hasGo() && embed == "" {
 		return goLibrary // empty
 	}
@@ -385,39 +517,130 @@ func (g *generator) generateLib(pkg *goPackage, embed string) *rule.Rule {
 		// Libraries made for a go_binary should not be exposed to the public.
 		visibility = "//visibility:private"
 	} else {
-		visibility = checkInternalVisibility(pkg.rel, "//visibility:public")
+		visibility = g.checkInternalVisibility(pkg.rel, "//visibility:public")
 	}
 	g.setCommonAttrs(goLibrary, pkg.rel, visibility, pkg.library, embed)
 	g.setImportAttrs(goLibrary, pkg)
+	g.setManagedVisibility(goLibrary)
+	g.setTestonly(goLibrary)
 	return goLibrary
 }
 
 func (g *generator) generateBin(pkg *goPackage, library string) *rule.Rule {
-	name := pathtools.RelBaseName(pkg.rel, getGoConfig(g.c).prefix, g.c.RepoRoot)
+	name := g.ruleName("go_binary", pathtools.RelBaseName(pkg.rel, getGoConfig(g.c).prefix, g.c.RepoRoot))
 	goBinary := rule.NewRule("go_binary", name)
-	if !pkg.isCommand() || pkg.binary.sources.isEmpty() && library == "" {
+	if !pkg.isCommand() {
+		// With # gazelle:go_split_main, main files in a library's directory
+		// are built by a binary, which can't embed the library.
+		if !pkg.binary.sources.hasGo() {
+			return goBinary // empty
+		}
+		library = ""
+	}
+	if pkg.binary.sources.isEmpty() && library == "" {
 		return goBinary // empty
 	}
-	visibility := checkInternalVisibility(pkg.rel, "//visibility:public")
+	visibility := g.checkInternalVisibility(pkg.rel, "//visibility:public")
 	g.setCommonAttrs(goBinary, pkg.rel, visibility, pkg.binary, library)
+	g.setPure(goBinary, pkg.binary.cgo || library != "" && pkg.library.cgo)
+	g.setXDefs(goBinary)
+	if library != "" {
+		// A binary can't depend on a testonly library unless it's testonly.
+		g.setTestonly(goBinary)
+	}
 	return goBinary
 }
 
 func (g *generator) generateTest(pkg *goPackage, library string) *rule.Rule {
-	goTest := rule.NewRule("go_test", config.DefaultTestName)
+	goTest := rule.NewRule("go_test", g.ruleName("go_test", config.DefaultTestName))
 	if !pkg.test.sources.hasGo() {
 		return goTest // empty
 	}
 	g.setCommonAttrs(goTest, pkg.rel, "", pkg.test, library)
+	g.setPure(goTest, pkg.test.cgo || library != "" && pkg.library.cgo)
+	if pkg.hasTestdata {
+		goTest.SetAttr("data", rule.GlobValue{Patterns: []string{"testdata/**"}})
+	}
+	return goTest
+}
+
+// generateTaggedTest generates a go_test rule for test files that require
+// tag, one of the tags listed with # gazelle:go_test_tags. The rule is
+// tagged "manual", so it's only run when requested explicitly.
+func (g *generator) generateTaggedTest(pkg *goPackage, tag, library string) *rule.Rule {
+	goTest := rule.NewRule("go_test", g.ruleName("go_test", config.DefaultTestName+"_"+tag))
+	target, ok := pkg.taggedTests[tag]
+	if !ok || !target.sources.hasGo() {
+		return goTest // empty
+	}
+	g.setCommonAttrs(goTest, pkg.rel, "", *target, library)
+	g.setPure(goTest, target.cgo || library != "" && pkg.library.cgo)
 	if pkg.hasTestdata {
 		goTest.SetAttr("data", rule.GlobValue{Patterns: []string{"testdata/**"}})
 	}
+	goTest.SetAttr("tags", []string{tag, "manual"})
+	return goTest
+}
+
+// staleTaggedTests returns empty go_test rules for tagged tests in the
+// existing build file whose tags are no longer listed with
+// # gazelle:go_test_tags, so they're deleted. Tagged tests are recognized by
+// the names and tags generateTaggedTest gives them.
+func (g *generator) staleTaggedTests() []*rule.Rule {
+	if g.f == nil {
+		return nil
+	}
+	testTags := getGoConfig(g.c).testTags
+	var rules []*rule.Rule
+	for _, r := range g.f.Rules {
+		if g.c.UnmappedKind(r.Kind()) != "go_test" {
+			continue
+		}
+		tags := r.AttrStrings("tags")
+		if len(tags) != 2 || tags[0] != "manual" && tags[1] != "manual" {
+			continue
+		}
+		tag := tags[0]
+		if tag == "manual" {
+			tag = tags[1]
+		}
+		if r.Name() != g.ruleName("go_test", config.DefaultTestName+"_"+tag) {
+			continue
+		}
+		listed := false
+		for _, t := range testTags {
+			listed = listed || t == tag
+		}
+		if !listed {
+			rules = append(rules, rule.NewRule("go_test", r.Name()))
+		}
+	}
+	return rules
+}
+
+// generateInstrumentedTest generates a go_test rule like the one generated
+// by generateTest, but named after the instrumentation attr ("race" or
+// "msan"), which is set to "on". The rule is empty unless enabled is true,
+// so that it's deleted when the directive that enables it is turned off.
+func (g *generator) generateInstrumentedTest(pkg *goPackage, attr string, enabled bool, library string) *rule.Rule {
+	name := g.ruleName("go_test", config.DefaultTestName+"_"+attr)
+	if !enabled {
+		return rule.NewRule("go_test", name)
+	}
+	goTest := g.generateTest(pkg, library)
+	goTest.SetName(name)
+	if goTest.IsEmpty(goKinds["go_test"]) {
+		return goTest
+	}
+	goTest.SetAttr(attr, "on")
+	managed, _ := goTest.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	goTest.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, attr))
 	return goTest
 }
 
 func (g *generator) setCommonAttrs(r *rule.Rule, pkgRel, visibility string, target goTarget, embed string) {
 	if !target.sources.isEmpty() {
-		r.SetAttr("srcs", target.sources.buildFlat())
+		r.SetAttr("srcs", g.srcs(target.sources.buildFlat()))
 	}
 	if target.cgo {
 		r.SetAttr("cgo", true)
@@ -434,7 +657,268 @@ func (g *generator) setCommonAttrs(r *rule.Rule, pkgRel, visibility string, targ
 	if embed != "" {
 		r.SetAttr("embed", []string{":" + embed})
 	}
+	if len(target.embeds) > 0 {
+		if srcs := g.embedsrcs(pkgRel, target.embeds); len(srcs) > 0 {
+			r.SetAttr("embedsrcs", srcs)
+		}
+	}
 	r.SetPrivateAttr(config.GazelleImportsKey, target.imports.build())
+	r.SetPrivateAttr(platformsKey, getGoConfig(g.c).platforms)
+	if extraDeps := getGoConfig(g.c).extraDeps; len(extraDeps) > 0 {
+		r.SetPrivateAttr(extraDepsKey, extraDeps)
+	}
+	if ignoredImports := getGoConfig(g.c).ignoredImports; len(ignoredImports) > 0 {
+		r.SetPrivateAttr(ignoredImportsKey, ignoredImports)
+	}
+}
+
+// goGlobPatterns are the patterns srcs writes in globs. Globs in existing
+// rules that only use these patterns are replaced when globbing is turned off.
+var goGlobPatterns = []string{"*.go", "*_test.go"}
+
+// srcs returns the value of the srcs attribute for a rule with the given
+// source files. With # gazelle:go_generate_glob, .go files are matched with
+// a glob: "*_test.go" for tests, and "*.go" excluding tests otherwise. Files
+// the glob would match that aren't in srcs, for example, files excluded by
+// build constraints on all platforms, are excluded explicitly. Other files,
+// like generated and cgo files, are listed after the glob.
+func (g *generator) srcs(srcs []string) interface{} {
+	if g.dirGoFiles == nil {
+		return srcs
+	}
+	isTest := false
+	for _, src := range srcs {
+		if strings.HasSuffix(src, "_test.go") {
+			isTest = true
+			break
+		}
+	}
+	matches := func(name string) bool {
+		return g.dirGoFiles[name] && strings.HasSuffix(name, "_test.go") == isTest
+	}
+
+	inSrcs := make(map[string]bool)
+	var listed []string
+	for _, src := range srcs {
+		inSrcs[src] = true
+		if !matches(src) {
+			listed = append(listed, src)
+		}
+	}
+	if len(listed) == len(srcs) {
+		return srcs
+	}
+	glob := rule.GlobValue{Patterns: []string{"*.go"}}
+	if isTest {
+		glob.Patterns = []string{"*_test.go"}
+	} else {
+		glob.Excludes = []string{"*_test.go"}
+	}
+	for name := range g.dirGoFiles {
+		if matches(name) && !inSrcs[name] {
+			glob.Excludes = append(glob.Excludes, name)
+		}
+	}
+	sort.Strings(glob.Excludes)
+	if len(listed) == 0 {
+		return glob
+	}
+	return &bzl.BinaryExpr{
+		X:  rule.ExprFromValue(glob),
+		Op: "+",
+		Y:  rule.ExprFromValue(listed),
+	}
+}
+
+// listGoFiles returns the set of .go files in dir.
+func listGoFiles(c *config.Config, dir string) map[string]bool {
+	files := make(map[string]bool)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
+		return files
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".go") {
+			files[fi.Name()] = true
+		}
+	}
+	return files
+}
+
+// embedsrcs returns the files in the package at pkgRel that match the
+// //go:embed patterns. Like the go command, directories that match are
+// included recursively, except for files whose names begin with '.' or '_'
+// (unless the pattern has the prefix "all:"). Files in subdirectories that
+// contain build files belong to other packages and are not included.
+func (g *generator) embedsrcs(pkgRel string, patterns []string) []string {
+	dir := filepath.Join(g.c.RepoRoot, filepath.FromSlash(pkgRel))
+	seen := make(map[string]bool)
+	var srcs []string
+	add := func(path string) {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		if !seen[rel] {
+			seen[rel] = true
+			srcs = append(srcs, rel)
+		}
+	}
+	for _, pattern := range patterns {
+		all := strings.HasPrefix(pattern, "all:")
+		pattern = strings.TrimPrefix(pattern, "all:")
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil || len(matches) == 0 {
+			g.c.Log(config.Diagnostic{
+				Severity: config.Warning,
+				Message:  fmt.Sprintf("%s: pattern %s: no matching files found", dir, pattern),
+			})
+			continue
+		}
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				continue
+			}
+			if !fi.IsDir() {
+				add(m)
+				continue
+			}
+			filepath.Walk(m, func(path string, info os.FileInfo, err error) error {
+				if err != nil || path == m {
+					return err
+				}
+				base := info.Name()
+				if !all && (strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if info.IsDir() {
+					if g.isBuildDir(path) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				add(path)
+				return nil
+			})
+		}
+	}
+	sort.Strings(srcs)
+	return srcs
+}
+
+// isBuildDir returns whether dir contains a build file.
+func (g *generator) isBuildDir(dir string) bool {
+	for _, name := range g.c.ValidBuildFileNames {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setManagedVisibility sets the visibility attribute of r to the labels
+// listed with # gazelle:go_visibility, if any were given. In that case,
+// visibility is marked as managed, so it replaces the visibility of an
+// existing rule during merge. Visibility is set even if the build file
+// declares a default_visibility, since the directive is explicit.
+func (g *generator) setManagedVisibility(r *rule.Rule) {
+	gc := getGoConfig(g.c)
+	if len(gc.visibility) == 0 {
+		return
+	}
+	r.SetAttr("visibility", gc.visibility)
+	managed, _ := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	r.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, "visibility"))
+}
+
+// ruleName returns the name of a generated rule of the given kind in the
+// current package. name is the default name, which may be changed by
+// config.Config.RuleNamer.
+func (g *generator) ruleName(kind, name string) string {
+	return g.c.RuleName(kind, g.rel, name)
+}
+
+// setGrpcCompilers sets the compilers attribute of r, a go_proto_library
+// for a proto with services, to the labels listed with
+// # gazelle:go_grpc_compilers, or to the default grpc compiler if none were
+// given. compilers is marked as managed, so changing or removing the
+// directive updates the attribute of an existing rule during merge.
+func (g *generator) setGrpcCompilers(r *rule.Rule) {
+	compilers := getGoConfig(g.c).grpcCompilers
+	if len(compilers) == 0 {
+		compilers = []string{config.GrpcCompilerLabel}
+	}
+	r.SetAttr("compilers", compilers)
+	managed, _ := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	r.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, "compilers"))
+}
+
+// setPure sets the pure attribute of r according to # gazelle:go_pure. cgo
+// indicates whether r uses cgo, directly or through an embedded library.
+// Unless the directive is unset, pure is marked as managed, so it replaces
+// or removes the attribute of an existing rule during merge.
+func (g *generator) setPure(r *rule.Rule, cgo bool) {
+	switch getGoConfig(g.c).pureMode {
+	case pureUnset:
+		return
+	case pureAuto:
+		if !cgo {
+			r.SetAttr("pure", "on")
+		}
+	case pureOn:
+		r.SetAttr("pure", "on")
+	case pureOff:
+		r.SetAttr("pure", "off")
+	}
+	managed, _ := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	r.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, "pure"))
+}
+
+// setTestonly sets testonly = True on r if # gazelle:go_testonly is true.
+// Once the directive is given, testonly is marked as managed, so it replaces
+// or removes the attribute of an existing rule during merge.
+func (g *generator) setTestonly(r *rule.Rule) {
+	gc := getGoConfig(g.c)
+	if !gc.testonlySet {
+		return
+	}
+	if gc.testonly {
+		r.SetAttr("testonly", true)
+	}
+	managed, _ := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	r.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, "testonly"))
+}
+
+// setXDefs sets the x_defs attribute of r to the definitions given with
+// # gazelle:go_x_defs, if any. In that case, x_defs is marked as managed, so
+// it replaces the attribute of an existing rule during merge. Otherwise,
+// x_defs is left alone.
+func (g *generator) setXDefs(r *rule.Rule) {
+	xDefs := getGoConfig(g.c).xDefs
+	if len(xDefs) == 0 {
+		return
+	}
+	names := make([]string, 0, len(xDefs))
+	for name := range xDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dict := &bzl.DictExpr{ForceMultiLine: true}
+	for _, name := range names {
+		dict.List = append(dict.List, &bzl.KeyValueExpr{
+			Key:   &bzl.StringExpr{Value: name},
+			Value: &bzl.StringExpr{Value: xDefs[name]},
+		})
+	}
+	r.SetAttr("x_defs", dict)
+	managed, _ := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	r.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, "x_defs"))
 }
 
 func (g *generator) setImportAttrs(r *rule.Rule, pkg *goPackage) {
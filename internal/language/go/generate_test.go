@@ -103,11 +103,17 @@ filegroup(name = "go_default_library_protos")
 
 go_proto_library(name = "foo_go_proto")
 
+go_proto_gateway_library(name = "foo_gateway")
+
 go_library(name = "go_default_library")
 
 go_binary(name = "foo")
 
 go_test(name = "go_default_test")
+
+go_test(name = "go_default_test_race")
+
+go_test(name = "go_default_test_msan")
 `)
 	if got != want {
 		t.Errorf("got:\n%s\nwant:\n%s", got, want)
@@ -0,0 +1,296 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+// stringerLabel is the label of the stringer tool used by genrules
+// generated from //go:generate directives.
+const stringerLabel = "@org_golang_x_tools//cmd/stringer"
+
+// defaultMockgenTool is the label of the mockgen tool used by genrules
+// generated from //go:generate directives, unless another label is set with
+// # gazelle:go_mockgen_tool.
+const defaultMockgenTool = "@com_github_golang_mock//mockgen"
+
+// gomockImport is the import path of the package imported by mocks that
+// mockgen generates. It's added to the imports of tests that use mocks.
+const gomockImport = "github.com/golang/mock/gomock"
+
+// genruleManagedAttrs are the attributes Gazelle updates in the genrules it
+// generates for //go:generate directives. genrule isn't one of the Go kinds,
+// since most genrules are written by hand and must be left alone, so the
+// generated rules list these attributes in config.GazelleManagedAttrsKey
+// instead.
+var genruleManagedAttrs = []string{"cmd", "outs", "srcs", "tools"}
+
+// goGenerate is a //go:generate directive.
+type goGenerate struct {
+	// file is the name of the .go file containing the directive.
+	file string
+
+	// args are the words of the command. The first is the command name.
+	args []string
+}
+
+// readGoGenerates returns the //go:generate directives in the Go file at
+// path. Like the go command, only directives at the start of a line are
+// recognized. Quoted arguments are not supported.
+func readGoGenerates(path string) ([]goGenerate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var gens []goGenerate
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "//go:generate ") && !strings.HasPrefix(line, "//go:generate\t") {
+			continue
+		}
+		args := strings.Fields(line[len("//go:generate"):])
+		if len(args) > 0 {
+			gens = append(gens, goGenerate{file: filepath.Base(path), args: args})
+		}
+	}
+	return gens, scanner.Err()
+}
+
+// generateGoGenerateRules returns genrules for //go:generate directives in
+// the library sources of pkg that invoke recognized tools. stringer is
+// recognized with # gazelle:go_generate_genrule, and mockgen is recognized
+// with # gazelle:go_mockgen. Other directives are ignored. Files generated by
+// stringer replace any checked-in copies in the library sources, and mocks
+// generated by mockgen are added to the sources of the package's test, so
+// this must be called before the library and test are generated. mockgen
+// directives are ignored in packages without tests.
+func (g *generator) generateGoGenerateRules(pkg *goPackage) []*rule.Rule {
+	gc := getGoConfig(g.c)
+	var srcs []string
+	for _, src := range pkg.library.sources.buildFlat() {
+		if strings.HasSuffix(src, ".go") {
+			srcs = append(srcs, src)
+		}
+	}
+	var rules, stringers []*rule.Rule
+	stringerOuts := make(map[string]bool)
+	for _, src := range srcs {
+		gens, err := readGoGenerates(filepath.Join(pkg.dir, src))
+		if err != nil {
+			g.c.Log(config.Diagnostic{
+				Severity: config.Error,
+				Message:  fmt.Sprintf("%s: error reading go file: %v", filepath.Join(pkg.dir, src), err),
+			})
+			continue
+		}
+		for _, gen := range gens {
+			var r *rule.Rule
+			var err error
+			switch {
+			case gen.args[0] == "stringer" && gc.goGenerateGenrule:
+				r, err = stringerRule(gen, srcs)
+				if err == nil {
+					out := r.AttrStrings("outs")[0]
+					pkg.library.sources.removeString(out)
+					pkg.library.sources.addGenericString(":" + out)
+					stringers = append(stringers, r)
+					stringerOuts[out] = true
+				}
+			case gen.args[0] == "mockgen" && gc.mockgen:
+				if !pkg.test.sources.hasGo() {
+					// Mocks are only built into the test, so they aren't
+					// generated when there is no test.
+					continue
+				}
+				var out string
+				var external bool
+				r, out, external, err = mockgenRule(gen, pkg.name, gc.mockgenTool)
+				if err == nil {
+					addMock(pkg, out, r.AttrStrings("srcs")[0], external)
+				}
+			default:
+				continue
+			}
+			if err != nil {
+				g.c.Log(config.Diagnostic{
+					Severity: config.Error,
+					Message:  fmt.Sprintf("%s: %v", filepath.Join(pkg.dir, src), err),
+				})
+				continue
+			}
+			r.SetPrivateAttr(config.GazelleManagedAttrsKey, genruleManagedAttrs)
+			rules = append(rules, r)
+		}
+	}
+
+	// Checked-in copies of files generated by stringer aren't inputs of
+	// other stringer genrules, since they'd declare methods twice.
+	for _, r := range stringers {
+		var genSrcs []string
+		for _, src := range r.AttrStrings("srcs") {
+			if !stringerOuts[src] {
+				genSrcs = append(genSrcs, src)
+			}
+		}
+		r.SetAttr("srcs", genSrcs)
+	}
+	return rules
+}
+
+// addMock adds the mock generated from source to the sources of the
+// package's test in place of any checked-in copy. The mock imports gomock.
+// When it's in the external test package, it also imports the mocked package
+// and the packages the mocked interfaces refer to, which are approximated by
+// the imports of source.
+func addMock(pkg *goPackage, out, source string, external bool) {
+	pkg.library.sources.removeString(out)
+	pkg.test.sources.removeString(out)
+	pkg.test.sources.addGenericString(out)
+	pkg.test.imports.addGenericString(gomockImport)
+	if !external {
+		return
+	}
+	pkg.test.imports.addGenericString(pkg.importPath)
+	info := goFileInfo(filepath.Join(pkg.dir, source), pkg.rel)
+	for _, imp := range info.imports {
+		pkg.test.imports.addGenericString(imp)
+	}
+}
+
+// stringerRule returns a genrule that runs stringer as the //go:generate
+// directive gen would. srcs are the Go sources of the package. The output
+// file is excluded from the genrule's srcs, since the library is built with
+// the generated file instead of any checked-in copy.
+func stringerRule(gen goGenerate, srcs []string) (*rule.Rule, error) {
+	var types, out string
+	var flags []string
+	for i := 1; i < len(gen.args); i++ {
+		arg := gen.args[i]
+		if !strings.HasPrefix(arg, "-") {
+			// Directory or file arguments are replaced with the package sources.
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		} else if name != "linecomment" && i+1 < len(gen.args) {
+			i++
+			value = gen.args[i]
+		}
+		switch name {
+		case "type":
+			types = value
+		case "output":
+			out = value
+			continue
+		}
+		if name == "linecomment" {
+			flags = append(flags, "-"+name)
+		} else {
+			flags = append(flags, fmt.Sprintf("-%s=%s", name, value))
+		}
+	}
+	if types == "" {
+		return nil, fmt.Errorf("//go:generate stringer: -type must be set")
+	}
+	if out == "" {
+		out = strings.ToLower(strings.Split(types, ",")[0]) + "_string.go"
+	}
+
+	var genSrcs []string
+	for _, src := range srcs {
+		if src != out {
+			genSrcs = append(genSrcs, src)
+		}
+	}
+	sort.Strings(genSrcs)
+
+	r := rule.NewRule("genrule", strings.TrimSuffix(out, ".go"))
+	r.SetAttr("srcs", genSrcs)
+	r.SetAttr("outs", []string{out})
+	r.SetAttr("tools", []string{stringerLabel})
+	r.SetAttr("cmd", fmt.Sprintf("$(location %s) %s -output=$@ $(SRCS)", stringerLabel, strings.Join(flags, " ")))
+	return r, nil
+}
+
+// mockgenRule returns a genrule that runs mockgen in source mode as the
+// //go:generate directive gen would. The directive must set -source and
+// -destination to files in the package directory, and -package to pkgName
+// (or the external test package), since the mock is built as part of the
+// package's test. tool is the label of mockgen. The name of the output file
+// is also returned, along with whether the mock is in the external test
+// package.
+func mockgenRule(gen goGenerate, pkgName, tool string) (*rule.Rule, string, bool, error) {
+	var source, out, mockPkg string
+	var flags []string
+	for i := 1; i < len(gen.args); i++ {
+		arg := gen.args[i]
+		if !strings.HasPrefix(arg, "-") {
+			return nil, "", false, fmt.Errorf("//go:generate mockgen: only source mode is supported; use -source instead of %q", arg)
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		if j := strings.IndexByte(name, '='); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		} else if name != "write_package_comment" && name != "debug_parser" && i+1 < len(gen.args) {
+			i++
+			value = gen.args[i]
+		}
+		switch name {
+		case "source":
+			source = value
+			continue
+		case "destination":
+			out = value
+			continue
+		case "package":
+			mockPkg = value
+		}
+		if value == "" {
+			flags = append(flags, "-"+name)
+		} else {
+			flags = append(flags, fmt.Sprintf("-%s=%s", name, value))
+		}
+	}
+	if source == "" || out == "" {
+		return nil, "", false, fmt.Errorf("//go:generate mockgen: -source and -destination must be set")
+	}
+	if strings.Contains(source, "/") || strings.Contains(out, "/") || !strings.HasSuffix(out, ".go") {
+		return nil, "", false, fmt.Errorf("//go:generate mockgen: -source and -destination must be .go files in the package directory")
+	}
+	if mockPkg != pkgName && mockPkg != pkgName+"_test" {
+		return nil, "", false, fmt.Errorf("//go:generate mockgen: -package must be %s or %s_test, since the mock is built into the test", pkgName, pkgName)
+	}
+
+	r := rule.NewRule("genrule", strings.TrimSuffix(out, ".go"))
+	r.SetAttr("srcs", []string{source})
+	r.SetAttr("outs", []string{out})
+	r.SetAttr("tools", []string{tool})
+	r.SetAttr("cmd", fmt.Sprintf("$(location %s) -source=$(location %s) -destination=$@ %s", tool, source, strings.Join(flags, " ")))
+	return r, out, mockPkg == pkgName+"_test", nil
+}
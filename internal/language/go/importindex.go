@@ -0,0 +1,68 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+)
+
+// readImportIndex reads an import index file set with -go_import_index.
+// See parseImportIndex for the format.
+func readImportIndex(path string) (map[string]label.Label, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseImportIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return index, nil
+}
+
+// parseImportIndex parses the contents of an import index file. Each line
+// has an import path (a Go package path or a .proto file path), a tab, and
+// the absolute label of the rule that provides it. Blank lines and lines
+// starting with "#" are ignored.
+func parseImportIndex(data []byte) (map[string]label.Label, error) {
+	index := make(map[string]label.Label)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: want import path and label separated by a tab, got %q", lineNum, line)
+		}
+		l, err := label.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if l.Relative {
+			return nil, fmt.Errorf("line %d: label must be absolute: %q", lineNum, fields[1])
+		}
+		index[fields[0]] = l
+	}
+	return index, scanner.Err()
+}
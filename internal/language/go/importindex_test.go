@@ -0,0 +1,56 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+)
+
+func TestParseImportIndex(t *testing.T) {
+	data := []byte(`# generated by a previous run
+
+example.com/foo	@com_example_foo//:go_default_library
+example.com/foo/bar	@com_example_foo//bar
+google/api/annotations.proto	@go_googleapis//google/api:annotations_go_proto
+`)
+	got, err := parseImportIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]label.Label{
+		"example.com/foo":              label.New("com_example_foo", "", "go_default_library"),
+		"example.com/foo/bar":          label.New("com_example_foo", "bar", "bar"),
+		"google/api/annotations.proto": label.New("go_googleapis", "google/api", "annotations_go_proto"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+
+	for _, bad := range []string{
+		"example.com/foo @com_example_foo//:go_default_library",
+		"example.com/foo\t@com_example_foo//:lib\textra",
+		"\t@com_example_foo//:go_default_library",
+		"example.com/foo\t:go_default_library",
+		"example.com/foo\t@bad repo//:lib",
+	} {
+		if _, err := parseImportIndex([]byte(bad)); err == nil {
+			t.Errorf("%q: got success; want error", bad)
+		}
+	}
+}
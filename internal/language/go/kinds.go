@@ -15,12 +15,53 @@ limitations under the License.
 
 package golang
 
-import "github.com/bazelbuild/bazel-gazelle/internal/rule"
+import (
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+// goRuleAttrOrder is the order of attributes in go_binary, go_library, and
+// go_test rules. It agrees with the default order for these attributes,
+// except that deps comes after the others. Attributes that aren't listed,
+// like those written by hand, are written after all of these, in the
+// default order.
+var goRuleAttrOrder = []string{
+	"name",
+	"size",
+	"timeout",
+	"testonly",
+	"srcs",
+	"args",
+	"cgo",
+	"clinkopts",
+	"copts",
+	"data",
+	"embed",
+	"embedsrcs",
+	"gc_goopts",
+	"gc_linkopts",
+	"goarch",
+	"goos",
+	"importmap",
+	"importpath",
+	"importpath_aliases",
+	"linkmode",
+	"msan",
+	"pure",
+	"race",
+	"rundir",
+	"static",
+	"tags",
+	"visibility",
+	"x_defs",
+	"deps",
+}
 
 var goKinds = map[string]rule.KindInfo{
 	"filegroup": {
 		NonEmptyAttrs:  map[string]bool{"srcs": true},
 		MergeableAttrs: map[string]bool{"srcs": true},
+		AttrOrder:      []string{"name", "testonly", "srcs", "visibility"},
 	},
 	"go_binary": {
 		MatchAny: true,
@@ -35,9 +76,11 @@ var goKinds = map[string]rule.KindInfo{
 			"clinkopts": true,
 			"copts":     true,
 			"embed":     true,
+			"embedsrcs": true,
 			"srcs":      true,
 		},
 		ResolveAttrs: map[string]bool{"deps": true},
+		AttrOrder:    goRuleAttrOrder,
 	},
 	"go_library": {
 		MatchAttrs: []string{"importpath"},
@@ -54,11 +97,13 @@ var goKinds = map[string]rule.KindInfo{
 			"clinkopts":  true,
 			"copts":      true,
 			"embed":      true,
+			"embedsrcs":  true,
 			"importmap":  true,
 			"importpath": true,
 			"srcs":       true,
 		},
 		ResolveAttrs: map[string]bool{"deps": true},
+		AttrOrder:    goRuleAttrOrder,
 	},
 	"go_proto_library": {
 		MatchAttrs: []string{"importpath"},
@@ -80,6 +125,38 @@ var goKinds = map[string]rule.KindInfo{
 			"proto":      true,
 		},
 		ResolveAttrs: map[string]bool{"deps": true},
+		AttrOrder: []string{
+			"name",
+			"srcs",
+			"compilers",
+			"embed",
+			"importmap",
+			"importpath",
+			"proto",
+			"visibility",
+			"deps",
+		},
+	},
+	gatewayKind: {
+		MatchAttrs: []string{"importpath"},
+		NonEmptyAttrs: map[string]bool{
+			"proto": true,
+		},
+		SubstituteAttrs: map[string]bool{"proto": true},
+		MergeableAttrs: map[string]bool{
+			"importpath": true,
+			"importmap":  true,
+			"proto":      true,
+		},
+		ResolveAttrs: map[string]bool{"deps": true},
+		AttrOrder: []string{
+			"name",
+			"importmap",
+			"importpath",
+			"proto",
+			"visibility",
+			"deps",
+		},
 	},
 	"go_repository": {
 		MatchAttrs:    []string{"importpath"},
@@ -107,9 +184,18 @@ var goKinds = map[string]rule.KindInfo{
 			"clinkopts": true,
 			"copts":     true,
 			"embed":     true,
+			"embedsrcs": true,
 			"srcs":      true,
 		},
 		ResolveAttrs: map[string]bool{"deps": true},
+		AttrOrder:    goRuleAttrOrder,
+		PreservedAttrs: map[string]bool{
+			"flaky":       true,
+			"shard_count": true,
+			"size":        true,
+			"tags":        true,
+			"timeout":     true,
+		},
 	},
 }
 
@@ -145,3 +231,17 @@ var goLoads = []rule.LoadInfo{
 
 func (_ *goLang) Kinds() map[string]rule.KindInfo { return goKinds }
 func (_ *goLang) Loads() []rule.LoadInfo          { return goLoads }
+
+// gatewayKind is the kind of grpc-gateway libraries generated when
+// # gazelle:proto_gateway is set. It's not a real rule; the directive maps
+// it to the kind named by the user, as if by # gazelle:map_kind.
+const gatewayKind = "go_proto_gateway_library"
+
+// setGatewayKind maps gatewayKind to kind, loaded from load.
+func setGatewayKind(c *config.Config, kind, load string) {
+	c.MapKind(config.MappedKind{
+		FromKind: gatewayKind,
+		KindName: kind,
+		KindLoad: load,
+	})
+}
@@ -18,10 +18,24 @@ limitations under the License.
 //
 // Configuration
 //
-// Go rules support the flags -build_tags, -go_prefix, and -external.
-// They also support the directives # gazelle:build_tags, # gazelle:prefix,
-// and # gazelle:importmap_prefix. See
-// https://github.com/bazelbuild/bazel-gazelle/blob/master/README.rst#directives
+// Go rules support the flags -build_tags, -go_prefix, -external,
+// -go_import_index, -go_import_index_strict, and -go_internal_visibility.
+// They also support the directives # gazelle:build_tags,
+// # gazelle:go_extra_deps, # gazelle:go_generate_genrule,
+// # gazelle:go_generate_glob, # gazelle:go_grpc_compilers,
+// # gazelle:go_grpc_library_suffix, # gazelle:go_ignore_import,
+// # gazelle:go_local_repository, # gazelle:go_mockgen,
+// # gazelle:go_mockgen_tool, # gazelle:go_platform_mapping,
+// # gazelle:go_platforms, # gazelle:go_prefix_map,
+// # gazelle:go_proto_library_suffix, # gazelle:go_pure,
+// # gazelle:go_repository_default_repo, # gazelle:go_split_main,
+// # gazelle:go_stdlib_packages, # gazelle:go_test_msan,
+// # gazelle:go_test_race, # gazelle:go_test_tags, # gazelle:go_testonly,
+// # gazelle:go_vendor_dir, # gazelle:go_vendor_fallback,
+// # gazelle:go_visibility, # gazelle:go_x_defs, # gazelle:prefix,
+// # gazelle:prefer_alias, # gazelle:importmap_prefix,
+// # gazelle:proto_gateway, and # gazelle:resolve.
+// See https://github.com/bazelbuild/bazel-gazelle/blob/master/README.rst#directives
 // for information on these.
 //
 // Rule generation
@@ -42,23 +56,36 @@ limitations under the License.
 //
 // Dependency resolution
 //
-// Go libraries are indexed by their importpath attribute. Gazelle attempts to
-// resolve libraries by import path using the index, filtered using the
-// vendoring algorithm. If an import doesn't match any known library, Gazelle
-// guesses a name for it, locally (if the import path is under the current
-// prefix), or in an external repository or vendor directory (depending
-// on external mode).
+// Go libraries are indexed by their importpath attribute and by any paths
+// in their importpath_aliases attribute. Gazelle attempts to resolve
+// libraries by import path using the index, filtered using the vendoring
+// algorithm. If an import doesn't match any known library, Gazelle guesses a
+// name for it, locally (if the import path is under the current prefix), or
+// in an external repository or vendor directory (depending on external
+// mode).
+//
+// Subdirectories with their own go.mod files are treated as nested modules.
+// Their module paths are used as prefixes, and imports of packages in other
+// modules are resolved as external, even if the rules are indexed.
 //
 // Gazelle has special cases for import paths associated with proto Well
 // Known Types and Google APIs. rules_go declares canonical rules for these.
 
 package golang
 
-import "github.com/bazelbuild/bazel-gazelle/internal/language"
+import (
+	"sync"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/language"
+)
 
 const goName = "go"
 
 type goLang struct {
+	// testdataPkgs is the set of testdata directories that contain buildable
+	// packages. It's guarded by mu, since rules may be generated for several
+	// directories concurrently.
+	mu           sync.Mutex
 	testdataPkgs map[string]bool
 }
 
@@ -0,0 +1,264 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
+)
+
+// moduleReplace is a replace directive from a go.mod file. It substitutes
+// the module oldPath with either a directory (when newVersion is empty) or
+// a different module path and version.
+type moduleReplace struct {
+	oldPath, newPath, newVersion string
+}
+
+// isLocal returns whether the replacement is a directory.
+func (r moduleReplace) isLocal() bool {
+	return r.newVersion == ""
+}
+
+// readModFile reads the module path and replace directives from the go.mod
+// file at path. No error is returned if the file doesn't exist.
+func readModFile(path string) (modulePath string, replaces []moduleReplace, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	replaces, err = parseModReplaces(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return parseModulePath(data), replaces, nil
+}
+
+// parseModulePath returns the module path from the module directive in the
+// contents of a go.mod file. "" is returned if there is no module directive.
+func parseModulePath(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "module" {
+			continue
+		}
+		if s, err := strconv.Unquote(fields[1]); err == nil {
+			return s
+		}
+		return fields[1]
+	}
+	return ""
+}
+
+// parseModReplaces extracts replace directives from the contents of a
+// go.mod file. Both the single-line form and the parenthesized block form
+// are recognized. Other directives are ignored.
+func parseModReplaces(data []byte) ([]moduleReplace, error) {
+	var replaces []moduleReplace
+	inBlock := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inBlock:
+			if fields[0] == ")" {
+				inBlock = false
+				continue
+			}
+		case fields[0] == "replace" && len(fields) == 2 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == "replace":
+			fields = fields[1:]
+		default:
+			continue
+		}
+		r, err := parseModReplace(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		replaces = append(replaces, r)
+	}
+	return replaces, scanner.Err()
+}
+
+// parseModReplace parses the fields of a replace directive, which have one
+// of the forms below. The old version, if any, is ignored.
+//
+//     old [version] => dir
+//     old [version] => new version
+func parseModReplace(fields []string) (moduleReplace, error) {
+	for i := range fields {
+		if s, err := strconv.Unquote(fields[i]); err == nil {
+			fields[i] = s
+		}
+	}
+	arrow := -1
+	for i, f := range fields {
+		if f == "=>" {
+			arrow = i
+			break
+		}
+	}
+	if arrow < 1 || arrow > 2 {
+		return moduleReplace{}, fmt.Errorf("invalid replace directive: %q", strings.Join(fields, " "))
+	}
+	r := moduleReplace{oldPath: fields[0]}
+	switch rhs := fields[arrow+1:]; len(rhs) {
+	case 1:
+		if !isModDirPath(rhs[0]) {
+			return moduleReplace{}, fmt.Errorf("replacement module without version must be a directory path starting with ./ or ../: %q", rhs[0])
+		}
+		r.newPath = rhs[0]
+	case 2:
+		if isModDirPath(rhs[0]) {
+			return moduleReplace{}, fmt.Errorf("replacement directory must not have a version: %q", rhs[0])
+		}
+		r.newPath, r.newVersion = rhs[0], rhs[1]
+	default:
+		return moduleReplace{}, fmt.Errorf("invalid replace directive: %q", strings.Join(fields, " "))
+	}
+	return r, nil
+}
+
+func isModDirPath(p string) bool {
+	return strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") || p == "." || p == ".." || filepath.IsAbs(p)
+}
+
+// findModReplace returns the replace directive for the module that provides
+// the package imp. When several modules could provide imp, the one with the
+// longest path is chosen, matching the go command. false is returned if no
+// replacement applies.
+func findModReplace(replaces []moduleReplace, imp string) (moduleReplace, bool) {
+	var best moduleReplace
+	found := false
+	for _, r := range replaces {
+		if pathtools.HasPrefix(imp, r.oldPath) && (!found || len(r.oldPath) > len(best.oldPath)) {
+			best = r
+			found = true
+		}
+	}
+	return best, found
+}
+
+// replacedImportPath returns the import path imp would have in the
+// replacement module.
+func replacedImportPath(r moduleReplace, imp string) string {
+	return path.Join(r.newPath, pathtools.TrimPrefix(imp, r.oldPath))
+}
+
+// replacedPackagePath returns the import path of the package in the
+// directory rel when rel is in a directory that replaces a module with a
+// local replace directive. The import path is derived from the path of the
+// replaced module. Replacements only apply if their directories are nested
+// more deeply than the directory where the prefix was set, so an explicit
+// prefix or a go.mod file in the replacement directory takes precedence.
+// false is returned if no replacement applies.
+func (gc *goConfig) replacedPackagePath(rel string) (string, bool) {
+	var best moduleReplace
+	bestDir := ""
+	found := false
+	for _, r := range gc.moduleReplaces {
+		if !r.isLocal() {
+			continue
+		}
+		dir := path.Clean(r.newPath)
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") || path.IsAbs(dir) {
+			continue
+		}
+		if pathtools.HasPrefix(rel, dir) && len(dir) > len(gc.prefixRel) && (!found || len(dir) > len(bestDir)) {
+			best, bestDir, found = r, dir, true
+		}
+	}
+	if !found {
+		return "", false
+	}
+	return path.Join(best.oldPath, pathtools.TrimPrefix(rel, bestDir)), true
+}
+
+// isVendorPath returns whether rel is in a vendor directory. go.mod files
+// of vendored modules don't start nested modules.
+func isVendorPath(gc *goConfig, rel string) bool {
+	return pathtools.HasPrefix(rel, gc.vendorDir) || strings.Contains("/"+rel+"/", "/vendor/")
+}
+
+// nestedModule returns the directory and path of the innermost module with
+// a go.mod file in a subdirectory that contains the package rel. false is
+// returned if rel is in the root module.
+func (gc *goConfig) nestedModule(rel string) (modRel, modPath string, ok bool) {
+	for r, p := range gc.nestedModules {
+		if pathtools.HasPrefix(rel, r) && (!ok || len(r) > len(modRel)) {
+			modRel, modPath, ok = r, p, true
+		}
+	}
+	return modRel, modPath, ok
+}
+
+// forPackage returns a config for resolving imports of the package rel.
+// If rel is in a nested module, the prefix is that module's path.
+// Otherwise, gc is returned.
+func (gc *goConfig) forPackage(rel string) *goConfig {
+	modRel, modPath, ok := gc.nestedModule(rel)
+	if !ok {
+		return gc
+	}
+	gcCopy := *gc
+	gcCopy.prefix = modPath
+	gcCopy.prefixRel = modRel
+	return &gcCopy
+}
+
+// sameModule returns whether the packages rel and otherRel are in the same
+// module.
+func (gc *goConfig) sameModule(rel, otherRel string) bool {
+	modRel, _, ok := gc.nestedModule(rel)
+	otherModRel, _, otherOk := gc.nestedModule(otherRel)
+	return ok == otherOk && modRel == otherModRel
+}
+
+// importInModule returns whether imp is provided by the module containing
+// the package rel, rather than by a nested module whose path is a longer
+// prefix of imp.
+func (gc *goConfig) importInModule(imp, rel string) bool {
+	modRel, _, _ := gc.nestedModule(rel)
+	for r, p := range gc.nestedModules {
+		if r != modRel && pathtools.HasPrefix(imp, p) && len(p) > len(gc.prefix) {
+			return false
+		}
+	}
+	return true
+}
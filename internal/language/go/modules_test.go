@@ -0,0 +1,238 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package golang
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+func TestParseModReplaces(t *testing.T) {
+	data := []byte(`module example.com/local
+
+require example.com/foo v1.0.0
+
+replace example.com/foo => ./third_party/foo // local copy
+
+replace (
+	example.com/old v1.0.0 => example.com/fork v1.2.3
+	"example.com/quoted" => "../quoted"
+)
+`)
+	got, err := parseModReplaces(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []moduleReplace{
+		{oldPath: "example.com/foo", newPath: "./third_party/foo"},
+		{oldPath: "example.com/old", newPath: "example.com/fork", newVersion: "v1.2.3"},
+		{oldPath: "example.com/quoted", newPath: "../quoted"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+
+	for _, bad := range []string{
+		"replace example.com/foo",
+		"replace example.com/foo => example.com/bar",
+		"replace example.com/foo => ./a ./b",
+	} {
+		if _, err := parseModReplaces([]byte(bad)); err == nil {
+			t.Errorf("%q: got success; want error", bad)
+		}
+	}
+}
+
+func TestParseModulePath(t *testing.T) {
+	for _, tc := range []struct {
+		desc, data, want string
+	}{
+		{
+			desc: "plain",
+			data: "module example.com/repo\n\nrequire example.com/foo v1.0.0\n",
+			want: "example.com/repo",
+		}, {
+			desc: "quoted",
+			data: "// comment\nmodule \"example.com/repo\" // trailing\n",
+			want: "example.com/repo",
+		}, {
+			desc: "missing",
+			data: "require example.com/foo v1.0.0\n",
+			want: "",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := parseModulePath([]byte(tc.data)); got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestModulePrefixConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "modules_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	goMod := "module example.com/repo\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc, build, want string
+	}{
+		{
+			desc: "go.mod",
+			want: "example.com/repo",
+		}, {
+			desc:  "directive",
+			build: "# gazelle:prefix example.com/directive",
+			want:  "example.com/directive",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			c.RepoRoot = dir
+			var f *rule.File
+			if tc.build != "" {
+				f, err = rule.LoadData(filepath.Join(dir, "BUILD.bazel"), []byte(tc.build))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, lang := range langs {
+				lang.Configure(c, "", f)
+			}
+			gc := getGoConfig(c)
+			if gc.prefix != tc.want || gc.prefixRel != "" {
+				t.Errorf("got prefix %q in %q; want %q in \"\"", gc.prefix, gc.prefixRel, tc.want)
+			}
+
+			// The prefix is inherited by subdirectories.
+			for _, lang := range langs {
+				lang.Configure(c, "sub", nil)
+			}
+			if gc := getGoConfig(c); gc.prefix != tc.want {
+				t.Errorf("sub: got prefix %q; want %q", gc.prefix, tc.want)
+			}
+		})
+	}
+}
+
+func TestNestedModuleConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "modules_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for rel, goMod := range map[string]string{
+		"":           "module example.com/repo\n",
+		"sub":        "module example.com/sub\n",
+		"vendor/dep": "module example.com/dep\n",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, rel), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, rel, "go.mod"), []byte(goMod), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, _, langs := testConfig()
+	c.RepoRoot = dir
+	for _, rel := range []string{"", "sub", "sub/pkg"} {
+		for _, lang := range langs {
+			lang.Configure(c, rel, nil)
+		}
+	}
+	gc := getGoConfig(c)
+	if got, want := inferImportPath(gc, "sub/pkg"), "example.com/sub/pkg"; got != want {
+		t.Errorf("sub/pkg: got importpath %q; want %q", got, want)
+	}
+
+	// go.mod files in vendor directories don't start nested modules.
+	for _, rel := range []string{"vendor", "vendor/dep"} {
+		for _, lang := range langs {
+			lang.Configure(c, rel, nil)
+		}
+	}
+	want := map[string]string{"sub": "example.com/sub"}
+	if !reflect.DeepEqual(gc.nestedModules, want) {
+		t.Errorf("got nested modules %v; want %v", gc.nestedModules, want)
+	}
+	if gc.sameModule("sub/pkg", "pkg") || !gc.sameModule("sub/pkg", "sub") {
+		t.Errorf("sameModule: sub/pkg should be in the module of sub, not the root module")
+	}
+}
+
+func TestModReplacesConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "modules_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	abs := filepath.Join(dir, "abs")
+	goMod := "module example.com/local\n\nreplace example.com/abs => " + abs + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _, langs := testConfig()
+	c.RepoRoot = dir
+	for _, lang := range langs {
+		lang.Configure(c, "", nil)
+	}
+	gc := getGoConfig(c)
+	want := []moduleReplace{{oldPath: "example.com/abs", newPath: "abs"}}
+	if !reflect.DeepEqual(gc.moduleReplaces, want) {
+		t.Errorf("got %#v; want %#v", gc.moduleReplaces, want)
+	}
+}
+
+func TestReplacedPackagePath(t *testing.T) {
+	gc := newGoConfig()
+	gc.prefix = "example.com/repo"
+	gc.moduleReplaces = []moduleReplace{
+		{oldPath: "example.com/foo", newPath: "./local/foo"},
+		{oldPath: "example.com/foo/v2", newPath: "./local/foo/v2"},
+		{oldPath: "example.com/up", newPath: "../up"},
+		{oldPath: "example.com/bar", newPath: "example.com/baz", newVersion: "v1.0.0"},
+	}
+	for _, tc := range []struct {
+		desc, prefixRel, rel, want string
+	}{
+		{desc: "module_root", rel: "local/foo", want: "example.com/foo"},
+		{desc: "subdir", rel: "local/foo/sub", want: "example.com/foo/sub"},
+		{desc: "longest", rel: "local/foo/v2/sub", want: "example.com/foo/v2/sub"},
+		{desc: "outside", rel: "local/bar"},
+		{desc: "prefix_in_dir", prefixRel: "local/foo", rel: "local/foo/sub"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			gc.prefixRel = tc.prefixRel
+			got, ok := gc.replacedPackagePath(tc.rel)
+			if want := tc.want != ""; ok != want || got != tc.want {
+				t.Errorf("got %q, %v; want %q, %v", got, ok, tc.want, want)
+			}
+		})
+	}
+}
@@ -34,6 +34,10 @@ type goPackage struct {
 	proto                 protoTarget
 	hasTestdata           bool
 	importPath            string
+
+	// taggedTests contains test files that require one of the tags listed
+	// with # gazelle:go_test_tags, keyed by tag.
+	taggedTests map[string]*goTarget
 }
 
 // goTarget contains information used to generate an individual Go rule
@@ -41,6 +45,9 @@ type goPackage struct {
 type goTarget struct {
 	sources, imports, copts, clinkopts platformStringsBuilder
 	cgo                                bool
+
+	// embeds is a list of patterns from //go:embed directives in sources.
+	embeds []string
 }
 
 // protoTarget contains information used to generate a go_proto_library rule.
@@ -96,7 +103,11 @@ func (pkg *goPackage) addFile(c *config.Config, info fileInfo, cgo bool) error {
 		if info.isCgo {
 			return fmt.Errorf("%s: use of cgo in test not supported", info.path)
 		}
-		pkg.test.addFile(c, info)
+		if tag := testTag(c, info); tag != "" {
+			pkg.addTaggedTest(c, tag, info)
+		} else {
+			pkg.test.addFile(c, info)
+		}
 	default:
 		pkg.library.addFile(c, info)
 	}
@@ -104,11 +115,53 @@ func (pkg *goPackage) addFile(c *config.Config, info fileInfo, cgo bool) error {
 	return nil
 }
 
+// addTaggedTest adds a test file that requires tag to the target in
+// pkg.taggedTests for that tag. Build constraints are evaluated as if tag
+// were set with # gazelle:build_tags.
+func (pkg *goPackage) addTaggedTest(c *config.Config, tag string, info fileInfo) {
+	if pkg.taggedTests == nil {
+		pkg.taggedTests = make(map[string]*goTarget)
+	}
+	t, ok := pkg.taggedTests[tag]
+	if !ok {
+		t = &goTarget{}
+		pkg.taggedTests[tag] = t
+	}
+	tc := c.Clone()
+	gc := getGoConfig(c).clone()
+	gc.genericTags[tag] = true
+	tc.Exts[goName] = gc
+	t.addFile(tc, info)
+}
+
+// testTag returns the first tag listed with # gazelle:go_test_tags that
+// appears without negation in the build constraints of a test file. "" is
+// returned if there is no such tag.
+func testTag(c *config.Config, info fileInfo) string {
+	for _, tag := range getGoConfig(c).testTags {
+		for _, l := range info.tags {
+			for _, g := range l {
+				for _, t := range g {
+					if t == tag {
+						return tag
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
 // isCommand returns true if the package name is "main".
 func (pkg *goPackage) isCommand() bool {
 	return pkg.name == "main"
 }
 
+// hasTests returns whether the package has any test files.
+func (pkg *goPackage) hasTests() bool {
+	return pkg.test.sources.hasGo() || len(pkg.taggedTests) > 0
+}
+
 // isBuildable returns true if anything in the package is buildable.
 // This is true if the package has Go code that satisfies build constraints
 // on any platform or has proto files not in legacy mode.
@@ -124,6 +177,9 @@ func (pkg *goPackage) firstGoFile() string {
 		pkg.binary.sources,
 		pkg.test.sources,
 	}
+	for _, t := range pkg.taggedTests {
+		goSrcs = append(goSrcs, t.sources)
+	}
 	for _, sb := range goSrcs {
 		if sb.strs != nil {
 			for s, _ := range sb.strs {
@@ -156,7 +212,14 @@ func (pkg *goPackage) inferImportPath(c *config.Config) error {
 	return nil
 }
 
+// inferImportPath returns the import path of the package in the directory
+// rel. If rel is in a directory that replaces a module in go.mod, the path
+// is derived from the replaced module's path. Otherwise, it's derived from
+// the prefix.
 func inferImportPath(gc *goConfig, rel string) string {
+	if imp, ok := gc.replacedPackagePath(rel); ok {
+		return imp
+	}
 	if rel == gc.prefixRel {
 		return gc.prefix
 	} else {
@@ -170,6 +233,7 @@ func (t *goTarget) addFile(c *config.Config, info fileInfo) {
 	add := getPlatformStringsAddFunction(c, info, nil)
 	add(&t.sources, info.name)
 	add(&t.imports, info.imports...)
+	t.embeds = append(t.embeds, info.embeds...)
 	for _, copts := range info.copts {
 		optAdd := add
 		if len(copts.tags) > 0 {
@@ -197,7 +261,13 @@ func (t *protoTarget) addFile(c *config.Config, info fileInfo) {
 // getPlatformStringsAddFunction returns a function used to add strings to
 // a *platformStringsBuilder under the same set of constraints. This is a
 // performance optimization to avoid evaluating constraints repeatedly.
+//
+// Constraints from the file name (like "_linux") and from build constraint
+// lines (like "//go:build arm64") are checked together, so strings are only
+// added for platforms that satisfy both. For example, imports of foo_linux.go
+// with "//go:build arm64" are only added for linux_arm64.
 func getPlatformStringsAddFunction(c *config.Config, info fileInfo, cgoTags tagLine) func(sb *platformStringsBuilder, ss ...string) {
+	gc := getGoConfig(c)
 	isOSSpecific, isArchSpecific := isOSArchSpecific(info, cgoTags)
 
 	switch {
@@ -212,7 +282,7 @@ func getPlatformStringsAddFunction(c *config.Config, info fileInfo, cgoTags tagL
 
 	case isOSSpecific && !isArchSpecific:
 		var osMatch []string
-		for _, os := range rule.KnownOSs {
+		for _, os := range gc.platformOSs {
 			if checkConstraints(c, os, "", info.goos, info.goarch, info.tags, cgoTags) {
 				osMatch = append(osMatch, os)
 			}
@@ -227,7 +297,7 @@ func getPlatformStringsAddFunction(c *config.Config, info fileInfo, cgoTags tagL
 
 	case !isOSSpecific && isArchSpecific:
 		var archMatch []string
-		for _, arch := range rule.KnownArchs {
+		for _, arch := range gc.platformArchs {
 			if checkConstraints(c, "", arch, info.goos, info.goarch, info.tags, cgoTags) {
 				archMatch = append(archMatch, arch)
 			}
@@ -242,7 +312,7 @@ func getPlatformStringsAddFunction(c *config.Config, info fileInfo, cgoTags tagL
 
 	default:
 		var platformMatch []rule.Platform
-		for _, platform := range rule.KnownPlatforms {
+		for _, platform := range gc.platforms {
 			if checkConstraints(c, platform.OS, platform.Arch, info.goos, info.goarch, info.tags, cgoTags) {
 				platformMatch = append(platformMatch, platform)
 			}
@@ -279,6 +349,10 @@ func (sb *platformStringsBuilder) addGenericString(s string) {
 	sb.strs[s] = platformStringInfo{set: genericSet}
 }
 
+func (sb *platformStringsBuilder) removeString(s string) {
+	delete(sb.strs, s)
+}
+
 func (sb *platformStringsBuilder) addOSString(s string, oss []string) {
 	if sb.strs == nil {
 		sb.strs = make(map[string]platformStringInfo)
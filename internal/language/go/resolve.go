@@ -19,33 +19,77 @@ import (
 	"errors"
 	"fmt"
 	"go/build"
-	"log"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/language/proto"
 	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/internal/repos"
 	"github.com/bazelbuild/bazel-gazelle/internal/resolve"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
 )
 
-func (_ *goLang) Imports(_ *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
-	if !isGoLibrary(r.Kind()) {
+func (_ *goLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	if isLegacyProtoFilegroup(c, r) {
+		return legacyProtoImports(c, r, f)
+	}
+	if !isGoLibrary(c.UnmappedKind(r.Kind())) {
 		return nil
 	}
-	if importPath := r.AttrString("importpath"); importPath == "" {
+	importPath := r.AttrString("importpath")
+	if importPath == "" {
 		return []resolve.ImportSpec{}
-	} else {
-		return []resolve.ImportSpec{{goName, importPath}}
 	}
+	// Libraries may also be imported with the paths in importpath_aliases,
+	// for example, when a package has moved and old importers haven't
+	// been updated.
+	imps := []resolve.ImportSpec{{Lang: goName, Imp: importPath}}
+	for _, alias := range r.AttrStrings("importpath_aliases") {
+		imps = append(imps, resolve.ImportSpec{Lang: goName, Imp: alias})
+	}
+	return imps
+}
+
+// isLegacyProtoFilegroup returns whether r is a filegroup of .proto files
+// generated in legacy proto mode.
+func isLegacyProtoFilegroup(c *config.Config, r *rule.Rule) bool {
+	return r.Kind() == "filegroup" && r.Name() == legacyProtoFilegroupName && proto.GetProtoConfig(c).Mode == proto.LegacyMode
+}
+
+// legacyProtoImports returns the proto imports of the .proto files in a
+// legacy filegroup. This lets proto imports be resolved to the filegroup
+// when there are no proto_library rules.
+func legacyProtoImports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	rel := f.Rel(c.RepoRoot)
+	if pc := proto.GetProtoConfig(c); pathtools.HasPrefix(rel, pc.ProtoRoot) {
+		rel = pathtools.TrimPrefix(rel, pc.ProtoRoot)
+	}
+	var imports []resolve.ImportSpec
+	for _, src := range r.AttrStrings("srcs") {
+		if strings.HasSuffix(src, ".proto") {
+			imports = append(imports, resolve.ImportSpec{Lang: "proto", Imp: path.Join(rel, src)})
+		}
+	}
+	return imports
+}
+
+// VendorRoot implements resolve.VendorResolver, so vendored copies of
+// libraries aren't reported as duplicates of the originals.
+func (_ *goLang) VendorRoot(c *config.Config, rel string) (string, bool) {
+	return findVendorRoot(getGoConfig(c), rel)
 }
 
 func (_ *goLang) Embeds(r *rule.Rule, from label.Label) []label.Label {
 	embedStrings := r.AttrStrings("embed")
-	if isGoProtoLibrary(r.Kind()) {
-		embedStrings = append(embedStrings, r.AttrString("proto"))
+	// go_proto_library rules embed their proto_library. The attribute is
+	// checked instead of the kind, since the kind may have been replaced
+	// with # gazelle:map_kind, and no configuration is available here.
+	if proto := r.AttrString("proto"); proto != "" {
+		embedStrings = append(embedStrings, proto)
 	}
 	embedLabels := make([]label.Label, 0, len(embedStrings))
 	for _, s := range embedStrings {
@@ -67,16 +111,33 @@ func (gl *goLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.Rem
 	}
 	imports := importsRaw.(rule.PlatformStrings)
 	r.DelAttr("deps")
-	resolve := resolveGo
-	if r.Kind() == "go_proto_library" {
-		resolve = resolveProto
+	resolveImport := resolveGo
+	if c.UnmappedKind(r.Kind()) == "go_proto_library" {
+		pc := proto.GetProtoConfig(c)
+		resolveImport = func(c *config.Config, gc *goConfig, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, imp string, from label.Label) (label.Label, string, error) {
+			return resolveProto(c, gc, pc, ix, rc, r, imp, from)
+		}
 	}
-	gc := getGoConfig(c)
-	deps, errs := imports.Map(func(imp string) (string, error) {
-		l, err := resolve(gc, ix, rc, r, imp, from)
+	gc := getGoConfig(c).forPackage(from.Pkg)
+	var how map[string]string
+	if c.AnnotateDeps {
+		how = make(map[string]string)
+	}
+	// Map calls the function once per platform an import appears on, but
+	// each import is only counted once in c.Stats.
+	counted := make(map[string]bool)
+	deps, _ := imports.Map(func(imp string) (string, error) {
+		count := !counted[imp]
+		counted[imp] = true
+		l, via, err := resolveImport(c, gc, ix, rc, r, imp, from)
 		if err == skipImportError {
 			return "", nil
 		} else if err != nil {
+			if count {
+				_, ambiguous := err.(*resolve.AmbiguousImportError)
+				c.Stats.Unresolved(ambiguous)
+			}
+			c.Log(config.Diagnostic{Severity: config.Error, From: from, Imp: imp, Message: err.Error()})
 			return "", err
 		}
 		for _, embed := range gl.Embeds(r, from) {
@@ -84,60 +145,348 @@ func (gl *goLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.Rem
 				return "", nil
 			}
 		}
+		if count {
+			c.Stats.Resolved(via)
+		}
 		l = l.Rel(from.Repo, from.Pkg)
+		if how != nil {
+			how[l.String()] = via
+		}
 		return l.String(), nil
 	})
-	for _, err := range errs {
-		log.Print(err)
+	// Imports that resolve to the same label on different platforms are
+	// combined, so each label is listed in as few select branches as
+	// possible.
+	platforms, _ := r.PrivateAttr(platformsKey).([]rule.Platform)
+	deps = deps.Collapse(platforms)
+	if extraDeps, ok := r.PrivateAttr(extraDepsKey).([]string); ok {
+		deps.Generic = addExtraDeps(deps.Generic, extraDeps, from, gl.Embeds(r, from))
+		if how != nil {
+			for _, dep := range deps.Generic {
+				if _, ok := how[dep]; !ok {
+					how[dep] = viaExtraDeps
+				}
+			}
+		}
 	}
 	if !deps.IsEmpty() {
+		if gc.checkDepCycles {
+			checkDepCycles(ix, deps, from, gl.Embeds(r, from))
+		}
 		r.SetAttr("deps", deps)
+		// Platform labels set during generation also apply to dependencies.
+		if labels, ok := r.PrivateAttr(rule.PlatformLabelsKey).(map[string]string); ok {
+			r.SetPlatformLabels(labels)
+		}
+		if how != nil {
+			rule.AnnotateExprStrings(r.Attr("deps"), how)
+		}
 	}
 }
 
+// addExtraDeps returns deps with the labels in extraDeps added, relative to
+// from. Extra deps are inherited by subdirectories, so labels of from and
+// of rules it embeds are skipped; a rule doesn't depend on itself. The
+// result is sorted and doesn't contain duplicates.
+func addExtraDeps(deps, extraDeps []string, from label.Label, embeds []label.Label) []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(s string) {
+		if l, err := label.Parse(s); err == nil {
+			s = l.Abs(from.Repo, from.Pkg).Rel(from.Repo, from.Pkg).String()
+		}
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	for _, dep := range deps {
+		add(dep)
+	}
+	for _, dep := range extraDeps {
+		if l, err := label.Parse(dep); err == nil && isSelfOrEmbed(l.Abs(from.Repo, from.Pkg), from, embeds) {
+			continue
+		}
+		add(dep)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// isSelfOrEmbed returns whether l is from or one of the labels in embeds.
+func isSelfOrEmbed(l, from label.Label, embeds []label.Label) bool {
+	if l.Equal(from) {
+		return true
+	}
+	for _, e := range embeds {
+		if l.Equal(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDepCycles logs a diagnostic for each dependency in deps that leads
+// back to from (or to a rule embedded by from) through dependencies of
+// indexed rules in the repository. Bazel rejects such cycles, but its errors
+// don't explain which imports are responsible.
+func checkDepCycles(ix *resolve.RuleIndex, deps rule.PlatformStrings, from label.Label, embeds []label.Label) {
+	targets := append([]label.Label{from}, embeds...)
+	for _, s := range deps.Flat() {
+		l, err := label.Parse(s)
+		if err != nil {
+			continue
+		}
+		l = l.Abs(from.Repo, from.Pkg)
+		cycle := ix.FindDepCycle(l, targets)
+		if cycle == nil {
+			continue
+		}
+		names := make([]string, 0, len(cycle)+1)
+		names = append(names, from.String())
+		for _, c := range cycle {
+			names = append(names, c.String())
+		}
+		if last := cycle[len(cycle)-1]; !last.Equal(from) {
+			names[len(names)-1] += fmt.Sprintf(" (embedded by %s)", from)
+		}
+		ix.Log(config.Diagnostic{
+			Severity: config.Warning,
+			From:     from,
+			Message:  fmt.Sprintf("%s: dependency on %s creates an import cycle: %s", from, l, strings.Join(names, " -> ")),
+		})
+	}
+}
+
+// Descriptions of how imports are resolved, written in comments on
+// dependencies with -annotate_deps.
+const (
+	viaIndex       = "index"
+	viaImportIndex = "import index"
+	viaWellKnown   = "well-known types"
+	viaReplace     = "module replacement"
+	viaPrefix      = "prefix"
+	viaPrefixMap   = "go_prefix_map directive"
+	viaDefaultRepo = "go_repository_default_repo directive"
+	viaRemote      = "remote cache"
+	viaVendor      = "vendor fallback"
+	viaProtoPath   = "proto import path"
+	viaKnownProto  = "proto_known directive"
+	viaExtraDeps   = "go_extra_deps directive"
+	viaLocalRepo   = "go_local_repository directive"
+	viaOverride    = "resolve directive"
+)
+
 var (
-	skipImportError = errors.New("std or self import")
+	// skipImportError is returned for imports that don't need a dependency,
+	// like standard and self imports, and for imports deliberately left
+	// unresolved, like ignored imports and guesses in packages with dynamic
+	// targets. Any diagnostic is logged before it's returned.
+	skipImportError = errors.New("import skipped")
 	notFoundError   = errors.New("rule not found")
 )
 
-func resolveGo(gc *goConfig, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, imp string, from label.Label) (label.Label, error) {
+func resolveGo(c *config.Config, gc *goConfig, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, imp string, from label.Label) (label.Label, string, error) {
+	imp = pathtools.CleanImport(imp)
+	// Relative imports are interpreted from the package of the importing
+	// rule, whatever its kind and whatever it embeds.
 	if build.IsLocalImport(imp) {
 		cleanRel := path.Clean(path.Join(from.Pkg, imp))
 		if build.IsLocalImport(cleanRel) {
-			return label.NoLabel, fmt.Errorf("relative import path %q from %q points outside of repository", imp, from.Pkg)
+			return label.NoLabel, "", fmt.Errorf("relative import path %q from %q points outside of repository", imp, from.Pkg)
 		}
-		imp = path.Join(gc.prefix, cleanRel)
+		imp = inferImportPath(gc, cleanRel)
 	}
 
-	if isStandard(imp) {
-		return label.NoLabel, skipImportError
+	// Ignored imports are skipped even if they match a resolve directive.
+	// A rule doesn't depend on itself when it's the target of a wildcard
+	// directive, for example, a catch-all rule for a subtree.
+	if isIgnoredImport(r, imp) {
+		return label.NoLabel, "", skipImportError
+	}
+
+	if l, ok := gc.findResolveOverride(imp); ok {
+		if l.Equal(from) {
+			return label.NoLabel, "", skipImportError
+		}
+		return l, viaOverride, nil
+	}
+
+	if gc.isStandard(imp) {
+		return label.NoLabel, "", skipImportError
 	}
 
 	if l := resolveWellKnownGo(imp); !l.Equal(label.NoLabel) {
-		return l, nil
+		return l, viaWellKnown, nil
 	}
 
-	if l, err := resolveWithIndexGo(ix, imp, from); err == nil || err == skipImportError {
-		return l, err
-	} else if err != notFoundError {
-		return label.NoLabel, err
+	// Rules in other modules in the repository are ignored, since they're
+	// provided by those modules' external repositories.
+	if l, err := resolveWithIndexGo(gc, ix, imp, from); err == skipImportError || err == nil && gc.sameModule(l.Pkg, from.Pkg) {
+		return l, viaIndex, err
+	} else if err != nil && err != notFoundError {
+		return label.NoLabel, "", err
 	}
 
-	if pathtools.HasPrefix(imp, gc.prefix) {
+	if l, ok := gc.importIndex[imp]; ok {
+		return l, viaImportIndex, nil
+	}
+
+	if r, ok := findModReplace(gc.moduleReplaces, imp); ok {
+		if r.isLocal() {
+			l, err := resolveLocalReplace(c, gc, ix, r, imp, from)
+			return l, viaReplace, err
+		}
+		if gc.depMode == externalMode {
+			// The package is provided by the repository for the replacement
+			// module. Vendored packages keep their original paths.
+			l, err := resolveExternalModule(rc, r.newPath, replacedImportPath(r, imp))
+			return l, viaReplace, err
+		}
+	}
+
+	if lr, ok := gc.findLocalRepo(imp); ok {
+		return lr.libLabel(c, imp), viaLocalRepo, nil
+	}
+
+	if pkg, ok := gc.mapPrefix(imp); ok {
+		return checkGuess(ix, libLabel(c, pkg), viaPrefixMap, imp, from)
+	}
+
+	if pathtools.HasPrefix(imp, gc.prefix) && gc.importInModule(imp, from.Pkg) {
 		pkg := path.Join(gc.prefixRel, pathtools.TrimPrefix(imp, gc.prefix))
-		return label.New("", pkg, config.DefaultLibName), nil
+		return checkGuess(ix, libLabel(c, pkg), viaPrefix, imp, from)
 	}
 
 	if gc.depMode == externalMode {
-		return resolveExternal(rc, imp)
+		if gc.importIndexStrict {
+			return label.NoLabel, "", fmt.Errorf("import %q is not in the import index %s", imp, gc.importIndexPath)
+		}
+		if gc.defaultRepo != "" {
+			return resolveDefaultRepo(gc, rc, imp), viaDefaultRepo, nil
+		}
+		l, err := resolveExternal(ix, rc, imp, from)
+		return l, viaRemote, err
+	} else if !gc.vendorFallback {
+		return label.NoLabel, "", fmt.Errorf("no rule provides import %q, and the vendor fallback is disabled", imp)
 	} else {
-		return resolveVendored(rc, imp)
+		l, err := resolveVendored(c, gc, ix, imp)
+		if err != nil {
+			return label.NoLabel, "", err
+		}
+		return checkGuess(ix, l, viaVendor, imp, from)
+	}
+}
+
+// checkGuess returns l, a label guessed for imp since no indexed rule
+// provides it, and via. If l is in a package with targets that can't be
+// indexed, like those declared by list comprehensions, the guess may be
+// wrong. In that case, a warning is logged, and imp is left unresolved.
+func checkGuess(ix *resolve.RuleIndex, l label.Label, via, imp string, from label.Label) (label.Label, string, error) {
+	if l.Repo == "" && ix.HasDynamicTargets(l.Pkg) {
+		ix.Log(config.Diagnostic{
+			Severity: config.Warning,
+			From:     from,
+			Imp:      imp,
+			Message:  fmt.Sprintf("import %q is not provided by an indexed rule; it may be provided by a target generated in //%s, so it's left unresolved", imp, l.Pkg),
+		})
+		return label.NoLabel, "", skipImportError
+	}
+	return l, via, nil
+}
+
+// resolveLocalReplace resolves imp, which is provided by a module replaced
+// with a directory in the repository. If a library in that directory is
+// indexed, its label is returned. Otherwise, a label is guessed from the
+// directory and checked with checkGuess.
+func resolveLocalReplace(c *config.Config, gc *goConfig, ix *resolve.RuleIndex, r moduleReplace, imp string, from label.Label) (label.Label, error) {
+	rel := replacedImportPath(r, imp)
+	if rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+		return label.NoLabel, fmt.Errorf("import %q is replaced with %q, which is outside the repository", imp, r.newPath)
+	}
+	if rel == "." {
+		rel = ""
+	}
+	if gc.prefix != "" && pathtools.HasPrefix(rel, gc.prefixRel) {
+		localImp := path.Join(gc.prefix, pathtools.TrimPrefix(rel, gc.prefixRel))
+		if l, err := resolveWithIndexGo(gc, ix, localImp, from); err == nil || err == skipImportError {
+			return l, err
+		} else if err != notFoundError {
+			return label.NoLabel, err
+		}
+	}
+	l, _, err := checkGuess(ix, libLabel(c, rel), viaReplace, imp, from)
+	return l, err
+}
+
+// findLocalRepo returns the repository declared with
+// # gazelle:go_local_repository whose prefix is the longest prefix of imp.
+// false is returned if no prefix matches, or if imp is under gc.prefix and
+// no matching prefix is more specific.
+func (gc *goConfig) findLocalRepo(imp string) (*localRepo, bool) {
+	bestLen := -1
+	if gc.prefix != "" && pathtools.HasPrefix(imp, gc.prefix) {
+		bestLen = len(gc.prefix)
+	}
+	var best *localRepo
+	for _, lr := range gc.localRepos {
+		if len(lr.prefix) > bestLen && pathtools.HasPrefix(imp, lr.prefix) {
+			best = lr
+			bestLen = len(lr.prefix)
+		}
 	}
+	return best, best != nil
 }
 
-// isStandard returns whether a package is in the standard library.
-func isStandard(imp string) bool {
-	return stdPackages[imp]
+// libLabel returns the label of the library imported with imp in the
+// repository lr. If lr's directory is known and the build file of the
+// package there has a library with the importpath imp, that library's name
+// is used. Otherwise, the name is guessed like libLabel does.
+func (lr *localRepo) libLabel(c *config.Config, imp string) label.Label {
+	rel := pathtools.TrimPrefix(imp, lr.prefix)
+	name := c.RuleName("go_library", rel, config.DefaultLibName)
+	if lr.dir != "" {
+		lr.mu.Lock()
+		if lr.libNames == nil {
+			lr.libNames = make(map[string]string)
+		}
+		n, ok := lr.libNames[imp]
+		if !ok {
+			n = findLibName(c, filepath.Join(lr.dir, filepath.FromSlash(rel)), imp)
+			lr.libNames[imp] = n
+		}
+		lr.mu.Unlock()
+		if n != "" {
+			name = n
+		}
+	}
+	return label.New(lr.name, rel, name)
+}
+
+// findLibName returns the name of a library with the importpath imp in the
+// build file in dir. "" is returned if there's no such library or if the
+// build file can't be read.
+func findLibName(c *config.Config, dir, imp string) string {
+	for _, base := range c.ValidBuildFileNames {
+		f, err := rule.LoadFile(filepath.Join(dir, base))
+		if err != nil {
+			continue
+		}
+		for _, r := range f.Rules {
+			if isGoLibrary(r.Kind()) && r.AttrString("importpath") == imp {
+				return r.Name()
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// libLabel returns the label of the library in the package rel of the main
+// repository. It's used for libraries that aren't in the index, so the name
+// is guessed: it's the default name, as changed by c.RuleNamer.
+func libLabel(c *config.Config, rel string) label.Label {
+	return label.New("", rel, c.RuleName("go_library", rel, config.DefaultLibName))
 }
 
 func resolveWellKnownGo(imp string) label.Label {
@@ -176,8 +525,8 @@ func resolveWellKnownGo(imp string) label.Label {
 	return label.NoLabel
 }
 
-func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
-	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "go", Imp: imp}, "go")
+func resolveWithIndexGo(gc *goConfig, ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
+	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "go", Imp: imp}, "go", from)
 	var bestMatch resolve.FindResult
 	var bestMatchIsVendored bool
 	var bestMatchVendorRoot string
@@ -188,19 +537,8 @@ func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (la
 		// is only visible in the parent tree. Vendored libraries supercede
 		// non-vendored libraries, and libraries closer to from.Pkg supercede
 		// those further up the tree.
-		isVendored := false
-		vendorRoot := ""
-		parts := strings.Split(m.Label.Pkg, "/")
-		for i := len(parts) - 1; i >= 0; i-- {
-			if parts[i] == "vendor" {
-				isVendored = true
-				vendorRoot = strings.Join(parts[:i], "/")
-				break
-			}
-		}
-		if isVendored {
-		}
-		if isVendored && !label.New(m.Label.Repo, vendorRoot, "").Contains(from) {
+		vendorRoot, isVendored := findVendorRoot(gc, m.Label.Pkg)
+		if isVendored && (m.Label.Repo != from.Repo || !pathtools.Contains(vendorRoot, from.Pkg)) {
 			// vendor directory not visible
 			continue
 		}
@@ -214,7 +552,7 @@ func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (la
 			// Current match is worse
 		} else {
 			// Match is ambiguous
-			matchError = fmt.Errorf("multiple rules (%s and %s) may be imported with %q from %s", bestMatch.Label, m.Label, imp, from)
+			matchError = &resolve.AmbiguousImportError{Imp: imp, From: from, Label: bestMatch.Label, Other: m.Label}
 		}
 	}
 	if matchError != nil {
@@ -226,55 +564,196 @@ func resolveWithIndexGo(ix *resolve.RuleIndex, imp string, from label.Label) (la
 	if bestMatch.Label.Equal(from) {
 		return label.NoLabel, skipImportError
 	}
+	if gc.preferAlias {
+		return preferredAlias(ix, bestMatch, imp, from), nil
+	}
 	return bestMatch.Label, nil
 }
 
-func resolveExternal(rc *repos.RemoteCache, imp string) (label.Label, error) {
+// preferredAlias returns the label of the alias rule that points to m, if
+// there is exactly one. If there are several, the conventional one is used:
+// the alias in m's package that's named after the package's directory, like
+// //foo/bar:bar. If there are no aliases, or if the choice is still
+// ambiguous, m.Label is returned.
+func preferredAlias(ix *resolve.RuleIndex, m resolve.FindResult, imp string, from label.Label) label.Label {
+	switch len(m.Aliases) {
+	case 0:
+		return m.Label
+	case 1:
+		return m.Aliases[0]
+	default:
+		for _, a := range m.Aliases {
+			if a.Repo == m.Label.Repo && a.Pkg == m.Label.Pkg && a.Pkg != "" && a.Name == path.Base(a.Pkg) {
+				return a
+			}
+		}
+		ix.Log(config.Diagnostic{
+			Severity: config.Warning,
+			From:     from,
+			Imp:      imp,
+			Message:  fmt.Sprintf("multiple aliases (%s and %s) of %s may be imported with %q from %s; using %s", m.Aliases[0], m.Aliases[1], m.Label, imp, from, m.Label),
+		})
+		return m.Label
+	}
+}
+
+// findVendorRoot returns the directory containing the innermost vendor
+// directory that pkg is in. Directories named "vendor" are vendor directories
+// of their parents, as they are for "go build". The directory set with
+// # gazelle:go_vendor_dir is a vendor directory of the whole repository. The
+// second result is false if pkg is not in a vendor directory.
+func findVendorRoot(gc *goConfig, pkg string) (string, bool) {
+	parts := strings.Split(pkg, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.Join(parts[:i+1], "/") == gc.vendorDir {
+			return "", true
+		}
+		if parts[i] == "vendor" {
+			return strings.Join(parts[:i], "/"), true
+		}
+	}
+	return "", false
+}
+
+// resolveExternal resolves imp to a library in the repository whose root
+// is found with rc. If finding the root times out, imp is assumed to be the
+// root of its own repository, and a warning is logged.
+func resolveExternal(ix *resolve.RuleIndex, rc *repos.RemoteCache, imp string, from label.Label) (label.Label, error) {
 	prefix, repo, err := rc.Root(imp)
+	if repos.IsTimeout(err) {
+		ix.Log(config.Diagnostic{
+			Severity: config.Warning,
+			From:     from,
+			Imp:      imp,
+			Message:  fmt.Sprintf("%v; guessing that %q is the root of its repository", err, imp),
+		})
+		return externalLabel(rc, imp, rc.ModuleRepoName(imp), imp), nil
+	}
 	if err != nil {
 		return label.NoLabel, err
 	}
+	return externalLabel(rc, prefix, repo, imp), nil
+}
+
+// resolveDefaultRepo resolves imp to a library in a known repository if
+// there is one. Otherwise, imp is resolved to a package in the repository
+// set with # gazelle:go_repository_default_repo named after imp.
+func resolveDefaultRepo(gc *goConfig, rc *repos.RemoteCache, imp string) label.Label {
+	if prefix, repo, ok := rc.KnownRoot(imp); ok {
+		return externalLabel(rc, prefix, repo, imp)
+	}
+	switch gc.defaultRepoNaming {
+	case "import", "import_alias":
+		return label.New(gc.defaultRepo, imp, importPathBase(imp))
+	default:
+		return label.New(gc.defaultRepo, imp, config.DefaultLibName)
+	}
+}
+
+// resolveExternalModule is like resolveExternal, but imp is known to be
+// provided by the module modPath, so the repository root isn't looked up.
+func resolveExternalModule(rc *repos.RemoteCache, modPath, imp string) (label.Label, error) {
+	return externalLabel(rc, modPath, rc.ModuleRepoName(modPath), imp), nil
+}
 
+// externalLabel returns the label of the library with import path imp in
+// the external repository repo, which has the root import path prefix.
+func externalLabel(rc *repos.RemoteCache, prefix, repo, imp string) label.Label {
 	var pkg string
 	if imp != prefix {
 		pkg = pathtools.TrimPrefix(imp, prefix)
 	}
 
-	return label.New(repo, pkg, config.DefaultLibName), nil
+	switch rc.BuildNamingConvention(prefix) {
+	case "import", "import_alias":
+		return label.New(repo, pkg, importPathBase(imp))
+	default:
+		return label.New(repo, pkg, config.DefaultLibName)
+	}
 }
 
-func resolveVendored(rc *repos.RemoteCache, imp string) (label.Label, error) {
-	return label.New("", path.Join("vendor", imp), config.DefaultLibName), nil
+// importPathBase returns the last element of imp, skipping a trailing
+// major version suffix like "/v2", as "go build" does when naming packages.
+func importPathBase(imp string) string {
+	if dir, base := path.Split(imp); dir != "" && isMajorVersionSuffix(base) {
+		return path.Base(dir)
+	}
+	return path.Base(imp)
 }
 
-func resolveProto(gc *goConfig, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, imp string, from label.Label) (label.Label, error) {
+// isMajorVersionSuffix returns whether s is a path element like "v2" that
+// names a major version of a module.
+func isMajorVersionSuffix(s string) bool {
+	if len(s) < 2 || s[0] != 'v' || s[1] < '1' || s[1] > '9' {
+		return false
+	}
+	for _, c := range s[2:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != "v1"
+}
+
+// resolveVendored returns the label of the library for imp in the vendor
+// directory. The library wasn't found by its import path, but if there's
+// exactly one indexed library in its directory (for example, one without an
+// importpath attribute), that library is used. Otherwise, a library with the
+// default name is assumed to exist.
+func resolveVendored(c *config.Config, gc *goConfig, ix *resolve.RuleIndex, imp string) (label.Label, error) {
+	pkg := path.Join(gc.vendorDir, imp)
+	if matches := ix.FindRulesByPackage(pkg, "go"); len(matches) == 1 {
+		return matches[0].Label, nil
+	}
+	return libLabel(c, pkg), nil
+}
+
+func resolveProto(c *config.Config, gc *goConfig, pc *proto.ProtoConfig, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, imp string, from label.Label) (label.Label, string, error) {
+	imp = pathtools.CleanImport(imp)
 	if !strings.HasSuffix(imp, ".proto") {
-		return label.NoLabel, fmt.Errorf("can't import non-proto: %q", imp)
+		return label.NoLabel, "", fmt.Errorf("can't import non-proto: %q", imp)
+	}
+	imp, err := pc.RelativeImport(imp, from.Pkg)
+	if err != nil {
+		return label.NoLabel, "", err
 	}
 	stem := imp[:len(imp)-len(".proto")]
 
 	if isWellKnownProto(stem) {
-		return label.NoLabel, skipImportError
+		return label.NoLabel, "", skipImportError
 	}
 
-	if l, err := resolveWithIndexProto(ix, imp, from); err == nil || err == skipImportError {
-		return l, err
+	// Protos declared with # gazelle:proto_known are provided by external
+	// repositories. Their go_proto_library rules are named like the ones
+	// Gazelle generates, after the proto_library rules.
+	if l, ok := pc.ResolveKnownProto(imp); ok && pc.Mode != proto.LegacyMode {
+		return label.New(l.Repo, l.Pkg, gc.goProtoLibraryName(l.Name, false)), viaKnownProto, nil
+	}
+
+	if l, err := resolveWithIndexProto(gc, pc, ix, imp, from); err == nil || err == skipImportError {
+		return l, viaIndex, err
 	} else if err != notFoundError {
-		return label.NoLabel, err
+		return label.NoLabel, "", err
+	}
+
+	if l, ok := gc.importIndex[imp]; ok {
+		return l, viaImportIndex, nil
 	}
 
 	// As a fallback, guess the label based on the proto file name. We assume
 	// all proto files in a directory belong to the same package, and the
 	// package name matches the directory base name. We also assume that protos
-	// in the vendor directory must refer to something else in vendor.
-	rel := path.Dir(imp)
-	if rel == "." {
-		rel = ""
+	// in the vendor directory must refer to something else there. In legacy
+	// mode, there are no go_proto_library rules, so the filegroup of .proto
+	// files is used instead.
+	rel := pc.ImportDir(imp)
+	if pathtools.HasPrefix(from.Pkg, gc.vendorDir) {
+		rel = path.Join(gc.vendorDir, rel)
 	}
-	if from.Pkg == "vendor" || strings.HasPrefix(from.Pkg, "vendor/") {
-		rel = path.Join("vendor", rel)
+	if pc.Mode == proto.LegacyMode {
+		return checkGuess(ix, label.New("", rel, legacyProtoFilegroupName), viaProtoPath, imp, from)
 	}
-	return label.New("", rel, config.DefaultLibName), nil
+	return checkGuess(ix, libLabel(c, rel), viaProtoPath, imp, from)
 }
 
 // wellKnownProtos is the set of proto sets for which we don't need to add
@@ -300,24 +779,50 @@ func isWellKnownProto(stem string) bool {
 	return wellKnownProtos[stem]
 }
 
-func resolveWithIndexProto(ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
-	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "proto", Imp: imp}, "go")
-	if len(matches) == 0 {
-		return label.NoLabel, notFoundError
+// resolveWithIndexProto finds the rule that provides the .proto file imp.
+// In legacy mode, that's the filegroup of .proto files that contains it.
+func resolveWithIndexProto(gc *goConfig, pc *proto.ProtoConfig, ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
+	resolveWithIndex := proto.ResolveWithIndex
+	if pc.Mode == proto.LegacyMode {
+		resolveWithIndex = proto.ResolveLegacyWithIndex
 	}
-	if len(matches) > 1 {
-		return label.NoLabel, fmt.Errorf("multiple rules (%s and %s) may be imported with %q from %s", matches[0].Label, matches[1].Label, imp, from)
+	match, err := resolveWithIndex(ix, imp, goName, from)
+	switch err {
+	case nil:
+	case proto.ErrNotFound:
+		return label.NoLabel, notFoundError
+	case proto.ErrSkipImport:
+		return label.NoLabel, skipImportError
+	default:
+		return label.NoLabel, err
 	}
 	// If some go_library embeds the go_proto_library we found, use that instead.
-	importpath := matches[0].Rule.AttrString("importpath")
-	if l, err := resolveWithIndexGo(ix, importpath, from); err == nil {
-		return l, nil
+	if importpath := match.Rule.AttrString("importpath"); importpath != "" {
+		if l, err := resolveWithIndexGo(gc, ix, importpath, from); err == nil {
+			return l, nil
+		}
+	}
+	return match.Label, nil
+}
+
+// isIgnoredImport returns whether imp matches a pattern listed with
+// # gazelle:go_ignore_import in the directory where r was generated.
+func isIgnoredImport(r *rule.Rule, imp string) bool {
+	ignoredImports, _ := r.PrivateAttr(ignoredImportsKey).([]string)
+	for _, ignored := range ignoredImports {
+		if prefix := strings.TrimSuffix(ignored, "/..."); prefix != ignored {
+			if pathtools.HasPrefix(imp, prefix) {
+				return true
+			}
+		} else if imp == ignored {
+			return true
+		}
 	}
-	return matches[0].Label, nil
+	return false
 }
 
 func isGoLibrary(kind string) bool {
-	return kind == "go_library" || isGoProtoLibrary(kind)
+	return kind == "go_library" || kind == gatewayKind || isGoProtoLibrary(kind)
 }
 
 func isGoProtoLibrary(kind string) bool {
@@ -16,13 +16,22 @@ limitations under the License.
 package golang
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/language/proto"
 	"github.com/bazelbuild/bazel-gazelle/internal/repos"
 	"github.com/bazelbuild/bazel-gazelle/internal/resolve"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
@@ -125,6 +134,129 @@ go_binary(
     name = "bin",
     deps = ["//a:a_lib"],
 )
+`,
+		}, {
+			desc: "nested_importpath",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+go_library(
+    name = "foo_lib",
+    importpath = "example.com/foo",
+)
+`,
+			}, {
+				rel: "foo/bar",
+				content: `
+go_library(
+    name = "bar_lib",
+    importpath = "example.com/foo/bar",
+)
+`,
+			}},
+			old: buildFile{
+				rel: "bin",
+				content: `
+go_binary(
+    name = "bin",
+    _imports = [
+        "example.com/foo",
+        "example.com/foo/bar",
+    ],
+)
+`,
+			},
+			want: `
+go_binary(
+    name = "bin",
+    deps = [
+        "//foo:foo_lib",
+        "//foo/bar:bar_lib",
+    ],
+)
+`,
+		}, {
+			desc: "unclean_import",
+			index: []buildFile{{
+				rel: "a",
+				content: `
+go_library(
+    name = "a_lib",
+    importpath = "example.com/a",
+)
+`,
+			}},
+			old: buildFile{
+				rel: "b",
+				content: `
+go_binary(
+    name = "trailing_slash",
+    _imports = ["example.com/a/"],
+)
+
+go_binary(
+    name = "dot",
+    _imports = ["example.com/./a"],
+)
+
+go_binary(
+    name = "dot_dot",
+    _imports = ["example.com/c/../a"],
+)
+`,
+			},
+			want: `
+go_binary(
+    name = "trailing_slash",
+    deps = ["//a:a_lib"],
+)
+
+go_binary(
+    name = "dot",
+    deps = ["//a:a_lib"],
+)
+
+go_binary(
+    name = "dot_dot",
+    deps = ["//a:a_lib"],
+)
+`,
+		}, {
+			desc: "importpath_aliases",
+			index: []buildFile{{
+				rel: "a",
+				content: `
+go_library(
+    name = "a_lib",
+    importpath = "example.com/a",
+    importpath_aliases = ["example.com/old/a"],
+)
+`,
+			}},
+			old: buildFile{
+				rel: "b",
+				content: `
+go_binary(
+    name = "canonical",
+    _imports = ["example.com/a"],
+)
+
+go_binary(
+    name = "alias",
+    _imports = ["example.com/old/a"],
+)
+`,
+			},
+			want: `
+go_binary(
+    name = "canonical",
+    deps = ["//a:a_lib"],
+)
+
+go_binary(
+    name = "alias",
+    deps = ["//a:a_lib"],
+)
 `,
 		}, {
 			desc: "multiple_rules_ambiguous",
@@ -368,6 +500,77 @@ go_library(
     name = "d",
     deps = [":b"],
 )
+`,
+		}, {
+			desc: "transitive_embed",
+			index: []buildFile{{
+				rel: "c",
+				content: `
+go_library(
+    name = "c",
+    importpath = "example.com/c",
+)
+`,
+			}, {
+				rel: "b",
+				content: `
+go_library(
+    name = "b",
+    embed = ["//c"],
+)
+`,
+			}, {
+				rel: "a",
+				content: `
+go_library(
+    name = "a",
+    embed = ["//b"],
+)
+`,
+			}},
+			old: buildFile{content: `
+go_binary(
+    name = "bin",
+    _imports = ["example.com/c"],
+)
+`},
+			want: `
+go_binary(
+    name = "bin",
+    deps = ["//a"],
+)
+`,
+		}, {
+			desc: "embed_cycle",
+			index: []buildFile{{
+				rel: "a",
+				content: `
+go_library(
+    name = "a",
+    embed = ["//b"],
+    importpath = "example.com/a",
+)
+`,
+			}, {
+				rel: "b",
+				content: `
+go_library(
+    name = "b",
+    embed = ["//a"],
+)
+`,
+			}},
+			old: buildFile{content: `
+go_binary(
+    name = "bin",
+    _imports = ["example.com/a"],
+)
+`},
+			want: `
+go_binary(
+    name = "bin",
+    deps = ["//a"],
+)
 `,
 		}, {
 			desc: "local_unknown",
@@ -413,6 +616,59 @@ go_binary(
         "//c:go_default_library",
     ],
 )
+`,
+		}, {
+			desc: "local_relative_test",
+			old: buildFile{
+				rel: "a",
+				content: `
+go_test(
+    name = "go_default_test",
+    _imports = [
+        ".",
+        "./b",
+        "../c",
+    ],
+)
+`,
+			},
+			want: `
+go_test(
+    name = "go_default_test",
+    deps = [
+        ":go_default_library",
+        "//a/b:go_default_library",
+        "//c:go_default_library",
+    ],
+)
+`,
+		}, {
+			// Relative imports are resolved from the package of the test, not
+			// the library it embeds. The embedded library itself is omitted.
+			desc: "local_relative_test_embed",
+			old: buildFile{
+				rel: "a",
+				content: `
+go_test(
+    name = "go_default_test",
+    embed = [":go_default_library"],
+    _imports = [
+        ".",
+        "./b",
+        "../c",
+    ],
+)
+`,
+			},
+			want: `
+go_test(
+    name = "go_default_test",
+    embed = [":go_default_library"],
+    deps = [
+        "//a/b:go_default_library",
+        "//c:go_default_library",
+    ],
+)
 `,
 		}, {
 			desc: "vendor_no_index",
@@ -427,6 +683,29 @@ go_binary(
     name = "bin",
     deps = ["//vendor/example.com/outside/prefix:go_default_library"],
 )
+`,
+		}, {
+			desc: "vendor_no_importpath",
+			index: []buildFile{{
+				rel: "vendor/example.com/outside/prefix",
+				content: `
+go_library(
+    name = "custom_lib",
+    srcs = ["prefix.go"],
+)
+`,
+			}},
+			old: buildFile{content: `
+go_binary(
+    name = "bin",
+    _imports = ["example.com/outside/prefix"],
+)
+`},
+			want: `
+go_binary(
+    name = "bin",
+    deps = ["//vendor/example.com/outside/prefix:custom_lib"],
+)
 `,
 		}, {
 			desc: "test_and_library_not_indexed",
@@ -491,50 +770,252 @@ go_proto_library(
 )
 `,
 		}, {
-			desc: "proto_embed",
-			old: buildFile{content: `
+			desc: "proto_index_separate_dir",
+			index: []buildFile{{
+				rel: "protos/sub",
+				content: `
 proto_library(
     name = "foo_proto",
-    srcs = ["foo.proto"],
+    srcs = ["bar.proto"],
 )
-
+`,
+			}, {
+				rel: "gen/sub",
+				content: `
 go_proto_library(
     name = "foo_go_proto",
-    importpath = "example.com/repo/foo",
-    proto = ":foo_proto",
-)
-
-go_library(
-    name = "foo_embedder",
-    embed = [":foo_go_proto"],
+    importpath = "example.com/gen/sub",
+    proto = "//protos/sub:foo_proto",
 )
-
-proto_library(
-    name = "bar_proto",
-    srcs = ["bar.proto"],
-    _imports = ["foo.proto"],
+`,
+			}},
+			old: buildFile{content: `
+go_proto_library(
+    name = "dep_proto",
+    _imports = ["protos/sub/bar.proto"],
 )
 
-go_proto_library(
-    name = "bar_go_proto",
-    proto = ":bar_proto",
-    _imports = ["foo.proto"],
+go_library(
+    name = "dep",
+    _imports = ["example.com/gen/sub"],
 )
 `},
 			want: `
-proto_library(
-    name = "foo_proto",
-    srcs = ["foo.proto"],
-)
-
 go_proto_library(
-    name = "foo_go_proto",
-    importpath = "example.com/repo/foo",
-    proto = ":foo_proto",
+    name = "dep_proto",
+    deps = ["//gen/sub:foo_go_proto"],
 )
 
 go_library(
-    name = "foo_embedder",
+    name = "dep",
+    deps = ["//gen/sub:foo_go_proto"],
+)
+`,
+		}, {
+			desc: "proto_index_separate_dir_embed",
+			index: []buildFile{{
+				rel: "protos/sub",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["bar.proto"],
+)
+`,
+			}, {
+				rel: "gen/sub",
+				content: `
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/gen/sub",
+    proto = "//protos/sub:foo_proto",
+)
+
+go_library(
+    name = "sub",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/gen/sub",
+)
+`,
+			}},
+			old: buildFile{content: `
+go_proto_library(
+    name = "dep_proto",
+    _imports = ["protos/sub/bar.proto"],
+)
+
+go_library(
+    name = "dep",
+    _imports = ["example.com/gen/sub"],
+)
+`},
+			want: `
+go_proto_library(
+    name = "dep_proto",
+    deps = ["//gen/sub"],
+)
+
+go_library(
+    name = "dep",
+    deps = ["//gen/sub"],
+)
+`,
+		}, {
+			desc: "proto_index_cross_dir_embed",
+			index: []buildFile{{
+				rel: "b",
+				content: `
+proto_library(
+    name = "b_proto",
+    srcs = ["b.proto"],
+)
+
+go_proto_library(
+    name = "b_go_proto",
+    importpath = "example.com/a",
+    proto = ":b_proto",
+)
+`,
+			}, {
+				rel: "a",
+				content: `
+go_library(
+    name = "a",
+    srcs = ["extra.go"],
+    embed = ["//b:b_go_proto"],
+    importpath = "example.com/a",
+)
+`,
+			}},
+			old: buildFile{content: `
+go_proto_library(
+    name = "dep_proto",
+    _imports = ["b/b.proto"],
+)
+
+go_library(
+    name = "dep",
+    _imports = ["example.com/a"],
+)
+`},
+			want: `
+go_proto_library(
+    name = "dep_proto",
+    deps = ["//a"],
+)
+
+go_library(
+    name = "dep",
+    deps = ["//a"],
+)
+`,
+		}, {
+			desc: "proto_index_cross_dir_embed_chain",
+			index: []buildFile{{
+				rel: "b",
+				content: `
+proto_library(
+    name = "b_proto",
+    srcs = ["b.proto"],
+)
+
+go_proto_library(
+    name = "b_go_proto",
+    importpath = "example.com/c",
+    proto = ":b_proto",
+)
+
+go_library(
+    name = "go_default_library",
+    embed = [":b_go_proto"],
+    importpath = "example.com/c",
+)
+`,
+			}, {
+				rel: "a",
+				content: `
+go_library(
+    name = "a",
+    embed = ["//b:go_default_library"],
+    importpath = "example.com/c",
+)
+`,
+			}, {
+				rel: "c",
+				content: `
+go_library(
+    name = "c",
+    embed = ["//a"],
+    importpath = "example.com/c",
+)
+`,
+			}},
+			old: buildFile{content: `
+go_proto_library(
+    name = "dep_proto",
+    _imports = ["b/b.proto"],
+)
+
+go_library(
+    name = "dep",
+    _imports = ["example.com/c"],
+)
+`},
+			want: `
+go_proto_library(
+    name = "dep_proto",
+    deps = ["//c"],
+)
+
+go_library(
+    name = "dep",
+    deps = ["//c"],
+)
+`,
+		}, {
+			desc: "proto_embed",
+			old: buildFile{content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+)
+
+go_library(
+    name = "foo_embedder",
+    embed = [":foo_go_proto"],
+)
+
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    _imports = ["foo.proto"],
+)
+
+go_proto_library(
+    name = "bar_go_proto",
+    proto = ":bar_proto",
+    _imports = ["foo.proto"],
+)
+`},
+			want: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/foo",
+    proto = ":foo_proto",
+)
+
+go_library(
+    name = "foo_embedder",
     embed = [":foo_go_proto"],
 )
 
@@ -549,6 +1030,97 @@ go_proto_library(
     proto = ":bar_proto",
     deps = [":foo_embedder"],
 )
+`,
+		}, {
+			desc: "proto_embed_multi_hop",
+			index: []buildFile{{
+				rel: "protos/foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}, {
+				rel: "gen/foo",
+				content: `
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/gen/foo",
+    proto = "//protos/foo:foo_proto",
+)
+
+go_library(
+    name = "foo_inner",
+    embed = [":foo_go_proto"],
+    importpath = "example.com/gen/foo",
+)
+
+go_library(
+    name = "foo",
+    embed = [":foo_inner"],
+    importpath = "example.com/gen/foo",
+)
+`,
+			}},
+			old: buildFile{content: `
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    _imports = ["protos/foo/foo.proto"],
+)
+
+go_proto_library(
+    name = "bar_go_proto",
+    proto = ":bar_proto",
+    _imports = ["protos/foo/foo.proto"],
+)
+
+go_library(
+    name = "bar",
+    _imports = ["example.com/gen/foo"],
+)
+`},
+			want: `
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+    deps = ["//protos/foo:foo_proto"],
+)
+
+go_proto_library(
+    name = "bar_go_proto",
+    proto = ":bar_proto",
+    deps = ["//gen/foo"],
+)
+
+go_library(
+    name = "bar",
+    deps = ["//gen/foo"],
+)
+`,
+		}, {
+			desc: "proto_local_relative",
+			old: buildFile{
+				rel: "a",
+				content: `
+go_proto_library(
+    name = "a_go_proto",
+    _imports = [
+        "./a.proto",
+        "../b/b.proto",
+    ],
+)
+`,
+			},
+			want: `
+go_proto_library(
+    name = "a_go_proto",
+    deps = [
+        ":go_default_library",
+        "//b:go_default_library",
+    ],
+)
 `,
 		}, {
 			desc: "proto_wkt",
@@ -659,34 +1231,382 @@ go_library(
 	}
 }
 
-func TestResolveExternal(t *testing.T) {
-	c, _, langs := testConfig()
-	gc := getGoConfig(c)
-	gc.prefix = "example.com/local"
-	ix := resolve.NewRuleIndex(nil)
-	ix.Finish()
-	gl := langs[1].(*goLang)
-	for _, tc := range []struct {
-		desc, importpath string
-		repos            []repos.Repo
-		want             string
-	}{
-		{
-			desc:       "top",
-			importpath: "example.com/repo",
-			want:       "@com_example_repo//:go_default_library",
-		}, {
-			desc:       "sub",
-			importpath: "example.com/repo/lib",
-			want:       "@com_example_repo//lib:go_default_library",
-		}, {
-			desc: "custom_repo",
-			repos: []repos.Repo{{
-				Name:     "custom_repo_name",
-				GoPrefix: "example.com/repo",
-			}},
-			importpath: "example.com/repo/lib",
+func TestResolveAlias(t *testing.T) {
+	libContent := []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/resolve/lib",
+)
+
+go_library(
+    name = "ambiguous",
+    importpath = "example.com/repo/resolve/ambiguous",
+)
+
+go_library(
+    name = "hidden",
+    importpath = "example.com/repo/resolve/hidden",
+)
+`)
+	convContent := []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/resolve/conv",
+)
+
+alias(
+    name = "conv",
+    actual = ":go_default_library",
+    visibility = ["//visibility:public"],
+)
+`)
+	aliasContent := []byte(`
+alias(
+    name = "lib",
+    actual = "//lib:go_default_library",
+    visibility = ["//visibility:public"],
+)
+
+alias(
+    name = "lib_alias",
+    actual = ":lib",
+)
+
+alias(
+    name = "ambiguous_a",
+    actual = "//lib:ambiguous",
+)
+
+alias(
+    name = "ambiguous_b",
+    actual = "//lib:ambiguous",
+)
+
+alias(
+    name = "conv_other",
+    actual = "//conv:go_default_library",
+)
+
+alias(
+    name = "hidden",
+    actual = "//lib:hidden",
+)
+`)
+	for _, tc := range []struct {
+		desc, directive string
+		checkVisibility bool
+		want            []string
+	}{
+		{
+			desc: "default",
+			want: []string{"//lib:ambiguous", "//conv:go_default_library", "//lib:hidden", "//lib:go_default_library"},
+		}, {
+			desc:      "prefer_alias",
+			directive: "# gazelle:prefer_alias true",
+			want:      []string{"//lib:ambiguous", "//conv", "//lib:hidden", "//public:lib"},
+		}, {
+			desc:            "prefer_alias_check_visibility",
+			directive:       "# gazelle:prefer_alias true",
+			checkVisibility: true,
+			want:            []string{"//lib:ambiguous", "//conv", "//lib:hidden", "//public:lib"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			kindToResolver := make(map[string]resolve.Resolver)
+			for _, lang := range langs {
+				for kind := range lang.Kinds() {
+					kindToResolver[kind] = lang
+				}
+			}
+			ix := resolve.NewRuleIndex(kindToResolver)
+			ix.CheckVisibility = tc.checkVisibility
+			for _, bf := range []struct {
+				rel     string
+				content []byte
+			}{{"lib", libContent}, {"conv", convContent}, {"public", aliasContent}} {
+				f, err := rule.LoadData(filepath.Join(bf.rel, "BUILD.bazel"), bf.content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range f.Rules {
+					ix.AddRule(c, r, f)
+				}
+			}
+			ix.Finish()
+
+			f, err := rule.LoadData(filepath.Join("bin", "BUILD.bazel"), []byte(tc.directive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, lang := range langs {
+				lang.Configure(c, "bin", f)
+			}
+			getGoConfig(c).prefix = "example.com/repo/resolve"
+			r := rule.NewRule("go_binary", "bin")
+			imports := rule.PlatformStrings{Generic: []string{
+				"example.com/repo/resolve/ambiguous",
+				"example.com/repo/resolve/conv",
+				"example.com/repo/resolve/hidden",
+				"example.com/repo/resolve/lib",
+			}}
+			r.SetPrivateAttr(config.GazelleImportsKey, imports)
+			langs[1].Resolve(c, ix, testRemoteCache(nil), r, label.New("", "bin", "bin"))
+			if got := r.AttrStrings("deps"); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveVisibility(t *testing.T) {
+	files := []struct {
+		rel     string
+		content []byte
+	}{
+		{"a", []byte(`
+go_library(
+    name = "lib",
+    importpath = "example.com/repo/dup",
+    visibility = ["//b:__pkg__"],
+)
+`)},
+		{"c", []byte(`
+package(default_visibility = ["//c:__subpackages__"])
+
+go_library(
+    name = "lib",
+    importpath = "example.com/repo/dup",
+)
+`)},
+	}
+	for _, tc := range []struct {
+		desc, rel       string
+		checkVisibility bool
+		want            []string
+	}{
+		{
+			desc: "unchecked ambiguous",
+			rel:  "b",
+		}, {
+			desc:            "visible by pkg",
+			rel:             "b",
+			checkVisibility: true,
+			want:            []string{"//a:lib"},
+		}, {
+			desc:            "visible by default subpackages",
+			rel:             "c/sub",
+			checkVisibility: true,
+			want:            []string{"//c:lib"},
+		}, {
+			desc:            "none visible",
+			rel:             "d",
+			checkVisibility: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			kindToResolver := make(map[string]resolve.Resolver)
+			for _, lang := range langs {
+				for kind := range lang.Kinds() {
+					kindToResolver[kind] = lang
+				}
+			}
+			ix := resolve.NewRuleIndex(kindToResolver)
+			ix.CheckVisibility = tc.checkVisibility
+			for _, bf := range files {
+				f, err := rule.LoadData(filepath.Join(bf.rel, "BUILD.bazel"), bf.content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range f.Rules {
+					ix.AddRule(c, r, f)
+				}
+			}
+			ix.Finish()
+
+			r := rule.NewRule("go_binary", "bin")
+			imports := rule.PlatformStrings{Generic: []string{"example.com/repo/dup"}}
+			r.SetPrivateAttr(config.GazelleImportsKey, imports)
+			langs[1].Resolve(c, ix, testRemoteCache(nil), r, label.New("", tc.rel, "bin"))
+			if got := r.AttrStrings("deps"); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveDepCycle(t *testing.T) {
+	files := []struct {
+		rel     string
+		content []byte
+	}{
+		{"lib", []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)
+`)},
+		{"helper", []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/helper",
+    deps = ["//lib:go_default_library"],
+)
+`)},
+	}
+	for _, tc := range []struct {
+		desc, kind, rel, name, embed, wantLog string
+		check                                 bool
+	}{
+		{
+			desc:    "test embedding library",
+			kind:    "go_test",
+			rel:     "lib",
+			name:    "go_default_test",
+			embed:   ":go_default_library",
+			wantLog: "import cycle: //lib:go_default_test -> //helper:go_default_library -> //lib:go_default_library (embedded by //lib:go_default_test)",
+			check:   true,
+		}, {
+			desc:  "no cycle",
+			kind:  "go_binary",
+			rel:   "bin",
+			name:  "bin",
+			check: true,
+		}, {
+			desc:  "not checked",
+			kind:  "go_test",
+			rel:   "lib",
+			name:  "go_default_test",
+			embed: ":go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			gc := getGoConfig(c)
+			gc.prefix = "example.com/repo"
+			gc.checkDepCycles = tc.check
+			kindToResolver := make(map[string]resolve.Resolver)
+			for _, lang := range langs {
+				for kind := range lang.Kinds() {
+					kindToResolver[kind] = lang
+				}
+			}
+			ix := resolve.NewRuleIndex(kindToResolver)
+			for _, bf := range files {
+				f, err := rule.LoadData(filepath.Join(bf.rel, "BUILD.bazel"), bf.content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range f.Rules {
+					ix.AddRule(c, r, f)
+				}
+			}
+			ix.Finish()
+
+			r := rule.NewRule(tc.kind, tc.name)
+			if tc.embed != "" {
+				r.SetAttr("embed", []string{tc.embed})
+			}
+			imports := rule.PlatformStrings{Generic: []string{"example.com/repo/helper"}}
+			r.SetPrivateAttr(config.GazelleImportsKey, imports)
+
+			buf := &bytes.Buffer{}
+			log.SetOutput(buf)
+			defer log.SetOutput(os.Stderr)
+			langs[1].Resolve(c, ix, testRemoteCache(nil), r, label.New("", tc.rel, tc.name))
+
+			if got, want := r.AttrStrings("deps"), []string{"//helper:go_default_library"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got deps %#v; want %#v", got, want)
+			}
+			if tc.wantLog == "" {
+				if buf.Len() > 0 {
+					t.Errorf("got unexpected log output:\n%s", buf.String())
+				}
+			} else if !strings.Contains(buf.String(), tc.wantLog) {
+				t.Errorf("got log output:\n%s\nwant output containing %q", buf.String(), tc.wantLog)
+			}
+		})
+	}
+}
+
+func TestResolveExternal(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/local"
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+	for _, tc := range []struct {
+		desc, importpath string
+		repos            []repos.Repo
+		repoName         func(string) string
+		want             string
+	}{
+		{
+			desc:       "top",
+			importpath: "example.com/repo",
+			want:       "@com_example_repo//:go_default_library",
+		}, {
+			desc:       "sub",
+			importpath: "example.com/repo/lib",
+			want:       "@com_example_repo//lib:go_default_library",
+		}, {
+			desc:       "partial_prefix",
+			importpath: "example.com/localfoo",
+			want:       "@com_example//localfoo:go_default_library",
+		}, {
+			desc:       "partial_prefix_sub",
+			importpath: "example.com/localfoo/lib",
+			want:       "@com_example//localfoo/lib:go_default_library",
+		}, {
+			desc:       "parent_of_prefix",
+			importpath: "example.com",
+			want:       "@com_example//:go_default_library",
+		}, {
+			desc: "custom_repo",
+			repos: []repos.Repo{{
+				Name:     "custom_repo_name",
+				GoPrefix: "example.com/repo",
+			}},
+			importpath: "example.com/repo/lib",
 			want:       "@custom_repo_name//lib:go_default_library",
+		}, {
+			desc: "import_naming_convention",
+			repos: []repos.Repo{{
+				Name:                  "com_example_repo",
+				GoPrefix:              "example.com/repo",
+				BuildNamingConvention: "import",
+			}},
+			importpath: "example.com/repo/lib",
+			want:       "@com_example_repo//lib",
+		}, {
+			desc: "import_naming_convention_top",
+			repos: []repos.Repo{{
+				Name:                  "com_example_repo",
+				GoPrefix:              "example.com/repo",
+				BuildNamingConvention: "import_alias",
+			}},
+			importpath: "example.com/repo",
+			want:       "@com_example_repo//:repo",
+		}, {
+			desc: "import_naming_convention_major_version",
+			repos: []repos.Repo{{
+				Name:                  "com_example_repo_v2",
+				GoPrefix:              "example.com/repo/v2",
+				BuildNamingConvention: "import",
+			}},
+			importpath: "example.com/repo/v2",
+			want:       "@com_example_repo_v2//:repo",
+		}, {
+			desc: "go_default_library_naming_convention",
+			repos: []repos.Repo{{
+				Name:                  "com_example_repo",
+				GoPrefix:              "example.com/repo",
+				BuildNamingConvention: "go_default_library",
+			}},
+			importpath: "example.com/repo/lib",
+			want:       "@com_example_repo//lib:go_default_library",
 		}, {
 			desc:       "qualified",
 			importpath: "example.com/repo.git/lib",
@@ -695,10 +1615,31 @@ func TestResolveExternal(t *testing.T) {
 			desc:       "domain",
 			importpath: "example.com/lib",
 			want:       "@com_example//lib:go_default_library",
+		}, {
+			desc:       "vanity",
+			importpath: "vanity.example.org/quote/v3/sub/pkg",
+			want:       "@org_example_vanity_quote//v3/sub/pkg:go_default_library",
+		}, {
+			desc:       "custom_naming",
+			importpath: "example.com/repo/lib",
+			repoName:   func(root string) string { return "go_" + strings.Replace(root, "/", "_", -1) },
+			want:       "@go_example.com_repo//lib:go_default_library",
+		}, {
+			desc: "custom_naming_known_repo",
+			repos: []repos.Repo{{
+				Name:     "custom_repo_name",
+				GoPrefix: "example.com/repo",
+			}},
+			importpath: "example.com/repo/lib",
+			repoName:   func(root string) string { return "go_" + strings.Replace(root, "/", "_", -1) },
+			want:       "@custom_repo_name//lib:go_default_library",
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			rc := testRemoteCache(tc.repos)
+			if tc.repoName != nil {
+				rc.RepoName = tc.repoName
+			}
 			r := rule.NewRule("go_library", "x")
 			imports := rule.PlatformStrings{Generic: []string{tc.importpath}}
 			r.SetPrivateAttr(config.GazelleImportsKey, imports)
@@ -749,6 +1690,14 @@ func stubRepoRootForImportPath(importpath string, verbose bool) (*vcs.RepoRoot,
 		}, nil
 	}
 
+	if strings.HasPrefix(importpath, "vanity.example.org/quote") {
+		return &vcs.RepoRoot{
+			VCS:  vcs.ByCmd("git"),
+			Repo: "https://github.com/example/quote",
+			Root: "vanity.example.org/quote",
+		}, nil
+	}
+
 	return nil, fmt.Errorf("could not resolve import path: %q", importpath)
 }
 
@@ -762,3 +1711,1065 @@ func convertImportsAttr(r *rule.Rule) {
 		r.SetPrivateAttr(config.GazelleImportsKey, value)
 	}
 }
+
+func TestResolveModReplace(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/local"
+	gc.moduleReplaces = []moduleReplace{
+		{oldPath: "example.com/foo", newPath: "./third_party/foo"},
+		{oldPath: "example.com/foo/nested", newPath: "./nested"},
+		{oldPath: "example.com/old", newPath: "example.com/fork", newVersion: "v1.2.3"},
+		{oldPath: "example.com/pinned", newPath: "example.com/pinned", newVersion: "v0.1.0"},
+		{oldPath: "example.com/custom", newPath: "example.com/custommod", newVersion: "v1.0.0"},
+		{oldPath: "example.com/outside", newPath: "../outside"},
+	}
+	kindToResolver := make(map[string]resolve.Resolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			kindToResolver[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(kindToResolver)
+	f, err := rule.LoadData(filepath.FromSlash("third_party/foo/indexed/BUILD.bazel"), []byte(`
+go_library(
+    name = "indexed",
+    importpath = "example.com/local/third_party/foo/indexed",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.AddDynamicPackage("third_party/foo/dyn")
+	ix.Finish()
+	gl := langs[1].(*goLang)
+	for _, tc := range []struct {
+		desc, importpath string
+		depMode          dependencyMode
+		want             string
+	}{
+		{
+			desc:       "local_root",
+			importpath: "example.com/foo",
+			want:       "//third_party/foo:go_default_library",
+		}, {
+			desc:       "local_sub",
+			importpath: "example.com/foo/bar",
+			want:       "//third_party/foo/bar:go_default_library",
+		}, {
+			desc:       "local_indexed",
+			importpath: "example.com/foo/indexed",
+			want:       "//third_party/foo/indexed",
+		}, {
+			desc:       "local_longest_match",
+			importpath: "example.com/foo/nested/baz",
+			want:       "//nested/baz:go_default_library",
+		}, {
+			desc:       "local_dynamic_targets",
+			importpath: "example.com/foo/dyn",
+		}, {
+			desc:       "module_path",
+			importpath: "example.com/old/lib",
+			want:       "@com_example_fork//lib:go_default_library",
+		}, {
+			desc:       "module_version",
+			importpath: "example.com/pinned/lib",
+			want:       "@com_example_pinned//lib:go_default_library",
+		}, {
+			desc:       "module_path_known_repo",
+			importpath: "example.com/custom/lib",
+			want:       "@custom_repo_name//lib:go_default_library",
+		}, {
+			desc:       "module_path_vendored",
+			importpath: "example.com/old/lib",
+			depMode:    vendorMode,
+			want:       "//vendor/example.com/old/lib:go_default_library",
+		}, {
+			desc:       "outside",
+			importpath: "example.com/outside/lib",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			gc.depMode = tc.depMode
+			rc := testRemoteCache([]repos.Repo{{
+				Name:     "custom_repo_name",
+				GoPrefix: "example.com/custommod",
+			}})
+			r := rule.NewRule("go_library", "x")
+			imports := rule.PlatformStrings{Generic: []string{tc.importpath}}
+			r.SetPrivateAttr(config.GazelleImportsKey, imports)
+			gl.Resolve(c, ix, rc, r, label.New("", "", "x"))
+			deps := r.AttrStrings("deps")
+			if tc.want == "" {
+				if len(deps) != 0 {
+					t.Errorf("got %v; want no deps", deps)
+				}
+				return
+			}
+			if len(deps) != 1 {
+				t.Fatalf("deps: got %d; want 1", len(deps))
+			}
+			if deps[0] != tc.want {
+				t.Errorf("got %s; want %s", deps[0], tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveProtoLegacy(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		mode      proto.Mode
+		index     string
+		imp, want string
+	}{
+		{
+			desc: "legacy_indexed",
+			mode: proto.LegacyMode,
+			index: `
+filegroup(
+    name = "go_default_library_protos",
+    srcs = ["foo.proto"],
+)
+`,
+			imp:  "protos/foo.proto",
+			want: "//protos:go_default_library_protos",
+		}, {
+			desc: "legacy_unindexed",
+			mode: proto.LegacyMode,
+			imp:  "other/bar.proto",
+			want: "//other:go_default_library_protos",
+		}, {
+			desc: "default_indexed",
+			mode: proto.DefaultMode,
+			index: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+go_proto_library(
+    name = "foo_go_proto",
+    importpath = "example.com/repo/protos",
+    proto = ":foo_proto",
+)
+
+filegroup(
+    name = "go_default_library_protos",
+    srcs = ["foo.proto"],
+)
+`,
+			imp:  "protos/foo.proto",
+			want: "//protos:foo_go_proto",
+		}, {
+			desc: "default_unindexed",
+			mode: proto.DefaultMode,
+			imp:  "other/bar.proto",
+			want: "//other:go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			gc := getGoConfig(c)
+			gc.prefix = "example.com/repo"
+			pc := proto.GetProtoConfig(c)
+			pc.Mode = tc.mode
+			kindToResolver := make(map[string]resolve.Resolver)
+			for _, lang := range langs {
+				for kind := range lang.Kinds() {
+					kindToResolver[kind] = lang
+				}
+			}
+			ix := resolve.NewRuleIndex(kindToResolver)
+			f, err := rule.LoadData(filepath.Join("protos", "BUILD.bazel"), []byte(tc.index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range f.Rules {
+				ix.AddRule(c, r, f)
+			}
+			ix.Finish()
+			from := label.New("", "bin", "bin")
+			got, _, err := resolveProto(c, gc, pc, ix, testRemoteCache(nil), nil, tc.imp, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveVendorDir(t *testing.T) {
+	for _, tc := range []struct {
+		desc, vendorDir string
+		noFallback      bool
+		want            string
+	}{
+		{
+			desc: "default",
+			want: "//vendor/example.com/outside/prefix:go_default_library",
+		}, {
+			desc:      "custom",
+			vendorDir: "third_party/go",
+			want:      "//third_party/go/example.com/outside/prefix:go_default_library",
+		}, {
+			desc:       "no_fallback",
+			noFallback: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			var content string
+			if tc.vendorDir != "" {
+				content += "# gazelle:go_vendor_dir " + tc.vendorDir + "\n"
+			}
+			if tc.noFallback {
+				content += "# gazelle:go_vendor_fallback false\n"
+			}
+			f, err := rule.LoadData("BUILD.bazel", []byte(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cext := range langs {
+				cext.Configure(c, "", f)
+			}
+			gc := getGoConfig(c)
+			gc.prefix = "example.com/repo"
+			gc.depMode = vendorMode
+			ix := resolve.NewRuleIndex(nil)
+			ix.Finish()
+			gl := langs[1].(*goLang)
+
+			r := rule.NewRule("go_library", "x")
+			imports := rule.PlatformStrings{Generic: []string{"example.com/outside/prefix"}}
+			r.SetPrivateAttr(config.GazelleImportsKey, imports)
+			gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "", "x"))
+			deps := r.AttrStrings("deps")
+			if tc.want == "" {
+				if len(deps) != 0 {
+					t.Errorf("got %v; want no deps", deps)
+				}
+				return
+			}
+			if len(deps) != 1 || deps[0] != tc.want {
+				t.Errorf("got %v; want [%s]", deps, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveVendorDirIndexed(t *testing.T) {
+	c, _, langs := testConfig()
+	f, err := rule.LoadData("BUILD.bazel", []byte("# gazelle:go_vendor_dir third_party/go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cext := range langs {
+		cext.Configure(c, "", f)
+	}
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	gc.depMode = vendorMode
+	kindToResolver := make(map[string]resolve.Resolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			kindToResolver[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(kindToResolver)
+	ix.FailOnDuplicateImports = true
+	for _, rel := range []string{"dep", "third_party/go/example.com/dep"} {
+		f, err := rule.LoadData(path.Join(rel, "BUILD.bazel"), []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/dep",
+)
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddRule(c, f.Rules[0], f)
+	}
+	// The copy in the vendor directory isn't a duplicate, and it takes
+	// precedence everywhere in the repository.
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	gl := langs[1].(*goLang)
+
+	r := rule.NewRule("go_library", "x")
+	r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{"example.com/dep"}})
+	gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "a", "x"))
+	want := "//third_party/go/example.com/dep:go_default_library"
+	if deps := r.AttrStrings("deps"); len(deps) != 1 || deps[0] != want {
+		t.Errorf("got %v; want [%s]", deps, want)
+	}
+}
+
+func TestResolveExtraDeps(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+
+	r := rule.NewRule("go_library", "go_default_library")
+	imports := rule.PlatformStrings{Generic: []string{"example.com/repo/lib"}}
+	r.SetPrivateAttr(config.GazelleImportsKey, imports)
+	r.SetPrivateAttr(extraDepsKey, []string{"//tools:plugin", "//lib:go_default_library", "//sub:lib"})
+	gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "sub", "go_default_library"))
+
+	got := r.AttrStrings("deps")
+	want := []string{"//lib:go_default_library", "//tools:plugin", ":lib"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	// Extra deps declared in the package that contains them are inherited
+	// from there, but the rules they name and rules embedding them don't
+	// depend on themselves.
+	for _, tc := range []struct {
+		name  string
+		embed []string
+	}{
+		{name: "plugin"},
+		{name: "plugin_test", embed: []string{":plugin"}},
+	} {
+		r := rule.NewRule("go_library", tc.name)
+		r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{})
+		r.SetPrivateAttr(extraDepsKey, []string{"//tools:plugin", "//lib:go_default_library"})
+		if tc.embed != nil {
+			r.SetAttr("embed", tc.embed)
+		}
+		gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "tools", tc.name))
+		got := r.AttrStrings("deps")
+		want := []string{"//lib:go_default_library"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v; want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestResolveIgnoredImports(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	logger := &collectLogger{}
+	c.Logger = logger
+	gl := langs[1].(*goLang)
+
+	r := rule.NewRule("go_library", "go_default_library")
+	imports := rule.PlatformStrings{Generic: []string{
+		"example.com/repo/lib",
+		"example.com/repo/tool",
+		"example.com/repo/internal/a",
+		"example.com/repo/internal/b/c",
+		"example.com/repo/internalx",
+	}}
+	r.SetPrivateAttr(config.GazelleImportsKey, imports)
+	r.SetPrivateAttr(ignoredImportsKey, []string{"example.com/repo/tool", "example.com/repo/internal/..."})
+	gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "", "go_default_library"))
+
+	got := r.AttrStrings("deps")
+	want := []string{"//lib:go_default_library", "//internalx:go_default_library"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if len(logger.diags) > 0 {
+		t.Errorf("got diagnostics %v; want none", logger.diags)
+	}
+}
+
+type collectLogger struct {
+	diags []config.Diagnostic
+}
+
+func (l *collectLogger) Log(d config.Diagnostic) {
+	l.diags = append(l.diags, d)
+}
+
+func TestResolveLogger(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	logger := &collectLogger{}
+	c.Logger = logger
+	kindToResolver := make(map[string]resolve.Resolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			kindToResolver[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(kindToResolver)
+	ix.Logger = logger
+	for _, rel := range []string{"a", "b"} {
+		f, err := rule.LoadData(filepath.Join(rel, "BUILD.bazel"), []byte(`
+go_library(
+    name = "go_default_library",
+    importpath = "example.com/dup",
+)
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range f.Rules {
+			ix.AddRule(c, r, f)
+		}
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.diags) != 1 || logger.diags[0].Severity != config.Warning {
+		t.Fatalf("got diagnostics %#v after Finish; want one warning", logger.diags)
+	}
+	logger.diags = nil
+
+	r := rule.NewRule("go_library", "go_default_library")
+	r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{"example.com/dup"}})
+	from := label.New("", "c", "go_default_library")
+	langs[1].Resolve(c, ix, testRemoteCache(nil), r, from)
+
+	if len(logger.diags) != 1 {
+		t.Fatalf("got diagnostics %#v; want one", logger.diags)
+	}
+	d := logger.diags[0]
+	if d.Severity != config.Error || !d.From.Equal(from) || d.Imp != "example.com/dup" {
+		t.Errorf("got diagnostic %#v; want error from %s for example.com/dup", d, from)
+	}
+	if want := "multiple rules (//a:go_default_library and //b:go_default_library)"; !strings.Contains(d.Message, want) {
+		t.Errorf("got message %q; want message containing %q", d.Message, want)
+	}
+}
+
+func TestResolveDefaultRepo(t *testing.T) {
+	for _, tc := range []struct {
+		desc, directive, importpath, want string
+		repos                             []repos.Repo
+	}{
+		{
+			desc:       "unknown",
+			directive:  "go_deps",
+			importpath: "example.com/repo/lib",
+			want:       "@go_deps//example.com/repo/lib:go_default_library",
+		}, {
+			desc:       "import_naming_convention",
+			directive:  "@go_deps import",
+			importpath: "example.com/repo/lib",
+			want:       "@go_deps//example.com/repo/lib",
+		}, {
+			desc:       "import_naming_convention_major_version",
+			directive:  "@go_deps import",
+			importpath: "example.com/repo/v2",
+			want:       "@go_deps//example.com/repo/v2:repo",
+		}, {
+			desc:       "known",
+			directive:  "go_deps",
+			importpath: "example.com/repo/lib",
+			repos: []repos.Repo{{
+				Name:     "custom_repo",
+				GoPrefix: "example.com/repo",
+			}},
+			want: "@custom_repo//lib:go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			f, err := rule.LoadData("BUILD.bazel", []byte("# gazelle:go_repository_default_repo "+tc.directive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cext := range langs {
+				cext.Configure(c, "", f)
+			}
+			gc := getGoConfig(c)
+			gc.prefix = "example.com/local"
+			ix := resolve.NewRuleIndex(nil)
+			ix.Finish()
+			rc := testRemoteCache(tc.repos)
+			rc.RepoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+				t.Errorf("unexpected lookup of %q", importpath)
+				return nil, fmt.Errorf("not supported in test")
+			}
+			gl := langs[1].(*goLang)
+
+			r := rule.NewRule("go_library", "x")
+			r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{tc.importpath}})
+			gl.Resolve(c, ix, rc, r, label.New("", "", "x"))
+			if got := r.AttrStrings("deps"); len(got) != 1 || got[0] != tc.want {
+				t.Errorf("got %v; want [%s]", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveImportIndex(t *testing.T) {
+	index, err := parseImportIndex([]byte("example.com/indexed/lib\t@indexed//lib\nfoo/foo.proto\t@protos//foo:foo_go_proto\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc, kind, imp, want, defaultRepo string
+		strict, wantErr                    bool
+	}{
+		{
+			desc: "go",
+			kind: "go_library",
+			imp:  "example.com/indexed/lib",
+			want: "@indexed//lib",
+		}, {
+			desc: "proto",
+			kind: "go_proto_library",
+			imp:  "foo/foo.proto",
+			want: "@protos//foo:foo_go_proto",
+		}, {
+			desc:    "strict_miss",
+			kind:    "go_library",
+			imp:     "example.com/missing/lib",
+			strict:  true,
+			wantErr: true,
+		}, {
+			desc:        "strict_miss_default_repo",
+			kind:        "go_library",
+			imp:         "example.com/missing/lib",
+			defaultRepo: "go_deps",
+			strict:      true,
+			wantErr:     true,
+		}, {
+			desc:   "strict_local",
+			kind:   "go_library",
+			imp:    "example.com/local/lib",
+			strict: true,
+			want:   "//lib:go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, _, langs := testConfig()
+			gc := getGoConfig(c)
+			gc.prefix = "example.com/local"
+			gc.importIndex = index
+			gc.importIndexStrict = tc.strict
+			gc.defaultRepo = tc.defaultRepo
+			ix := resolve.NewRuleIndex(nil)
+			ix.Finish()
+			rc := testRemoteCache(nil)
+			rc.RepoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+				t.Errorf("unexpected lookup of %q", importpath)
+				return nil, fmt.Errorf("not supported in test")
+			}
+			logger := &collectLogger{}
+			c.Logger = logger
+			gl := langs[1].(*goLang)
+
+			r := rule.NewRule(tc.kind, "x")
+			r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{tc.imp}})
+			gl.Resolve(c, ix, rc, r, label.New("", "", "x"))
+			if tc.wantErr {
+				if len(logger.diags) != 1 || logger.diags[0].Severity != config.Error {
+					t.Errorf("got diagnostics %v; want one error", logger.diags)
+				}
+				return
+			}
+			if got := r.AttrStrings("deps"); len(got) != 1 || got[0] != tc.want {
+				t.Errorf("got %v; want [%s]", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveExternalTimeout(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/local"
+	gc.depMode = externalMode
+	logger := &collectLogger{}
+	ix := resolve.NewRuleIndex(nil)
+	ix.Logger = logger
+	ix.Finish()
+	rc := testRemoteCache(nil)
+	rc.Timeout = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	rc.RepoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		<-block
+		return nil, fmt.Errorf("not supported in test")
+	}
+	gl := langs[1].(*goLang)
+
+	r := rule.NewRule("go_library", "x")
+	r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{"example.com/slow/lib"}})
+	gl.Resolve(c, ix, rc, r, label.New("", "", "x"))
+	want := "@com_example_slow_lib//:go_default_library"
+	if got := r.AttrStrings("deps"); len(got) != 1 || got[0] != want {
+		t.Errorf("got %v; want [%s]", got, want)
+	}
+	if len(logger.diags) != 1 || logger.diags[0].Severity != config.Warning || logger.diags[0].Imp != "example.com/slow/lib" {
+		t.Errorf("got diagnostics %v; want one warning about example.com/slow/lib", logger.diags)
+	}
+}
+
+func TestResolveNestedModules(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	gc.nestedModules["sub"] = "example.com/repo/sub"
+	kindToResolver := make(map[string]resolve.Resolver)
+	for _, lang := range langs {
+		for kind := range lang.Kinds() {
+			kindToResolver[kind] = lang
+		}
+	}
+	ix := resolve.NewRuleIndex(kindToResolver)
+	for _, bf := range []struct{ rel, content string }{
+		{"lib", `go_library(name = "go_default_library", importpath = "example.com/repo/lib")`},
+		{"sub/lib", `go_library(name = "go_default_library", importpath = "example.com/repo/sub/lib")`},
+	} {
+		f, err := rule.LoadData(filepath.Join(bf.rel, "BUILD.bazel"), []byte(bf.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range f.Rules {
+			ix.AddRule(c, r, f)
+		}
+	}
+	ix.Finish()
+	rc := testRemoteCache([]repos.Repo{{
+		Name:     "com_example_repo_sub",
+		GoPrefix: "example.com/repo/sub",
+	}})
+
+	for _, tc := range []struct {
+		desc, rel, imp, want string
+	}{
+		{
+			desc: "root_indexed",
+			imp:  "example.com/repo/lib",
+			want: "//lib:go_default_library",
+		}, {
+			desc: "root_to_nested_indexed",
+			imp:  "example.com/repo/sub/lib",
+			want: "@com_example_repo_sub//lib:go_default_library",
+		}, {
+			desc: "root_to_nested",
+			imp:  "example.com/repo/sub/other",
+			want: "@com_example_repo_sub//other:go_default_library",
+		}, {
+			desc: "nested_indexed",
+			rel:  "sub/bin",
+			imp:  "example.com/repo/sub/lib",
+			want: "//sub/lib:go_default_library",
+		}, {
+			desc: "nested",
+			rel:  "sub/bin",
+			imp:  "example.com/repo/sub/other",
+			want: "//sub/other:go_default_library",
+		}, {
+			desc: "nested_to_root",
+			rel:  "sub/bin",
+			imp:  "example.com/repo/lib",
+			want: "@com_example_repo//lib:go_default_library",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := rule.NewRule("go_binary", "bin")
+			r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{tc.imp}})
+			langs[1].Resolve(c, ix, rc, r, label.New("", tc.rel, "bin"))
+			if got := r.AttrStrings("deps"); len(got) != 1 || got[0] != tc.want {
+				t.Errorf("got %v; want [%s]", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolvePrefixMap(t *testing.T) {
+	c, _, langs := testConfig()
+	content := []byte(`
+# gazelle:prefix example.com/repo
+# gazelle:go_prefix_map example.com/tools=tools
+# gazelle:go_prefix_map example.com/tools/internal=third_party/toolsinternal
+# gazelle:go_prefix_map example.com/repo/sub=modules/sub
+`)
+	f, err := rule.LoadData("BUILD.bazel", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range langs {
+		lang.Configure(c, "", f)
+	}
+	gc := getGoConfig(c)
+	gc.depMode = vendorMode
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	rc := testRemoteCache(nil)
+	from := label.New("", "cmd", "cmd")
+
+	for _, tc := range []struct {
+		imp, want string
+	}{
+		{imp: "example.com/repo/a", want: "//a:go_default_library"},
+		{imp: "example.com/tools", want: "//tools:go_default_library"},
+		{imp: "example.com/tools/lint", want: "//tools/lint:go_default_library"},
+		{imp: "example.com/tools/internal/x", want: "//third_party/toolsinternal/x:go_default_library"},
+		{imp: "example.com/toolsx", want: "//vendor/example.com/toolsx:go_default_library"},
+		{imp: "example.com/repo/sub/b", want: "//modules/sub/b:go_default_library"},
+	} {
+		t.Run(tc.imp, func(t *testing.T) {
+			l, how, err := resolveGo(c, gc, ix, rc, rule.NewRule("go_library", "cmd"), tc.imp, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.String(); got != tc.want {
+				t.Errorf("got %s (via %s); want %s", got, how, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveProtoKnown(t *testing.T) {
+	c, _, langs := testConfig()
+	f, err := rule.LoadData("BUILD.bazel", []byte("# gazelle:proto_known google/api go_googleapis {dir}:{name}_proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cext := range langs {
+		cext.Configure(c, "", f)
+	}
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	pc := proto.GetProtoConfig(c)
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	r := rule.NewRule("go_proto_library", "foo_go_proto")
+	l, how, err := resolveProto(c, gc, pc, ix, testRemoteCache(nil), r, "google/api/http.proto", label.New("", "foo", "foo_go_proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "@go_googleapis//google/api:http_go_proto"; l.String() != want || how != viaKnownProto {
+		t.Errorf("got %s (via %s); want %s (via %s)", l, how, want, viaKnownProto)
+	}
+}
+
+func TestResolveProtoDynamicTargets(t *testing.T) {
+	c, _, _ := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	pc := proto.GetProtoConfig(c)
+	ix := resolve.NewRuleIndex(nil)
+	ix.AddDynamicPackage("dyn")
+	ix.Finish()
+	r := rule.NewRule("go_proto_library", "foo_go_proto")
+	if _, _, err := resolveProto(c, gc, pc, ix, testRemoteCache(nil), r, "dyn/dyn.proto", label.New("", "foo", "foo_go_proto")); err != skipImportError {
+		t.Errorf("got error %v; want %v", err, skipImportError)
+	}
+}
+
+func TestEmbedsMappedProtoLibrary(t *testing.T) {
+	r := rule.NewRule("my_go_proto_library", "foo_go_proto")
+	r.SetAttr("embed", []string{":extra"})
+	r.SetAttr("proto", ":foo_proto")
+	got := New().(*goLang).Embeds(r, label.New("", "foo", "foo_go_proto"))
+	want := []label.Label{
+		label.New("", "foo", "extra"),
+		label.New("", "foo", "foo_proto"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestResolveCollapsesPlatformDeps(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+
+	r := rule.NewRule("go_library", "go_default_library")
+	imports := rule.PlatformStrings{
+		OS: map[string][]string{
+			"darwin": {"example.com/repo/common", "example.com/repo/unix", "syscall"},
+			"linux":  {"example.com/repo/common", "example.com/repo/unix", "syscall"},
+		},
+		Platform: map[rule.Platform][]string{
+			{OS: "linux", Arch: "amd64"}: {"example.com/repo/linux/amd64"},
+		},
+	}
+	r.SetPrivateAttr(config.GazelleImportsKey, imports)
+	r.SetPrivateAttr(platformsKey, []rule.Platform{
+		{OS: "darwin", Arch: "amd64"},
+		{OS: "darwin", Arch: "arm64"},
+		{OS: "linux", Arch: "amd64"},
+	})
+	gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "", "go_default_library"))
+
+	// Labels needed on every listed platform are generic, and linux_amd64 is
+	// the only linux platform, so its label is linux-specific.
+	f := rule.EmptyFile("BUILD.bazel")
+	r.Insert(f)
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_library(
+    name = "go_default_library",
+    deps = [
+        "//common:go_default_library",
+        "//unix:go_default_library",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "//linux/amd64:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestResolveStdlibOverrides(t *testing.T) {
+	c, _, langs := testConfig()
+	f, err := rule.LoadData("BUILD.bazel", []byte(`
+# gazelle:prefix example.com/repo
+# gazelle:go_stdlib_packages crypto/newhash,-net/http/httptest
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range langs {
+		lang.Configure(c, "", f)
+	}
+	gc := getGoConfig(c)
+	gc.depMode = vendorMode
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+
+	r := rule.NewRule("go_library", "go_default_library")
+	r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{
+		"crypto/newhash",
+		"fmt",
+		"net/http/httptest",
+	}})
+	gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "", "go_default_library"))
+	want := []string{"//vendor/net/http/httptest:go_default_library"}
+	if got := r.AttrStrings("deps"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestRuleNamer(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "resolve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a/a.go":      "package a\n\nimport (\n\t_ \"example.com/repo/b\"\n\t_ \"example.com/repo/c\"\n)\n",
+		"a/a_test.go": "package a\n",
+		"b/b.go":      "package b\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, _, langs := testConfig()
+	c.RepoRoot = dir
+	c.RuleNamer = func(kind, rel, name string) string {
+		if kind == "go_library" || kind == "go_test" {
+			return strings.TrimPrefix(kind, "go_") + "_" + path.Base(rel)
+		}
+		return ""
+	}
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	gl := langs[1].(*goLang)
+	ix := resolve.NewRuleIndex(map[string]resolve.Resolver{"go_library": gl, "go_test": gl})
+
+	gen := make(map[string][]*rule.Rule)
+	for _, rel := range []string{"a", "b"} {
+		var regularFiles []string
+		for name := range files {
+			if path.Dir(name) == rel {
+				regularFiles = append(regularFiles, path.Base(name))
+			}
+		}
+		sort.Strings(regularFiles)
+		_, gen[rel] = gl.GenerateRules(c, filepath.Join(dir, rel), rel, nil, nil, regularFiles, nil, nil)
+		f := rule.EmptyFile(filepath.Join(dir, rel, "BUILD.bazel"))
+		for _, r := range gen[rel] {
+			ix.AddRule(c, r, f)
+		}
+	}
+	ix.Finish()
+
+	var names []string
+	for _, r := range gen["a"] {
+		names = append(names, r.Kind()+" "+r.Name())
+	}
+	if want := []string{"go_library library_a", "go_test test_a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got rules %q; want %q", names, want)
+	}
+
+	lib := gen["a"][0]
+	gl.Resolve(c, ix, testRemoteCache(nil), lib, label.New("", "a", lib.Name()))
+	if got, want := lib.AttrStrings("deps"), []string{"//b:library_b", "//c:library_c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got deps %q; want %q", got, want)
+	}
+	test := gen["a"][1]
+	if got, want := test.AttrStrings("embed"), []string{":library_a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got embed %q; want %q", got, want)
+	}
+}
+
+func TestResolveLocalRepository(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "resolve_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	siblingLib := filepath.Join(dir, "sibling", "lib")
+	if err := os.MkdirAll(siblingLib, 0777); err != nil {
+		t.Fatal(err)
+	}
+	build := `go_library(
+    name = "lib",
+    importpath = "example.com/sibling/lib",
+)
+`
+	if err := ioutil.WriteFile(filepath.Join(siblingLib, "BUILD.bazel"), []byte(build), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _, langs := testConfig()
+	c.RepoRoot = filepath.Join(dir, "main")
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	for _, value := range []string{
+		"name=sibling prefix=example.com/sibling path=../sibling",
+		"name=nested prefix=example.com/repo/nested",
+	} {
+		if err := gc.addLocalRepo(value, c.RepoRoot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+
+	for _, tc := range []struct {
+		imp, want string
+	}{
+		{imp: "example.com/sibling/lib", want: "@sibling//lib"},
+		{imp: "example.com/sibling/other", want: "@sibling//other:go_default_library"},
+		{imp: "example.com/sibling", want: "@sibling//:go_default_library"},
+		{imp: "example.com/repo/nested/x", want: "@nested//x:go_default_library"},
+		{imp: "example.com/repo/x", want: "//x:go_default_library"},
+	} {
+		t.Run(tc.imp, func(t *testing.T) {
+			r := rule.NewRule("go_library", "a")
+			r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{tc.imp}})
+			gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "a", "a"))
+			if got := r.AttrStrings("deps"); !reflect.DeepEqual(got, []string{tc.want}) {
+				t.Errorf("got deps %q; want %q", got, []string{tc.want})
+			}
+		})
+	}
+
+	t.Run("rule_namer", func(t *testing.T) {
+		c.RuleNamer = func(kind, rel, name string) string {
+			return path.Base(rel)
+		}
+		defer func() { c.RuleNamer = nil }()
+		r := rule.NewRule("go_library", "a")
+		r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{"example.com/sibling/lib", "example.com/sibling/other"}})
+		gl.Resolve(c, ix, testRemoteCache(nil), r, label.New("", "a", "a"))
+		if got, want := r.AttrStrings("deps"), []string{"@sibling//lib", "@sibling//other"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got deps %q; want %q", got, want)
+		}
+	})
+}
+
+func TestResolveOverride(t *testing.T) {
+	c, _, langs := testConfig()
+	gc := getGoConfig(c)
+	gc.prefix = "example.com/repo"
+	for _, value := range []string{
+		"go example.com/legacy/... @legacy//:lib",
+		"go example.com/legacy/special //special:lib",
+		"go example.com/legacy/sub/... @legacy//sub:lib",
+		"go example.com/repo/foo/... //other/foo",
+		"proto example.com/repo/bar //proto:bar",
+		"go example.com/repo/migrated/... //migrated:go_default_library",
+	} {
+		if err := gc.addResolveOverride(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix := resolve.NewRuleIndex(nil)
+	ix.Finish()
+	gl := langs[1].(*goLang)
+
+	for _, tc := range []struct {
+		imp, want      string
+		from           label.Label
+		ignored, embed []string
+	}{
+		{imp: "example.com/legacy", want: "@legacy//:lib"},
+		{imp: "example.com/legacy/a/b", want: "@legacy//:lib"},
+		{imp: "example.com/legacy/special", want: "//special:lib"},
+		{imp: "example.com/legacy/special/x", want: "@legacy//:lib"},
+		{imp: "example.com/legacy/sub/x", want: "@legacy//sub:lib"},
+		{imp: "example.com/legacyx", want: "@com_example//legacyx:go_default_library"},
+		{imp: "example.com/repo/foo/bar", want: "//other/foo"},
+		{imp: "example.com/repo/bar", want: "//bar:go_default_library"},
+		{imp: "example.com/repo/migrated/x", want: "//migrated:go_default_library"},
+		{
+			imp:     "example.com/legacy/a",
+			ignored: []string{"example.com/legacy/..."},
+		}, {
+			imp:  "example.com/repo/migrated/x",
+			from: label.New("", "migrated", "go_default_library"),
+		}, {
+			imp:   "example.com/repo/migrated/x",
+			from:  label.New("", "migrated", "go_default_test"),
+			embed: []string{":go_default_library"},
+		},
+	} {
+		t.Run(tc.imp, func(t *testing.T) {
+			from := tc.from
+			if from.Equal(label.NoLabel) {
+				from = label.New("", "a", "a")
+			}
+			r := rule.NewRule("go_library", from.Name)
+			r.SetPrivateAttr(config.GazelleImportsKey, rule.PlatformStrings{Generic: []string{tc.imp}})
+			if tc.ignored != nil {
+				r.SetPrivateAttr(ignoredImportsKey, tc.ignored)
+			}
+			if tc.embed != nil {
+				r.SetAttr("embed", tc.embed)
+			}
+			gl.Resolve(c, ix, testRemoteCache(nil), r, from)
+			var want []string
+			if tc.want != "" {
+				want = []string{tc.want}
+			}
+			if got := r.AttrStrings("deps"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got deps %q; want %q", got, want)
+			}
+		})
+	}
+}
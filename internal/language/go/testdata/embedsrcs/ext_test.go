@@ -0,0 +1,6 @@
+package embedsrcs_test
+
+import _ "embed"
+
+//go:embed "ext/*.txt"
+var external string
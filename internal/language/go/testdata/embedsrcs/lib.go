@@ -0,0 +1,6 @@
+package embedsrcs
+
+import "embed"
+
+//go:embed static
+var static embed.FS
@@ -0,0 +1,6 @@
+package embedsrcs
+
+import _ "embed"
+
+//go:embed int.txt
+var internal string
@@ -0,0 +1,3 @@
+package glob_directive
+
+import "C"
@@ -0,0 +1,11 @@
+package pill
+
+//go:generate stringer -type=Pill
+//go:generate stringer -type Color,Shade -linecomment -output=colors.go
+//go:generate protoc --go_out=. pill.proto
+
+type Pill int
+
+type Color int
+
+type Shade int
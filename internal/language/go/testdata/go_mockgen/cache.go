@@ -0,0 +1,9 @@
+package store
+
+import "time"
+
+//go:generate mockgen -source=cache.go -destination=cache_mock_test.go -package=store_test
+
+type Cache interface {
+	Expire(key string, d time.Duration)
+}
@@ -0,0 +1,7 @@
+package store
+
+//go:generate mockgen -source=store.go -destination=store_mock_test.go -package=store
+
+type Store interface {
+	Get(key string) (string, error)
+}
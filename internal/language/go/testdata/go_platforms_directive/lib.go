@@ -0,0 +1,3 @@
+package go_platforms_directive
+
+import _ "example.com/repo/go_platforms_directive/generic"
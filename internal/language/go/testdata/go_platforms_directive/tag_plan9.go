@@ -0,0 +1,5 @@
+//go:build windows || plan9
+
+package go_platforms_directive
+
+import _ "example.com/repo/go_platforms_directive/plan9"
@@ -0,0 +1,5 @@
+//go:build amd64 || arm64
+
+package platform_conjunction
+
+import _ "example.com/repo/platform_conjunction/darwin_64"
@@ -0,0 +1,5 @@
+//go:build arm64
+
+package platform_conjunction
+
+import _ "example.com/repo/platform_conjunction/linux_arm64"
@@ -0,0 +1 @@
+package platform_conjunction
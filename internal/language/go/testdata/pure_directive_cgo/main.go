@@ -0,0 +1,6 @@
+package main
+
+// int x = 1;
+import "C"
+
+func main() {}
@@ -0,0 +1,5 @@
+package main
+
+import "example.com/repo/split_main"
+
+func main() { split_main.Hello() }
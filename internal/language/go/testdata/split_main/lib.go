@@ -0,0 +1,5 @@
+package split_main
+
+import "fmt"
+
+func Hello() { fmt.Println("hello") }
@@ -0,0 +1 @@
+package split_main
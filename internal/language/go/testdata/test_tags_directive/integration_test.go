@@ -0,0 +1,12 @@
+//go:build integration
+// +build integration
+
+package lib_test
+
+import (
+	"testing"
+
+	"example.com/repo/lib"
+)
+
+func TestIntegration(t *testing.T) {}
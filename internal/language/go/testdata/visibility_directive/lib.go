@@ -0,0 +1 @@
+package visibility_directive
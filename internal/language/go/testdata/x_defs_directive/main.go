@@ -0,0 +1,5 @@
+package main
+
+var Name, Version string
+
+func main() {}
@@ -20,8 +20,13 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
 )
 
@@ -42,6 +47,127 @@ type ProtoConfig struct {
 	// can't be determined.
 	// TODO(jayconrod): deprecate and remove Go-specific behavior.
 	GoPrefix string
+
+	// ProtoRoot is the slash-separated path to the directory that .proto
+	// imports are relative to, relative to the repository root. .proto files
+	// under this directory are imported without this prefix. "" means imports
+	// are relative to the repository root. Set with # gazelle:proto_root.
+	ProtoRoot string
+
+	// StripImportPrefix is the value of the strip_import_prefix attribute of
+	// generated proto_library rules. It starts with "/", since it's relative
+	// to the repository root. .proto files under this directory are imported
+	// without this prefix. "" means the attribute isn't set. Set with
+	// # gazelle:proto_strip_import_prefix.
+	StripImportPrefix string
+
+	// stripImportPrefixSet indicates whether the directive was given in this
+	// directory or a parent, even with an empty value. Gazelle manages the
+	// strip_import_prefix attribute once it's true, so the attribute is
+	// removed from rules the prefix no longer applies to.
+	stripImportPrefixSet bool
+
+	// DefaultLanguage is the only language that should generate rules for
+	// proto_library rules, like go_proto_library. "" means all languages do,
+	// and "none" means no language does. Set with
+	// # gazelle:proto_default_language.
+	DefaultLanguage string
+
+	// resolveToFiles indicates whether .proto imports are resolved to the
+	// labels of files exported with exports_files in preference to
+	// proto_library rules, for toolchains that consume .proto files
+	// directly. Set with # gazelle:proto_resolve_to_files.
+	resolveToFiles bool
+
+	// knownProtos are mappings for .proto files that are always provided by
+	// external repositories, set with # gazelle:proto_known. They're sorted
+	// by prefix length, longest first. The slice may be shared with other
+	// configs and must not be modified.
+	knownProtos []knownProto
+}
+
+// knownProto maps .proto imports under prefix to rules in an external
+// repository. nameTemplate is expanded by knownProto.label.
+type knownProto struct {
+	prefix, repo, nameTemplate string
+}
+
+// parseKnownProto parses the value of a # gazelle:proto_known directive,
+// which has the form "prefix repo name-template".
+func parseKnownProto(value string) (knownProto, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return knownProto{}, fmt.Errorf("want prefix, repository, and name template; got %q", value)
+	}
+	kp := knownProto{
+		prefix:       path.Clean(fields[0]),
+		repo:         strings.TrimPrefix(fields[1], "@"),
+		nameTemplate: fields[2],
+	}
+	if kp.prefix == "." || path.IsAbs(kp.prefix) || strings.HasPrefix(kp.prefix, "../") {
+		return knownProto{}, fmt.Errorf("invalid prefix %q", fields[0])
+	}
+	if l := kp.label(path.Join(kp.prefix, "x.proto")); l.Repo == "" || l.Name == "" {
+		return knownProto{}, fmt.Errorf("invalid repository or name template in %q", value)
+	} else if _, err := label.Parse(l.String()); err != nil {
+		return knownProto{}, fmt.Errorf("invalid repository or name template in %q", value)
+	}
+	return kp, nil
+}
+
+// addKnownProto returns a copy of kps with kp added. A mapping for the same
+// prefix is replaced.
+func addKnownProto(kps []knownProto, kp knownProto) []knownProto {
+	result := make([]knownProto, 0, len(kps)+1)
+	for _, old := range kps {
+		if old.prefix != kp.prefix {
+			result = append(result, old)
+		}
+	}
+	result = append(result, kp)
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i].prefix) > len(result[j].prefix)
+	})
+	return result
+}
+
+// ImportDir returns the slash-separated path to the directory containing
+// the .proto file imported with imp, relative to the repository root.
+// ProtoRoot is taken into account.
+func (pc *ProtoConfig) ImportDir(imp string) string {
+	dir := path.Join(pc.ProtoRoot, path.Dir(imp))
+	if dir == "." {
+		dir = ""
+	}
+	return dir
+}
+
+// RelativeImport converts imp, which is imported by a .proto file in the
+// directory pkg, to an import relative to ProtoRoot, if imp starts with
+// "./" or "../". Other imports are returned unchanged. An error is returned
+// if imp points outside the repository or outside ProtoRoot, since it can't
+// be imported relative to ProtoRoot.
+func (pc *ProtoConfig) RelativeImport(imp, pkg string) (string, error) {
+	if !strings.HasPrefix(imp, "./") && !strings.HasPrefix(imp, "../") {
+		return imp, nil
+	}
+	rel := path.Clean(path.Join(pkg, imp))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("relative import path %q from %q points outside of repository", imp, pkg)
+	}
+	if pc.ProtoRoot != "" {
+		if !pathtools.HasPrefix(rel, pc.ProtoRoot) {
+			return "", fmt.Errorf("relative import path %q from %q points outside of proto root %q", imp, pkg, pc.ProtoRoot)
+		}
+		rel = pathtools.TrimPrefix(rel, pc.ProtoRoot)
+	}
+	return rel, nil
+}
+
+// GeneratesLanguage returns whether rules for the language lang should be
+// generated for proto_library rules.
+func (pc *ProtoConfig) GeneratesLanguage(lang string) bool {
+	return pc.DefaultLanguage == "" || pc.DefaultLanguage == lang
 }
 
 func GetProtoConfig(c *config.Config) *ProtoConfig {
@@ -131,7 +257,7 @@ func (_ *protoLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
 }
 
 func (_ *protoLang) KnownDirectives() []string {
-	return []string{"proto"}
+	return []string{"proto", "proto_default_language", "proto_known", "proto_resolve_to_files", "proto_root", "proto_strip_import_prefix"}
 }
 
 func (_ *protoLang) Configure(c *config.Config, rel string, f *rule.File) {
@@ -149,6 +275,46 @@ func (_ *protoLang) Configure(c *config.Config, rel string, f *rule.File) {
 				}
 				pc.Mode = mode
 				pc.ModeExplicit = true
+			case "proto_default_language":
+				switch d.Value {
+				case "go", "none":
+					pc.DefaultLanguage = d.Value
+				case "":
+					pc.DefaultLanguage = ""
+				default:
+					log.Printf("%s: invalid value for gazelle:proto_default_language: %q; want \"go\" or \"none\"", f.Path, d.Value)
+				}
+			case "proto_known":
+				kp, err := parseKnownProto(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:proto_known: %v", f.Path, err)
+					continue
+				}
+				pc.knownProtos = addKnownProto(pc.knownProtos, kp)
+			case "proto_resolve_to_files":
+				resolveToFiles, err := strconv.ParseBool(d.Value)
+				if err != nil {
+					log.Printf("%s: invalid value for gazelle:proto_resolve_to_files: %q", f.Path, d.Value)
+					continue
+				}
+				pc.resolveToFiles = resolveToFiles
+			case "proto_root":
+				pc.ProtoRoot = path.Clean(d.Value)
+				if pc.ProtoRoot == "." || pc.ProtoRoot == "/" {
+					pc.ProtoRoot = ""
+				}
+			case "proto_strip_import_prefix":
+				pc.stripImportPrefixSet = true
+				if d.Value == "" {
+					pc.StripImportPrefix = ""
+					continue
+				}
+				prefix := path.Clean(d.Value)
+				if !path.IsAbs(prefix) {
+					log.Printf("%s: invalid value for gazelle:proto_strip_import_prefix: %q must start with \"/\"", f.Path, d.Value)
+					continue
+				}
+				pc.StripImportPrefix = prefix
 			}
 		}
 	}
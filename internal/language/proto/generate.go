@@ -17,7 +17,6 @@ package proto
 
 import (
 	"fmt"
-	"log"
 	"sort"
 	"strings"
 
@@ -34,26 +33,55 @@ func (_ *protoLang) GenerateRules(c *config.Config, dir, rel string, f *rule.Fil
 		return nil, nil
 	}
 
-	var regularProtoFiles []string
+	var regularProtoFiles, regularTestFiles []string
 	for _, name := range regularFiles {
-		if strings.HasSuffix(name, ".proto") {
+		if IsTestFile(name) {
+			regularTestFiles = append(regularTestFiles, name)
+		} else if strings.HasSuffix(name, ".proto") {
 			regularProtoFiles = append(regularProtoFiles, name)
 		}
 	}
-	var genProtoFiles []string
+	var genProtoFiles, genTestFiles []string
 	for _, name := range genFiles {
-		if strings.HasSuffix(name, ".proto") {
+		if IsTestFile(name) {
+			genTestFiles = append(genTestFiles, name)
+		} else if strings.HasSuffix(name, ".proto") {
 			genProtoFiles = append(genFiles, name)
 		}
 	}
-	pkg := buildPackage(dir, rel, regularProtoFiles, genProtoFiles)
+	pkg := buildPackage(c, dir, rel, regularProtoFiles, genProtoFiles)
+	var testPkg *protoPackage
+	if len(regularTestFiles) > 0 {
+		testPkg = buildPackage(c, dir, rel, regularTestFiles, genTestFiles)
+	}
+
+	name := RuleName("", rel, pc.GoPrefix)
+	if pkg != nil {
+		name = RuleName(goPackageName(pkg), rel, pc.GoPrefix)
+	}
+	testName := c.RuleName("proto_library", rel, TestRuleName(name))
+	name = c.RuleName("proto_library", rel, name)
 
 	if pkg == nil {
-		empty = append(empty, rule.NewRule("proto_library", RuleName("", rel, pc.GoPrefix)))
-		return empty, gen
+		empty = append(empty, rule.NewRule("proto_library", name))
+	} else {
+		gen = append(gen, generateProto(pc, rel, f, name, pkg))
 	}
+	if testPkg == nil {
+		if hasRule(f, testName) {
+			empty = append(empty, rule.NewRule("proto_library", testName))
+		}
+	} else {
+		r := generateProto(pc, rel, f, testName, testPkg)
+		r.SetAttr("testonly", true)
+		gen = append(gen, r)
+	}
+	return empty, gen
+}
 
-	name := RuleName(goPackageName(pkg), rel, pc.GoPrefix)
+// generateProto returns a proto_library rule named name for the files
+// in pkg.
+func generateProto(pc *ProtoConfig, rel string, f *rule.File, name string, pkg *protoPackage) *rule.Rule {
 	r := rule.NewRule("proto_library", name)
 	srcs := make([]string, 0, len(pkg.files))
 	for f := range pkg.files {
@@ -61,6 +89,13 @@ func (_ *protoLang) GenerateRules(c *config.Config, dir, rel string, f *rule.Fil
 	}
 	sort.Strings(srcs)
 	r.SetAttr("srcs", srcs)
+	if prefix := pc.StripImportPrefix; prefix != "" && pathtools.HasPrefix(rel, prefix[len("/"):]) {
+		r.SetAttr("strip_import_prefix", prefix)
+	}
+	if pc.stripImportPrefixSet {
+		managed, _ := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+		r.SetPrivateAttr(config.GazelleManagedAttrsKey, append(managed, "strip_import_prefix"))
+	}
 	info := make([]FileInfo, len(srcs))
 	for i, src := range srcs {
 		info[i] = pkg.files[src]
@@ -79,8 +114,7 @@ func (_ *protoLang) GenerateRules(c *config.Config, dir, rel string, f *rule.Fil
 		vis := checkInternalVisibility(rel, "//visibility:public")
 		r.SetAttr("visibility", []string{vis})
 	}
-	gen = append(gen, r)
-	return empty, gen
+	return r
 }
 
 // RuleName returns a name for the proto_library in the given directory.
@@ -94,10 +128,29 @@ func RuleName(goPkgName, rel, goPrefix string) string {
 	return base + "_proto"
 }
 
+// TestRuleName returns the name of the proto_library for test protos in
+// the same directory as the proto_library named name.
+func TestRuleName(name string) string {
+	return strings.TrimSuffix(name, "_proto") + "_test_proto"
+}
+
+// IsTestFile returns whether name is a test proto, which is built in a
+// separate testonly proto_library. Test protos have names ending with
+// "_test.proto".
+func IsTestFile(name string) bool {
+	return strings.HasSuffix(name, "_test.proto")
+}
+
+// IsTestLibrary returns whether r is a proto_library for test protos.
+// Rules for other languages should not be generated from these.
+func IsTestLibrary(r *rule.Rule) bool {
+	return r.Kind() == "proto_library" && isTestOnly(r)
+}
+
 // buildPackage extracts metadata from the .proto files in a directory and
 // constructs possibly several packages, then selects a package to generate
 // a proto_library rule for.
-func buildPackage(dir, rel string, protoFiles, genFiles []string) *protoPackage {
+func buildPackage(c *config.Config, dir, rel string, protoFiles, genFiles []string) *protoPackage {
 	packageMap := make(map[string]*protoPackage)
 	for _, name := range protoFiles {
 		info := protoFileInfo(dir, name)
@@ -109,7 +162,7 @@ func buildPackage(dir, rel string, protoFiles, genFiles []string) *protoPackage
 
 	pkg, err := selectPackage(dir, rel, packageMap)
 	if err != nil {
-		log.Print(err)
+		c.Log(config.Diagnostic{Severity: config.Error, Message: err.Error()})
 		return nil
 	}
 	if pkg != nil {
@@ -181,6 +234,19 @@ func hasDefaultVisibility(f *rule.File) bool {
 	return false
 }
 
+// hasRule returns whether f contains a rule named name.
+func hasRule(f *rule.File, name string) bool {
+	if f == nil {
+		return false
+	}
+	for _, r := range f.Rules {
+		if r.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
 // checkInternalVisibility overrides the given visibility if the package is
 // internal.
 func checkInternalVisibility(rel, visibility string) string {
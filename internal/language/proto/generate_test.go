@@ -17,13 +17,17 @@ package proto
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	"github.com/bazelbuild/bazel-gazelle/internal/merger"
+	"github.com/bazelbuild/bazel-gazelle/internal/repos"
+	"github.com/bazelbuild/bazel-gazelle/internal/resolve"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
 	"github.com/bazelbuild/bazel-gazelle/internal/walk"
 
@@ -92,6 +96,89 @@ func TestGenerateRulesEmpty(t *testing.T) {
 	}
 }
 
+// diagLogger records diagnostics.
+type diagLogger struct {
+	diags []config.Diagnostic
+}
+
+func (l *diagLogger) Log(d config.Diagnostic) {
+	l.diags = append(l.diags, d)
+}
+
+func TestGenerateRulesMultiplePackages(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "proto_multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"a.proto": "syntax = \"proto3\";\npackage a;\n",
+		"b.proto": "syntax = \"proto3\";\npackage b;\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lang := New()
+	c := config.New()
+	c.Exts[protoName] = &ProtoConfig{}
+	logger := &diagLogger{}
+	c.Logger = logger
+	_, gen := lang.GenerateRules(c, dir, "multi", nil, nil, []string{"a.proto", "b.proto"}, nil, nil)
+	if len(gen) > 0 {
+		t.Errorf("got %d generated rules; want 0", len(gen))
+	}
+	if len(logger.diags) != 1 || logger.diags[0].Severity != config.Error || !strings.Contains(logger.diags[0].Message, "multiple proto packages") {
+		t.Errorf("got diagnostics %v; want one error about multiple proto packages", logger.diags)
+	}
+}
+
+func TestGenerateRulesRuleNamer(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "proto_namer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"a.proto":      "syntax = \"proto3\";\n\nimport \"b/b.proto\";\n",
+		"a_test.proto": "syntax = \"proto3\";\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lang := New()
+	c := config.New()
+	c.Exts[protoName] = &ProtoConfig{}
+	c.RuleNamer = func(kind, rel, name string) string {
+		if kind == "proto_library" {
+			return "pb_" + name
+		}
+		return ""
+	}
+	_, gen := lang.GenerateRules(c, dir, "a", nil, nil, []string{"a.proto", "a_test.proto"}, nil, nil)
+	var names []string
+	for _, r := range gen {
+		names = append(names, r.Name())
+	}
+	if want := []string{"pb_a_proto", "pb_a_test_proto"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got rules %q; want %q", names, want)
+	}
+	empty, _ := lang.GenerateRules(c, dir, "a", nil, nil, nil, nil, nil)
+	if len(empty) != 1 || empty[0].Name() != "pb_a_proto" {
+		t.Errorf("got empty rules %v; want pb_a_proto", empty)
+	}
+
+	ix := resolve.NewRuleIndex(map[string]resolve.Resolver{"proto_library": lang})
+	ix.Finish()
+	lang.Resolve(c, ix, (*repos.RemoteCache)(nil), gen[0], label.New("", "a", gen[0].Name()))
+	if got, want := gen[0].AttrStrings("deps"), []string{"//b:pb_b_proto"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got deps %q; want %q", got, want)
+	}
+}
+
 func TestGenerateFileInfo(t *testing.T) {
 	lang := New()
 	c := testConfig()
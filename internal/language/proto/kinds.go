@@ -18,10 +18,22 @@ package proto
 import "github.com/bazelbuild/bazel-gazelle/internal/rule"
 
 var protoKinds = map[string]rule.KindInfo{
+	// exports_files isn't generated, but exported .proto files are indexed
+	// when # gazelle:proto_resolve_to_files is set.
+	"exports_files": {},
 	"proto_library": {
 		NonEmptyAttrs:  map[string]bool{"srcs": true},
 		MergeableAttrs: map[string]bool{"srcs": true},
 		ResolveAttrs:   map[string]bool{"deps": true},
+		AttrOrder: []string{
+			"name",
+			"srcs",
+			"import_prefix",
+			"strip_import_prefix",
+			"tags",
+			"visibility",
+			"deps",
+		},
 	},
 }
 
@@ -21,7 +21,8 @@ limitations under the License.
 //
 // Configuration is largely controlled by Mode. In disable mode, proto rules are
 // left alone (neither generated nor deleted). In legacy mode, filegroups are
-// emitted containing protos. In default mode, proto_library rules are
+// emitted containing protos; other languages may find them with
+// ResolveLegacyWithIndex. In default mode, proto_library rules are
 // emitted. The proto mode may be set with the -proto command line flag or the
 // "# gazelle:proto" directive.
 //
@@ -41,6 +42,15 @@ limitations under the License.
 // proto or the package. For example, for foo/bar/baz.proto, a proto_library
 // rule will be generated named //foo/bar:bar_proto.
 //
+// Test protos, whose names end with "_test.proto", are built in a separate
+// testonly proto_library named like //foo/bar:bar_test_proto. Imports from
+// test protos are resolved for that rule only, so test-only dependencies
+// don't leak into the main rule. No Go rules are generated for test protos.
+//
+// Other languages generate rules like go_proto_library for each
+// proto_library. The "# gazelle:proto_default_language" directive limits this
+// to one language, or to none, so only proto_library rules are generated.
+//
 // Dependency resolution
 //
 // proto_library rules are indexed by their srcs attribute. Gazelle attempts
@@ -49,6 +59,23 @@ limitations under the License.
 // (e.g., //foo/bar:bar_proto). If no indexed proto_library provides the source
 // file, Gazelle will guess a label, following conventions.
 //
+// Imports are relative to the repository root by default. The
+// "# gazelle:proto_root" directive names a directory that imports are
+// relative to instead; files in that directory are indexed without the
+// prefix, and guessed labels include it. Imports starting with "./" or "../"
+// are relative to the directory of the importing file; they're not resolved
+// if they point outside the proto root.
+//
+// The "# gazelle:proto_strip_import_prefix" directive sets the
+// strip_import_prefix attribute on generated proto_library rules. Files in
+// rules with strip_import_prefix or import_prefix are indexed by the paths
+// they're imported with.
+//
+// When "# gazelle:proto_resolve_to_files" is set, .proto files exported with
+// exports_files are indexed too, and imports of them are resolved to file
+// labels (e.g., //foo/bar:bar.proto) for toolchains that consume .proto files
+// directly.
+//
 // No attempt is made to resolve protos to rules in external repositories,
 // since there's no indication that a proto import comes from an external
 // repository. In the future, build files in external repos will be indexed,
@@ -56,7 +83,9 @@ limitations under the License.
 //
 // Gazelle has special cases for Well Known Types (i.e., imports of the form
 // google/protobuf/*.proto). These are resolved to rules in
-// @com_google_protobuf.
+// @com_google_protobuf. Other families of protos that are always provided by
+// external repositories may be declared with the "# gazelle:proto_known"
+// directive.
 package proto
 
 import "github.com/bazelbuild/bazel-gazelle/internal/language"
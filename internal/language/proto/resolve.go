@@ -18,7 +18,6 @@ package proto
 import (
 	"errors"
 	"fmt"
-	"log"
 	"path"
 	"strings"
 
@@ -28,10 +27,14 @@ import (
 	"github.com/bazelbuild/bazel-gazelle/internal/repos"
 	"github.com/bazelbuild/bazel-gazelle/internal/resolve"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func (_ *protoLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
-	rel := f.Rel(c.RepoRoot)
+	if r.Kind() == "exports_files" {
+		return exportedProtoImports(c, r, f)
+	}
+	rel := importRel(c, r, f.Rel(c.RepoRoot))
 	srcs := r.AttrStrings("srcs")
 	imports := make([]resolve.ImportSpec, len(srcs))
 	for i, src := range srcs {
@@ -40,6 +43,63 @@ func (_ *protoLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []reso
 	return imports
 }
 
+// fileLang is the language of imports of .proto files exported with
+// exports_files. It's distinct from "proto", so exported files don't make
+// imports of proto_library rules ambiguous.
+const fileLang = "proto_file"
+
+// exportedProtoImports returns the imports of .proto files exported by the
+// exports_files call r. nil is returned unless
+// # gazelle:proto_resolve_to_files is set.
+func exportedProtoImports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	if !GetProtoConfig(c).resolveToFiles || len(r.Args()) == 0 {
+		return nil
+	}
+	list, ok := r.Args()[0].(*bzl.ListExpr)
+	if !ok {
+		return nil
+	}
+	rel := importRel(c, r, f.Rel(c.RepoRoot))
+	var imports []resolve.ImportSpec
+	for _, e := range list.List {
+		if s, ok := e.(*bzl.StringExpr); ok && strings.HasSuffix(s.Value, ".proto") {
+			imports = append(imports, resolve.ImportSpec{Lang: fileLang, Imp: path.Join(rel, s.Value)})
+		}
+	}
+	return imports
+}
+
+// importRel returns the directory that .proto files of r in the package rel
+// are imported from. This is the virtual directory formed by the
+// strip_import_prefix and import_prefix attributes of r, if either is set.
+// Otherwise, files under the proto root are imported relative to it.
+func importRel(c *config.Config, r *rule.Rule, rel string) string {
+	strip, hasStrip := r.Attr("strip_import_prefix").(*bzl.StringExpr)
+	importPrefix, hasImportPrefix := r.Attr("import_prefix").(*bzl.StringExpr)
+	if !hasStrip && !hasImportPrefix {
+		if pc := GetProtoConfig(c); pathtools.HasPrefix(rel, pc.ProtoRoot) {
+			rel = pathtools.TrimPrefix(rel, pc.ProtoRoot)
+		}
+		return rel
+	}
+	if hasStrip {
+		stripRel := path.Join(rel, strip.Value)
+		if path.IsAbs(strip.Value) {
+			stripRel = path.Clean(strip.Value[len("/"):])
+		}
+		if stripRel == "." {
+			stripRel = ""
+		}
+		if pathtools.HasPrefix(rel, stripRel) {
+			rel = pathtools.TrimPrefix(rel, stripRel)
+		}
+	}
+	if hasImportPrefix {
+		rel = path.Join(importPrefix.Value, rel)
+	}
+	return rel
+}
+
 func (_ *protoLang) Embeds(r *rule.Rule, from label.Label) []label.Label {
 	return nil
 }
@@ -54,12 +114,15 @@ func (_ *protoLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.R
 	r.DelAttr("deps")
 	deps := make([]string, 0, len(imports))
 	for _, imp := range imports {
-		l, err := resolveProto(ix, r, imp, from)
-		if err == skipImportError {
+		l, via, err := resolveProto(c, GetProtoConfig(c), ix, r, imp, from)
+		if err == ErrSkipImport {
 			continue
 		} else if err != nil {
-			log.Print(err)
+			_, ambiguous := err.(*resolve.AmbiguousImportError)
+			c.Stats.Unresolved(ambiguous)
+			c.Log(config.Diagnostic{Severity: config.Error, From: from, Imp: imp, Message: err.Error()})
 		} else {
+			c.Stats.Resolved(via)
 			l = l.Rel(from.Repo, from.Pkg)
 			deps = append(deps, l.String())
 		}
@@ -70,47 +133,257 @@ func (_ *protoLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.R
 }
 
 var (
-	skipImportError = errors.New("std import")
-	notFoundError   = errors.New("not found")
+	// ErrSkipImport is returned by ResolveWithIndex when the importing rule
+	// provides the import itself, so no dependency is needed.
+	ErrSkipImport = errors.New("std import")
+
+	// ErrNotFound is returned by ResolveWithIndex when no rule provides
+	// the import.
+	ErrNotFound = errors.New("not found")
+)
+
+// Descriptions of how imports are resolved, counted with -stats.
+const (
+	viaWellKnown  = "well-known types"
+	viaKnownProto = "proto_known directive"
+	viaIndex      = "index"
+	viaImportPath = "proto import path"
 )
 
-func resolveProto(ix *resolve.RuleIndex, r *rule.Rule, imp string, from label.Label) (label.Label, error) {
+func resolveProto(c *config.Config, pc *ProtoConfig, ix *resolve.RuleIndex, r *rule.Rule, imp string, from label.Label) (label.Label, string, error) {
+	imp = pathtools.CleanImport(imp)
 	if !strings.HasSuffix(imp, ".proto") {
-		return label.NoLabel, fmt.Errorf("can't import non-proto: %q", imp)
+		return label.NoLabel, "", fmt.Errorf("can't import non-proto: %q", imp)
+	}
+	imp, err := pc.RelativeImport(imp, from.Pkg)
+	if err != nil {
+		return label.NoLabel, "", err
 	}
 	if isWellKnownProto(imp) {
 		name := path.Base(imp[:len(imp)-len(".proto")]) + "_proto"
-		return label.New(config.WellKnownTypesProtoRepo, "", name), nil
+		return label.New(config.WellKnownTypesProtoRepo, "", name), viaWellKnown, nil
+	}
+	if l, ok := pc.ResolveKnownProto(imp); ok {
+		return l, viaKnownProto, nil
 	}
 
-	if l, err := resolveWithIndex(ix, imp, from); err == nil || err == skipImportError {
-		return l, err
-	} else if err != notFoundError {
-		return label.NoLabel, err
+	if pc.resolveToFiles {
+		if l, ok := resolveExportedFile(pc, ix, imp, from); ok {
+			return l, viaIndex, nil
+		}
 	}
 
-	rel := path.Dir(imp)
-	if rel == "." {
-		rel = ""
+	if m, err := ResolveWithIndex(ix, imp, "proto", from); err == nil {
+		if isTestOnly(m.Rule) && !isTestOnly(r) {
+			return label.NoLabel, "", fmt.Errorf("%q is only provided by testonly rule %s, which can't be a dependency of %s", imp, m.Label, from)
+		}
+		return m.Label, viaIndex, nil
+	} else if err == ErrSkipImport {
+		return label.NoLabel, "", err
+	} else if err != ErrNotFound {
+		return label.NoLabel, "", err
 	}
+
+	rel := pc.ImportDir(imp)
 	name := RuleName("", rel, "")
-	return label.New("", rel, name), nil
+	if IsTestFile(imp) {
+		name = TestRuleName(name)
+	}
+	return label.New("", rel, c.RuleName("proto_library", rel, name)), viaImportPath, nil
+}
+
+// resolveExportedFile returns the label of the .proto file imported by imp,
+// if exactly one package exports it with exports_files. false is returned
+// otherwise, and imp is resolved to a proto_library as usual.
+func resolveExportedFile(pc *ProtoConfig, ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, bool) {
+	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: fileLang, Imp: imp}, "proto", from)
+	if len(matches) != 1 {
+		return label.NoLabel, false
+	}
+	pkg := matches[0].Label.Pkg
+	dir := pkg
+	if pathtools.HasPrefix(dir, pc.ProtoRoot) {
+		dir = pathtools.TrimPrefix(dir, pc.ProtoRoot)
+	}
+	return label.New("", pkg, pathtools.TrimPrefix(imp, dir)), true
 }
 
 func isWellKnownProto(imp string) bool {
 	return pathtools.HasPrefix(imp, config.WellKnownTypesProtoPrefix) && pathtools.TrimPrefix(imp, config.WellKnownTypesProtoPrefix) == path.Base(imp)
 }
 
-func resolveWithIndex(ix *resolve.RuleIndex, imp string, from label.Label) (label.Label, error) {
-	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "proto", Imp: imp}, "proto")
+// ResolveKnownProto returns the label of the proto_library for imp from the
+// mapping set with # gazelle:proto_known with the longest prefix of imp.
+// false is returned if no mapping applies. Other languages may use this to
+// find the rules their own rules for imp are named after.
+func (pc *ProtoConfig) ResolveKnownProto(imp string) (label.Label, bool) {
+	for _, kp := range pc.knownProtos {
+		if pathtools.HasPrefix(imp, kp.prefix) {
+			return kp.label(imp), true
+		}
+	}
+	return label.NoLabel, false
+}
+
+// label returns the label of the rule providing imp. In the name template,
+// "{dir}" is replaced with the directory containing imp and "{name}" with
+// the base name of imp without the .proto extension. If the expanded
+// template contains a colon, the part before it is the package name.
+func (kp knownProto) label(imp string) label.Label {
+	dir := path.Dir(imp)
+	if dir == "." {
+		dir = ""
+	}
+	name := strings.TrimSuffix(path.Base(imp), ".proto")
+	s := strings.NewReplacer("{dir}", dir, "{name}", name).Replace(kp.nameTemplate)
+	pkg := ""
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		pkg, s = strings.TrimPrefix(s[:i], "//"), s[i+1:]
+	}
+	return label.New(kp.repo, pkg, s)
+}
+
+// ResolveWithIndex finds the rule that provides the .proto file imported
+// with imp for the rule from, which is written in the language lang. lang is
+// the name of a resolve.Resolver. It's "proto" when resolving dependencies
+// of proto_library rules; other languages may pass their own names to find
+// their own rules built from proto_library rules, like go_proto_library.
+// Those rules are indexed by the imports of proto_library rules they embed.
+//
+// ErrNotFound is returned if no rule provides imp. ErrSkipImport is returned
+// if from provides imp itself. When more than one rule provides imp, rules
+// without testonly = True are preferred over test rules. After that, rules in
+// packages closer to from.Pkg are preferred, that is, those whose package
+// names share more leading path components with from.Pkg. An error is
+// returned if more than one rule is left after these preferences.
+func ResolveWithIndex(ix *resolve.RuleIndex, imp, lang string, from label.Label) (resolve.FindResult, error) {
+	matches := ix.FindRulesByImport(resolve.ImportSpec{Lang: "proto", Imp: imp}, lang, from)
+	return chooseMatch(matches, imp, from)
+}
+
+// chooseMatch returns the rule in matches that from should depend on to
+// import imp, as described in ResolveWithIndex.
+func chooseMatch(matches []resolve.FindResult, imp string, from label.Label) (resolve.FindResult, error) {
 	if len(matches) == 0 {
-		return label.NoLabel, notFoundError
+		return resolve.FindResult{}, ErrNotFound
+	}
+	for _, m := range matches {
+		if from.Equal(m.Label) {
+			return resolve.FindResult{}, ErrSkipImport
+		}
+	}
+	if len(matches) > 1 {
+		matches = preferredMatches(matches, from)
 	}
 	if len(matches) > 1 {
-		return label.NoLabel, fmt.Errorf("multiple rules (%s and %s) may be imported with %q from %s", matches[0].Label, matches[1].Label, imp, from)
+		return resolve.FindResult{}, &resolve.AmbiguousImportError{Imp: imp, From: from, Label: matches[0].Label, Other: matches[1].Label}
+	}
+	return matches[0], nil
+}
+
+// legacyFilegroupLang is the name of the resolver that indexes filegroups of
+// .proto files generated in legacy mode. Those filegroups are generated by
+// the Go extension, which indexes them by the .proto files in their srcs.
+const legacyFilegroupLang = "go"
+
+// ResolveLegacyWithIndex is like ResolveWithIndex, but it also finds
+// filegroups of .proto files generated in legacy mode (# gazelle:proto
+// legacy), named go_default_library_protos. There are no proto_library rules
+// in that mode, so rules written in lang can't be found by the imports of
+// proto_library rules they embed. If no rule written in lang provides imp,
+// the filegroup that contains imp is returned, so any language can depend
+// on the .proto files it needs.
+func ResolveLegacyWithIndex(ix *resolve.RuleIndex, imp, lang string, from label.Label) (resolve.FindResult, error) {
+	if lang != legacyFilegroupLang {
+		if m, err := ResolveWithIndex(ix, imp, lang, from); err != ErrNotFound {
+			return m, err
+		}
+	}
+	var filegroups []resolve.FindResult
+	for _, m := range ix.FindRulesByImport(resolve.ImportSpec{Lang: "proto", Imp: imp}, legacyFilegroupLang, from) {
+		if m.Rule.Kind() == "filegroup" && m.Label.Name == config.DefaultProtosName {
+			filegroups = append(filegroups, m)
+		}
+	}
+	return chooseMatch(filegroups, imp, from)
+}
+
+// ResolveCCInclude finds the rule that provides the C++ header included with
+// include, like "foo/bar.pb.h", which is generated from the .proto file
+// "foo/bar.proto". This is only a hook for C++ extensions: Gazelle doesn't
+// generate, index, or resolve C++ rules itself. An extension that does may
+// call this to resolve includes to cc_proto_library rules. Those rules must
+// be indexed by a resolver named "cc" that reports the proto_library rules
+// they're built from as embeds.
+// In legacy mode, the filegroup containing the .proto file is returned, as
+// with ResolveLegacyWithIndex. Errors are returned as in ResolveWithIndex.
+// ErrNotFound is returned if include isn't the name of a header generated
+// from a .proto file.
+func ResolveCCInclude(ix *resolve.RuleIndex, include string, from label.Label) (resolve.FindResult, error) {
+	imp, ok := ccHeaderImport(include)
+	if !ok {
+		return resolve.FindResult{}, ErrNotFound
+	}
+	return ResolveLegacyWithIndex(ix, imp, "cc", from)
+}
+
+// ccHeaderImport returns the import path of the .proto file that the C++
+// header include is generated from. false is returned if include doesn't
+// have the suffix of generated headers.
+func ccHeaderImport(include string) (string, bool) {
+	include = pathtools.CleanImport(include)
+	if !strings.HasSuffix(include, ".pb.h") {
+		return "", false
+	}
+	return strings.TrimSuffix(include, ".pb.h") + ".proto", true
+}
+
+// preferredMatches returns the matches that are best for from, as described
+// in ResolveWithIndex. More than one match is returned if there's a tie.
+func preferredMatches(matches []resolve.FindResult, from label.Label) []resolve.FindResult {
+	var nonTest []resolve.FindResult
+	for _, m := range matches {
+		if !isTestOnly(m.Rule) {
+			nonTest = append(nonTest, m)
+		}
+	}
+	if len(nonTest) > 0 {
+		matches = nonTest
+	}
+
+	var closest []resolve.FindResult
+	closestLen := -1
+	for _, m := range matches {
+		n := commonPathLen(m.Label.Pkg, from.Pkg)
+		if n > closestLen {
+			closest = []resolve.FindResult{m}
+			closestLen = n
+		} else if n == closestLen {
+			closest = append(closest, m)
+		}
+	}
+	return closest
+}
+
+// isTestOnly returns whether r has the attribute testonly = True.
+func isTestOnly(r *rule.Rule) bool {
+	if r == nil {
+		return false
+	}
+	lit, ok := r.Attr("testonly").(*bzl.LiteralExpr)
+	return ok && lit.Token == "True"
+}
+
+// commonPathLen returns the number of leading path components shared by
+// the slash-separated paths a and b.
+func commonPathLen(a, b string) int {
+	if a == "" || b == "" {
+		return 0
 	}
-	if from.Equal(matches[0].Label) {
-		return label.NoLabel, skipImportError
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	n := 0
+	for n < len(as) && n < len(bs) && as[n] == bs[n] {
+		n++
 	}
-	return matches[0].Label, nil
+	return n
 }
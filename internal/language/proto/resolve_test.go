@@ -16,6 +16,7 @@ limitations under the License.
 package proto
 
 import (
+	"path"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -33,9 +34,11 @@ func TestResolveProto(t *testing.T) {
 		rel, content string
 	}
 	type testCase struct {
-		desc      string
-		index     []buildFile
-		old, want string
+		desc       string
+		protoRoot  string
+		directives string
+		index      []buildFile
+		old, want  string
 	}
 	for _, tc := range []testCase{
 		{
@@ -145,6 +148,71 @@ proto_library(
     name = "dep_proto",
     srcs = ["foo.proto"],
 )
+`,
+		}, {
+			desc: "unclean",
+			index: []buildFile{{
+				rel: "bar",
+				content: `
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["baz/../bar/./bar.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//bar:bar_proto"],
+)
+`,
+		}, {
+			desc: "local_relative",
+			index: []buildFile{{
+				rel: "bar",
+				content: `
+proto_library(
+    name = "baz_proto",
+    srcs = ["bar.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "./foo.proto",
+        "../bar/bar.proto",
+        "../other/other.proto",
+        "../../outside.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+proto_library(
+    name = "dep_proto",
+    deps = [
+        ":foo_proto",
+        "//bar:baz_proto",
+        "//other:other_proto",
+    ],
+)
 `,
 		}, {
 			desc: "unknown",
@@ -159,14 +227,287 @@ proto_library(
     name = "dep_proto",
     deps = ["//foo/bar:bar_proto"],
 )
+`,
+		}, {
+			desc:      "proto_root_index",
+			protoRoot: "proto",
+			index: []buildFile{{
+				rel: "proto/foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["bar.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["foo/bar.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//proto/foo:foo_proto"],
+)
+`,
+		}, {
+			desc:      "proto_root_unknown",
+			protoRoot: "proto",
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["foo/bar.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//proto/foo:foo_proto"],
+)
+`,
+		}, {
+			desc:      "proto_root_relative",
+			protoRoot: "test",
+			index: []buildFile{{
+				rel: "test/bar",
+				content: `
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "./bar/bar.proto",
+        "../outside.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//test/bar:bar_proto"],
+)
+`,
+		}, {
+			desc: "known",
+			directives: `
+# gazelle:proto_known google @com_google_common {name}_proto
+# gazelle:proto_known google/api go_googleapis {dir}:{name}_proto
+`,
+			index: []buildFile{{
+				rel: "google/api",
+				content: `
+proto_library(
+    name = "api_proto",
+    srcs = ["annotations.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "google/api/annotations.proto",
+        "google/rpc/status.proto",
+        "google/protobuf/any.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = [
+        "@com_google_common//:status_proto",
+        "@com_google_protobuf//:any_proto",
+        "@go_googleapis//google/api:annotations_proto",
+    ],
+)
+`,
+		}, {
+			desc:       "resolve_to_files",
+			directives: "# gazelle:proto_resolve_to_files true",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+exports_files(["foo.proto"])
+
+proto_library(
+    name = "foo_proto",
+    srcs = [
+        "bar.proto",
+        "foo.proto",
+    ],
+)
+
+exports_files(["baz.proto"])
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "foo/bar.proto",
+        "foo/baz.proto",
+        "foo/foo.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = [
+        "//foo:baz.proto",
+        "//foo:foo.proto",
+        "//foo:foo_proto",
+    ],
+)
+`,
+		}, {
+			desc: "resolve_to_files_off",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+exports_files(["foo.proto"])
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["foo/foo.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//foo:foo_proto"],
+)
+`,
+		}, {
+			desc: "strip_import_prefix",
+			index: []buildFile{{
+				rel: "third_party/protos/foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    strip_import_prefix = "/third_party/protos",
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["foo/foo.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//third_party/protos/foo:foo_proto"],
+)
+`,
+		}, {
+			desc: "strip_import_prefix_with_import_prefix",
+			index: []buildFile{{
+				rel: "third_party/protos/foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    strip_import_prefix = "/third_party/protos",
+    import_prefix = "vendor",
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = ["vendor/foo/foo.proto"],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//third_party/protos/foo:foo_proto"],
+)
+`,
+		}, {
+			desc: "test_protos",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+proto_library(
+    name = "foo_test_proto",
+    testonly = True,
+    srcs = ["foo_test.proto"],
+)
+`,
+			}},
+			old: `
+proto_library(
+    name = "dep_proto",
+    _imports = [
+        "foo/foo.proto",
+        "foo/foo_test.proto",
+    ],
+)
+
+proto_library(
+    name = "dep_test_proto",
+    testonly = True,
+    _imports = [
+        "bar/bar_test.proto",
+        "foo/foo.proto",
+        "foo/foo_test.proto",
+    ],
+)
+`,
+			want: `
+proto_library(
+    name = "dep_proto",
+    deps = ["//foo:foo_proto"],
+)
+
+proto_library(
+    name = "dep_test_proto",
+    testonly = True,
+    deps = [
+        "//bar:bar_test_proto",
+        "//foo:foo_proto",
+        "//foo:foo_test_proto",
+    ],
+)
 `,
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			c := config.New()
-			c.Exts[protoName] = &ProtoConfig{}
+			c.Exts[protoName] = &ProtoConfig{ProtoRoot: tc.protoRoot}
 			lang := New()
-			ix := resolve.NewRuleIndex(map[string]resolve.Resolver{"proto_library": lang})
+			if tc.directives != "" {
+				df, err := rule.LoadData("BUILD.bazel", []byte(tc.directives))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lang.Configure(c, "", df)
+			}
+			ix := resolve.NewRuleIndex(map[string]resolve.Resolver{"exports_files": lang, "proto_library": lang})
 			rc := (*repos.RemoteCache)(nil)
 			for _, bf := range tc.index {
 				f, err := rule.LoadData(filepath.Join(bf.rel, "BUILD.bazel"), []byte(bf.content))
@@ -207,3 +548,348 @@ func convertImportsAttr(r *rule.Rule) {
 	r.DelAttr("_imports")
 	r.SetPrivateAttr(config.GazelleImportsKey, value)
 }
+
+// pyProtoResolver indexes py_proto_library rules by the imports of the
+// proto_library rules they embed.
+type pyProtoResolver struct{}
+
+func (_ pyProtoResolver) Name() string { return "py" }
+
+func (_ pyProtoResolver) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	return []resolve.ImportSpec{}
+}
+
+func (_ pyProtoResolver) Embeds(r *rule.Rule, from label.Label) []label.Label {
+	l, err := label.Parse(r.AttrString("proto"))
+	if err != nil {
+		return nil
+	}
+	return []label.Label{l.Abs(from.Repo, from.Pkg)}
+}
+
+func (_ pyProtoResolver) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, from label.Label) {
+}
+
+func TestResolveWithIndexLang(t *testing.T) {
+	c := config.New()
+	c.Exts[protoName] = &ProtoConfig{}
+	ix := resolve.NewRuleIndex(map[string]resolve.Resolver{
+		"proto_library":    New(),
+		"py_proto_library": pyProtoResolver{},
+	})
+	f, err := rule.LoadData("foo/BUILD.bazel", []byte(`
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+
+py_proto_library(
+    name = "foo_py_proto",
+    proto = ":foo_proto",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.Finish()
+
+	from := label.New("", "bar", "bar")
+	for _, tc := range []struct {
+		lang, imp string
+		want      label.Label
+		wantErr   error
+	}{
+		{lang: "proto", imp: "foo/foo.proto", want: label.New("", "foo", "foo_proto")},
+		{lang: "py", imp: "foo/foo.proto", want: label.New("", "foo", "foo_py_proto")},
+		{lang: "py", imp: "foo/missing.proto", wantErr: ErrNotFound},
+		{lang: "go", imp: "foo/foo.proto", wantErr: ErrNotFound},
+	} {
+		got, err := ResolveWithIndex(ix, tc.imp, tc.lang, from)
+		if err != tc.wantErr {
+			t.Errorf("%s %s: got error %v; want %v", tc.lang, tc.imp, err, tc.wantErr)
+		} else if err == nil && !got.Label.Equal(tc.want) {
+			t.Errorf("%s %s: got %s; want %s", tc.lang, tc.imp, got.Label, tc.want)
+		}
+	}
+}
+
+// ccProtoResolver indexes cc_proto_library rules by the imports of the
+// proto_library rules in their deps.
+type ccProtoResolver struct{}
+
+func (_ ccProtoResolver) Name() string { return "cc" }
+
+func (_ ccProtoResolver) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	return []resolve.ImportSpec{}
+}
+
+func (_ ccProtoResolver) Embeds(r *rule.Rule, from label.Label) []label.Label {
+	var embeds []label.Label
+	for _, dep := range r.AttrStrings("deps") {
+		if l, err := label.Parse(dep); err == nil {
+			embeds = append(embeds, l.Abs(from.Repo, from.Pkg))
+		}
+	}
+	return embeds
+}
+
+func (_ ccProtoResolver) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, from label.Label) {
+}
+
+func TestResolveCCInclude(t *testing.T) {
+	c := config.New()
+	c.Exts[protoName] = &ProtoConfig{}
+	ix := resolve.NewRuleIndex(map[string]resolve.Resolver{
+		"proto_library":    New(),
+		"cc_proto_library": ccProtoResolver{},
+	})
+	f, err := rule.LoadData("sub/BUILD.bazel", []byte(`
+proto_library(
+    name = "bar_proto",
+    srcs = ["bar.proto"],
+)
+
+cc_proto_library(
+    name = "bar_cc_proto",
+    deps = [":bar_proto"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.Finish()
+
+	from := label.New("", "app", "app")
+	for _, tc := range []struct {
+		include string
+		want    label.Label
+		wantErr error
+	}{
+		{include: "sub/bar.pb.h", want: label.New("", "sub", "bar_cc_proto")},
+		{include: "sub/./bar.pb.h", want: label.New("", "sub", "bar_cc_proto")},
+		{include: "sub/bar.h", wantErr: ErrNotFound},
+		{include: "sub/missing.pb.h", wantErr: ErrNotFound},
+	} {
+		got, err := ResolveCCInclude(ix, tc.include, from)
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v; want %v", tc.include, err, tc.wantErr)
+		} else if err == nil && !got.Label.Equal(tc.want) {
+			t.Errorf("%s: got %s; want %s", tc.include, got.Label, tc.want)
+		}
+	}
+}
+
+// legacyFilegroupResolver stands in for the Go extension, which indexes
+// filegroups of .proto files generated in legacy mode by their srcs.
+type legacyFilegroupResolver struct{}
+
+func (_ legacyFilegroupResolver) Name() string { return "go" }
+
+func (_ legacyFilegroupResolver) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	var imports []resolve.ImportSpec
+	for _, src := range r.AttrStrings("srcs") {
+		imports = append(imports, resolve.ImportSpec{Lang: "proto", Imp: path.Join(f.Rel(c.RepoRoot), src)})
+	}
+	return imports
+}
+
+func (_ legacyFilegroupResolver) Embeds(r *rule.Rule, from label.Label) []label.Label {
+	return nil
+}
+
+func (_ legacyFilegroupResolver) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repos.RemoteCache, r *rule.Rule, from label.Label) {
+}
+
+func TestResolveLegacyWithIndex(t *testing.T) {
+	c := config.New()
+	c.Exts[protoName] = &ProtoConfig{Mode: LegacyMode}
+	ix := resolve.NewRuleIndex(map[string]resolve.Resolver{
+		"filegroup":        legacyFilegroupResolver{},
+		"cc_proto_library": ccProtoResolver{},
+	})
+	f, err := rule.LoadData("sub/BUILD.bazel", []byte(`
+filegroup(
+    name = "go_default_library_protos",
+    srcs = ["bar.proto"],
+)
+
+filegroup(
+    name = "other_protos",
+    srcs = ["other.proto"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.Finish()
+
+	from := label.New("", "app", "app")
+	want := label.New("", "sub", "go_default_library_protos")
+	for _, lang := range []string{"go", "cc"} {
+		if got, err := ResolveLegacyWithIndex(ix, "sub/bar.proto", lang, from); err != nil {
+			t.Errorf("%s: got error %v", lang, err)
+		} else if !got.Label.Equal(want) {
+			t.Errorf("%s: got %s; want %s", lang, got.Label, want)
+		}
+		if _, err := ResolveLegacyWithIndex(ix, "sub/other.proto", lang, from); err != ErrNotFound {
+			t.Errorf("%s: other.proto: got error %v; want %v", lang, err, ErrNotFound)
+		}
+	}
+	if got, err := ResolveCCInclude(ix, "sub/bar.pb.h", from); err != nil {
+		t.Errorf("ResolveCCInclude: got error %v", err)
+	} else if !got.Label.Equal(want) {
+		t.Errorf("ResolveCCInclude: got %s; want %s", got.Label, want)
+	}
+}
+
+func TestResolveWithIndexPreference(t *testing.T) {
+	type buildFile struct {
+		rel, content string
+	}
+	for _, tc := range []struct {
+		desc    string
+		index   []buildFile
+		from    label.Label
+		want    label.Label
+		wantErr bool
+	}{
+		{
+			desc: "non_test",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "foo_test_proto",
+    srcs = ["foo.proto"],
+    testonly = True,
+)
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}},
+			from: label.New("", "bar", "bar_proto"),
+			want: label.New("", "foo", "foo_proto"),
+		}, {
+			desc: "closest",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}, {
+				rel: "proto/foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}},
+			from: label.New("", "proto/bar", "bar_proto"),
+			want: label.New("", "proto/foo", "foo_proto"),
+		}, {
+			desc: "non_test_before_closest",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}, {
+				rel: "proto/foo",
+				content: `
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+    testonly = True,
+)
+`,
+			}},
+			from: label.New("", "proto/bar", "bar_proto"),
+			want: label.New("", "foo", "foo_proto"),
+		}, {
+			desc: "self",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "foo_test_proto",
+    srcs = ["foo.proto"],
+    testonly = True,
+)
+
+proto_library(
+    name = "foo_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}},
+			from:    label.New("", "foo", "foo_test_proto"),
+			wantErr: true,
+		}, {
+			desc: "tie",
+			index: []buildFile{{
+				rel: "foo",
+				content: `
+proto_library(
+    name = "a_proto",
+    srcs = ["foo.proto"],
+)
+
+proto_library(
+    name = "b_proto",
+    srcs = ["foo.proto"],
+)
+`,
+			}},
+			from:    label.New("", "bar", "bar_proto"),
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := config.New()
+			c.Exts[protoName] = &ProtoConfig{ProtoRoot: "proto"}
+			ix := resolve.NewRuleIndex(map[string]resolve.Resolver{"proto_library": New()})
+			for _, bf := range tc.index {
+				f, err := rule.LoadData(filepath.Join(bf.rel, "BUILD.bazel"), []byte(bf.content))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range f.Rules {
+					ix.AddRule(c, r, f)
+				}
+			}
+			ix.Finish()
+
+			got, err := ResolveWithIndex(ix, "foo/foo.proto", "proto", tc.from)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %s; want error", got.Label)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			} else if !got.Label.Equal(tc.want) {
+				t.Errorf("got %s; want %s", got.Label, tc.want)
+			}
+		})
+	}
+}
@@ -23,8 +23,10 @@ import (
 )
 
 // FixLoads removes loads of unused go rules and adds loads of newly used rules.
-// This should be called after FixFile and MergeFile, since symbols
-// may be introduced that aren't loaded.
+// Loads of the same known file are consolidated into the first of them, and
+// their symbols are sorted. Aliased symbols (like foo = "bar") and symbols
+// Gazelle doesn't know about are preserved. This should be called after
+// FixFile and MergeFile, since symbols may be introduced that aren't loaded.
 //
 // This function calls File.Sync before processing loads.
 func FixLoads(f *rule.File, knownLoads []rule.LoadInfo) {
@@ -72,27 +74,31 @@ func FixLoads(f *rule.File, knownLoads []rule.LoadInfo) {
 	// knownLoads instead of knownFiles.
 	for _, known := range knownLoads {
 		file := known.Name
-		first := true
+		var first *rule.Load
 		for _, l := range loads {
 			if l.Name() != file {
 				continue
 			}
-			if first {
-				fixLoad(l, file, usedKinds[file], knownKinds)
-				first = false
+			if first == nil {
+				first = l
 			} else {
-				fixLoad(l, file, nil, knownKinds)
-			}
-			if l.IsEmpty() {
+				first.Merge(l)
 				l.Delete()
 			}
 		}
-		if first {
+		if first == nil {
 			load := fixLoad(nil, file, usedKinds[file], knownKinds)
 			if load != nil {
 				index := newLoadIndex(f, known.After)
 				load.Insert(f, index)
 			}
+			continue
+		}
+		fixLoad(first, file, usedKinds[file], knownKinds)
+		if first.IsEmpty() {
+			first.Delete()
+		} else {
+			first.Sort()
 		}
 	}
 }
@@ -100,8 +106,8 @@ func FixLoads(f *rule.File, knownLoads []rule.LoadInfo) {
 // fixLoad updates a load statement with the given symbols. If load is nil,
 // a new load may be created and returned. Symbols in kinds will be added
 // to the load if they're not already present. Known symbols not in kinds
-// will be removed if present. Other symbols will be preserved. If load is
-// empty, nil is returned.
+// will be removed if present. Other symbols and aliases will be preserved.
+// If load is empty, nil is returned.
 func fixLoad(load *rule.Load, file string, kinds map[string]bool, knownKinds map[string]string) *rule.Load {
 	if load == nil {
 		if len(kinds) == 0 {
@@ -114,7 +120,7 @@ func fixLoad(load *rule.Load, file string, kinds map[string]bool, knownKinds map
 		load.Add(k)
 	}
 	for _, k := range load.Symbols() {
-		if knownKinds[k] != "" && !kinds[k] {
+		if knownKinds[k] != "" && !kinds[k] && !load.IsAlias(k) {
 			load.Remove(k)
 		}
 	}
@@ -0,0 +1,63 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// headerMarker is the last line of headers written by SetHeader. It lets
+// SetHeader recognize and update a header it wrote earlier, without
+// mistaking other comments at the top of a file for a header.
+const headerMarker = "# The header above is set with # gazelle:build_file_header."
+
+// SetHeader ensures that f starts with header, a list of comment lines set
+// with # gazelle:build_file_header, followed by headerMarker. The header is
+// the block of comments at the top of the file, separated from the next
+// statement by a blank line. If that block ends with headerMarker, it was
+// written by SetHeader, and it's replaced with header, so an outdated header
+// is updated. Otherwise, header is inserted above it. Nothing is done if
+// header is empty.
+//
+// SetHeader edits the syntax tree of f directly, so it should be called
+// after f.Sync, just before f is written.
+func SetHeader(f *rule.File, header []string) {
+	if len(header) == 0 {
+		return
+	}
+	comments := make([]bzl.Comment, len(header)+1)
+	for i, line := range header {
+		comments[i] = bzl.Comment{Token: line}
+	}
+	comments[len(header)] = bzl.Comment{Token: headerMarker}
+	block := &bzl.CommentBlock{Comments: bzl.Comments{After: comments}}
+
+	if len(f.File.Stmt) > 0 {
+		if old, ok := f.File.Stmt[0].(*bzl.CommentBlock); ok && isHeader(old.Comments.After) {
+			old.Comments.After = comments
+			return
+		}
+	}
+	f.File.Stmt = append([]bzl.Expr{block}, f.File.Stmt...)
+}
+
+// isHeader returns whether comments were written by SetHeader.
+func isHeader(comments []bzl.Comment) bool {
+	return len(comments) > 0 && strings.TrimSpace(comments[len(comments)-1].Token) == headerMarker
+}
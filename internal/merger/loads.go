@@ -0,0 +1,114 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// UnusedSymbol is a symbol loaded by a load statement in a build file that
+// isn't used anywhere else in the file.
+type UnusedSymbol struct {
+	// Load is the name of the file the symbol is loaded from, for example,
+	// "@io_bazel_rules_go//go:def.bzl".
+	Load string
+
+	// Symbol is the name the symbol is bound to in the build file. For
+	// aliased symbols (like foo = "bar"), this is the alias.
+	Symbol string
+}
+
+// FindUnusedLoads returns the symbols loaded in f that aren't used by any
+// other statement, sorted by load and symbol. Unlike FixLoads, which only
+// considers symbols called as rules, any reference to a symbol counts as a
+// use, for example, a constant in an attribute value. f is not modified.
+func FindUnusedLoads(f *rule.File) []UnusedSymbol {
+	used := usedSymbols(f)
+	var unused []UnusedSymbol
+	for _, l := range f.Loads {
+		for _, sym := range l.Symbols() {
+			if !used[sym] {
+				unused = append(unused, UnusedSymbol{Load: l.Name(), Symbol: sym})
+			}
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		if unused[i].Load != unused[j].Load {
+			return unused[i].Load < unused[j].Load
+		}
+		return unused[i].Symbol < unused[j].Symbol
+	})
+	return unused
+}
+
+// RemoveUnusedLoads removes the symbols reported by FindUnusedLoads from
+// the load statements in f. Load statements left without symbols are
+// deleted. The removed symbols are returned.
+func RemoveUnusedLoads(f *rule.File) []UnusedSymbol {
+	unused := FindUnusedLoads(f)
+	if len(unused) == 0 {
+		return nil
+	}
+	isUnused := make(map[UnusedSymbol]bool)
+	for _, u := range unused {
+		isUnused[u] = true
+	}
+	for _, l := range f.Loads {
+		for _, sym := range l.Symbols() {
+			if isUnused[UnusedSymbol{Load: l.Name(), Symbol: sym}] {
+				l.Remove(sym)
+			}
+		}
+		if l.IsEmpty() {
+			l.Delete()
+		}
+	}
+	f.Sync()
+	return unused
+}
+
+// identRe matches identifiers in blocks of Python code, like function
+// definitions, which the build file parser doesn't interpret.
+var identRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// usedSymbols returns the set of identifiers referenced by statements in f
+// other than load statements. This may include names that aren't loaded,
+// like attribute names, but every use of a loaded symbol is included.
+func usedSymbols(f *rule.File) map[string]bool {
+	used := make(map[string]bool)
+	for _, stmt := range f.File.Stmt {
+		if call, ok := stmt.(*bzl.CallExpr); ok {
+			if x, ok := call.X.(*bzl.LiteralExpr); ok && x.Token == "load" {
+				continue
+			}
+		}
+		bzl.Walk(stmt, func(x bzl.Expr, _ []bzl.Expr) {
+			switch x := x.(type) {
+			case *bzl.LiteralExpr:
+				used[x.Token] = true
+			case *bzl.PythonBlock:
+				for _, id := range identRe.FindAllString(x.Token, -1) {
+					used[id] = true
+				}
+			}
+		})
+	}
+	return used
+}
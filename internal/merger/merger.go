@@ -20,7 +20,9 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 // Phase indicates which attributes should be merged in matching rules.
@@ -43,22 +45,53 @@ const (
 // adds unmatched rules to the end of the merged file. MergeFile also merges
 // rules in empty with matching rules in f and deletes rules that
 // are empty after merging. attrs is the set of attributes to merge. Attributes
-// not in this set will be left alone if they already exist.
-func MergeFile(oldFile *rule.File, emptyRules, genRules []*rule.Rule, phase Phase, kinds map[string]rule.KindInfo) {
+// not in this set will be left alone if they already exist. Rules with the
+// config.GazelleOnlyAttrsKey private attribute only modify the attributes
+// listed there, and they aren't added or deleted. c is the configuration for
+// the directory of oldFile. Rules of kinds replaced with # gazelle:map_kind
+// in c are written with attributes in the order of the kinds they replace.
+// c may be nil if no kinds are mapped.
+func MergeFile(oldFile *rule.File, emptyRules, genRules []*rule.Rule, phase Phase, kinds map[string]rule.KindInfo, c *config.Config) {
 	getMergeAttrs := func(r *rule.Rule) map[string]bool {
+		var attrs map[string]bool
 		if phase == PreResolve {
-			return kinds[r.Kind()].MergeableAttrs
+			attrs = withManagedAttrs(r, kinds[r.Kind()].MergeableAttrs)
 		} else {
-			return kinds[r.Kind()].ResolveAttrs
+			attrs = kinds[r.Kind()].ResolveAttrs
 		}
+		return withOnlyAttrs(r, attrs)
+	}
+
+	// Updated rules are written with attributes in the conventional order
+	// for their kinds.
+	attrOrder := func(kind string) []string {
+		if c != nil {
+			kind = c.UnmappedKind(kind)
+		}
+		return kinds[kind].AttrOrder
+	}
+	for _, r := range oldFile.Rules {
+		r.SetAttrOrder(attrOrder(r.Kind()))
+	}
+	for _, r := range genRules {
+		r.SetAttrOrder(attrOrder(r.Kind()))
 	}
 
 	// Merge empty rules into the file and delete any rules which become empty.
+	// Attributes of deleted rules are remembered, so preserved attributes can
+	// be carried over if a rule with the same name is generated again.
+	deleted := make(map[string]*rule.Rule)
 	for _, emptyRule := range emptyRules {
 		if oldRule, _ := match(oldFile.Rules, emptyRule, kinds[emptyRule.Kind()]); oldRule != nil {
-			rule.MergeRules(emptyRule, oldRule, getMergeAttrs(emptyRule), oldFile.Path)
-			if oldRule.IsEmpty(kinds[oldRule.Kind()]) {
+			saved := rule.NewRule(oldRule.Kind(), oldRule.Name())
+			for _, key := range oldRule.AttrKeys() {
+				saved.SetAttr(key, oldRule.Attr(key))
+			}
+			limitSortedAttrs(emptyRule, oldRule)
+			rule.MergeRules(onlyAttrsRule(emptyRule), oldRule, getMergeAttrs(emptyRule), oldFile.Path)
+			if !hasOnlyAttrs(emptyRule) && oldRule.IsEmpty(kinds[oldRule.Kind()]) {
 				oldRule.Delete()
+				deleted[saved.Name()] = saved
 			}
 		}
 	}
@@ -98,11 +131,168 @@ func MergeFile(oldFile *rule.File, emptyRules, genRules []*rule.Rule, phase Phas
 			continue
 		}
 		if matchRules[i] == nil {
+			if hasOnlyAttrs(genRule) {
+				continue
+			}
+			if old, ok := deleted[genRule.Name()]; ok && phase == PreResolve && old.Kind() == genRule.Kind() {
+				preserveAttrs(genRule, old, kinds[genRule.Kind()])
+			}
 			genRule.Insert(oldFile)
 		} else {
-			rule.MergeRules(genRule, matchRules[i], getMergeAttrs(genRule), oldFile.Path)
+			if phase == PreResolve {
+				preserveAttrs(genRule, matchRules[i], kinds[genRule.Kind()])
+			}
+			limitSortedAttrs(genRule, matchRules[i])
+			rule.MergeRules(onlyAttrsRule(genRule), matchRules[i], getMergeAttrs(genRule), oldFile.Path)
+		}
+	}
+}
+
+// MergeFiles merges the rules in gen into a copy of old, as Gazelle does when
+// it updates a build file, and returns the copy. Both merge phases are
+// performed, so attributes that depend on resolution, like deps, are merged
+// too. Rules in gen that are empty according to kinds are merged like rules
+// that Gazelle didn't generate: matching rules in old are deleted if they're
+// empty afterward. Rules and attributes marked with "# keep" are preserved.
+// Finally, load statements are fixed for the kinds in loads. If old is nil,
+// an empty file at the path of gen is used.
+//
+// gen and old are not modified, but they must not have pending edits (they
+// must be newly loaded or synced), since they're copied by formatting them.
+// Private attributes of rules in gen are copied.
+func MergeFiles(gen, old *rule.File, loads []rule.LoadInfo, kinds map[string]rule.KindInfo) (*rule.File, error) {
+	genCopy, err := copyFile(gen)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range genCopy.Rules {
+		for _, key := range gen.Rules[i].PrivateAttrKeys() {
+			r.SetPrivateAttr(key, gen.Rules[i].PrivateAttr(key))
+		}
+	}
+	var f *rule.File
+	if old == nil {
+		f = rule.EmptyFile(gen.Path)
+	} else if f, err = copyFile(old); err != nil {
+		return nil, err
+	}
+
+	var emptyRules, genRules []*rule.Rule
+	for _, r := range genCopy.Rules {
+		if r.IsEmpty(kinds[r.Kind()]) {
+			emptyRules = append(emptyRules, r)
+		} else {
+			genRules = append(genRules, r)
+		}
+	}
+	MergeFile(f, emptyRules, genRules, PreResolve, kinds, nil)
+	MergeFile(f, emptyRules, genRules, PostResolve, kinds, nil)
+	FixLoads(f, loads)
+	f.Sync()
+	return f, nil
+}
+
+// copyFile returns a copy of f made by formatting and parsing it again.
+func copyFile(f *rule.File) (*rule.File, error) {
+	c, err := rule.LoadData(f.Path, bzl.Format(f.File))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Rules) != len(f.Rules) {
+		return nil, fmt.Errorf("%s: file has pending edits", f.Path)
+	}
+	return c, nil
+}
+
+// withManagedAttrs returns attrs, extended with attributes listed in the
+// config.GazelleManagedAttrsKey private attribute of r. attrs is not modified.
+func withManagedAttrs(r *rule.Rule, attrs map[string]bool) map[string]bool {
+	managed, ok := r.PrivateAttr(config.GazelleManagedAttrsKey).([]string)
+	if !ok || len(managed) == 0 {
+		return attrs
+	}
+	merged := make(map[string]bool)
+	for k, v := range attrs {
+		merged[k] = v
+	}
+	for _, k := range managed {
+		merged[k] = true
+	}
+	return merged
+}
+
+// hasOnlyAttrs returns whether r has the config.GazelleOnlyAttrsKey private
+// attribute, which limits the attributes it may modify.
+func hasOnlyAttrs(r *rule.Rule) bool {
+	_, ok := r.PrivateAttr(config.GazelleOnlyAttrsKey).([]string)
+	return ok
+}
+
+// withOnlyAttrs returns the attributes in attrs that are also listed in the
+// config.GazelleOnlyAttrsKey private attribute of r. If r doesn't have that
+// attribute, attrs is returned. attrs is not modified.
+func withOnlyAttrs(r *rule.Rule, attrs map[string]bool) map[string]bool {
+	only, ok := r.PrivateAttr(config.GazelleOnlyAttrsKey).([]string)
+	if !ok {
+		return attrs
+	}
+	filtered := make(map[string]bool)
+	for _, k := range only {
+		if attrs[k] {
+			filtered[k] = true
+		}
+	}
+	return filtered
+}
+
+// onlyAttrsRule returns r if it doesn't have the config.GazelleOnlyAttrsKey
+// private attribute. Otherwise, it returns a copy of r with only the
+// attributes listed there, so other attributes aren't added to existing
+// rules. Private attributes are copied.
+func onlyAttrsRule(r *rule.Rule) *rule.Rule {
+	only, ok := r.PrivateAttr(config.GazelleOnlyAttrsKey).([]string)
+	if !ok {
+		return r
+	}
+	c := rule.NewRule(r.Kind(), r.Name())
+	for _, k := range only {
+		if v := r.Attr(k); v != nil {
+			c.SetAttr(k, v)
 		}
 	}
+	for _, k := range r.PrivateAttrKeys() {
+		c.SetPrivateAttr(k, r.PrivateAttr(k))
+	}
+	return c
+}
+
+// limitSortedAttrs copies the config.GazelleOnlyAttrsKey private attribute of
+// src, if set, to the rule.SortedAttrsKey private attribute of dst, so lists
+// in attributes src may not modify keep their order.
+func limitSortedAttrs(src, dst *rule.Rule) {
+	if only, ok := src.PrivateAttr(config.GazelleOnlyAttrsKey).([]string); ok {
+		dst.SetPrivateAttr(rule.SortedAttrsKey, only)
+	}
+}
+
+// preserveAttrs copies attributes listed in info.PreservedAttrs or in the
+// config.GazellePreservedAttrsKey private attribute of genRule from oldRule
+// to genRule, unless genRule already sets them.
+func preserveAttrs(genRule, oldRule *rule.Rule, info rule.KindInfo) {
+	extra, _ := genRule.PrivateAttr(config.GazellePreservedAttrsKey).([]string)
+	copyAttr := func(key string) {
+		if genRule.Attr(key) == nil {
+			if value := oldRule.Attr(key); value != nil {
+				genRule.SetAttr(key, value)
+			}
+		}
+	}
+	for key := range info.PreservedAttrs {
+		copyAttr(key)
+	}
+	for _, key := range extra {
+		copyAttr(key)
+	}
 }
 
 // substituteRule replaces local labels (those beginning with ":", referring to
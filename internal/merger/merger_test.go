@@ -16,8 +16,12 @@ limitations under the License.
 package merger
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/language"
 	"github.com/bazelbuild/bazel-gazelle/internal/language/go"
 	"github.com/bazelbuild/bazel-gazelle/internal/language/proto"
@@ -368,6 +372,45 @@ go_library(
     name = "go_default_library",
     srcs = glob(["*.go"]),
 )
+`,
+	}, {
+		desc: "stale select with keep keeps old",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    deps = select({
+        "//platforms:lx": [
+            "//foo:go_default_library",  # keep
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    deps = ["//bar:go_default_library"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    deps = select({
+        "//platforms:lx": [
+            "//foo:go_default_library",  # keep
+        ],
+        "//conditions:default": [],
+    }),
+)
 `,
 	}, {
 		desc: "delete empty list",
@@ -863,6 +906,97 @@ go_proto_library(
     importpath = "example.com/repo/foo",
     proto = ":foo_proto",
 )
+`,
+	}, {
+		desc: "merge old list with gen glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+        "extra.go",  # keep
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["*_test.go"]) + ["a.c"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(
+        ["*.go"],
+        exclude = ["*_test.go"],
+    ) + [
+        "a.c",
+        "extra.go",  # keep
+    ],
+)
+`,
+	}, {
+		desc: "merge old glob with gen glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["*_test.go", "old.go"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["*_test.go"]),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(
+        ["*.go"],
+        exclude = ["*_test.go"],
+    ),
+)
+`,
+	}, {
+		desc: "old glob not merged with gen list",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"]),
+)
 `,
 	},
 }
@@ -882,7 +1016,7 @@ func TestMergeFile(t *testing.T) {
 			if err != nil {
 				t.Fatalf("%s: %v", tc.desc, err)
 			}
-			MergeFile(f, emptyFile.Rules, genFile.Rules, PreResolve, testKinds)
+			MergeFile(f, emptyFile.Rules, genFile.Rules, PreResolve, testKinds, nil)
 			FixLoads(f, testLoads)
 
 			want := tc.expected
@@ -897,6 +1031,201 @@ func TestMergeFile(t *testing.T) {
 	}
 }
 
+func TestMergeManagedAttrs(t *testing.T) {
+	old := `
+go_library(
+    name = "a",
+    visibility = ["//old:__pkg__"],
+)
+
+go_library(
+    name = "b",
+    visibility = ["//old:__pkg__"],
+)
+`
+	gen := `
+go_library(
+    name = "a",
+    visibility = ["//new:__pkg__"],
+)
+
+go_library(
+    name = "b",
+    visibility = ["//new:__pkg__"],
+)
+`
+	want := `go_library(
+    name = "a",
+    visibility = ["//new:__pkg__"],
+)
+
+go_library(
+    name = "b",
+    visibility = ["//old:__pkg__"],
+)
+`
+	genFile, err := rule.LoadData("current", []byte(gen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := rule.LoadData("previous", []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genFile.Rules[0].SetPrivateAttr(config.GazelleManagedAttrsKey, []string{"visibility"})
+	MergeFile(f, nil, genFile.Rules, PreResolve, testKinds, nil)
+	if got := string(f.Format()); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
+
+func TestMergeGlobPatterns(t *testing.T) {
+	old := `
+go_library(
+    name = "a",
+    srcs = glob(["*.go"], exclude = ["*_test.go"]) + [
+        "gen.go",  # keep
+    ],
+)
+
+go_library(
+    name = "b",
+    srcs = glob(["src/*.go"]),
+)
+
+go_library(
+    name = "c",
+    srcs = glob(["*.go"]),
+)
+`
+	gen := `
+go_library(
+    name = "a",
+    srcs = ["a.go"],
+)
+
+go_library(
+    name = "b",
+    srcs = ["b.go"],
+)
+`
+	empty := `
+go_library(name = "c")
+`
+	want := `go_library(
+    name = "a",
+    srcs = [
+        "a.go",
+        "gen.go",  # keep
+    ],
+)
+
+go_library(
+    name = "b",
+    srcs = glob(["src/*.go"]),
+)
+`
+	genFile, err := rule.LoadData("current", []byte(gen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyFile, err := rule.LoadData("empty", []byte(empty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := rule.LoadData("previous", []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range append(genFile.Rules, emptyFile.Rules...) {
+		r.SetPrivateAttr(rule.GlobPatternsKey, []string{"*.go", "*_test.go"})
+	}
+	MergeFile(f, emptyFile.Rules, genFile.Rules, PreResolve, testKinds, nil)
+	if got := string(f.Format()); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	old := `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "gen.go",  # keep
+    ],
+    importpath = "example.com/repo",
+    deps = ["//old:go_default_library"],
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["a_test.go"],
+)
+`
+	gen := `go_library(
+    name = "go_default_library",
+    srcs = ["b.go"],
+    importpath = "example.com/repo",
+    deps = ["//new:go_default_library"],
+)
+
+go_test(name = "go_default_test")
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+)
+`
+	want := `load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        "gen.go",  # keep
+    ],
+    importpath = "example.com/repo",
+    deps = ["//new:go_default_library"],
+)
+
+go_binary(
+    name = "cmd",
+    embed = [":go_default_library"],
+)
+`
+	genFile, err := rule.LoadData("BUILD.bazel", []byte(gen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFile, err := rule.LoadData("BUILD.bazel", []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := MergeFiles(genFile, oldFile, testLoads, testKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(f.Format()); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+	if got := string(oldFile.Format()); got != old {
+		t.Errorf("old file was modified: %s", got)
+	}
+	if got := string(genFile.Format()); got != gen {
+		t.Errorf("generated file was modified: %s", got)
+	}
+
+	f, err = MergeFiles(genFile, nil, testLoads, testKinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Rules) != 2 || f.Rules[0].Name() != "go_default_library" || f.Rules[1].Name() != "cmd" {
+		t.Errorf("merging into an empty file: got %s", f.Format())
+	}
+}
+
 var (
 	testKinds map[string]rule.KindInfo
 	testLoads []rule.LoadInfo
@@ -994,3 +1323,429 @@ go_binary(name = "z")
 		})
 	}
 }
+
+func TestSetDefaultVisibility(t *testing.T) {
+	for _, tc := range []struct {
+		desc, old, want string
+		visibility      []string
+	}{
+		{
+			desc: "insert_before_rules",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(name = "a")
+`,
+			visibility: []string{"//visibility:public"},
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(
+    default_visibility = ["//visibility:public"],  # managed by gazelle
+)
+
+go_library(name = "a")
+`,
+		}, {
+			desc: "replace_hand_written",
+			old: `package(default_visibility = ["//visibility:private"])
+`,
+			visibility: []string{"//visibility:public"},
+			want: `package(
+    default_visibility = ["//visibility:public"],  # managed by gazelle
+)
+`,
+		}, {
+			desc: "keep",
+			old: `package(
+    default_visibility = ["//visibility:private"],  # keep
+)
+`,
+			visibility: []string{"//visibility:public"},
+			want: `package(
+    default_visibility = ["//visibility:private"],  # keep
+)
+`,
+		}, {
+			desc: "remove_managed",
+			old: `package(
+    default_visibility = ["//visibility:public"],  # managed by gazelle
+    features = ["-layering_check"],
+)
+`,
+			want: `package(features = ["-layering_check"])
+`,
+		}, {
+			desc: "remove_managed_package",
+			old: `package(
+    default_visibility = ["//visibility:public"],  # managed by gazelle
+)
+
+go_library(name = "a")
+`,
+			want: `go_library(name = "a")
+`,
+		}, {
+			desc: "hand_written_not_removed",
+			old: `package(default_visibility = ["//visibility:public"])
+`,
+			want: `package(default_visibility = ["//visibility:public"])
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := rule.LoadData("BUILD.bazel", []byte(tc.old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetDefaultVisibility(f, tc.visibility)
+			if got := string(f.Format()); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeFileAttrOrder(t *testing.T) {
+	kinds := map[string]rule.KindInfo{
+		"x_library": {
+			MergeableAttrs: map[string]bool{"srcs": true},
+			AttrOrder:      []string{"name", "importpath", "srcs"},
+		},
+	}
+	f, err := rule.LoadData("previous", []byte(`
+x_library(
+    name = "lib",
+    srcs = ["old.x"],
+    importpath = "example.com/lib",
+    data = ["data.txt"],
+)
+
+x_library(
+    name = "kept",
+    srcs = ["kept.x"],
+    importpath = "example.com/kept",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := rule.NewRule("x_library", "lib")
+	gen.SetAttr("srcs", []string{"new.x"})
+	MergeFile(f, nil, []*rule.Rule{gen}, PreResolve, kinds, nil)
+
+	want := `x_library(
+    name = "lib",
+    importpath = "example.com/lib",
+    srcs = ["new.x"],
+    data = ["data.txt"],
+)
+
+x_library(
+    name = "kept",
+    srcs = ["kept.x"],
+    importpath = "example.com/kept",
+)
+`
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMergeFileAttrOrderMappedKind(t *testing.T) {
+	// my_library is known without an attribute order, as happens when a
+	// mapped kind has the name of another kind.
+	kinds := map[string]rule.KindInfo{
+		"x_library": {
+			MergeableAttrs: map[string]bool{"srcs": true},
+			AttrOrder:      []string{"name", "importpath", "srcs"},
+		},
+		"my_library": {
+			MergeableAttrs: map[string]bool{"srcs": true},
+		},
+	}
+	c := config.New()
+	c.MapKind(config.MappedKind{FromKind: "x_library", KindName: "my_library", KindLoad: "//:defs.bzl"})
+	f, err := rule.LoadData("previous", []byte(`
+my_library(
+    name = "lib",
+    srcs = ["old.x"],
+    importpath = "example.com/lib",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := rule.NewRule("my_library", "lib")
+	gen.SetAttr("srcs", []string{"new.x"})
+	MergeFile(f, nil, []*rule.Rule{gen}, PreResolve, kinds, c)
+
+	want := `my_library(
+    name = "lib",
+    importpath = "example.com/lib",
+    srcs = ["new.x"],
+)
+`
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMergeFilePreservedAttrs(t *testing.T) {
+	kinds := map[string]rule.KindInfo{
+		"x_test": {
+			NonEmptyAttrs:  map[string]bool{"srcs": true},
+			MergeableAttrs: map[string]bool{"srcs": true, "size": true, "tags": true, "flaky": true},
+			PreservedAttrs: map[string]bool{"size": true},
+		},
+	}
+	f, err := rule.LoadData("previous", []byte(`
+x_test(
+    name = "matched",
+    srcs = ["old.x"],
+    flaky = True,
+    size = "large",
+    tags = ["manual"],
+)
+
+x_test(
+    name = "regenerated",
+    size = "small",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched := rule.NewRule("x_test", "matched")
+	matched.SetAttr("srcs", []string{"new.x"})
+	matched.SetPrivateAttr(config.GazellePreservedAttrsKey, []string{"tags"})
+	empty := rule.NewRule("x_test", "regenerated")
+	regenerated := rule.NewRule("x_test", "regenerated")
+	regenerated.SetAttr("srcs", []string{"regenerated.x"})
+	MergeFile(f, []*rule.Rule{empty}, []*rule.Rule{matched, regenerated}, PreResolve, kinds, nil)
+
+	want := `x_test(
+    name = "matched",
+    size = "large",
+    srcs = ["new.x"],
+    tags = ["manual"],
+)
+
+x_test(
+    name = "regenerated",
+    size = "small",
+    srcs = ["regenerated.x"],
+)
+`
+	if got := string(f.Format()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRenameRules(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	grace := 30 * 24 * time.Hour
+	for _, tc := range []struct {
+		desc, old, gen, want string
+		grace                time.Duration
+	}{
+		{
+			desc: "rename",
+			old: `go_library(
+    name = "old_lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/lib",
+)
+`,
+			gen: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+`,
+			grace: grace,
+			want: `go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+    importpath = "example.com/lib",
+)
+
+alias(
+    name = "old_lib",
+    actual = ":go_default_library",  # managed by gazelle until 2018-07-01
+    deprecation = "renamed to :go_default_library; this alias will be removed after 2018-07-01",
+)
+`,
+		}, {
+			desc: "disabled",
+			old: `go_library(
+    name = "old_lib",
+    importpath = "example.com/lib",
+)
+`,
+			gen: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+`,
+			want: `go_library(
+    name = "old_lib",
+    importpath = "example.com/lib",
+)
+`,
+		}, {
+			desc: "keep",
+			old: `go_library(
+    name = "old_lib",
+    importpath = "example.com/lib",
+)  # keep
+`,
+			gen: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+`,
+			grace: grace,
+			want: `go_library(
+    name = "old_lib",
+    importpath = "example.com/lib",
+)  # keep
+`,
+		}, {
+			desc: "keep_unexpired",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+
+alias(
+    name = "old_lib",
+    actual = ":go_default_library",  # managed by gazelle until 2018-06-01
+)
+`,
+			gen: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+`,
+			grace: grace,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+
+alias(
+    name = "old_lib",
+    actual = ":go_default_library",  # managed by gazelle until 2018-06-01
+)
+`,
+		}, {
+			desc: "delete_expired",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+
+alias(
+    name = "old_lib",
+    actual = ":go_default_library",  # managed by gazelle until 2018-05-31
+)
+
+alias(
+    name = "hand_written",
+    actual = ":go_default_library",
+)
+`,
+			grace: grace,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+
+alias(
+    name = "hand_written",
+    actual = ":go_default_library",
+)
+`,
+		}, {
+			desc: "delete_disabled",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+
+alias(
+    name = "old_lib",
+    actual = ":go_default_library",  # managed by gazelle until 2018-07-01
+)
+`,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/lib",
+)
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := rule.LoadData("BUILD.bazel", []byte(tc.old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			genFile, err := rule.LoadData("gen", []byte(tc.gen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			RenameRules(f, genFile.Rules, testKinds, tc.grace, now)
+			if got := string(f.Format()); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnusedLoads(t *testing.T) {
+	f, err := rule.LoadData("BUILD.bazel", []byte(`
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+load("//build:defs.bzl", "SRCS", my_rule = "custom_rule", "unused_macro")
+load("//build:other.bzl", "other")
+
+go_library(
+    name = "go_default_library",
+    srcs = SRCS,
+)
+
+my_rule(name = "custom")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UnusedSymbol{
+		{Load: "//build:defs.bzl", Symbol: "unused_macro"},
+		{Load: "//build:other.bzl", Symbol: "other"},
+		{Load: "@io_bazel_rules_go//go:def.bzl", Symbol: "go_binary"},
+		{Load: "@io_bazel_rules_go//go:def.bzl", Symbol: "go_test"},
+	}
+	if got := FindUnusedLoads(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindUnusedLoads: got %v; want %v", got, want)
+	}
+	if got := RemoveUnusedLoads(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("RemoveUnusedLoads: got %v; want %v", got, want)
+	}
+	gotText := strings.TrimSpace(string(f.Format()))
+	wantText := strings.TrimSpace(`
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+load(
+    "//build:defs.bzl",
+    "SRCS",
+    my_rule = "custom_rule",
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = SRCS,
+)
+
+my_rule(name = "custom")
+`)
+	if gotText != wantText {
+		t.Errorf("got:\n%s\nwant:\n%s", gotText, wantText)
+	}
+}
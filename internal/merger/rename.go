@@ -0,0 +1,109 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// AliasKindInfo describes alias rules written by RenameRules. Alias rules
+// are built into Bazel, so no load is needed.
+var AliasKindInfo = rule.KindInfo{
+	NonEmptyAttrs:  map[string]bool{"actual": true},
+	MergeableAttrs: map[string]bool{"actual": true, "deprecation": true},
+	AttrOrder:      []string{"name", "actual", "deprecation"},
+}
+
+// aliasExpiryPrefix starts the suffix comment on the "actual" attribute of
+// alias rules written by RenameRules. It's followed by the date after which
+// the alias is deleted.
+const aliasExpiryPrefix = managedComment + " until "
+
+// aliasDateFormat is the format of dates in alias comments.
+const aliasDateFormat = "2006-01-02"
+
+// RenameRules renames existing rules in f that match rules in genRules but
+// have different names, so that they're merged under the generated names.
+// An alias rule with the old name is written for each renamed rule, so that
+// references to the old name keep working. Aliases are kept until grace has
+// passed since now, then deleted by a later call. Renaming is enabled with
+// # gazelle:rename_aliases.
+//
+// If grace is zero, no rules are renamed, and all aliases previously written
+// by RenameRules are deleted. Rules marked with "# keep" are not renamed.
+func RenameRules(f *rule.File, genRules []*rule.Rule, kinds map[string]rule.KindInfo, grace time.Duration, now time.Time) {
+	genNames := make(map[string]bool)
+	for _, r := range genRules {
+		genNames[r.Name()] = true
+	}
+	for _, r := range f.Rules {
+		expiry, ok := aliasExpiry(r)
+		if ok && (grace == 0 || !now.Before(expiry) || genNames[r.Name()]) {
+			r.Delete()
+		}
+	}
+	f.Sync()
+	if grace == 0 {
+		return
+	}
+
+	until := now.Add(grace).Format(aliasDateFormat)
+	for _, genRule := range genRules {
+		oldRule, err := match(f.Rules, genRule, kinds[genRule.Kind()])
+		if err != nil || oldRule == nil || oldRule.Name() == genRule.Name() || oldRule.ShouldKeep() {
+			continue
+		}
+		oldName, newName := oldRule.Name(), genRule.Name()
+		oldRule.SetName(newName)
+
+		alias := rule.NewRule("alias", oldName)
+		alias.SetAttr("actual", ":"+newName)
+		alias.SetAttr("deprecation", fmt.Sprintf("renamed to :%s; this alias will be removed after %s", newName, until))
+		alias.SetAttrOrder(AliasKindInfo.AttrOrder)
+		comments := alias.AttrComments("actual")
+		comments.Suffix = append(comments.Suffix, bzl.Comment{Token: "# " + aliasExpiryPrefix + until})
+		alias.InsertAt(f, oldRule.Index()+1)
+	}
+}
+
+// aliasExpiry returns the date after which r should be deleted if r is an
+// alias rule written by RenameRules. false is returned for other rules.
+func aliasExpiry(r *rule.Rule) (time.Time, bool) {
+	if r.Kind() != "alias" {
+		return time.Time{}, false
+	}
+	comments := r.AttrComments("actual")
+	if comments == nil {
+		return time.Time{}, false
+	}
+	for _, c := range comments.Suffix {
+		text := strings.TrimSpace(strings.TrimPrefix(c.Token, "#"))
+		if !strings.HasPrefix(text, aliasExpiryPrefix) {
+			continue
+		}
+		expiry, err := time.Parse(aliasDateFormat, strings.TrimPrefix(text, aliasExpiryPrefix))
+		if err != nil {
+			return time.Time{}, false
+		}
+		return expiry.AddDate(0, 0, 1), true
+	}
+	return time.Time{}, false
+}
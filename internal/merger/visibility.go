@@ -0,0 +1,93 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package merger
+
+import (
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// managedComment is the text of the suffix comment that marks a
+// default_visibility attribute as set by Gazelle. Only marked attributes are
+// removed when # gazelle:default_visibility no longer applies.
+const managedComment = "managed by gazelle"
+
+// SetDefaultVisibility sets the default_visibility attribute of the package
+// rule in f to visibility, which is set with # gazelle:default_visibility.
+// A package rule is inserted before other rules if there is none. If
+// visibility is empty, an attribute previously set by this function is
+// removed, together with the package rule if it has no other attributes.
+// Attributes written by hand or marked with "# keep" are not modified.
+func SetDefaultVisibility(f *rule.File, visibility []string) {
+	var pkg *rule.Rule
+	for _, r := range f.Rules {
+		if r.Kind() == "package" {
+			pkg = r
+			break
+		}
+	}
+
+	if len(visibility) == 0 {
+		if pkg == nil || !hasComment(pkg.AttrComments("default_visibility"), managedComment) {
+			return
+		}
+		pkg.DelAttr("default_visibility")
+		if len(pkg.AttrKeys()) == 0 && len(pkg.Args()) == 0 {
+			pkg.Delete()
+		}
+		return
+	}
+
+	if pkg == nil {
+		pkg = rule.NewRule("package", "")
+		pkg.DelAttr("name")
+		pkg.InsertAt(f, firstRuleIndex(f))
+	} else if pkg.ShouldKeep() || hasComment(pkg.AttrComments("default_visibility"), "keep") {
+		return
+	}
+	pkg.SetAttr("default_visibility", visibility)
+	if comments := pkg.AttrComments("default_visibility"); !hasComment(comments, managedComment) {
+		comments.Suffix = append(comments.Suffix, bzl.Comment{Token: "# " + managedComment})
+	}
+}
+
+// firstRuleIndex returns the index of the first rule in f or the number of
+// statements if there are no rules. Package rules must precede other rules.
+func firstRuleIndex(f *rule.File) int {
+	index := len(f.File.Stmt)
+	for _, r := range f.Rules {
+		if r.Index() < index {
+			index = r.Index()
+		}
+	}
+	return index
+}
+
+// hasComment returns whether comments include a comment with the given text,
+// ignoring the leading "#" and surrounding space.
+func hasComment(comments *bzl.Comments, text string) bool {
+	if comments == nil {
+		return false
+	}
+	for _, c := range append(comments.Before, comments.Suffix...) {
+		if strings.TrimSpace(strings.TrimPrefix(c.Token, "#")) == text {
+			return true
+		}
+	}
+	return false
+}
@@ -29,6 +29,16 @@ func HasPrefix(p, prefix string) bool {
 	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
 }
 
+// Contains returns whether the slash-separated path child is the same as
+// parent or is nested within parent. Like HasPrefix, component boundaries
+// are respected. Trailing slashes on either path are ignored. An empty
+// parent contains every path.
+func Contains(parent, child string) bool {
+	parent = strings.TrimSuffix(parent, "/")
+	child = strings.TrimSuffix(child, "/")
+	return HasPrefix(child, parent)
+}
+
 // TrimPrefix returns p without the provided prefix. If p doesn't start
 // with prefix, it returns p unchanged. Unlike strings.HasPrefix, this function
 // respects component boundaries (assuming slash-separated paths), so
@@ -43,6 +53,18 @@ func TrimPrefix(p, prefix string) string {
 	return strings.TrimPrefix(p, prefix+"/")
 }
 
+// CleanImport returns imp, a slash-separated import path, in canonical form.
+// Trailing slashes, repeated slashes, and "." and ".." components are
+// removed, so cosmetically different imports of the same package are equal.
+// Relative imports like "./b" and "../b" are returned unchanged, since they
+// must be interpreted relative to the importing directory.
+func CleanImport(imp string) string {
+	if imp == "" || imp == "." || imp == ".." || strings.HasPrefix(imp, "./") || strings.HasPrefix(imp, "../") {
+		return imp
+	}
+	return path.Clean(imp)
+}
+
 // RelBaseName returns the base name for rel, a slash-separated path relative
 // to the repository root. If rel is empty, RelBaseName returns the base name
 // of prefix. If prefix is empty, RelBaseName returns the base name of root,
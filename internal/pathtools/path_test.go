@@ -57,6 +57,61 @@ func TestHasPrefix(t *testing.T) {
 	}
 }
 
+func TestContains(t *testing.T) {
+	for _, tc := range []struct {
+		desc, parent, child string
+		want                bool
+	}{
+		{
+			desc:   "empty parent",
+			parent: "",
+			child:  "home/jr_hacker",
+			want:   true,
+		}, {
+			desc:   "identical",
+			parent: "home/jr_hacker",
+			child:  "home/jr_hacker",
+			want:   true,
+		}, {
+			desc:   "nested",
+			parent: "home",
+			child:  "home/jr_hacker/vendor",
+			want:   true,
+		}, {
+			desc:   "parent trailing slash",
+			parent: "home/",
+			child:  "home/jr_hacker",
+			want:   true,
+		}, {
+			desc:   "child trailing slash",
+			parent: "home/jr_hacker",
+			child:  "home/jr_hacker/",
+			want:   true,
+		}, {
+			desc:   "partial component",
+			parent: "home/jr_",
+			child:  "home/jr_hacker",
+			want:   false,
+		}, {
+			desc:   "child is parent of parent",
+			parent: "home/jr_hacker",
+			child:  "home",
+			want:   false,
+		}, {
+			desc:   "sibling",
+			parent: "home/jr_hacker",
+			child:  "home/sr_hacker",
+			want:   false,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := Contains(tc.parent, tc.child); got != tc.want {
+				t.Errorf("got %v ; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestTrimPrefix(t *testing.T) {
 	for _, tc := range []struct {
 		desc, path, prefix, want string
@@ -90,3 +145,57 @@ func TestTrimPrefix(t *testing.T) {
 		})
 	}
 }
+
+func TestCleanImport(t *testing.T) {
+	for _, tc := range []struct {
+		desc, imp, want string
+	}{
+		{
+			desc: "canonical",
+			imp:  "example.com/foo",
+			want: "example.com/foo",
+		}, {
+			desc: "trailing slash",
+			imp:  "example.com/foo/",
+			want: "example.com/foo",
+		}, {
+			desc: "repeated slash",
+			imp:  "example.com//foo",
+			want: "example.com/foo",
+		}, {
+			desc: "dot",
+			imp:  "example.com/foo/./bar",
+			want: "example.com/foo/bar",
+		}, {
+			desc: "dot dot",
+			imp:  "example.com/foo/../bar",
+			want: "example.com/bar",
+		}, {
+			desc: "trailing dot",
+			imp:  "example.com/foo/.",
+			want: "example.com/foo",
+		}, {
+			desc: "proto",
+			imp:  "foo/./bar.proto",
+			want: "foo/bar.proto",
+		}, {
+			desc: "relative",
+			imp:  "./b",
+			want: "./b",
+		}, {
+			desc: "relative parent",
+			imp:  "../b/./c",
+			want: "../b/./c",
+		}, {
+			desc: "empty",
+			imp:  "",
+			want: "",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := CleanImport(tc.imp); got != tc.want {
+				t.Errorf("got %q ; want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -18,7 +18,6 @@ package repos
 import (
 	"io/ioutil"
 
-	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	toml "github.com/pelletier/go-toml"
 )
 
@@ -32,7 +31,7 @@ type depProject struct {
 	Source   string `toml:"source"`
 }
 
-func importRepoRulesDep(filename string) ([]Repo, error) {
+func importRepoRulesDep(filename string, rc *RemoteCache) ([]Repo, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -45,7 +44,7 @@ func importRepoRulesDep(filename string) ([]Repo, error) {
 	var repos []Repo
 	for _, p := range file.Projects {
 		repos = append(repos, Repo{
-			Name:     label.ImportPathToBazelRepoName(p.Name),
+			Name:     rc.RepoName(p.Name),
 			GoPrefix: p.Name,
 			Commit:   p.Revision,
 			Remote:   p.Source,
@@ -72,7 +72,7 @@ func TestImportDep(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	rules, err := ImportRepoRules(lockFilename)
+	rules, err := ImportRepoRules(lockFilename, NewRemoteCache(nil))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -17,12 +17,14 @@ package repos
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
 	"path"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
@@ -76,9 +78,49 @@ type RemoteCache struct {
 	// repository. This is used by Head. It may be stubbed out for tests.
 	HeadCmd func(remote, vcs string) (string, error)
 
+	// RepoName returns the name of the repository with the given root import
+	// path. It's used for repositories that aren't known, so names of known
+	// repositories are never changed. It's label.ImportPathToBazelRepoName by
+	// default, which converts "example.com/repo" to "com_example_repo". It may
+	// be overridden to match other naming schemes used in WORKSPACE files;
+	// fix and update set it from config.Config.ExternalRepoName.
+	RepoName func(root string) string
+
+	// Timeout limits how long each call to RepoRootForImportPath or HeadCmd
+	// may take. When a call takes longer, it's abandoned, and an error for
+	// which IsTimeout returns true is reported. Zero means no limit.
+	Timeout time.Duration
+
+	// Retries is the number of times a failed call to RepoRootForImportPath
+	// or HeadCmd is retried. Calls that time out are not retried, since a
+	// host that hangs once is likely to hang again.
+	Retries int
+
+	// RetryDelay is how long to wait before the first retry. The delay is
+	// doubled after each retry.
+	RetryDelay time.Duration
+
 	root, remote, head remoteCacheMap
 }
 
+// timeoutError is reported when a network call made by RemoteCache takes
+// longer than RemoteCache.Timeout.
+type timeoutError struct {
+	desc    string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s: timed out after %v", e.desc, e.timeout)
+}
+
+// IsTimeout returns whether err was returned by a RemoteCache method because
+// a network call took longer than RemoteCache.Timeout.
+func IsTimeout(err error) bool {
+	_, ok := err.(*timeoutError)
+	return ok
+}
+
 // remoteCacheMap is a thread-safe, idempotent cache. It is used to store
 // information which should be fetched over the network no more than once.
 // This follows the Memo pattern described in The Go Programming Language,
@@ -99,7 +141,7 @@ type remoteCacheEntry struct {
 }
 
 type rootValue struct {
-	root, name string
+	root, name, namingConvention string
 }
 
 type remoteValue struct {
@@ -119,6 +161,7 @@ func NewRemoteCache(knownRepos []Repo) *RemoteCache {
 	r := &RemoteCache{
 		RepoRootForImportPath: vcs.RepoRootForImportPath,
 		HeadCmd:               defaultHeadCmd,
+		RepoName:              label.ImportPathToBazelRepoName,
 		root:                  remoteCacheMap{cache: make(map[string]*remoteCacheEntry)},
 		remote:                remoteCacheMap{cache: make(map[string]*remoteCacheEntry)},
 		head:                  remoteCacheMap{cache: make(map[string]*remoteCacheEntry)},
@@ -126,8 +169,9 @@ func NewRemoteCache(knownRepos []Repo) *RemoteCache {
 	for _, repo := range knownRepos {
 		r.root.cache[repo.GoPrefix] = &remoteCacheEntry{
 			value: rootValue{
-				root: repo.GoPrefix,
-				name: repo.Name,
+				root:             repo.GoPrefix,
+				name:             repo.Name,
+				namingConvention: repo.BuildNamingConvention,
 			},
 		}
 		if repo.Remote != "" {
@@ -164,21 +208,8 @@ func (r *RemoteCache) Root(importPath string) (root, name string, err error) {
 	// to vcs yet. We do this before handling known special cases because
 	// the cache is pre-populated with repository rules, and we want to use their
 	// names if we can.
-	prefix := importPath
-	for {
-		v, ok, err := r.root.get(prefix)
-		if ok {
-			if err != nil {
-				return "", "", err
-			}
-			value := v.(rootValue)
-			return value.root, value.name, nil
-		}
-
-		prefix = path.Dir(prefix)
-		if prefix == "." || prefix == "/" {
-			break
-		}
+	if root, name, ok, err := r.cachedRoot(importPath); ok {
+		return root, name, err
 	}
 
 	// Try known prefixes.
@@ -196,7 +227,7 @@ func (r *RemoteCache) Root(importPath string) (root, name string, err error) {
 			for _, c := range components[:p.missing] {
 				root = path.Join(root, c)
 			}
-			name = label.ImportPathToBazelRepoName(root)
+			name = r.RepoName(root)
 			return root, name, nil
 		}
 	}
@@ -205,17 +236,27 @@ func (r *RemoteCache) Root(importPath string) (root, name string, err error) {
 	// missing paths. See http://labix.org/gopkg.in for URL patterns.
 	if match := gopkginPattern.FindStringSubmatch(importPath); len(match) > 0 {
 		root = match[1]
-		name = label.ImportPathToBazelRepoName(root)
+		name = r.RepoName(root)
 		return root, name, nil
 	}
 
-	// Find the prefix using vcs and cache the result.
+	// Find the prefix using vcs and cache the result. The root reported by vcs
+	// may be shorter than the import path, for example, when a vanity import
+	// path is served from a repository elsewhere. Both the name and the
+	// subpath within the repository are derived from the root, so the result
+	// is also cached under the root, together with the remote.
 	v, err := r.root.ensure(importPath, func() (interface{}, error) {
-		res, err := r.RepoRootForImportPath(importPath, false)
+		res, err := r.repoRootForImportPath(importPath)
 		if err != nil {
 			return nil, err
 		}
-		return rootValue{res.Root, label.ImportPathToBazelRepoName(res.Root)}, nil
+		if !pathtools.HasPrefix(importPath, res.Root) {
+			return nil, fmt.Errorf("import path %q is not within its repository root %q", importPath, res.Root)
+		}
+		value := rootValue{root: res.Root, name: r.RepoName(res.Root)}
+		r.root.add(res.Root, value)
+		r.remote.add(res.Root, remoteValue{remote: res.Repo, vcs: res.VCS.Cmd})
+		return value, nil
 	})
 	if err != nil {
 		return "", "", err
@@ -224,11 +265,75 @@ func (r *RemoteCache) Root(importPath string) (root, name string, err error) {
 	return value.root, value.name, nil
 }
 
+// KnownRoot is like Root, but it only finds repositories that are already
+// known: those the cache was created with and those found by earlier calls
+// to Root. false is returned if no known repository provides importPath.
+// This does not access the network.
+func (r *RemoteCache) KnownRoot(importPath string) (root, name string, ok bool) {
+	root, name, ok, err := r.cachedRoot(importPath)
+	if !ok || err != nil {
+		return "", "", false
+	}
+	return root, name, true
+}
+
+// cachedRoot looks up the longest prefix of importPath in the root cache.
+// ok is false if no prefix is cached. err is the cached error, if any.
+func (r *RemoteCache) cachedRoot(importPath string) (root, name string, ok bool, err error) {
+	prefix := importPath
+	for {
+		v, ok, err := r.root.get(prefix)
+		if ok {
+			if err != nil {
+				return "", "", true, err
+			}
+			value := v.(rootValue)
+			return value.root, value.name, true, nil
+		}
+
+		prefix = path.Dir(prefix)
+		if prefix == "." || prefix == "/" {
+			return "", "", false, nil
+		}
+	}
+}
+
+// AddRoot declares root as the root import path of a repository without
+// accessing the network, like the repositories passed to NewRemoteCache. The
+// repository is named with RepoName. Nothing changes if root is known.
+func (r *RemoteCache) AddRoot(root string) {
+	r.root.add(root, rootValue{root: root, name: r.RepoName(root)})
+}
+
+// ModuleRepoName returns the name of the repository for the Go module
+// modPath. Unlike Root, the module path is known to be the root of the
+// repository, which is the case for modules named in replace directives.
+// The name of a known repository is returned if there is one. Otherwise, a
+// name is generated. This does not access the network.
+func (r *RemoteCache) ModuleRepoName(modPath string) string {
+	if v, ok, err := r.root.get(modPath); ok && err == nil {
+		return v.(rootValue).name
+	}
+	return r.RepoName(modPath)
+}
+
+// BuildNamingConvention returns the build naming convention declared for
+// the repository with the given root import path (see
+// Repo.BuildNamingConvention). "" is returned if the repository is not
+// known or doesn't declare a convention. This does not access the network.
+func (r *RemoteCache) BuildNamingConvention(root string) string {
+	v, ok, err := r.root.get(root)
+	if !ok || err != nil {
+		return ""
+	}
+	return v.(rootValue).namingConvention
+}
+
 // Remote returns the VCS name and the remote URL for a repository with the
 // given root import path. This is suitable for creating new repository rules.
 func (r *RemoteCache) Remote(root string) (remote, vcs string, err error) {
 	v, err := r.remote.ensure(root, func() (interface{}, error) {
-		repo, err := r.RepoRootForImportPath(root, false)
+		repo, err := r.repoRootForImportPath(root)
 		if err != nil {
 			return nil, err
 		}
@@ -253,11 +358,13 @@ func (r *RemoteCache) Head(remote, vcs string) (commit, tag string, err error) {
 	}
 
 	v, err := r.head.ensure(remote, func() (interface{}, error) {
-		commit, err := r.HeadCmd(remote, vcs)
+		commit, err := r.call(fmt.Sprintf("finding head of %s", remote), func() (interface{}, error) {
+			return r.HeadCmd(remote, vcs)
+		})
 		if err != nil {
 			return nil, err
 		}
-		return headValue{commit: commit}, nil
+		return headValue{commit: commit.(string)}, nil
 	})
 	if err != nil {
 		return "", "", err
@@ -266,6 +373,60 @@ func (r *RemoteCache) Head(remote, vcs string) (commit, tag string, err error) {
 	return value.commit, value.tag, nil
 }
 
+// repoRootForImportPath calls r.RepoRootForImportPath with the configured
+// timeout and retries.
+func (r *RemoteCache) repoRootForImportPath(importPath string) (*vcs.RepoRoot, error) {
+	v, err := r.call(fmt.Sprintf("finding repository for %s", importPath), func() (interface{}, error) {
+		return r.RepoRootForImportPath(importPath, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*vcs.RepoRoot), nil
+}
+
+// call invokes f, which may access the network. f is retried up to r.Retries
+// times if it fails, waiting r.RetryDelay before the first retry and twice as
+// long before each later one. desc describes the operation in errors.
+func (r *RemoteCache) call(desc string, f func() (interface{}, error)) (interface{}, error) {
+	delay := r.RetryDelay
+	for attempt := 0; ; attempt++ {
+		v, err := r.callWithTimeout(desc, f)
+		if err == nil || IsTimeout(err) || attempt >= r.Retries {
+			return v, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// callWithTimeout invokes f and waits up to r.Timeout for it to return. If
+// the timeout expires first, f is left running in the background, and a
+// timeout error is returned.
+func (r *RemoteCache) callWithTimeout(desc string, f func() (interface{}, error)) (interface{}, error) {
+	if r.Timeout <= 0 {
+		return f()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	type result struct {
+		value interface{}
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := f()
+		ch <- result{v, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.value, res.err
+	case <-ctx.Done():
+		return nil, &timeoutError{desc: desc, timeout: r.Timeout}
+	}
+}
+
 func defaultHeadCmd(remote, vcs string) (string, error) {
 	switch vcs {
 	case "local":
@@ -309,6 +470,16 @@ func (m *remoteCacheMap) get(key string) (value interface{}, ok bool, err error)
 	return e.value, ok, e.err
 }
 
+// add associates a value with the given key unless the key is already in
+// the cache.
+func (m *remoteCacheMap) add(key string, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.cache[key]; !ok {
+		m.cache[key] = &remoteCacheEntry{value: value}
+	}
+}
+
 // ensure retreives a value associated with the given key from the cache. If
 // the key does not exist in the cache, the load function will be called,
 // and its result will be associated with the key. The load function will not
@@ -18,8 +18,11 @@ package repos
 import (
 	"fmt"
 	"os"
+	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/tools/go/vcs"
 )
@@ -92,6 +95,85 @@ func TestRootSpecialCases(t *testing.T) {
 	}
 }
 
+func TestRootVanity(t *testing.T) {
+	calls := 0
+	rc := newStubRemoteCache(nil)
+	rc.RepoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		calls++
+		if !strings.HasPrefix(importpath, "vanity.example.org/quote") {
+			return nil, fmt.Errorf("could not resolve import path: %q", importpath)
+		}
+		return &vcs.RepoRoot{
+			VCS:  vcs.ByCmd("git"),
+			Repo: "https://github.com/example/quote",
+			Root: "vanity.example.org/quote",
+		}, nil
+	}
+
+	for _, imp := range []string{"vanity.example.org/quote/v3/sub", "vanity.example.org/quote/other"} {
+		root, name, err := rc.Root(imp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != "vanity.example.org/quote" || name != "org_example_vanity_quote" {
+			t.Errorf("%s: got root %q, name %q; want %q, %q", imp, root, name, "vanity.example.org/quote", "org_example_vanity_quote")
+		}
+	}
+	remote, vcs, err := rc.Remote("vanity.example.org/quote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote != "https://github.com/example/quote" || vcs != "git" {
+		t.Errorf("got remote %q, vcs %q; want %q, %q", remote, vcs, "https://github.com/example/quote", "git")
+	}
+	if calls != 1 {
+		t.Errorf("got %d vcs lookups; want 1", calls)
+	}
+}
+
+func TestKnownRoot(t *testing.T) {
+	rc := newStubRemoteCache([]Repo{{Name: "custom_repo", GoPrefix: "example.com/known"}})
+	if root, name, ok := rc.KnownRoot("example.com/known/sub"); !ok || root != "example.com/known" || name != "custom_repo" {
+		t.Errorf("got %q, %q, %v; want %q, %q, true", root, name, ok, "example.com/known", "custom_repo")
+	}
+	if _, _, ok := rc.KnownRoot("example.com/repo/sub"); ok {
+		t.Errorf("got known root for example.com/repo/sub before lookup")
+	}
+	if _, _, err := rc.Root("example.com/repo/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if root, _, ok := rc.KnownRoot("example.com/repo/sub"); !ok || root != "example.com/repo" {
+		t.Errorf("got %q, %v after lookup; want %q, true", root, ok, "example.com/repo")
+	}
+}
+
+func TestAddRoot(t *testing.T) {
+	rc := newStubRemoteCache([]Repo{{Name: "custom_repo", GoPrefix: "example.com/known"}})
+	rc.RepoName = func(root string) string { return "custom_" + path.Base(root) }
+	rc.AddRoot("example.com/known")
+	rc.AddRoot("example.com/added")
+	if _, name, ok := rc.KnownRoot("example.com/known/sub"); !ok || name != "custom_repo" {
+		t.Errorf("got %q, %v; want %q, true", name, ok, "custom_repo")
+	}
+	if root, name, ok := rc.KnownRoot("example.com/added/sub"); !ok || root != "example.com/added" || name != "custom_added" {
+		t.Errorf("got %q, %q, %v; want %q, %q, true", root, name, ok, "example.com/added", "custom_added")
+	}
+}
+
+func TestRootNotPrefix(t *testing.T) {
+	rc := newStubRemoteCache(nil)
+	rc.RepoRootForImportPath = func(importpath string, verbose bool) (*vcs.RepoRoot, error) {
+		return &vcs.RepoRoot{
+			VCS:  vcs.ByCmd("git"),
+			Repo: "https://github.com/example/quote",
+			Root: "github.com/example/quote",
+		}, nil
+	}
+	if _, _, err := rc.Root("vanity.example.org/quote"); err == nil {
+		t.Error("unexpected success")
+	}
+}
+
 func TestRemote(t *testing.T) {
 	for _, tc := range []struct {
 		desc, root          string
@@ -179,6 +261,86 @@ func TestHead(t *testing.T) {
 	}
 }
 
+func TestRootTimeout(t *testing.T) {
+	rc := newStubRemoteCache(nil)
+	rc.Timeout = 10 * time.Millisecond
+	rc.Retries = 3
+	var calls int32
+	block := make(chan struct{})
+	defer close(block)
+	rc.RepoRootForImportPath = func(importPath string, verbose bool) (*vcs.RepoRoot, error) {
+		atomic.AddInt32(&calls, 1)
+		<-block
+		return stubRepoRootForImportPath(importPath, verbose)
+	}
+	_, _, err := rc.Root("example.com/repo/pkg")
+	if !IsTimeout(err) {
+		t.Fatalf("got error %v; want timeout", err)
+	}
+	if !strings.Contains(err.Error(), "example.com/repo/pkg") {
+		t.Errorf("error %q does not name the import path", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d calls; want 1 (timeouts are not retried)", n)
+	}
+}
+
+func TestRootRetries(t *testing.T) {
+	for _, tc := range []struct {
+		desc              string
+		retries, failures int
+		wantErr           bool
+	}{
+		{desc: "no_retries", retries: 0, failures: 1, wantErr: true},
+		{desc: "enough_retries", retries: 2, failures: 2},
+		{desc: "too_few_retries", retries: 2, failures: 3, wantErr: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			rc := newStubRemoteCache(nil)
+			rc.Retries = tc.retries
+			rc.RetryDelay = time.Millisecond
+			calls := 0
+			rc.RepoRootForImportPath = func(importPath string, verbose bool) (*vcs.RepoRoot, error) {
+				calls++
+				if calls <= tc.failures {
+					return nil, fmt.Errorf("transient failure %d", calls)
+				}
+				return stubRepoRootForImportPath(importPath, verbose)
+			}
+			root, _, err := rc.Root("example.com/repo/pkg")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got root %q; want error", root)
+				}
+				if want := tc.retries + 1; calls != want {
+					t.Errorf("got %d calls; want %d", calls, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != "example.com/repo" {
+				t.Errorf("got root %q; want %q", root, "example.com/repo")
+			}
+		})
+	}
+}
+
+func TestHeadTimeout(t *testing.T) {
+	rc := newStubRemoteCache(nil)
+	rc.Timeout = 10 * time.Millisecond
+	block := make(chan struct{})
+	defer close(block)
+	rc.HeadCmd = func(remote, vcs string) (string, error) {
+		<-block
+		return stubHeadCmd(remote, vcs)
+	}
+	if _, _, err := rc.Head("https://example.com/repo", "git"); !IsTimeout(err) {
+		t.Errorf("got error %v; want timeout", err)
+	}
+}
+
 func newStubRemoteCache(rs []Repo) *RemoteCache {
 	rc := NewRemoteCache(rs)
 	rc.RepoRootForImportPath = stubRepoRootForImportPath
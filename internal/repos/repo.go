@@ -17,12 +17,14 @@ package repos
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 // Repo describes an external repository rule declared in a Bazel
@@ -48,6 +50,14 @@ type Repo struct {
 	// VCS is the version control system used to check out the repository.
 	// May also be "http" for HTTP archives.
 	VCS string
+
+	// BuildNamingConvention is the value of the "build_naming_convention"
+	// attribute of the repository rule. It determines the names of library
+	// targets in build files generated for the repository. When empty or
+	// "go_default_library", libraries are named "go_default_library". When
+	// "import" or "import_alias", libraries are named after the last
+	// component of their import paths.
+	BuildNamingConvention string
 }
 
 type byName []Repo
@@ -63,21 +73,21 @@ const (
 	depFormat
 )
 
-var lockFileParsers = map[lockFileFormat]func(string) ([]Repo, error){
+var lockFileParsers = map[lockFileFormat]func(string, *RemoteCache) ([]Repo, error){
 	depFormat: importRepoRulesDep,
 }
 
 // ImportRepoRules reads the lock file of a vendoring tool and returns
 // a list of equivalent repository rules that can be merged into a WORKSPACE
 // file. The format of the file is inferred from its basename. Currently,
-// only Gopkg.lock is supported.
-func ImportRepoRules(filename string) ([]*rule.Rule, error) {
+// only Gopkg.lock is supported. Repositories are named with rc.RepoName.
+func ImportRepoRules(filename string, rc *RemoteCache) ([]*rule.Rule, error) {
 	format := getLockFileFormat(filename)
 	if format == unknownFormat {
 		return nil, fmt.Errorf(`%s: unrecognized lock file format. Expected "Gopkg.lock"`, filename)
 	}
 	parser := lockFileParsers[format]
-	repos, err := parser(filename)
+	repos, err := parser(filename, rc)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing %q: %v", filename, err)
 	}
@@ -111,6 +121,9 @@ func GenerateRule(repo Repo) *rule.Rule {
 	if repo.VCS != "" {
 		r.SetAttr("vcs", repo.VCS)
 	}
+	if repo.BuildNamingConvention != "" {
+		r.SetAttr("build_naming_convention", repo.BuildNamingConvention)
+	}
 	return r
 }
 
@@ -144,11 +157,92 @@ func FindExternalRepo(repoRoot, name string) (string, error) {
 // ListRepositories extracts metadata about repositories declared in a
 // WORKSPACE file.
 //
+// Repositories declared in macros are also listed if the WORKSPACE file
+// contains a directive naming the file and macro, for example:
+//
+//	# gazelle:repository_macro repositories.bzl%go_repositories
+//
+// The path is relative to the directory containing the WORKSPACE file.
+//
+// Repositories that aren't declared with go_repository, for example,
+// http_archive rules, may be described with directives that give their
+// names and import path prefixes:
+//
+//	# gazelle:repository http_archive name=com_example_foo importpath=example.com/foo
+//
+// Repositories declared with directives are listed last, so they take
+// precedence over rules with the same import path prefix when the list is
+// passed to NewRemoteCache.
+//
 // The set of repositories returned is necessarily incomplete, since we don't
-// evaluate the file, and repositories may be declared in macros in other files.
-func ListRepositories(workspace *rule.File) []Repo {
+// evaluate the file, and repositories may be declared in macros that aren't
+// named by directives.
+func ListRepositories(workspace *rule.File) ([]Repo, error) {
+	repos := listRepositoryRules(workspace.Rules)
+	var declared []Repo
+	for _, d := range workspace.Directives {
+		if d.Key == "repository" {
+			repo, err := parseRepositoryDirective(d.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid repository directive %q: %v", workspace.Path, d.Value, err)
+			}
+			declared = append(declared, repo)
+			continue
+		}
+		if d.Key != "repository_macro" {
+			continue
+		}
+		i := strings.LastIndexByte(d.Value, '%')
+		if i <= 0 || i == len(d.Value)-1 {
+			return nil, fmt.Errorf("%s: invalid repository_macro directive %q: want file%%macro", workspace.Path, d.Value)
+		}
+		macroPath := filepath.Join(filepath.Dir(workspace.Path), filepath.FromSlash(d.Value[:i]))
+		rules, err := loadMacroRules(macroPath, d.Value[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, listRepositoryRules(rules)...)
+	}
+	return append(repos, declared...), nil
+}
+
+// parseRepositoryDirective parses the value of a # gazelle:repository
+// directive. The value starts with the kind of the repository rule, which
+// is ignored, followed by attributes of the form key=value. The name and
+// importpath attributes are required.
+func parseRepositoryDirective(value string) (Repo, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return Repo{}, fmt.Errorf("want kind name=... importpath=...")
+	}
+	var repo Repo
+	for _, f := range fields[1:] {
+		i := strings.IndexByte(f, '=')
+		if i <= 0 {
+			return Repo{}, fmt.Errorf("attribute %q is not of the form key=value", f)
+		}
+		key, val := f[:i], f[i+1:]
+		switch key {
+		case "name":
+			repo.Name = val
+		case "importpath":
+			repo.GoPrefix = val
+		case "build_naming_convention":
+			repo.BuildNamingConvention = val
+		default:
+			return Repo{}, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	if repo.Name == "" || repo.GoPrefix == "" {
+		return Repo{}, fmt.Errorf("name and importpath must be set")
+	}
+	return repo, nil
+}
+
+// listRepositoryRules returns metadata for the repository rules in rs.
+func listRepositoryRules(rs []*rule.Rule) []Repo {
 	var repos []Repo
-	for _, r := range workspace.Rules {
+	for _, r := range rs {
 		name := r.Name()
 		if name == "" {
 			continue
@@ -163,15 +257,17 @@ func ListRepositories(workspace *rule.File) []Repo {
 			revision := r.AttrString("commit")
 			remote := r.AttrString("remote")
 			vcs := r.AttrString("vcs")
+			namingConvention := r.AttrString("build_naming_convention")
 			if goPrefix == "" {
 				continue
 			}
 			repo = Repo{
-				Name:     name,
-				GoPrefix: goPrefix,
-				Commit:   revision,
-				Remote:   remote,
-				VCS:      vcs,
+				Name:                  name,
+				GoPrefix:              goPrefix,
+				Commit:                revision,
+				Remote:                remote,
+				VCS:                   vcs,
+				BuildNamingConvention: namingConvention,
 			}
 
 			// TODO(jayconrod): infer from {new_,}git_repository, {new_,}http_archive,
@@ -182,9 +278,83 @@ func ListRepositories(workspace *rule.File) []Repo {
 		}
 		repos = append(repos, repo)
 	}
+	return repos
+}
+
+// loadMacroRules reads the .bzl file at path and returns the rules called
+// at the top level of the body of the function named macroName.
+func loadMacroRules(path, macroName string) ([]*rule.Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ast, err := bzl.Parse(path, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range ast.Stmt {
+		// The parser doesn't interpret function definitions in build files.
+		// They are passed through as raw Python blocks, so we parse the body
+		// of the function separately.
+		block, ok := stmt.(*bzl.PythonBlock)
+		if !ok {
+			continue
+		}
+		body, ok := macroBody(block.Token, macroName)
+		if !ok {
+			continue
+		}
+		f, err := rule.LoadData(path, []byte(body))
+		if err != nil {
+			return nil, err
+		}
+		return f.Rules, nil
+	}
+	return nil, fmt.Errorf("%s: macro %q not found", path, macroName)
+}
 
-	// TODO(jayconrod): look for directives that describe repositories that
-	// aren't declared in the top-level of WORKSPACE (e.g., behind a macro).
+// macroBody returns the dedented body of a function definition, if the
+// Python block in src defines a function named name.
+func macroBody(src, name string) (string, bool) {
+	if !strings.HasPrefix(src, "def ") {
+		return "", false
+	}
+	header := strings.TrimSpace(src[len("def "):])
+	if !strings.HasPrefix(header, name) || !strings.HasPrefix(strings.TrimSpace(header[len(name):]), "(") {
+		return "", false
+	}
 
-	return repos
+	// Skip the header, which ends with the first line ending in ":", not
+	// counting comments. One-line definitions like "def f(): pass" have no
+	// body to read.
+	lines := strings.Split(src, "\n")
+	i := 0
+	for i < len(lines) && !strings.HasSuffix(strings.TrimSpace(stripComment(lines[i])), ":") {
+		i++
+	}
+	if i == len(lines) {
+		return "", false
+	}
+	lines = lines[i+1:]
+
+	// Remove the indentation of the first non-blank line from each line.
+	indent := ""
+	for _, line := range lines {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != "" {
+			indent = line[:len(line)-len(trimmed)]
+			break
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// stripComment returns line without a trailing "#" comment.
+func stripComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		return line[:i]
+	}
+	return line
 }
@@ -107,6 +107,20 @@ go_repository(
 				Remote:   "https://example.com/repo",
 				Commit:   "123456",
 			}},
+		}, {
+			desc: "build_naming_convention",
+			workspace: `
+go_repository(
+    name = "custom_repo",
+    importpath = "example.com/repo",
+    build_naming_convention = "import",
+)
+`,
+			want: []Repo{{
+				Name:                  "custom_repo",
+				GoPrefix:              "example.com/repo",
+				BuildNamingConvention: "import",
+			}},
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -114,9 +128,166 @@ go_repository(
 			if err != nil {
 				t.Fatal(err)
 			}
-			if got := ListRepositories(workspace); !reflect.DeepEqual(got, tc.want) {
+			got, err := ListRepositories(workspace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
 				t.Errorf("got %#v ; want %#v", got, tc.want)
 			}
 		})
 	}
 }
+
+func TestListRepositoriesFromMacro(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TEMPDIR"), "TestListRepositoriesFromMacro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	macroData := []byte(`
+load("@bazel_gazelle//:deps.bzl", "go_repository")
+
+def go_repositories():
+    go_repository(
+        name = "custom_repo",
+        importpath = "example.com/repo",
+        commit = "123456",
+    )
+
+def other_repositories():
+    go_repository(
+        name = "other_repo",
+        importpath = "example.com/other",
+    )
+`)
+	if err := os.MkdirAll(filepath.Join(dir, "build"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "build", "repositories.bzl"), macroData, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	workspaceData := []byte(`
+# gazelle:repository_macro build/repositories.bzl%go_repositories
+
+go_repository(
+    name = "top_repo",
+    importpath = "example.com/top",
+)
+`)
+	workspace, err := rule.LoadData(filepath.Join(dir, "WORKSPACE"), workspaceData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ListRepositories(workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Repo{
+		{Name: "top_repo", GoPrefix: "example.com/top"},
+		{Name: "custom_repo", GoPrefix: "example.com/repo", Commit: "123456"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v ; want %#v", got, want)
+	}
+
+	for _, value := range []string{"build/repositories.bzl", "build/repositories.bzl%missing"} {
+		workspace, err := rule.LoadData(filepath.Join(dir, "WORKSPACE"), []byte("# gazelle:repository_macro "+value+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ListRepositories(workspace); err == nil {
+			t.Errorf("%s: got success; want error", value)
+		}
+	}
+}
+
+func TestMacroBody(t *testing.T) {
+	for _, tc := range []struct {
+		desc, src, want string
+		ok              bool
+	}{
+		{
+			desc: "simple",
+			src:  "def go_repositories():\n    go_repository(name = \"a\")\n",
+			want: "go_repository(name = \"a\")\n",
+			ok:   true,
+		}, {
+			desc: "header_comment",
+			src:  "def go_repositories():  # deps\n    go_repository(name = \"a\")\n",
+			want: "go_repository(name = \"a\")\n",
+			ok:   true,
+		}, {
+			desc: "one_line",
+			src:  "def go_repositories(): pass",
+		}, {
+			desc: "other_name",
+			src:  "def other_repositories():\n    pass\n",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := macroBody(tc.src, "go_repositories")
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("got %q, %v ; want %q, %v", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestListRepositoriesFromDirectives(t *testing.T) {
+	workspace, err := rule.LoadData("WORKSPACE", []byte(`
+# gazelle:repository http_archive name=custom_foo importpath=github.com/example/foo
+# gazelle:repository new_git_repository name=custom_bar importpath=example.com/bar build_naming_convention=import
+
+go_repository(
+    name = "com_github_example_foo",
+    importpath = "github.com/example/foo",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ListRepositories(workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Repo{
+		{Name: "com_github_example_foo", GoPrefix: "github.com/example/foo"},
+		{Name: "custom_foo", GoPrefix: "github.com/example/foo"},
+		{Name: "custom_bar", GoPrefix: "example.com/bar", BuildNamingConvention: "import"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v ; want %#v", got, want)
+	}
+
+	// Declared repositories take precedence over rules and derived names.
+	rc := NewRemoteCache(got)
+	for _, tc := range []struct{ imp, wantRoot, wantName string }{
+		{"github.com/example/foo/sub", "github.com/example/foo", "custom_foo"},
+		{"example.com/bar/sub", "example.com/bar", "custom_bar"},
+	} {
+		root, name, err := rc.Root(tc.imp)
+		if err != nil {
+			t.Errorf("%s: %v", tc.imp, err)
+		} else if root != tc.wantRoot || name != tc.wantName {
+			t.Errorf("%s: got %s, %s; want %s, %s", tc.imp, root, name, tc.wantRoot, tc.wantName)
+		}
+	}
+
+	for _, value := range []string{
+		"http_archive",
+		"http_archive name=foo",
+		"http_archive name=foo importpath",
+		"http_archive name=foo importpath=example.com/foo sha256=abc",
+	} {
+		workspace, err := rule.LoadData("WORKSPACE", []byte("# gazelle:repository "+value+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ListRepositories(workspace); err == nil {
+			t.Errorf("%s: got success; want error", value)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/repos"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// DepMismatchKind describes how a dependency in a build file differs from
+// the dependency Gazelle would resolve.
+type DepMismatchKind int
+
+const (
+	// MissingDep indicates a resolved dependency is not in the build file.
+	MissingDep DepMismatchKind = iota
+
+	// ExtraDep indicates a dependency in the build file is not resolved
+	// from any import.
+	ExtraDep
+
+	// WrongDep indicates a dependency in the build file provides the same
+	// import as a resolved dependency but has a different label.
+	WrongDep
+)
+
+func (k DepMismatchKind) String() string {
+	switch k {
+	case MissingDep:
+		return "missing"
+	case ExtraDep:
+		return "extra"
+	case WrongDep:
+		return "wrong"
+	default:
+		return "unknown"
+	}
+}
+
+// DepMismatch describes a difference between the "deps" attribute of a rule
+// in a build file and the dependencies resolved from its imports.
+type DepMismatch struct {
+	// From is the label of the rule with the dependency.
+	From label.Label
+
+	Kind DepMismatchKind
+
+	// Want is the resolved label. It's label.NoLabel for ExtraDep.
+	Want label.Label
+
+	// Got is the label in the build file. It's label.NoLabel for MissingDep.
+	Got label.Label
+}
+
+func (m DepMismatch) String() string {
+	switch m.Kind {
+	case MissingDep:
+		return fmt.Sprintf("%s: missing dependency %s", m.From, m.Want)
+	case ExtraDep:
+		return fmt.Sprintf("%s: extra dependency %s", m.From, m.Got)
+	default:
+		return fmt.Sprintf("%s: dependency %s should be %s", m.From, m.Got, m.Want)
+	}
+}
+
+// CheckIndex compares the "deps" attributes of rules in f with the
+// dependencies resolved from the imports of rules in gen, which were
+// generated for the same directory. Rules are matched by name and kind.
+// Neither f nor gen is modified: generated rules are resolved through
+// copies. Rules without a known resolver or without imports recorded by
+// the language that generated them are skipped, as are rules and
+// dependencies marked with "# keep". ix must be finished.
+//
+// CheckIndex is meant for checking that build files agree with sources
+// without rewriting them.
+func CheckIndex(c *config.Config, ix *RuleIndex, rc *repos.RemoteCache, f *rule.File, gen []*rule.Rule) []DepMismatch {
+	rel := f.Rel(c.RepoRoot)
+	var mismatches []DepMismatch
+	for _, g := range gen {
+		rslv, ok := ix.kindToResolver[g.Kind()]
+		if !ok || g.PrivateAttr(config.GazelleImportsKey) == nil {
+			continue
+		}
+		old := findRule(c, f, g)
+		if old == nil || old.ShouldKeep() {
+			continue
+		}
+		from := label.New("", rel, g.Name())
+		r := copyRule(g)
+		rslv.Resolve(c, ix, rc, r, from)
+		want := depSet(r.Attr("deps"), from, false)
+		got := depSet(old.Attr("deps"), from, true)
+		mismatches = append(mismatches, ix.compareDeps(from, want, got)...)
+	}
+	return mismatches
+}
+
+// findRule returns the rule in f with the same name as g and a kind that
+// maps to the kind of g, or nil if there is no such rule.
+func findRule(c *config.Config, f *rule.File, g *rule.Rule) *rule.Rule {
+	for _, r := range f.Rules {
+		if r.Name() == g.Name() && (r.Kind() == g.Kind() || c.UnmappedKind(r.Kind()) == g.Kind()) {
+			return r
+		}
+	}
+	return nil
+}
+
+// copyRule returns a copy of r that can be resolved without modifying r.
+func copyRule(r *rule.Rule) *rule.Rule {
+	cp := rule.NewRule(r.Kind(), r.Name())
+	for _, key := range r.AttrKeys() {
+		if key != "name" {
+			cp.SetAttr(key, r.Attr(key))
+		}
+	}
+	for _, key := range r.PrivateAttrKeys() {
+		cp.SetPrivateAttr(key, r.PrivateAttr(key))
+	}
+	return cp
+}
+
+// depSet returns the labels in a deps expression, made absolute relative to
+// from. If skipKeep is true, labels marked with "# keep" are omitted.
+// Values that aren't labels are ignored.
+func depSet(e bzl.Expr, from label.Label, skipKeep bool) map[label.Label]bool {
+	deps := make(map[label.Label]bool)
+	if e == nil {
+		return deps
+	}
+	list, ok := rule.FlattenExpr(e).(*bzl.ListExpr)
+	if !ok {
+		return deps
+	}
+	for _, elem := range list.List {
+		s, ok := elem.(*bzl.StringExpr)
+		if !ok || skipKeep && rule.ShouldKeep(s) {
+			continue
+		}
+		l, err := label.Parse(s.Value)
+		if err != nil {
+			continue
+		}
+		deps[l.Abs(from.Repo, from.Pkg)] = true
+	}
+	return deps
+}
+
+// compareDeps returns mismatches between the resolved labels in want and
+// the labels in the build file in got. A missing label and an extra label
+// are reported together as WrongDep if they provide a common import or,
+// when either isn't indexed, if they're in the same package.
+func (ix *RuleIndex) compareDeps(from label.Label, want, got map[label.Label]bool) []DepMismatch {
+	var missing, extra []label.Label
+	for l := range want {
+		if !got[l] {
+			missing = append(missing, l)
+		}
+	}
+	for l := range got {
+		if !want[l] {
+			extra = append(extra, l)
+		}
+	}
+	sortLabels(missing)
+	sortLabels(extra)
+
+	var mismatches []DepMismatch
+	paired := make(map[label.Label]bool)
+	for _, m := range missing {
+		var wrong label.Label
+		found := false
+		for _, e := range extra {
+			if !paired[e] && ix.isSameDep(m, e) {
+				wrong, found = e, true
+				break
+			}
+		}
+		if found {
+			paired[wrong] = true
+			mismatches = append(mismatches, DepMismatch{From: from, Kind: WrongDep, Want: m, Got: wrong})
+		} else {
+			mismatches = append(mismatches, DepMismatch{From: from, Kind: MissingDep, Want: m, Got: label.NoLabel})
+		}
+	}
+	for _, e := range extra {
+		if !paired[e] {
+			mismatches = append(mismatches, DepMismatch{From: from, Kind: ExtraDep, Want: label.NoLabel, Got: e})
+		}
+	}
+	return mismatches
+}
+
+// isSameDep returns whether the labels a and b are likely to be different
+// names for the same dependency.
+func (ix *RuleIndex) isSameDep(a, b label.Label) bool {
+	ra, aok := ix.labelMap[a]
+	rb, bok := ix.labelMap[b]
+	if !aok || !bok {
+		return a.Repo == b.Repo && a.Pkg == b.Pkg
+	}
+	for _, ia := range ra.importedAs {
+		for _, ib := range rb.importedAs {
+			if ix.importKey(ia) == ix.importKey(ib) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortLabels(labels []label.Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].String() < labels[j].String()
+	})
+}
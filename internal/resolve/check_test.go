@@ -0,0 +1,110 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+func TestCheckIndex(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+	for _, spec := range []struct{ rel, name, imp string }{
+		{"a", "a", "example.com/a"},
+		{"b", "b", "example.com/b"},
+		{"c", "c", "example.com/c"},
+		{"d", "d", "example.com/d"},
+	} {
+		f := rule.EmptyFile(filepath.Join(c.RepoRoot, spec.rel, "BUILD.bazel"))
+		r := rule.NewRule("test_library", spec.name)
+		r.SetAttr("importpath", spec.imp)
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := rule.LoadData(filepath.Join(c.RepoRoot, "x", "BUILD.bazel"), []byte(`
+test_library(
+    name = "x",
+    importpath = "example.com/x",
+    deps = [
+        "//a",
+        "//b:wrong",
+        "//d",
+        "//manual",  # keep
+        "@ext//example.com/y:other",
+    ],
+)
+
+# keep
+test_library(
+    name = "kept",
+    importpath = "example.com/kept",
+    deps = ["//d"],
+)
+
+test_library(
+    name = "ok",
+    importpath = "example.com/ok",
+    deps = ["//a"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRule := func(name string, imports ...string) *rule.Rule {
+		r := rule.NewRule("test_library", name)
+		r.SetAttr("importpath", "example.com/"+name)
+		r.SetPrivateAttr(config.GazelleImportsKey, imports)
+		return r
+	}
+	gen := []*rule.Rule{
+		newRule("x", "example.com/a", "example.com/b", "example.com/c", "example.com/y"),
+		newRule("kept", "example.com/a"),
+		newRule("ok", "example.com/a"),
+		newRule("new", "example.com/a"),
+	}
+
+	var got []string
+	for _, m := range CheckIndex(c, ix, nil, f, gen) {
+		got = append(got, m.String())
+	}
+	want := []string{
+		"//x: dependency //b:wrong should be //b",
+		"//x: missing dependency //c",
+		"//x: dependency @ext//example.com/y:other should be @ext//example.com/y:lib",
+		"//x: extra dependency //d",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+
+	// Neither the file nor the generated rules should be modified.
+	if deps := f.Rules[0].AttrStrings("deps"); len(deps) != 5 {
+		t.Errorf("file deps: got %v; want 5 deps", deps)
+	}
+	if deps := gen[0].Attr("deps"); deps != nil {
+		t.Errorf("generated deps: got %v; want nil", deps)
+	}
+}
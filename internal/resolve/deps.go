@@ -0,0 +1,119 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+// MapDepLabels applies c.MapDepLabel to each label in the "deps" attribute
+// of r, which has the label from. This should be called after r is resolved.
+// Labels that can't be parsed are left unchanged. Nothing is done if
+// c.MapDepLabel is nil.
+func MapDepLabels(c *config.Config, r *rule.Rule, from label.Label) {
+	if c.MapDepLabel == nil {
+		return
+	}
+	deps := r.Attr("deps")
+	if deps == nil {
+		return
+	}
+	mapped := rule.MapExprStrings(deps, func(s string) string {
+		l, err := label.Parse(s)
+		if err != nil {
+			return s
+		}
+		l = l.Abs(from.Repo, from.Pkg)
+		l = c.MapDepLabel(l, from)
+		return l.Rel(from.Repo, from.Pkg).String()
+	})
+	if mapped == nil {
+		r.DelAttr("deps")
+	} else {
+		r.SetAttr("deps", mapped)
+	}
+}
+
+// PruneEmbeddedDeps removes labels from the "deps" attribute of r, which has
+// the label from, that are embedded, directly or transitively, by rules named
+// by other labels in "deps", according to ix. The sources of an embedded
+// rule are built into the embedding rule, so a dependency on both is
+// redundant. This should be called after r is resolved and before
+// MapDepLabels.
+//
+// Only plain lists of labels are pruned. When "deps" contains select
+// expressions, it's left unchanged, since an embedding rule that's only a
+// dependency on some platforms doesn't make a dependency redundant on the
+// others.
+func PruneEmbeddedDeps(ix *RuleIndex, r *rule.Rule, from label.Label) {
+	deps := r.AttrStrings("deps")
+	if len(deps) < 2 {
+		return
+	}
+	labels := make([]label.Label, len(deps))
+	for i, dep := range deps {
+		l, err := label.Parse(dep)
+		if err != nil {
+			return
+		}
+		labels[i] = l.Abs(from.Repo, from.Pkg)
+	}
+	pruned := make(map[string]bool)
+	for i, dep := range deps {
+		for j, other := range labels {
+			if i != j && ix.Embeds(other, labels[i], from) {
+				pruned[dep] = true
+				break
+			}
+		}
+	}
+	if len(pruned) > 0 {
+		// Strings are removed from the existing expression, so comments on
+		// the remaining labels are preserved.
+		r.SetAttr("deps", rule.MapExprStrings(r.Attr("deps"), func(s string) string {
+			if pruned[s] {
+				return ""
+			}
+			return s
+		}))
+	}
+}
+
+// MissingDeps returns the labels in the "deps" attribute of r, which has the
+// label from, that name rules in the main repository that weren't added to
+// ix. This should be called after r is resolved and after all rules have been
+// added to ix, so it can catch dependencies that resolution produced from
+// stale information. Labels in external repositories aren't checked, nor are
+// labels that can't be parsed, nor are labels in packages that declare
+// targets that can't be indexed (see HasDynamicTargets) or in excluded
+// directories (see IsExcluded). Labels in select expressions are checked.
+func MissingDeps(ix *RuleIndex, r *rule.Rule, from label.Label) []label.Label {
+	var missing []label.Label
+	rule.MapExprStrings(r.Attr("deps"), func(s string) string {
+		l, err := label.Parse(s)
+		if err != nil {
+			return s
+		}
+		l = l.Abs(from.Repo, from.Pkg)
+		if l.Repo == "" && !ix.HasDynamicTargets(l.Pkg) && !ix.IsExcluded(l.Pkg) && !ix.HasTarget(l, from) {
+			missing = append(missing, l)
+		}
+		return s
+	})
+	return missing
+}
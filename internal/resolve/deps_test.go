@@ -0,0 +1,235 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+func TestMapDepLabels(t *testing.T) {
+	c := config.New()
+	c.MapDepLabel = func(l, from label.Label) label.Label {
+		if from.Pkg != "foo" {
+			t.Errorf("got from %s; want a label in //foo", from)
+		}
+		if strings.HasPrefix(l.Repo, "com_github_x") {
+			l.Repo = "mirror_x" + strings.TrimPrefix(l.Repo, "com_github_x")
+		}
+		if l.Pkg == "old" {
+			l.Pkg = "new"
+		}
+		return l
+	}
+
+	f, err := rule.LoadData("foo/BUILD.bazel", []byte(`
+go_library(
+    name = "go_default_library",
+    deps = [
+        ":sibling",
+        "//old:go_default_library",
+        "@com_github_x//lib:go_default_library",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "@com_github_x_sys//unix:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+
+proto_library(
+    name = "foo_proto",
+    deps = ["@com_github_x//api:api_proto"],
+)
+
+proto_library(
+    name = "nodeps_proto",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		MapDepLabels(c, r, label.New("", "foo", r.Name()))
+	}
+	f.Sync()
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_library(
+    name = "go_default_library",
+    deps = [
+        ":sibling",
+        "//new:go_default_library",
+        "@mirror_x//lib:go_default_library",
+    ] + select({
+        "@io_bazel_rules_go//go/platform:linux": [
+            "@mirror_x_sys//unix:go_default_library",
+        ],
+        "//conditions:default": [],
+    }),
+)
+
+proto_library(
+    name = "foo_proto",
+    deps = ["@mirror_x//api:api_proto"],
+)
+
+proto_library(
+    name = "nodeps_proto",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPruneEmbeddedDeps(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+	f, err := rule.LoadData("/root/lib/BUILD.bazel", []byte(`
+test_library(
+    name = "inner",
+    importpath = "example.com/lib/inner",
+)
+
+test_library(
+    name = "middle",
+    embed = [":inner"],
+    importpath = "example.com/lib/middle",
+)
+
+test_library(
+    name = "outer",
+    embed = [":middle"],
+    importpath = "example.com/lib",
+)
+
+test_library(
+    name = "other",
+    importpath = "example.com/lib/other",
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc       string
+		deps, want []string
+	}{
+		{
+			desc: "direct",
+			deps: []string{"//lib:middle", "//lib:inner"},
+			want: []string{"//lib:middle"},
+		}, {
+			desc: "transitive",
+			deps: []string{"//lib:inner", "//lib:other", "//lib:outer"},
+			want: []string{"//lib:other", "//lib:outer"},
+		}, {
+			desc: "not_embedded",
+			deps: []string{"//lib:inner", "//lib:other", "@ext//lib:lib"},
+			want: []string{"//lib:inner", "//lib:other", "@ext//lib:lib"},
+		}, {
+			desc: "embedder_not_in_deps",
+			deps: []string{"//lib:inner"},
+			want: []string{"//lib:inner"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := rule.NewRule("test_library", "bin")
+			r.SetAttr("deps", tc.deps)
+			PruneEmbeddedDeps(ix, r, label.New("", "bin", "bin"))
+			if got := r.AttrStrings("deps"); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMissingDeps(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+	f, err := rule.LoadData("/root/lib/BUILD.bazel", []byte(`
+test_library(
+    name = "lib",
+    importpath = "example.com/lib",
+)
+
+filegroup(
+    name = "data",
+)
+
+alias(
+    name = "alias",
+    actual = ":lib",
+)
+
+exports_files(["lib.txt"])
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.AddDynamicPackage("dyn")
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := rule.LoadData("/root/bin/BUILD.bazel", []byte(`
+test_binary(
+    name = "bin",
+    deps = [
+        ":sibling",
+        "//dyn:ext",
+        "//lib",
+        "//lib:alias",
+        "//lib:data",
+        "//lib:lib.txt",
+        "//lib:stale",
+        "@ext//lib",
+    ] + select({
+        "//conditions:default": ["//other:lib"],
+    }),
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := MissingDeps(ix, r.Rules[0], label.New("", "bin", "bin"))
+	want := []label.Label{
+		label.New("", "bin", "sibling"),
+		label.New("", "lib", "stale"),
+		label.New("", "other", "lib"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
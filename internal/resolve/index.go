@@ -16,12 +16,20 @@ limitations under the License.
 package resolve
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
 	"github.com/bazelbuild/bazel-gazelle/internal/repos"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 // ImportSpec describes a library to be imported. Imp is an import string for
@@ -44,12 +52,18 @@ type Resolver interface {
 	//
 	// If nil is returned, the rule will not be indexed. If any non-nil slice is
 	// returned, including an empty slice, the rule will be indexed.
+	//
+	// A rule may return more than one ImportSpec, for example, when it can be
+	// imported with aliases of its canonical path. FindRulesByImport finds
+	// the rule with any of them. An import is only ambiguous when distinct
+	// rules provide it.
 	Imports(c *config.Config, r *rule.Rule, f *rule.File) []ImportSpec
 
 	// Embeds returns a list of labels of rules that the given rule embeds. If
 	// a rule is embedded by another importable rule of the same language, only
 	// the embedding rule will be indexed. The embedding rule will inherit
-	// the imports of the embedded rule.
+	// the imports of the embedded rule. Embeds are followed transitively, so
+	// Embeds only needs to return rules that are embedded directly.
 	Embeds(r *rule.Rule, from label.Label) []label.Label
 
 	// Resolve translates imported libraries for a given rule into Bazel
@@ -61,13 +75,60 @@ type Resolver interface {
 	Resolve(c *config.Config, ix *RuleIndex, rc *repos.RemoteCache, r *rule.Rule, from label.Label)
 }
 
+// VendorResolver may be implemented by a Resolver for a language with
+// vendoring, like Go. A rule in a vendor directory may only be imported from
+// the tree containing that directory, where it takes precedence over rules
+// in vendor directories further up and rules that aren't vendored. Rules
+// that provide the same import from different vendor trees are never
+// ambiguous, so Finish doesn't report them as duplicates.
+type VendorResolver interface {
+	// VendorRoot returns the directory containing the innermost vendor
+	// directory that the package rel is in. The second result is false if
+	// rel is not in a vendor directory.
+	VendorRoot(c *config.Config, rel string) (string, bool)
+}
+
 // RuleIndex is a table of rules in a workspace, indexed by label and by
 // import path. Used by Resolver to map import paths to labels.
+//
+// AddRule may be called concurrently from multiple goroutines. Finish must
+// be called once all AddRule calls have returned. After Finish, the index
+// is read-only, and FindRulesByImport may be called concurrently without
+// locking.
 type RuleIndex struct {
+	// mu guards rules, targets, aliases, dynamicPkgs, and excludedDirs while
+	// rules are being added. labelMap is built by Finish.
+	mu             sync.Mutex
 	rules          []*ruleRecord
 	labelMap       map[label.Label]*ruleRecord
+	targets        map[label.Label]bool
 	importMap      map[ImportSpec][]*ruleRecord
+	pkgMap         map[string][]*ruleRecord
+	aliases        []aliasRecord
+	dynamicPkgs    map[string]bool
+	excludedDirs   map[string]bool
 	kindToResolver map[string]Resolver
+
+	// CheckVisibility indicates whether FindRulesByImport should exclude
+	// rules that are not visible to the importing rule.
+	CheckVisibility bool
+
+	// FailOnDuplicateImports indicates whether Finish should return an error
+	// when the same import is provided by more than one rule. When false,
+	// a warning is logged instead.
+	FailOnDuplicateImports bool
+
+	// FoldImportCase indicates whether imports should be matched without
+	// regard to case, as they are by tools on case-insensitive file systems.
+	// FindRulesByImport logs a warning when an import only matches a rule
+	// that provides it with different case. This must be set before Finish
+	// is called.
+	FoldImportCase bool
+
+	// Logger receives warnings about indexed rules and ambiguous imports.
+	// If nil, config.DefaultLogger is used. It's usually set to the
+	// Logger of the root Config.
+	Logger config.Logger
 }
 
 // ruleRecord contains information about a rule relevant to import indexing.
@@ -77,6 +138,30 @@ type ruleRecord struct {
 	importedAs       []ImportSpec
 	embedded         bool
 	haveEmbedImports bool
+
+	// aliases lists records of alias rules that name this rule in their
+	// "actual" attributes. They're only used for labels and visibility.
+	aliases []*ruleRecord
+
+	// embeds lists rules of the same language that this rule embeds
+	// directly. It's set by Finish.
+	embeds []*ruleRecord
+
+	// defaultVisibility is the default_visibility of the package containing
+	// the rule, used when the rule has no visibility attribute.
+	defaultVisibility []string
+
+	// vendorRoot is the directory containing the vendor directory the rule
+	// is in, if vendored is true. See VendorResolver.
+	vendorRoot string
+	vendored   bool
+}
+
+// aliasRecord contains information about an alias rule. Aliases are not
+// indexed by import, but they are attached to the rules they point to.
+type aliasRecord struct {
+	record *ruleRecord
+	actual label.Label
 }
 
 // NewRuleIndex creates a new index.
@@ -86,6 +171,9 @@ type ruleRecord struct {
 func NewRuleIndex(kindToResolver map[string]Resolver) *RuleIndex {
 	return &RuleIndex{
 		labelMap:       make(map[label.Label]*ruleRecord),
+		targets:        make(map[label.Label]bool),
+		dynamicPkgs:    make(map[string]bool),
+		excludedDirs:   make(map[string]bool),
 		kindToResolver: kindToResolver,
 	}
 }
@@ -94,10 +182,28 @@ func NewRuleIndex(kindToResolver map[string]Resolver) *RuleIndex {
 // is a known resolver for the rule's kind and Resolver.Imports returns a
 // non-nil slice.
 //
-// AddRule may only be called before Finish.
+// alias rules are recorded separately. After Finish, the label of an alias
+// is reported in FindResult.Aliases for the rule named in its "actual"
+// attribute. Aliases with a "deprecation" attribute, like those kept for
+// renamed rules, are ignored, since new dependencies shouldn't use them.
+//
+// The labels of all rules, including those that aren't indexed, are recorded
+// for HasTarget, as are the labels of files exported with exports_files.
+// Rules without names, like exports_files, may be indexed by import, but they
+// can't be found by label.
+//
+// AddRule may only be called before Finish. It's safe to call AddRule
+// concurrently.
 func (ix *RuleIndex) AddRule(c *config.Config, r *rule.Rule, f *rule.File) {
+	ix.addTarget(c, r, f)
+	if r.Kind() == "alias" {
+		ix.addAlias(c, r, f)
+		return
+	}
+
 	var imps []ImportSpec
-	if rslv, ok := ix.kindToResolver[r.Kind()]; ok {
+	rslv, ok := ix.kindToResolver[r.Kind()]
+	if ok {
 		imps = rslv.Imports(c, r, f)
 	}
 	// If imps == nil, the rule is not importable. If imps is the empty slice,
@@ -108,66 +214,338 @@ func (ix *RuleIndex) AddRule(c *config.Config, r *rule.Rule, f *rule.File) {
 
 	rel := f.Rel(c.RepoRoot)
 	record := &ruleRecord{
-		rule:       r,
-		label:      label.New("", rel, r.Name()),
-		importedAs: imps,
+		rule:              r,
+		label:             label.New("", rel, r.Name()),
+		importedAs:        imps,
+		defaultVisibility: packageDefaultVisibility(f),
 	}
-	if _, ok := ix.labelMap[record.label]; ok {
-		log.Printf("multiple rules found with label %s", record.label)
-		return
+	if vr, ok := rslv.(VendorResolver); ok {
+		record.vendorRoot, record.vendored = vr.VendorRoot(c, rel)
 	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
 	ix.rules = append(ix.rules, record)
-	ix.labelMap[record.label] = record
+}
+
+func (ix *RuleIndex) addTarget(c *config.Config, r *rule.Rule, f *rule.File) {
+	rel := f.Rel(c.RepoRoot)
+	var names []string
+	if r.Name() != "" {
+		names = append(names, r.Name())
+	}
+	if r.Kind() == "exports_files" && len(r.Args()) > 0 {
+		if list, ok := r.Args()[0].(*bzl.ListExpr); ok {
+			for _, e := range list.List {
+				if s, ok := e.(*bzl.StringExpr); ok {
+					names = append(names, s.Value)
+				}
+			}
+		}
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, name := range names {
+		ix.targets[label.New("", rel, name)] = true
+	}
+}
+
+func (ix *RuleIndex) addAlias(c *config.Config, r *rule.Rule, f *rule.File) {
+	if r.Attr("deprecation") != nil {
+		return
+	}
+	actual, err := label.Parse(r.AttrString("actual"))
+	if err != nil {
+		return
+	}
+	rel := f.Rel(c.RepoRoot)
+	record := aliasRecord{
+		record: &ruleRecord{
+			rule:              r,
+			label:             label.New("", rel, r.Name()),
+			defaultVisibility: packageDefaultVisibility(f),
+		},
+		actual: actual.Abs("", rel),
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.aliases = append(ix.aliases, record)
+}
+
+// AddDynamicPackage records that the build file in the package rel declares
+// targets that can't be indexed, for example, with list comprehensions or
+// macros. Resolvers check HasDynamicTargets before guessing labels in such
+// packages.
+//
+// AddDynamicPackage may only be called before Finish. It's safe to call
+// AddDynamicPackage concurrently.
+func (ix *RuleIndex) AddDynamicPackage(rel string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.dynamicPkgs[rel] = true
+}
+
+// AddExcludedDir records that the directory rel, a slash-separated path
+// relative to the repository root, is excluded with # gazelle:exclude, so
+// rules in it and its subdirectories aren't indexed. MissingDeps doesn't
+// report labels there.
+//
+// AddExcludedDir may only be called before Finish. It's safe to call
+// AddExcludedDir concurrently.
+func (ix *RuleIndex) AddExcludedDir(rel string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.excludedDirs[rel] = true
 }
 
 // Finish constructs the import index and performs any other necessary indexing
 // actions after all rules have been added. This step is necessary because
 // a rule may be indexed differently based on what rules are added later.
 //
-// Finish must be called after all AddRule calls and before any
-// FindRulesByImport calls.
-func (ix *RuleIndex) Finish() {
+// Finish must be called after all AddRule calls have returned and before
+// any FindRulesByImport calls. Finish doesn't need to lock the index, since
+// it's the only goroutine accessing it.
+//
+// Finish reports imports provided by more than one rule, since dependencies
+// on them may be ambiguous. Resolvers may still choose one of the rules, for
+// example, the only one visible to the importing rule, or they may leave the
+// dependency unresolved. A single warning listing all such imports is
+// logged. If FailOnDuplicateImports is set, the list is returned as an
+// error instead. The index is usable in either case.
+func (ix *RuleIndex) Finish() error {
+	ix.sortRecords()
+	ix.buildLabelMap()
 	for _, r := range ix.rules {
-		ix.collectEmbedImports(r)
+		ix.collectEmbedImports(r, nil)
 	}
+	ix.collectAliases()
 	ix.buildImportIndex()
+	return ix.checkDuplicateImports()
 }
 
-func (ix *RuleIndex) collectEmbedImports(r *ruleRecord) {
+// sortRecords sorts rules and aliases by label. Rules may be added
+// concurrently, so this keeps embed cycles, duplicates, aliases, and
+// diagnostics found by Finish the same from run to run. Records with the
+// same label keep the order they were added in.
+func (ix *RuleIndex) sortRecords() {
+	sort.SliceStable(ix.rules, func(i, j int) bool {
+		return labelLess(ix.rules[i].label, ix.rules[j].label)
+	})
+	sort.SliceStable(ix.aliases, func(i, j int) bool {
+		return labelLess(ix.aliases[i].record.label, ix.aliases[j].record.label)
+	})
+}
+
+// buildLabelMap indexes named rules by label. When several rules have the
+// same label, the first one is kept, and the others are dropped with a
+// warning.
+func (ix *RuleIndex) buildLabelMap() {
+	ix.labelMap = make(map[label.Label]*ruleRecord)
+	rules := ix.rules[:0]
+	for _, r := range ix.rules {
+		if r.rule.Name() == "" {
+			rules = append(rules, r)
+			continue
+		}
+		if _, ok := ix.labelMap[r.label]; ok {
+			ix.Log(config.Diagnostic{
+				Severity: config.Warning,
+				From:     r.label,
+				Message:  fmt.Sprintf("multiple rules found with label %s", r.label),
+			})
+			continue
+		}
+		rules = append(rules, r)
+		ix.labelMap[r.label] = r
+	}
+	ix.rules = rules
+}
+
+// labelLess orders labels by repository, package, and name.
+func labelLess(x, y label.Label) bool {
+	if x.Repo != y.Repo {
+		return x.Repo < y.Repo
+	}
+	if x.Pkg != y.Pkg {
+		return x.Pkg < y.Pkg
+	}
+	return x.Name < y.Name
+}
+
+// collectAliases attaches the labels of alias rules to the rules they point
+// to. Only aliases that name a rule directly are attached; aliases of
+// aliases are not followed.
+func (ix *RuleIndex) collectAliases() {
+	for _, a := range ix.aliases {
+		if r, ok := ix.labelMap[a.actual]; ok {
+			r.aliases = append(r.aliases, a.record)
+		}
+	}
+}
+
+// collectEmbedImports adds the imports of rules embedded by r to
+// r.importedAs. Embeds are followed transitively, so if A embeds B and B
+// embeds C, A will be imported with the imports of B and C. Embedded rules
+// of the same language are marked, so only the outermost embedding rule
+// is indexed.
+//
+// stack is the list of rules whose embeds are currently being collected.
+// It's used to detect embed cycles. When a cycle is found, it's reported,
+// and the embed that completes the cycle is ignored.
+func (ix *RuleIndex) collectEmbedImports(r *ruleRecord, stack []*ruleRecord) {
 	if r.haveEmbedImports {
 		return
 	}
-	r.haveEmbedImports = true
+	stack = append(stack, r)
 	embedLabels := ix.kindToResolver[r.rule.Kind()].Embeds(r.rule, r.label)
 	for _, e := range embedLabels {
 		er, ok := ix.findRuleByLabel(e, r.label)
 		if !ok {
 			continue
 		}
+		if cycle := findEmbedCycle(stack, er); cycle != nil {
+			ix.Log(config.Diagnostic{
+				Severity: config.Warning,
+				From:     r.label,
+				Message:  fmt.Sprintf("embed cycle detected: %s", strings.Join(cycle, " -> ")),
+			})
+			continue
+		}
 		if ix.kindToResolver[r.rule.Kind()] == ix.kindToResolver[er.rule.Kind()] {
 			er.embedded = true
+			r.embeds = append(r.embeds, er)
 		}
-		ix.collectEmbedImports(er)
+		ix.collectEmbedImports(er, stack)
 		r.importedAs = append(r.importedAs, er.importedAs...)
 	}
+	r.haveEmbedImports = true
 }
 
-// buildImportIndex constructs the map used by FindRulesByImport.
+// findEmbedCycle returns a list of labels forming a cycle if r is already
+// on the stack of rules being visited. nil is returned if there is no cycle.
+func findEmbedCycle(stack []*ruleRecord, r *ruleRecord) []string {
+	for i, s := range stack {
+		if s != r {
+			continue
+		}
+		cycle := make([]string, 0, len(stack)-i+1)
+		for _, s := range stack[i:] {
+			cycle = append(cycle, s.label.String())
+		}
+		return append(cycle, r.label.String())
+	}
+	return nil
+}
+
+// buildImportIndex constructs the maps used by FindRulesByImport and
+// FindRulesByPackage.
 func (ix *RuleIndex) buildImportIndex() {
 	ix.importMap = make(map[ImportSpec][]*ruleRecord)
+	ix.pkgMap = make(map[string][]*ruleRecord)
 	for _, r := range ix.rules {
 		if r.embedded {
 			continue
 		}
+		ix.pkgMap[r.label.Pkg] = append(ix.pkgMap[r.label.Pkg], r)
 		indexed := make(map[ImportSpec]bool)
 		for _, imp := range r.importedAs {
-			if indexed[imp] {
+			key := ix.importKey(imp)
+			if indexed[key] {
 				continue
 			}
-			indexed[imp] = true
-			ix.importMap[imp] = append(ix.importMap[imp], r)
+			indexed[key] = true
+			ix.importMap[key] = append(ix.importMap[key], r)
+		}
+	}
+}
+
+// importKey returns the key for imp in importMap. If FoldImportCase is set,
+// the import string is folded to lower case.
+func (ix *RuleIndex) importKey(imp ImportSpec) ImportSpec {
+	if ix.FoldImportCase {
+		imp.Imp = strings.ToLower(imp.Imp)
+	}
+	return imp
+}
+
+// checkDuplicateImports reports imports that are provided by more than one
+// rule of the same language in importMap. Rules of different languages may
+// provide the same import, for example, a proto_library and a
+// go_proto_library that embeds it, since FindRulesByImport only returns
+// rules of one language. Vendored copies of rules don't conflict with rules
+// in other vendor trees either. See Finish and VendorResolver.
+func (ix *RuleIndex) checkDuplicateImports() error {
+	dupRules := make(map[ImportSpec][]*ruleRecord)
+	var dups []ImportSpec
+	for imp, rs := range ix.importMap {
+		if rs = ix.duplicateRules(rs); len(rs) > 0 {
+			dupRules[imp] = rs
+			dups = append(dups, imp)
+		}
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		if dups[i].Lang != dups[j].Lang {
+			return dups[i].Lang < dups[j].Lang
+		}
+		return dups[i].Imp < dups[j].Imp
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("multiple rules provide the same imports; dependencies on them may be ambiguous:")
+	for _, imp := range dups {
+		labels := make([]string, len(dupRules[imp]))
+		for i, r := range dupRules[imp] {
+			labels[i] = r.label.String()
 		}
+		sort.Strings(labels)
+		fmt.Fprintf(&buf, "\n\t%s %q: %s", imp.Lang, imp.Imp, strings.Join(labels, ", "))
 	}
+	if ix.FailOnDuplicateImports {
+		return errors.New(buf.String())
+	}
+	ix.Log(config.Diagnostic{Severity: config.Warning, Message: buf.String()})
+	return nil
+}
+
+// duplicateRules returns the rules in rs whose language and vendor tree
+// have more than one rule in rs. Rules in different vendor trees shadow each
+// other or aren't visible from the same places, so they aren't ambiguous.
+func (ix *RuleIndex) duplicateRules(rs []*ruleRecord) []*ruleRecord {
+	if len(rs) < 2 {
+		return nil
+	}
+	type scope struct {
+		lang, vendorRoot string
+		vendored         bool
+	}
+	scopeOf := func(r *ruleRecord) scope {
+		return scope{ix.kindToResolver[r.rule.Kind()].Name(), r.vendorRoot, r.vendored}
+	}
+	count := make(map[scope]int)
+	for _, r := range rs {
+		count[scopeOf(r)]++
+	}
+	var dups []*ruleRecord
+	for _, r := range rs {
+		if count[scopeOf(r)] > 1 {
+			dups = append(dups, r)
+		}
+	}
+	return dups
+}
+
+// Log reports d to ix.Logger or to config.DefaultLogger if ix.Logger is nil.
+// Resolvers may use this for diagnostics found while searching the index.
+func (ix *RuleIndex) Log(d config.Diagnostic) {
+	if ix.Logger == nil {
+		config.DefaultLogger{}.Log(d)
+		return
+	}
+	ix.Logger.Log(d)
 }
 
 func (ix *RuleIndex) findRuleByLabel(label label.Label, from label.Label) (*ruleRecord, bool) {
@@ -176,29 +554,303 @@ func (ix *RuleIndex) findRuleByLabel(label label.Label, from label.Label) (*rule
 	return r, ok
 }
 
+// HasTarget returns whether a rule with label l, relative to from, was added
+// to the index. Unlike FindRulesByImport, this considers all rules, including
+// those that can't be imported and aliases. Labels in external repositories
+// are never found.
+func (ix *RuleIndex) HasTarget(l, from label.Label) bool {
+	return ix.targets[l.Abs(from.Repo, from.Pkg)]
+}
+
+// HasDynamicTargets returns whether the build file in the package pkg of
+// the main repository declares targets that can't be indexed, as recorded
+// with AddDynamicPackage. A label guessed in such a package for an import
+// that isn't indexed may be wrong, even if the import is provided there.
+func (ix *RuleIndex) HasDynamicTargets(pkg string) bool {
+	return ix.dynamicPkgs[pkg]
+}
+
+// IsExcluded returns whether the package pkg of the main repository is in a
+// directory recorded with AddExcludedDir. Targets in such packages aren't
+// indexed, but they may still exist.
+func (ix *RuleIndex) IsExcluded(pkg string) bool {
+	for {
+		if ix.excludedDirs[pkg] {
+			return true
+		}
+		if pkg == "" {
+			return false
+		}
+		pkg = path.Dir(pkg)
+		if pkg == "." {
+			pkg = ""
+		}
+	}
+}
+
 type FindResult struct {
 	Label label.Label
 	Rule  *rule.Rule
+
+	// Aliases is a list of labels of alias rules that point to Rule, in the
+	// order they were added to the index. FindRulesByImport only lists
+	// aliases visible to the importing rule, whether or not
+	// RuleIndex.CheckVisibility is set, since a dependency on an alias that
+	// isn't visible would break the build.
+	Aliases []label.Label
+}
+
+// AmbiguousImportError is returned by resolvers when more than one rule
+// may be imported with Imp, so no dependency can be chosen.
+type AmbiguousImportError struct {
+	Imp          string
+	From         label.Label
+	Label, Other label.Label
+}
+
+func (e *AmbiguousImportError) Error() string {
+	return fmt.Sprintf("multiple rules (%s and %s) may be imported with %q from %s", e.Label, e.Other, e.Imp, e.From)
 }
 
 // FindRulesByImport attempts to resolve an import string to a rule record.
 // imp is the import to resolve (which includes the target language). lang is
 // the language of the rule with the dependency (for example, in
 // go_proto_library, imp will have ProtoLang and lang will be GoLang).
-// from is the rule which is doing the dependency. This is used to check
-// vendoring visibility and to check for self-imports.
+// from is the rule which is doing the dependency.
+//
+// If CheckVisibility is set, rules that are not visible to from are
+// excluded. If none of the matching rules are visible, a warning is logged,
+// and all matching rules are returned.
 //
 // FindRulesByImport returns a list of rules, since any number of rules may
 // provide the same import. Callers may need to resolve ambiguities using
 // language-specific heuristics.
-func (ix *RuleIndex) FindRulesByImport(imp ImportSpec, lang string) []FindResult {
-	matches := ix.importMap[imp]
+//
+// Imports are matched exactly (apart from case, with FoldImportCase). A rule
+// that provides a prefix of imp, like "example.com/foo" for the import
+// "example.com/foo/bar", does not match; nested packages are provided by
+// their own rules.
+func (ix *RuleIndex) FindRulesByImport(imp ImportSpec, lang string, from label.Label) []FindResult {
+	matches := ix.importMap[ix.importKey(imp)]
 	results := make([]FindResult, 0, len(matches))
+	var visible []FindResult
 	for _, m := range matches {
 		if ix.kindToResolver[m.rule.Kind()].Name() != lang {
 			continue
 		}
-		results = append(results, FindResult{Label: m.label, Rule: m.rule})
+		if ix.FoldImportCase && !m.isImportedAs(imp) {
+			ix.Log(config.Diagnostic{
+				Severity: config.Warning,
+				From:     from,
+				Imp:      imp.Imp,
+				Message:  fmt.Sprintf("%s: import %q differs in case from the import provided by %s", from, imp.Imp, m.label),
+			})
+		}
+		result := FindResult{Label: m.label, Rule: m.rule, Aliases: m.aliasLabels(from)}
+		results = append(results, result)
+		if ix.CheckVisibility && m.isVisibleTo(from) {
+			visible = append(visible, result)
+		}
+	}
+	if !ix.CheckVisibility || len(results) == 0 {
+		return results
+	}
+	if len(visible) == 0 {
+		ix.Log(config.Diagnostic{
+			Severity: config.Warning,
+			From:     from,
+			Imp:      imp.Imp,
+			Message:  fmt.Sprintf("%s: none of the rules that provide %q are visible; ignoring visibility", from, imp.Imp),
+		})
+		return results
+	}
+	return visible
+}
+
+// FindRulesByPackage returns the indexed rules in the package pkg of the
+// main repository that are resolved in the language lang, in the order they
+// were added. Like FindRulesByImport, it doesn't return rules embedded by
+// other rules of the same language. This may be used to find the rule for an
+// import when the rule can't be found by its import path, for example,
+// because it doesn't declare one.
+func (ix *RuleIndex) FindRulesByPackage(pkg, lang string) []FindResult {
+	var results []FindResult
+	for _, m := range ix.pkgMap[pkg] {
+		if ix.kindToResolver[m.rule.Kind()].Name() != lang {
+			continue
+		}
+		results = append(results, FindResult{Label: m.label, Rule: m.rule, Aliases: m.aliasLabels(label.NoLabel)})
 	}
 	return results
 }
+
+// Embeds returns whether the rule named outer embeds the rule named inner,
+// directly or transitively, according to the rules' Resolvers. Only embeds
+// of rules of the same language are considered, since the sources of those
+// rules are always built into the embedding rule. Both labels are resolved
+// relative to from. Embeds may only be called after Finish.
+func (ix *RuleIndex) Embeds(outer, inner, from label.Label) bool {
+	or, ok := ix.findRuleByLabel(outer, from)
+	if !ok {
+		return false
+	}
+	ir, ok := ix.findRuleByLabel(inner, from)
+	if !ok || or == ir {
+		return false
+	}
+	return or.embedsRecord(ir)
+}
+
+// embedsRecord returns whether r embeds er, directly or transitively.
+func (r *ruleRecord) embedsRecord(er *ruleRecord) bool {
+	for _, e := range r.embeds {
+		if e == er || e.embedsRecord(er) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImportedAs returns whether r provides imp exactly.
+func (r *ruleRecord) isImportedAs(imp ImportSpec) bool {
+	for _, i := range r.importedAs {
+		if i == imp {
+			return true
+		}
+	}
+	return false
+}
+
+// packageDefaultVisibility returns the default_visibility attribute of the
+// package rule in f. If there is no such attribute, the default visibility
+// is private.
+func packageDefaultVisibility(f *rule.File) []string {
+	for _, r := range f.Rules {
+		if r.Kind() == "package" && r.Attr("default_visibility") != nil {
+			return r.AttrStrings("default_visibility")
+		}
+	}
+	return []string{"//visibility:private"}
+}
+
+// aliasLabels returns the labels of the aliases of r. Unless from is
+// label.NoLabel, only aliases visible to from are returned.
+func (r *ruleRecord) aliasLabels(from label.Label) []label.Label {
+	var labels []label.Label
+	for _, a := range r.aliases {
+		if from.Equal(label.NoLabel) || a.isVisibleTo(from) {
+			labels = append(labels, a.label)
+		}
+	}
+	return labels
+}
+
+// isVisibleTo returns whether r may be depended on by the rule from, based
+// on r's visibility attribute. Labels other than "//visibility:public",
+// "//visibility:private", __pkg__, and __subpackages__ (for example,
+// package_group labels) can't be evaluated, so they're assumed to grant
+// visibility.
+func (r *ruleRecord) isVisibleTo(from label.Label) bool {
+	if from.Repo == r.label.Repo && from.Pkg == r.label.Pkg {
+		return true
+	}
+	vis := r.defaultVisibility
+	if r.rule.Attr("visibility") != nil {
+		vis = r.rule.AttrStrings("visibility")
+	}
+	for _, v := range vis {
+		l, err := label.Parse(v)
+		if err != nil {
+			continue
+		}
+		l = l.Abs(r.label.Repo, r.label.Pkg)
+		switch {
+		case l.Repo == "" && l.Pkg == "visibility" && l.Name == "public":
+			return true
+		case l.Repo == "" && l.Pkg == "visibility" && l.Name == "private":
+			continue
+		case l.Repo != from.Repo:
+			continue
+		case l.Name == "__pkg__":
+			if l.Pkg == from.Pkg {
+				return true
+			}
+		case l.Name == "__subpackages__":
+			if pathtools.Contains(l.Pkg, from.Pkg) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// FindDepCycle reports whether a dependency on the rule labeled dep would
+// create a cycle leading back to one of the rules in targets. Only the
+// "deps" of indexed rules in the main repository are followed, so the result
+// reflects dependencies that have been resolved so far (or that were present
+// in existing build files). If a cycle is found, FindDepCycle returns the
+// path from dep to the target, inclusive. Otherwise, nil is returned.
+func (ix *RuleIndex) FindDepCycle(dep label.Label, targets []label.Label) []label.Label {
+	isTarget := make(map[label.Label]bool)
+	for _, t := range targets {
+		isTarget[t] = true
+	}
+	visited := make(map[label.Label]bool)
+	var visit func(l label.Label) []label.Label
+	visit = func(l label.Label) []label.Label {
+		if isTarget[l] {
+			return []label.Label{l}
+		}
+		if visited[l] {
+			return nil
+		}
+		visited[l] = true
+		r, ok := ix.labelMap[l]
+		if !ok {
+			return nil
+		}
+		for _, d := range depLabels(r) {
+			if path := visit(d); path != nil {
+				return append([]label.Label{l}, path...)
+			}
+		}
+		return nil
+	}
+	if dep.Repo != "" {
+		return nil
+	}
+	return visit(dep)
+}
+
+// depLabels returns the absolute labels in the "deps" attribute of r that
+// refer to rules in the main repository. Labels in select expressions are
+// included.
+func depLabels(r *ruleRecord) []label.Label {
+	e := r.rule.Attr("deps")
+	if e == nil {
+		return nil
+	}
+	list, ok := rule.FlattenExpr(e).(*bzl.ListExpr)
+	if !ok {
+		return nil
+	}
+	var deps []label.Label
+	for _, elem := range list.List {
+		s, ok := elem.(*bzl.StringExpr)
+		if !ok {
+			continue
+		}
+		l, err := label.Parse(s.Value)
+		if err != nil {
+			continue
+		}
+		l = l.Abs(r.label.Repo, r.label.Pkg)
+		if l.Repo != "" {
+			continue
+		}
+		deps = append(deps, l)
+	}
+	return deps
+}
@@ -0,0 +1,471 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/internal/config"
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
+	"github.com/bazelbuild/bazel-gazelle/internal/repos"
+	"github.com/bazelbuild/bazel-gazelle/internal/rule"
+)
+
+// testResolver indexes "test_library" rules by their "importpath" and
+// "importpath_aliases" attributes, and follows labels in their "embed"
+// attributes. It resolves imports recorded as a []string to indexed rules,
+// or to packages in the repository @ext if they're not indexed.
+type testResolver struct{}
+
+func (_ testResolver) Name() string { return "test" }
+
+func (_ testResolver) Imports(c *config.Config, r *rule.Rule, f *rule.File) []ImportSpec {
+	imps := []ImportSpec{{Lang: "test", Imp: r.AttrString("importpath")}}
+	for _, alias := range r.AttrStrings("importpath_aliases") {
+		imps = append(imps, ImportSpec{Lang: "test", Imp: alias})
+	}
+	return imps
+}
+
+func (_ testResolver) Embeds(r *rule.Rule, from label.Label) []label.Label {
+	var embeds []label.Label
+	for _, s := range r.AttrStrings("embed") {
+		if l, err := label.Parse(s); err == nil {
+			embeds = append(embeds, l.Abs(from.Repo, from.Pkg))
+		}
+	}
+	return embeds
+}
+
+func (_ testResolver) Resolve(c *config.Config, ix *RuleIndex, rc *repos.RemoteCache, r *rule.Rule, from label.Label) {
+	imports, _ := r.PrivateAttr(config.GazelleImportsKey).([]string)
+	r.DelAttr("deps")
+	var deps []string
+	for _, imp := range imports {
+		l := label.New("ext", imp, "lib")
+		if results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: imp}, "test", from); len(results) == 1 {
+			l = results[0].Label
+		}
+		deps = append(deps, l.Rel(from.Repo, from.Pkg).String())
+	}
+	if len(deps) > 0 {
+		r.SetAttr("deps", deps)
+	}
+}
+
+func TestAddRuleConcurrent(t *testing.T) {
+	const goroutines, rulesPerGoroutine = 8, 50
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rel := fmt.Sprintf("pkg%d", i)
+			f := rule.EmptyFile(filepath.Join(c.RepoRoot, rel, "BUILD.bazel"))
+			for j := 0; j < rulesPerGoroutine; j++ {
+				r := rule.NewRule("test_library", fmt.Sprintf("lib%d", j))
+				r.SetAttr("importpath", fmt.Sprintf("example.com/%s/lib%d", rel, j))
+				r.Insert(f)
+				ix.AddRule(c, r, f)
+			}
+			alias := rule.NewRule("alias", "alias")
+			alias.SetAttr("actual", ":lib0")
+			alias.SetAttr("visibility", []string{"//visibility:public"})
+			alias.Insert(f)
+			ix.AddRule(c, alias, f)
+		}(i)
+	}
+	wg.Wait()
+	ix.Finish()
+
+	var qwg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		qwg.Add(1)
+		go func(i int) {
+			defer qwg.Done()
+			from := label.New("", "other", "bin")
+			for j := 0; j < rulesPerGoroutine; j++ {
+				imp := ImportSpec{Lang: "test", Imp: fmt.Sprintf("example.com/pkg%d/lib%d", i, j)}
+				results := ix.FindRulesByImport(imp, "test", from)
+				if len(results) != 1 {
+					t.Errorf("%s: got %d results; want 1", imp.Imp, len(results))
+					continue
+				}
+				want := label.New("", fmt.Sprintf("pkg%d", i), fmt.Sprintf("lib%d", j))
+				if !results[0].Label.Equal(want) {
+					t.Errorf("%s: got %s; want %s", imp.Imp, results[0].Label, want)
+				}
+				if j == 0 && len(results[0].Aliases) != 1 {
+					t.Errorf("%s: got aliases %v; want 1 alias", imp.Imp, results[0].Aliases)
+				}
+			}
+		}(i)
+	}
+	qwg.Wait()
+}
+
+func TestFinishOrder(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+
+	// Rules may be added in any order when directories are visited
+	// concurrently. The embed cycle reported and the rules that embed others
+	// shouldn't depend on it.
+	for _, order := range [][]string{{"a", "b"}, {"b", "a"}} {
+		t.Run(strings.Join(order, ","), func(t *testing.T) {
+			ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+			for _, rel := range order {
+				f := rule.EmptyFile(filepath.Join(c.RepoRoot, rel, "BUILD.bazel"))
+				r := rule.NewRule("test_library", "lib")
+				r.SetAttr("importpath", "example.com/"+rel)
+				other := "a"
+				if rel == "a" {
+					other = "b"
+				}
+				r.SetAttr("embed", []string{"//" + other + ":lib"})
+				r.Insert(f)
+				ix.AddRule(c, r, f)
+			}
+
+			var logBuf bytes.Buffer
+			log.SetOutput(&logBuf)
+			defer log.SetOutput(os.Stderr)
+			if err := ix.Finish(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := "embed cycle detected: //a:lib -> //b:lib -> //a:lib"
+			if got := logBuf.String(); !strings.Contains(got, want) {
+				t.Errorf("got log %q; want it to contain %q", got, want)
+			}
+			results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: "example.com/b"}, "test", label.New("", "c", "bin"))
+			if len(results) != 1 || !results[0].Label.Equal(label.New("", "a", "lib")) {
+				t.Errorf("got results %v; want //a:lib", results)
+			}
+		})
+	}
+}
+
+func TestFinishDuplicateImports(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	for _, fail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fail=%v", fail), func(t *testing.T) {
+			ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+			ix.FailOnDuplicateImports = fail
+			for _, rel := range []string{"b", "a", "c"} {
+				f := rule.EmptyFile(filepath.Join(c.RepoRoot, rel, "BUILD.bazel"))
+				imp := "example.com/dup"
+				if rel == "c" {
+					imp = "example.com/c"
+				}
+				r := rule.NewRule("test_library", "lib")
+				r.SetAttr("importpath", imp)
+				r.Insert(f)
+				ix.AddRule(c, r, f)
+			}
+
+			var logBuf bytes.Buffer
+			log.SetOutput(&logBuf)
+			defer log.SetOutput(os.Stderr)
+			err := ix.Finish()
+
+			want := "test \"example.com/dup\": //a:lib, //b:lib"
+			var msg string
+			if fail {
+				if err == nil {
+					t.Fatal("got success; want error")
+				}
+				msg = err.Error()
+				if logBuf.Len() > 0 {
+					t.Errorf("got log %q; want no log", logBuf.String())
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				msg = logBuf.String()
+			}
+			if !strings.Contains(msg, want) {
+				t.Errorf("got %q; want it to contain %q", msg, want)
+			}
+			if strings.Contains(msg, "example.com/c") {
+				t.Errorf("got %q; want no mention of example.com/c", msg)
+			}
+
+			// Duplicate imports are still ambiguous after Finish.
+			results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: "example.com/dup"}, "test", label.New("", "d", "bin"))
+			if len(results) != 2 {
+				t.Errorf("got %d results; want 2", len(results))
+			}
+		})
+	}
+}
+
+func TestFindRulesByImportMultiplePaths(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+	ix.FailOnDuplicateImports = true
+	f := rule.EmptyFile(filepath.Join(c.RepoRoot, "lib", "BUILD.bazel"))
+	r := rule.NewRule("test_library", "lib")
+	r.SetAttr("importpath", "example.com/lib")
+	r.SetAttr("importpath_aliases", []string{"example.com/old/lib", "example.com/lib"})
+	r.Insert(f)
+	ix.AddRule(c, r, f)
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := label.New("", "bin", "bin")
+	want := label.New("", "lib", "lib")
+	for _, imp := range []string{"example.com/lib", "example.com/old/lib"} {
+		results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: imp}, "test", from)
+		if len(results) != 1 || !results[0].Label.Equal(want) {
+			t.Errorf("%s: got %v; want %s", imp, results, want)
+		}
+	}
+}
+
+func TestFindRulesByImportNested(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+	for _, rel := range []string{"foo", "foo/bar"} {
+		f := rule.EmptyFile(filepath.Join(c.RepoRoot, rel, "BUILD.bazel"))
+		r := rule.NewRule("test_library", "lib")
+		r.SetAttr("importpath", "example.com/"+rel)
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := label.New("", "bin", "bin")
+	for _, tc := range []struct {
+		imp  string
+		want []label.Label
+	}{
+		{imp: "example.com/foo", want: []label.Label{label.New("", "foo", "lib")}},
+		{imp: "example.com/foo/bar", want: []label.Label{label.New("", "foo/bar", "lib")}},
+		{imp: "example.com/foo/bar/baz"},
+		{imp: "example.com/foo/b"},
+	} {
+		results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: tc.imp}, "test", from)
+		var got []label.Label
+		for _, r := range results {
+			got = append(got, r.Label)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v; want %v", tc.imp, got, tc.want)
+		}
+	}
+}
+
+func TestFinishDuplicateImportsMultiplePaths(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+	ix.FailOnDuplicateImports = true
+	for _, rel := range []string{"a", "b"} {
+		f := rule.EmptyFile(filepath.Join(c.RepoRoot, rel, "BUILD.bazel"))
+		r := rule.NewRule("test_library", "lib")
+		r.SetAttr("importpath", "example.com/"+rel)
+		r.SetAttr("importpath_aliases", []string{"example.com/dup"})
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	err := ix.Finish()
+	if err == nil {
+		t.Fatal("got success; want error")
+	}
+	want := "test \"example.com/dup\": //a:lib, //b:lib"
+	if msg := err.Error(); !strings.Contains(msg, want) || strings.Contains(msg, "example.com/a") {
+		t.Errorf("got %q; want it to contain %q and only that import", msg, want)
+	}
+}
+
+func TestFindRulesByPackage(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{
+		"test_library":  testResolver{},
+		"other_library": otherResolver{},
+	})
+	f := rule.EmptyFile(filepath.Join(c.RepoRoot, "lib", "BUILD.bazel"))
+	for _, kind := range []string{"test_library", "other_library"} {
+		r := rule.NewRule(kind, kind)
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := ix.FindRulesByPackage("lib", "test")
+	want := label.New("", "lib", "test_library")
+	if len(results) != 1 || !results[0].Label.Equal(want) {
+		t.Errorf("got %v; want %s", results, want)
+	}
+	if results := ix.FindRulesByPackage("other", "test"); len(results) != 0 {
+		t.Errorf("other package: got %v; want no results", results)
+	}
+}
+
+// otherResolver indexes "other_library" rules like testResolver, but it's
+// a different language.
+type otherResolver struct{ testResolver }
+
+func (_ otherResolver) Name() string { return "other" }
+
+func TestFinishDuplicateImportsOtherLang(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{
+		"test_library":  testResolver{},
+		"other_library": otherResolver{},
+	})
+	ix.FailOnDuplicateImports = true
+	for _, kind := range []string{"test_library", "other_library"} {
+		f := rule.EmptyFile(filepath.Join(c.RepoRoot, kind, "BUILD.bazel"))
+		r := rule.NewRule(kind, "lib")
+		r.SetAttr("importpath", "example.com/lib")
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: "example.com/lib"}, "test", label.New("", "d", "bin"))
+	want := label.New("", "test_library", "lib")
+	if len(results) != 1 || !results[0].Label.Equal(want) {
+		t.Errorf("got %v; want %s", results, want)
+	}
+}
+
+// vendorResolver indexes rules like testResolver, but it treats
+// directories named "vendor" as vendor directories.
+type vendorResolver struct{ testResolver }
+
+func (_ vendorResolver) VendorRoot(c *config.Config, rel string) (string, bool) {
+	parts := strings.Split(rel, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if parts[i] == "vendor" {
+			return strings.Join(parts[:i], "/"), true
+		}
+	}
+	return "", false
+}
+
+func TestFinishDuplicateImportsVendored(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	ix := NewRuleIndex(map[string]Resolver{"test_library": vendorResolver{}})
+	ix.FailOnDuplicateImports = true
+	for _, rel := range []string{"lib", "vendor/example.com/lib", "a/vendor/example.com/lib", "b/vendor/example.com/lib"} {
+		f := rule.EmptyFile(filepath.Join(c.RepoRoot, rel, "BUILD.bazel"))
+		r := rule.NewRule("test_library", "lib")
+		r.SetAttr("importpath", "example.com/lib")
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	if err := ix.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := rule.EmptyFile(filepath.Join(c.RepoRoot, "a", "vendor", "example.com", "dup", "BUILD.bazel"))
+	r := rule.NewRule("test_library", "dup")
+	r.SetAttr("importpath", "example.com/lib")
+	r.Insert(f)
+	ix = NewRuleIndex(map[string]Resolver{"test_library": vendorResolver{}})
+	ix.FailOnDuplicateImports = true
+	ix.AddRule(c, r, f)
+	f = rule.EmptyFile(filepath.Join(c.RepoRoot, "a", "vendor", "example.com", "lib", "BUILD.bazel"))
+	r = rule.NewRule("test_library", "lib")
+	r.SetAttr("importpath", "example.com/lib")
+	r.Insert(f)
+	ix.AddRule(c, r, f)
+	err := ix.Finish()
+	if err == nil {
+		t.Fatal("got success; want error for rules in the same vendor tree")
+	}
+	want := "test \"example.com/lib\": //a/vendor/example.com/dup, //a/vendor/example.com/lib"
+	if msg := err.Error(); !strings.Contains(msg, want) {
+		t.Errorf("got %q; want it to contain %q", msg, want)
+	}
+}
+
+func TestFindRulesByImportFoldCase(t *testing.T) {
+	c := config.New()
+	c.RepoRoot = "/root"
+	f := rule.EmptyFile(filepath.Join(c.RepoRoot, "lib", "BUILD.bazel"))
+	r := rule.NewRule("test_library", "lib")
+	r.SetAttr("importpath", "example.com/Foo/Lib")
+	r.Insert(f)
+	from := label.New("", "bin", "bin")
+	want := label.New("", "lib", "lib")
+
+	for _, fold := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fold=%v", fold), func(t *testing.T) {
+			ix := NewRuleIndex(map[string]Resolver{"test_library": testResolver{}})
+			ix.FoldImportCase = fold
+			ix.AddRule(c, r, f)
+			if err := ix.Finish(); err != nil {
+				t.Fatal(err)
+			}
+
+			var logBuf bytes.Buffer
+			log.SetOutput(&logBuf)
+			defer log.SetOutput(os.Stderr)
+
+			results := ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: "example.com/Foo/Lib"}, "test", from)
+			if len(results) != 1 || !results[0].Label.Equal(want) {
+				t.Errorf("exact case: got %v; want %s", results, want)
+			}
+			if logBuf.Len() > 0 {
+				t.Errorf("exact case: got log %q; want no log", logBuf.String())
+			}
+
+			results = ix.FindRulesByImport(ImportSpec{Lang: "test", Imp: "example.com/foo/lib"}, "test", from)
+			if !fold {
+				if len(results) != 0 {
+					t.Errorf("different case: got %v; want no results", results)
+				}
+				return
+			}
+			if len(results) != 1 || !results[0].Label.Equal(want) {
+				t.Errorf("different case: got %v; want %s", results, want)
+			}
+			if !strings.Contains(logBuf.String(), "differs in case") {
+				t.Errorf("different case: got log %q; want a warning", logBuf.String())
+			}
+		})
+	}
+}
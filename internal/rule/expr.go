@@ -18,12 +18,158 @@ package rule
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	bzl "github.com/bazelbuild/buildtools/build"
 )
 
+// ResolveCommentPrefix starts suffix comments that explain how a dependency
+// was resolved, like "# resolved via index". They're written with
+// AnnotateExprStrings. When lists are merged, these comments are replaced
+// with those of the generated list, so they don't accumulate.
+const ResolveCommentPrefix = "# resolved via "
+
+// PlatformLabelsKey is the name of a private attribute of rules where
+// SetPlatformLabels was called. It maps names of conditions in
+// @io_bazel_rules_go//go/platform, like "linux_amd64", to the labels that
+// replace them as select keys.
+const PlatformLabelsKey = "_platform_labels"
+
+// platformConditionPrefix starts the labels of the platform conditions
+// ExprFromValue writes as select keys.
+const platformConditionPrefix = "@io_bazel_rules_go//go/platform:"
+
+// SetPlatformLabels replaces conditions in @io_bazel_rules_go//go/platform
+// used as select keys in r's attributes with the labels their names are
+// mapped to in labels. Conditions that aren't mapped are kept. labels is
+// stored in the PlatformLabelsKey private attribute of r, so MergeRules
+// recognizes the labels when r is merged into another rule. This should be
+// called again after attributes are set.
+func (r *Rule) SetPlatformLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	r.SetPrivateAttr(PlatformLabelsKey, labels)
+	for _, attr := range r.attrs {
+		bzl.Walk(attr.Y, func(x bzl.Expr, _ []bzl.Expr) {
+			call, ok := x.(*bzl.CallExpr)
+			if !ok || len(call.List) != 1 {
+				return
+			}
+			if callee, ok := call.X.(*bzl.LiteralExpr); !ok || callee.Token != "select" {
+				return
+			}
+			dict, ok := call.List[0].(*bzl.DictExpr)
+			if !ok {
+				return
+			}
+			mapped := false
+			for _, item := range dict.List {
+				kv, ok := item.(*bzl.KeyValueExpr)
+				if !ok {
+					continue
+				}
+				k, ok := kv.Key.(*bzl.StringExpr)
+				if !ok || !strings.HasPrefix(k.Value, platformConditionPrefix) {
+					continue
+				}
+				if l, ok := labels[strings.TrimPrefix(k.Value, platformConditionPrefix)]; ok {
+					kv.Key = &bzl.StringExpr{Value: l}
+					mapped = true
+				}
+			}
+			if mapped {
+				// Keep keys in the order mergeDict writes them.
+				sort.SliceStable(dict.List, func(i, j int) bool {
+					return dictKeyLess(dict.List[i], dict.List[j])
+				})
+				r.updated = true
+			}
+		})
+	}
+}
+
+// dictKeyLess orders entries of select dicts by key, with
+// //conditions:default last.
+func dictKeyLess(x, y bzl.Expr) bool {
+	xk, _, _ := dictEntryKeyValue(x)
+	yk, _, _ := dictEntryKeyValue(y)
+	if xk == "//conditions:default" || yk == "//conditions:default" {
+		return yk == "//conditions:default" && xk != yk
+	}
+	return xk < yk
+}
+
+// platformConditionNames returns the inverse of the labels set on r with
+// SetPlatformLabels: a map from labels to the names of the conditions they
+// replace. nil is returned if labels were not set.
+func platformConditionNames(r *Rule) map[string]string {
+	labels, _ := r.PrivateAttr(PlatformLabelsKey).(map[string]string)
+	if len(labels) == 0 {
+		return nil
+	}
+	names := make(map[string]string, len(labels))
+	for name, l := range labels {
+		names[l] = name
+	}
+	return names
+}
+
+// AnnotateExprStrings adds a suffix comment to each string sub-expression
+// within e that is a key in how. The comment is ResolveCommentPrefix
+// followed by the value in how. Comments previously added this way are
+// removed first. Lists containing annotated strings are printed on
+// multiple lines, so the comments stay with their strings.
+func AnnotateExprStrings(e bzl.Expr, how map[string]string) {
+	bzl.Walk(e, func(x bzl.Expr, _ []bzl.Expr) {
+		switch x := x.(type) {
+		case *bzl.StringExpr:
+			via, ok := how[x.Value]
+			if !ok {
+				return
+			}
+			x.Comments.Suffix = append(removeResolveComments(x.Comments.Suffix), bzl.Comment{Token: ResolveCommentPrefix + via})
+		case *bzl.ListExpr:
+			for _, elem := range x.List {
+				if s, ok := elem.(*bzl.StringExpr); ok {
+					if _, ok := how[s.Value]; ok {
+						x.ForceMultiLine = true
+						return
+					}
+				}
+			}
+		}
+	})
+}
+
+// replaceResolveComments replaces the resolution comments on dst, which
+// were added by AnnotateExprStrings, with those on src.
+func replaceResolveComments(dst, src bzl.Expr) {
+	if dst == src {
+		return
+	}
+	dstComments := dst.Comment()
+	dstComments.Suffix = removeResolveComments(dstComments.Suffix)
+	for _, c := range src.Comment().Suffix {
+		if strings.HasPrefix(c.Token, ResolveCommentPrefix) {
+			dstComments.Suffix = append(dstComments.Suffix, c)
+		}
+	}
+}
+
+// removeResolveComments returns comments without resolution comments.
+func removeResolveComments(comments []bzl.Comment) []bzl.Comment {
+	var kept []bzl.Comment
+	for _, c := range comments {
+		if !strings.HasPrefix(c.Token, ResolveCommentPrefix) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
 // MapExprStrings applies a function to string sub-expressions within e.
 // An expression containing the results with the same structure as e is
 // returned.
@@ -116,7 +262,7 @@ func MapExprStrings(e bzl.Expr, f func(string) string) bzl.Expr {
 // expressions. If the expression could not have been generted by
 // PlatformStrings, the expression will be returned unmodified.
 func FlattenExpr(e bzl.Expr) bzl.Expr {
-	ps, err := extractPlatformStringsExprs(e)
+	ps, err := extractPlatformStringsExprs(e, nil)
 	if err != nil {
 		return e
 	}
@@ -177,6 +323,13 @@ func isScalar(e bzl.Expr) bool {
 	}
 }
 
+// isDict returns whether e is a dict literal. Dicts that are arguments to
+// select are not checked, since they're nested in call expressions.
+func isDict(e bzl.Expr) bool {
+	_, ok := e.(*bzl.DictExpr)
+	return ok
+}
+
 func dictEntryKeyValue(e bzl.Expr) (string, *bzl.ListExpr, error) {
 	kv, ok := e.(*bzl.KeyValueExpr)
 	if !ok {
@@ -204,15 +357,17 @@ func stringValue(e bzl.Expr) string {
 // platformStringsExprs is a set of sub-expressions that match the structure
 // of package.PlatformStrings. ExprFromValue produces expressions that
 // follow this structure for srcs, deps, and other attributes, so this matches
-// all non-scalar expressions generated by Gazelle.
+// all non-scalar expressions generated by Gazelle. Select keys may also be
+// labels that replace platform conditions, as set with SetPlatformLabels.
 //
 // The matched expression has the form:
 //
-// [] + select({}) + select({}) + select({})
+// glob([]) + [] + select({}) + select({}) + select({})
 //
-// The four collections may appear in any order, and some or all of them may
+// The five collections may appear in any order, and some or all of them may
 // be omitted (all fields are nil for a nil expression).
 type platformStringsExprs struct {
+	glob               *bzl.CallExpr
 	generic            *bzl.ListExpr
 	os, arch, platform *bzl.DictExpr
 }
@@ -221,8 +376,10 @@ type platformStringsExprs struct {
 // sub-expressions in platformStringsExprs. The sub-expressions can then be
 // merged with corresponding sub-expressions. Any field in the returned
 // structure may be nil. An error is returned if the given expression does
-// not follow the pattern described by platformStringsExprs.
-func extractPlatformStringsExprs(expr bzl.Expr) (platformStringsExprs, error) {
+// not follow the pattern described by platformStringsExprs. conditionNames
+// maps labels used as select keys instead of platform conditions to the
+// names of those conditions; it may be nil.
+func extractPlatformStringsExprs(expr bzl.Expr, conditionNames map[string]string) (platformStringsExprs, error) {
 	var ps platformStringsExprs
 	if expr == nil {
 		return ps, nil
@@ -250,6 +407,13 @@ func extractPlatformStringsExprs(expr bzl.Expr) (platformStringsExprs, error) {
 			ps.generic = part
 
 		case *bzl.CallExpr:
+			if x, ok := part.X.(*bzl.LiteralExpr); ok && x.Token == "glob" {
+				if ps.glob != nil {
+					return platformStringsExprs{}, fmt.Errorf("expression could not be matched: multiple glob expressions")
+				}
+				ps.glob = part
+				continue
+			}
 			x, ok := part.X.(*bzl.LiteralExpr)
 			if !ok || x.Token != "select" || len(part.List) != 1 {
 				return platformStringsExprs{}, fmt.Errorf("expression could not be matched: callee other than select or wrong number of args")
@@ -272,15 +436,19 @@ func extractPlatformStringsExprs(expr bzl.Expr) (platformStringsExprs, error) {
 				if err != nil {
 					return platformStringsExprs{}, fmt.Errorf("expression could not be matched: dict key is not label: %q", k.Value)
 				}
-				if KnownOSSet[key.Name] {
+				name := key.Name
+				if n, ok := conditionNames[k.Value]; ok {
+					name = n
+				}
+				if KnownOSSet[name] {
 					dict = &ps.os
 					break
 				}
-				if KnownArchSet[key.Name] {
+				if KnownArchSet[name] {
 					dict = &ps.arch
 					break
 				}
-				osArch := strings.Split(key.Name, "_")
+				osArch := strings.Split(name, "_")
 				if len(osArch) != 2 || !KnownOSSet[osArch[0]] || !KnownArchSet[osArch[1]] {
 					return platformStringsExprs{}, fmt.Errorf("expression could not be matched: dict key contains unknown platform: %q", k.Value)
 				}
@@ -302,6 +470,28 @@ func extractPlatformStringsExprs(expr bzl.Expr) (platformStringsExprs, error) {
 	return ps, nil
 }
 
+// isPlatformKey returns whether the select key k is //conditions:default or
+// names a platform condition extractPlatformStringsExprs recognizes: an OS,
+// an architecture, or both, possibly replaced with a label in conditionNames.
+func isPlatformKey(k string, conditionNames map[string]string) bool {
+	if k == "//conditions:default" {
+		return true
+	}
+	l, err := label.Parse(k)
+	if err != nil {
+		return false
+	}
+	name := l.Name
+	if n, ok := conditionNames[k]; ok {
+		name = n
+	}
+	if KnownOSSet[name] || KnownArchSet[name] {
+		return true
+	}
+	osArch := strings.Split(name, "_")
+	return len(osArch) == 2 && KnownOSSet[osArch[0]] && KnownArchSet[osArch[1]]
+}
+
 // makePlatformStringsExpr constructs a single expression from the
 // sub-expressions in ps.
 func makePlatformStringsExpr(ps platformStringsExprs) bzl.Expr {
@@ -316,11 +506,16 @@ func makePlatformStringsExpr(ps platformStringsExprs) bzl.Expr {
 		case *bzl.ListExpr:
 			e.ForceMultiLine = true
 		case *bzl.CallExpr:
-			e.List[0].(*bzl.DictExpr).ForceMultiLine = true
+			if dict, ok := e.List[0].(*bzl.DictExpr); ok {
+				dict.ForceMultiLine = true
+			}
 		}
 	}
 
 	var parts []bzl.Expr
+	if ps.glob != nil {
+		parts = append(parts, ps.glob)
+	}
 	if ps.generic != nil {
 		parts = append(parts, ps.generic)
 	}
@@ -21,9 +21,29 @@ import (
 	"log"
 	"sort"
 
+	"github.com/bazelbuild/bazel-gazelle/internal/label"
 	bzl "github.com/bazelbuild/buildtools/build"
 )
 
+// GlobPatternsKey is the name of a private attribute of generated rules. It
+// lists the patterns, like "*.go", that the language writes in glob
+// expressions when it globs sources. When src lists its sources without a
+// glob, a glob in dst that only uses these patterns was written by Gazelle,
+// so it's replaced. Other globs in dst are left alone.
+const GlobPatternsKey = "_glob_patterns"
+
+// LabelAttrsKey is the name of a private attribute of generated rules. It
+// lists the attributes whose strings are labels, like "deps". When lists in
+// these attributes are merged, labels are compared in canonical form, so
+// "//foo:foo" in dst matches "//foo" in src, and duplicate labels in dst are
+// dropped. Strings in other attributes are compared as they are.
+const LabelAttrsKey = "_label_attrs"
+
+// LabelPkgKey is the name of a private attribute of generated rules. It's
+// the package of the build file the rule is merged into, so relative labels
+// like ":x" in attributes listed in LabelAttrsKey match "//pkg:x".
+const LabelPkgKey = "_label_pkg"
+
 // MergeRules copies information from src into dst, usually discarding
 // information in dst when they have the same attributes.
 //
@@ -45,6 +65,16 @@ func MergeRules(src, dst *Rule, mergeable map[string]bool, filename string) {
 	if ShouldKeep(dst.call) {
 		return
 	}
+	names := platformConditionNames(src)
+	globs, _ := src.PrivateAttr(GlobPatternsKey).([]string)
+	labelAttrs, _ := src.PrivateAttr(LabelAttrsKey).([]string)
+	pkg, hasPkg := src.PrivateAttr(LabelPkgKey).(string)
+	keyFor := func(attr string) func(bzl.Expr) string {
+		if stringIn(attr, labelAttrs) {
+			return func(v bzl.Expr) string { return labelKey(v, pkg, hasPkg) }
+		}
+		return stringValue
+	}
 
 	// Process attributes that are in dst but not in src.
 	for key, dstAttr := range dst.attrs {
@@ -52,7 +82,7 @@ func MergeRules(src, dst *Rule, mergeable map[string]bool, filename string) {
 			continue
 		}
 		dstValue := dstAttr.Y
-		if mergedValue, err := mergeExprs(nil, dstValue); err != nil {
+		if mergedValue, err := mergeExprs(nil, dstValue, names, globs, keyFor(key)); err != nil {
 			start, end := dstValue.Span()
 			log.Printf("%s:%d.%d-%d.%d: could not merge expression", filename, start.Line, start.LineRune, end.Line, end.LineRune)
 		} else if mergedValue == nil {
@@ -69,7 +99,7 @@ func MergeRules(src, dst *Rule, mergeable map[string]bool, filename string) {
 			dst.SetAttr(key, srcValue)
 		} else if mergeable[key] && !ShouldKeep(dstAttr) {
 			dstValue := dstAttr.Y
-			if mergedValue, err := mergeExprs(srcValue, dstValue); err != nil {
+			if mergedValue, err := mergeExprs(srcValue, dstValue, names, globs, keyFor(key)); err != nil {
 				start, end := dstValue.Span()
 				log.Printf("%s:%d.%d-%d.%d: could not merge expression", filename, start.Line, start.LineRune, end.Line, end.LineRune)
 			} else {
@@ -87,57 +117,169 @@ func MergeRules(src, dst *Rule, mergeable map[string]bool, filename string) {
 //
 //   * nil
 //   * strings (can only be merged with strings)
+//   * dicts that are not select arguments (src replaces dst)
 //   * lists of strings
 //   * a call to select with a dict argument. The dict keys must be strings,
 //     and the values must be lists of strings.
 //   * a list of strings combined with a select call using +. The list must
 //     be the left operand.
+//   * a call to glob, optionally combined with the above using +. A glob in
+//     src replaces a glob in dst. If src doesn't have a glob, a glob in dst
+//     is dropped if it only uses patterns in globPatterns, since Gazelle
+//     wrote it (see GlobPatternsKey). Otherwise, a glob in dst can't be
+//     merged, since src probably lists the same files.
 //
 // An error is returned if the expressions can't be merged, for example
-// because they are not in one of the above formats.
-func mergeExprs(src, dst bzl.Expr) (bzl.Expr, error) {
+// because they are not in one of the above formats. conditionNames is passed
+// to extractPlatformStringsExprs. Elements of lists are matched by the
+// strings key returns for them.
+func mergeExprs(src, dst bzl.Expr, conditionNames map[string]string, globPatterns []string, key func(bzl.Expr) string) (bzl.Expr, error) {
 	if ShouldKeep(dst) {
 		return nil, nil
 	}
-	if src == nil && (dst == nil || isScalar(dst)) {
+	if src == nil && (dst == nil || isScalar(dst) || isDict(dst)) {
 		return nil, nil
 	}
-	if isScalar(src) {
+	if isScalar(src) || isDict(src) {
 		return src, nil
 	}
 
-	srcExprs, err := extractPlatformStringsExprs(src)
+	srcExprs, err := extractPlatformStringsExprs(src, conditionNames)
 	if err != nil {
 		return nil, err
 	}
-	dstExprs, err := extractPlatformStringsExprs(dst)
+	dstExprs, err := extractPlatformStringsExprs(dropStaleSelects(dst, conditionNames), conditionNames)
 	if err != nil {
 		return nil, err
 	}
-	mergedExprs, err := mergePlatformStringsExprs(srcExprs, dstExprs)
+	mergedExprs, err := mergePlatformStringsExprs(srcExprs, dstExprs, globPatterns, key)
 	if err != nil {
 		return nil, err
 	}
 	return makePlatformStringsExpr(mergedExprs), nil
 }
 
-func mergePlatformStringsExprs(src, dst platformStringsExprs) (platformStringsExprs, error) {
+// dropStaleSelects returns expr without selects combined with + that have
+// keys other than platform conditions or labels in conditionNames. Gazelle
+// writes other labels when platform conditions are replaced with
+// SetPlatformLabels, so these selects are stale when the mapping was changed
+// or removed; src has the current keys. Selects with "# keep" comments are
+// not dropped.
+func dropStaleSelects(expr bzl.Expr, conditionNames map[string]string) bzl.Expr {
+	var parts []bzl.Expr
+	for e := expr; ; {
+		binop, ok := e.(*bzl.BinaryExpr)
+		if !ok || binop.Op != "+" {
+			parts = append(parts, e)
+			break
+		}
+		parts = append(parts, binop.Y)
+		e = binop.X
+	}
+
+	var kept []bzl.Expr
+	for i := len(parts) - 1; i >= 0; i-- {
+		if !isStaleSelect(parts[i], conditionNames) {
+			kept = append(kept, parts[i])
+		}
+	}
+	if len(kept) == len(parts) {
+		return expr
+	}
+	var result bzl.Expr
+	for _, part := range kept {
+		if result == nil {
+			result = part
+		} else {
+			result = &bzl.BinaryExpr{X: result, Op: "+", Y: part}
+		}
+	}
+	return result
+}
+
+// isStaleSelect returns whether e is a select with a key that isPlatformKey
+// doesn't recognize and without "# keep" comments.
+func isStaleSelect(e bzl.Expr, conditionNames map[string]string) bool {
+	call, ok := e.(*bzl.CallExpr)
+	if !ok || len(call.List) != 1 {
+		return false
+	}
+	if x, ok := call.X.(*bzl.LiteralExpr); !ok || x.Token != "select" {
+		return false
+	}
+	dict, ok := call.List[0].(*bzl.DictExpr)
+	if !ok {
+		return false
+	}
+	stale := false
+	for _, item := range dict.List {
+		kv, ok := item.(*bzl.KeyValueExpr)
+		if !ok {
+			return false
+		}
+		if k, ok := kv.Key.(*bzl.StringExpr); ok && !isPlatformKey(k.Value, conditionNames) {
+			stale = true
+		}
+	}
+	if !stale {
+		return false
+	}
+	keep := false
+	bzl.Walk(e, func(x bzl.Expr, _ []bzl.Expr) {
+		keep = keep || ShouldKeep(x)
+	})
+	return !keep
+}
+
+func mergePlatformStringsExprs(src, dst platformStringsExprs, globPatterns []string, key func(bzl.Expr) string) (platformStringsExprs, error) {
 	var ps platformStringsExprs
 	var err error
-	ps.generic = mergeList(src.generic, dst.generic)
-	if ps.os, err = mergeDict(src.os, dst.os); err != nil {
+	if src.glob == nil && dst.glob != nil && !onlyUsesPatterns(dst.glob, globPatterns) {
+		return platformStringsExprs{}, fmt.Errorf("glob can only be merged with another glob")
+	}
+	ps.glob = src.glob
+	ps.generic = mergeList(src.generic, dst.generic, key)
+	if ps.os, err = mergeDict(src.os, dst.os, key); err != nil {
 		return platformStringsExprs{}, err
 	}
-	if ps.arch, err = mergeDict(src.arch, dst.arch); err != nil {
+	if ps.arch, err = mergeDict(src.arch, dst.arch, key); err != nil {
 		return platformStringsExprs{}, err
 	}
-	if ps.platform, err = mergeDict(src.platform, dst.platform); err != nil {
+	if ps.platform, err = mergeDict(src.platform, dst.platform, key); err != nil {
 		return platformStringsExprs{}, err
 	}
 	return ps, nil
 }
 
-func mergeList(src, dst *bzl.ListExpr) *bzl.ListExpr {
+// onlyUsesPatterns returns whether the include patterns of the glob call are
+// all in patterns. Exclusions aren't checked.
+func onlyUsesPatterns(glob *bzl.CallExpr, patterns []string) bool {
+	if len(glob.List) == 0 || len(patterns) == 0 {
+		return false
+	}
+	list, ok := glob.List[0].(*bzl.ListExpr)
+	if !ok || len(list.List) == 0 {
+		return false
+	}
+	for _, e := range list.List {
+		s, ok := e.(*bzl.StringExpr)
+		if !ok || !stringIn(s.Value, patterns) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringIn(s string, ss []string) bool {
+	for _, t := range ss {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeList(src, dst *bzl.ListExpr, key func(bzl.Expr) string) *bzl.ListExpr {
 	if dst == nil {
 		return src
 	}
@@ -148,10 +290,14 @@ func mergeList(src, dst *bzl.ListExpr) *bzl.ListExpr {
 	// Build a list of strings from the src list and keep matching strings
 	// in the dst list. This preserves comments. Also keep anything with
 	// a "# keep" comment, whether or not it's in the src list.
-	srcSet := make(map[string]bool)
+	// Comments explaining how strings were resolved are taken from the src
+	// list, so they don't accumulate or go stale. Strings are compared by
+	// key, so for labels, "//foo:foo" in dst matches "//foo" in src, and the
+	// form written in dst is kept. Later duplicates in dst are dropped.
+	srcSet := make(map[string]bzl.Expr)
 	for _, v := range src.List {
-		if s := stringValue(v); s != "" {
-			srcSet[s] = true
+		if s := key(v); s != "" {
+			srcSet[s] = v
 		}
 	}
 
@@ -159,9 +305,17 @@ func mergeList(src, dst *bzl.ListExpr) *bzl.ListExpr {
 	kept := make(map[string]bool)
 	keepComment := false
 	for _, v := range dst.List {
-		s := stringValue(v)
-		if keep := ShouldKeep(v); keep || srcSet[s] {
+		s := key(v)
+		srcValue, inSrc := srcSet[s]
+		keep := ShouldKeep(v)
+		if !keep && s != "" && kept[s] {
+			continue
+		}
+		if keep || inSrc {
 			keepComment = keepComment || keep
+			if inSrc {
+				replaceResolveComments(v, srcValue)
+			}
 			merged = append(merged, v)
 			if s != "" {
 				kept[s] = true
@@ -171,7 +325,7 @@ func mergeList(src, dst *bzl.ListExpr) *bzl.ListExpr {
 
 	// Add anything in the src list that wasn't kept.
 	for _, v := range src.List {
-		if s := stringValue(v); kept[s] {
+		if s := key(v); kept[s] {
 			continue
 		}
 		merged = append(merged, v)
@@ -186,7 +340,22 @@ func mergeList(src, dst *bzl.ListExpr) *bzl.ListExpr {
 	}
 }
 
-func mergeDict(src, dst *bzl.DictExpr) (*bzl.DictExpr, error) {
+// labelKey returns a string used to match v, a label, with elements of
+// another list. Labels are converted to canonical form, so labels whose
+// names are the same as the last component of their packages match their
+// shorthand forms. If hasPkg is true, relative labels are made absolute in
+// pkg, so they match absolute labels there. Other strings are returned as
+// they are. "" is returned if v is not a string.
+func labelKey(v bzl.Expr, pkg string, hasPkg bool) string {
+	s := stringValue(v)
+	l, err := label.Parse(s)
+	if err != nil || l.Relative && !hasPkg {
+		return s
+	}
+	return l.Abs("", pkg).String()
+}
+
+func mergeDict(src, dst *bzl.DictExpr, key func(bzl.Expr) string) (*bzl.DictExpr, error) {
 	if dst == nil {
 		return src, nil
 	}
@@ -227,7 +396,7 @@ func mergeDict(src, dst *bzl.DictExpr) (*bzl.DictExpr, error) {
 	keys := make([]string, 0, len(entries))
 	haveDefault := false
 	for _, e := range entries {
-		e.mergedValue = mergeList(e.srcValue, e.dstValue)
+		e.mergedValue = mergeList(e.srcValue, e.dstValue, key)
 		if e.key == "//conditions:default" {
 			// Keep the default case, even if it's empty.
 			haveDefault = true
@@ -273,6 +442,7 @@ func SquashRules(src, dst *Rule, filename string) error {
 	if ShouldKeep(dst.call) {
 		return nil
 	}
+	names := platformConditionNames(src)
 
 	for key, srcAttr := range src.attrs {
 		srcValue := srcAttr.Y
@@ -280,7 +450,7 @@ func SquashRules(src, dst *Rule, filename string) error {
 			dst.SetAttr(key, srcValue)
 		} else if !ShouldKeep(dstAttr) {
 			dstValue := dstAttr.Y
-			if squashedValue, err := squashExprs(srcValue, dstValue); err != nil {
+			if squashedValue, err := squashExprs(srcValue, dstValue, names); err != nil {
 				start, end := dstValue.Span()
 				return fmt.Errorf("%s:%d.%d-%d.%d: could not squash expression", filename, start.Line, start.LineRune, end.Line, end.LineRune)
 			} else {
@@ -294,7 +464,7 @@ func SquashRules(src, dst *Rule, filename string) error {
 	return nil
 }
 
-func squashExprs(src, dst bzl.Expr) (bzl.Expr, error) {
+func squashExprs(src, dst bzl.Expr, conditionNames map[string]string) (bzl.Expr, error) {
 	if ShouldKeep(dst) {
 		return dst, nil
 	}
@@ -302,11 +472,11 @@ func squashExprs(src, dst bzl.Expr) (bzl.Expr, error) {
 		// may lose src, but they should always be the same.
 		return dst, nil
 	}
-	srcExprs, err := extractPlatformStringsExprs(src)
+	srcExprs, err := extractPlatformStringsExprs(src, conditionNames)
 	if err != nil {
 		return nil, err
 	}
-	dstExprs, err := extractPlatformStringsExprs(dst)
+	dstExprs, err := extractPlatformStringsExprs(dst, conditionNames)
 	if err != nil {
 		return nil, err
 	}
@@ -320,6 +490,13 @@ func squashExprs(src, dst bzl.Expr) (bzl.Expr, error) {
 func squashPlatformStringsExprs(x, y platformStringsExprs) (platformStringsExprs, error) {
 	var ps platformStringsExprs
 	var err error
+	if x.glob != nil && y.glob != nil {
+		return platformStringsExprs{}, fmt.Errorf("could not squash globs")
+	}
+	ps.glob = x.glob
+	if ps.glob == nil {
+		ps.glob = y.glob
+	}
 	if ps.generic, err = squashList(x.generic, y.generic); err != nil {
 		return platformStringsExprs{}, err
 	}
@@ -84,6 +84,180 @@ func (ps *PlatformStrings) Flat() []string {
 	return flat
 }
 
+// Collapse returns a copy of ps with each string moved to the most general
+// set that applies it to the same platforms. platforms lists the platforms
+// being considered; if it's empty, KnownPlatforms are considered. A string
+// that applies to every platform becomes generic. Otherwise, a string that
+// applies to all platforms of some operating systems and no others becomes
+// OS-specific, and a string that applies to all platforms of some
+// architectures becomes arch-specific. This minimizes the number of select
+// branches, and a string never appears in more than one set, so it can't be
+// listed twice for any platform.
+func (ps *PlatformStrings) Collapse(platforms []Platform) PlatformStrings {
+	if len(ps.OS) == 0 && len(ps.Arch) == 0 && len(ps.Platform) == 0 {
+		return *ps
+	}
+	if len(platforms) == 0 {
+		platforms = KnownPlatforms
+	}
+	universe := make(map[Platform]bool)
+	for _, p := range platforms {
+		universe[p] = true
+	}
+	// OS, arch, and platform keys outside the considered platforms still
+	// apply somewhere, so they're considered too.
+	for os := range ps.OS {
+		if !hasOS(universe, os) {
+			for _, arch := range KnownOSArchs[os] {
+				universe[Platform{OS: os, Arch: arch}] = true
+			}
+		}
+	}
+	for arch := range ps.Arch {
+		if !hasArch(universe, arch) {
+			for _, os := range KnownArchOSs[arch] {
+				universe[Platform{OS: os, Arch: arch}] = true
+			}
+		}
+	}
+	for p := range ps.Platform {
+		universe[p] = true
+	}
+
+	generic := make(map[string]bool)
+	for _, s := range ps.Generic {
+		generic[s] = true
+	}
+	covered := make(map[string]map[Platform]bool)
+	cover := func(s string, match func(Platform) bool) {
+		if generic[s] {
+			return
+		}
+		if covered[s] == nil {
+			covered[s] = make(map[Platform]bool)
+		}
+		for p := range universe {
+			if match(p) {
+				covered[s][p] = true
+			}
+		}
+	}
+	for os, ss := range ps.OS {
+		for _, s := range ss {
+			cover(s, func(p Platform) bool { return p.OS == os })
+		}
+	}
+	for arch, ss := range ps.Arch {
+		for _, s := range ss {
+			cover(s, func(p Platform) bool { return p.Arch == arch })
+		}
+	}
+	for platform, ss := range ps.Platform {
+		for _, s := range ss {
+			cover(s, func(p Platform) bool { return p == platform })
+		}
+	}
+
+	var result PlatformStrings
+	for s := range generic {
+		result.Generic = append(result.Generic, s)
+	}
+	for s, cov := range covered {
+		switch {
+		case len(cov) == len(universe):
+			result.Generic = append(result.Generic, s)
+		case coversWholeGroups(universe, cov, func(p, q Platform) bool { return p.OS == q.OS }):
+			if result.OS == nil {
+				result.OS = make(map[string][]string)
+			}
+			for _, os := range sortedOSs(cov) {
+				result.OS[os] = append(result.OS[os], s)
+			}
+		case coversWholeGroups(universe, cov, func(p, q Platform) bool { return p.Arch == q.Arch }):
+			if result.Arch == nil {
+				result.Arch = make(map[string][]string)
+			}
+			for _, arch := range sortedArchs(cov) {
+				result.Arch[arch] = append(result.Arch[arch], s)
+			}
+		default:
+			if result.Platform == nil {
+				result.Platform = make(map[Platform][]string)
+			}
+			for p := range cov {
+				result.Platform[p] = append(result.Platform[p], s)
+			}
+		}
+	}
+	sort.Strings(result.Generic)
+	for _, ss := range result.OS {
+		sort.Strings(ss)
+	}
+	for _, ss := range result.Arch {
+		sort.Strings(ss)
+	}
+	for _, ss := range result.Platform {
+		sort.Strings(ss)
+	}
+	return result
+}
+
+func hasOS(platforms map[Platform]bool, os string) bool {
+	for p := range platforms {
+		if p.OS == os {
+			return true
+		}
+	}
+	return false
+}
+
+func hasArch(platforms map[Platform]bool, arch string) bool {
+	for p := range platforms {
+		if p.Arch == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// coversWholeGroups returns whether, for each platform in cov, every platform
+// in universe in the same group is also in cov.
+func coversWholeGroups(universe, cov map[Platform]bool, sameGroup func(p, q Platform) bool) bool {
+	for p := range cov {
+		for q := range universe {
+			if sameGroup(p, q) && !cov[q] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sortedOSs(platforms map[Platform]bool) []string {
+	set := make(map[string]bool)
+	for p := range platforms {
+		set[p.OS] = true
+	}
+	return sortedSet(set)
+}
+
+func sortedArchs(platforms map[Platform]bool) []string {
+	set := make(map[string]bool)
+	for p := range platforms {
+		set[p.Arch] = true
+	}
+	return sortedSet(set)
+}
+
+func sortedSet(set map[string]bool) []string {
+	ss := make([]string, 0, len(set))
+	for s := range set {
+		ss = append(ss, s)
+	}
+	sort.Strings(ss)
+	return ss
+}
+
 func (ps *PlatformStrings) firstExtFile(ext string) string {
 	for _, f := range ps.Generic {
 		if strings.HasSuffix(f, ext) {
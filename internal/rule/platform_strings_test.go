@@ -0,0 +1,112 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rule
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollapse(t *testing.T) {
+	listed := []Platform{
+		{OS: "darwin", Arch: "amd64"},
+		{OS: "linux", Arch: "amd64"},
+		{OS: "linux", Arch: "arm64"},
+		{OS: "windows", Arch: "amd64"},
+	}
+	for _, tc := range []struct {
+		desc      string
+		platforms []Platform
+		ps, want  PlatformStrings
+	}{
+		{
+			desc: "generic_only",
+			ps:   PlatformStrings{Generic: []string{"b", "a"}},
+			want: PlatformStrings{Generic: []string{"b", "a"}},
+		}, {
+			desc:      "all_oss",
+			platforms: listed,
+			ps: PlatformStrings{
+				Generic: []string{"g"},
+				OS: map[string][]string{
+					"darwin":  {"all", "unix"},
+					"linux":   {"all", "unix"},
+					"windows": {"all", "win"},
+				},
+			},
+			want: PlatformStrings{
+				Generic: []string{"all", "g"},
+				OS: map[string][]string{
+					"darwin":  {"unix"},
+					"linux":   {"unix"},
+					"windows": {"win"},
+				},
+			},
+		}, {
+			desc:      "platforms_to_os",
+			platforms: listed,
+			ps: PlatformStrings{
+				Platform: map[Platform][]string{
+					{OS: "linux", Arch: "amd64"}: {"linux", "x"},
+					{OS: "linux", Arch: "arm64"}: {"linux"},
+				},
+			},
+			want: PlatformStrings{
+				OS: map[string][]string{"linux": {"linux"}},
+				Platform: map[Platform][]string{
+					{OS: "linux", Arch: "amd64"}: {"x"},
+				},
+			},
+		}, {
+			desc:      "platforms_to_arch",
+			platforms: listed,
+			ps: PlatformStrings{
+				OS: map[string][]string{"darwin": {"amd64"}},
+				Platform: map[Platform][]string{
+					{OS: "linux", Arch: "amd64"}:   {"amd64"},
+					{OS: "windows", Arch: "amd64"}: {"amd64"},
+				},
+			},
+			want: PlatformStrings{
+				Arch: map[string][]string{"amd64": {"amd64"}},
+			},
+		}, {
+			desc: "all_known",
+			ps: PlatformStrings{
+				Arch: map[string][]string{
+					"amd64": {"a", "b"},
+				},
+				OS: func() map[string][]string {
+					m := make(map[string][]string)
+					for _, os := range KnownOSs {
+						m[os] = []string{"a"}
+					}
+					return m
+				}(),
+			},
+			want: PlatformStrings{
+				Generic: []string{"a"},
+				Arch:    map[string][]string{"amd64": {"b"}},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := tc.ps.Collapse(tc.platforms); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
@@ -139,6 +139,26 @@ func (f *File) Rel(root string) string {
 	return filepath.ToSlash(rel)
 }
 
+// HasDynamicRules returns whether the file may declare rules that aren't in
+// Rules, since they're declared by list comprehensions or loops at the top
+// level. Their names can't be known without evaluating the file.
+func (f *File) HasDynamicRules() bool {
+	for _, stmt := range f.File.Stmt {
+		if assign, ok := stmt.(*bzl.BinaryExpr); ok && assign.Op == "=" {
+			stmt = assign.Y
+		}
+		switch stmt := stmt.(type) {
+		case *bzl.ListForExpr:
+			return true
+		case *bzl.PythonBlock:
+			if strings.HasPrefix(stmt.Token, "for ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Sync writes all changes back to the wrapped syntax tree. This should be
 // called after editing operations, before reading the syntax tree again.
 func (f *File) Sync() {
@@ -342,6 +362,45 @@ func (l *Load) Remove(sym string) {
 	}
 }
 
+// IsAlias returns whether sym is loaded under a different name, as in
+// load("file.bzl", sym = "name").
+func (l *Load) IsAlias(sym string) bool {
+	_, ok := l.symbols[sym].(*bzl.BinaryExpr)
+	return ok
+}
+
+// Merge adds the symbols loaded by other to this statement. Aliases are
+// preserved. Symbols already loaded by this statement are not changed.
+func (l *Load) Merge(other *Load) {
+	for sym, e := range other.symbols {
+		if _, ok := l.symbols[sym]; !ok {
+			l.symbols[sym] = e
+			l.updated = true
+		}
+	}
+}
+
+// Sort ensures the symbols of this statement are sorted when the file is
+// synced: plain symbols by name, followed by aliases by name. Statements
+// that are already sorted are not modified.
+func (l *Load) Sort() {
+	prevAlias, prev := false, ""
+	for i, arg := range l.call.List[1:] {
+		alias, name := false, ""
+		switch arg := arg.(type) {
+		case *bzl.StringExpr:
+			name = arg.Value
+		case *bzl.BinaryExpr:
+			alias, name = true, arg.X.(*bzl.LiteralExpr).Token
+		}
+		if i > 0 && (prevAlias && !alias || prevAlias == alias && name < prev) {
+			l.updated = true
+			return
+		}
+		prevAlias, prev = alias, name
+	}
+}
+
 // IsEmpty returns whether this statement loads any symbols.
 func (l *Load) IsEmpty() bool {
 	return len(l.symbols) == 0
@@ -375,7 +434,7 @@ func (l *Load) sync() {
 		return args[i].Value < args[j].Value
 	})
 	sort.Slice(kwargs, func(i, j int) bool {
-		return kwargs[i].X.(*bzl.StringExpr).Value < kwargs[j].Y.(*bzl.StringExpr).Value
+		return kwargs[i].X.(*bzl.LiteralExpr).Token < kwargs[j].X.(*bzl.LiteralExpr).Token
 	})
 
 	list := make([]bzl.Expr, 0, 1+len(l.symbols))
@@ -397,6 +456,10 @@ type Rule struct {
 	args    []bzl.Expr
 	attrs   map[string]*bzl.BinaryExpr
 	private map[string]interface{}
+
+	// attrOrder is a list of attributes that are written first, in this
+	// order, when the rule is synced. See SetAttrOrder.
+	attrOrder []string
 }
 
 // NewRule creates a new, empty rule with the given kind and name.
@@ -559,6 +622,17 @@ func (r *Rule) SetAttr(key string, value interface{}) {
 	r.updated = true
 }
 
+// AttrComments returns the comments attached to the named attribute, or nil
+// if the attribute is not set. Suffix comments written on the same line as
+// the attribute are found here. The returned comments may be modified.
+func (r *Rule) AttrComments(key string) *bzl.Comments {
+	attr, ok := r.attrs[key]
+	if !ok {
+		return nil
+	}
+	return attr.Comment()
+}
+
 // PrivateAttrKeys returns a sorted list of private attribute names.
 func (r *Rule) PrivateAttrKeys() []string {
 	keys := make([]string, 0, len(r.private))
@@ -581,6 +655,16 @@ func (r *Rule) SetPrivateAttr(key string, value interface{}) {
 	r.private[key] = value
 }
 
+// SetAttrOrder sets the order in which attributes are written when the rule
+// is synced. Attributes in order are written first, in that order. Other
+// attributes follow in the default order: by priority in buildifier's
+// tables, then by name. Attributes are only reordered when the rule is
+// modified, so unchanged rules keep their formatting. This is usually set
+// from KindInfo.AttrOrder.
+func (r *Rule) SetAttrOrder(order []string) {
+	r.attrOrder = order
+}
+
 // Args returns positional arguments passed to a rule.
 func (r *Rule) Args() []bzl.Expr {
 	return r.args
@@ -596,6 +680,15 @@ func (r *Rule) Insert(f *File) {
 	f.Rules = append(f.Rules, r)
 }
 
+// InsertAt marks this statement for insertion before the statement at the
+// given index. If multiple statements are inserted at the same index, they
+// will be inserted in the order InsertAt is called.
+func (r *Rule) InsertAt(f *File, index int) {
+	r.index = index
+	r.inserted = true
+	f.Rules = append(f.Rules, r)
+}
+
 // IsEmpty returns true when the rule contains none of the attributes in attrs
 // for its kind. attrs should contain attributes that make the rule buildable
 // like srcs or deps and not descriptive attributes like name or visibility.
@@ -623,13 +716,24 @@ func (r *Rule) IsEmptyOld(attrs map[string]bool) bool {
 	return true
 }
 
+// SortedAttrsKey is the name of a private attribute of rules that limits
+// which attributes have their string lists sorted when the rule is updated.
+// It's set on existing rules when only some of their attributes may be
+// modified, so lists in other attributes keep their order. Without it,
+// "srcs" and "deps" are sorted.
+const SortedAttrsKey = "_sorted_attrs"
+
 func (r *Rule) sync() {
 	if !r.updated {
 		return
 	}
 	r.updated = false
 
+	only, hasOnly := r.PrivateAttr(SortedAttrsKey).([]string)
 	for _, k := range []string{"srcs", "deps"} {
+		if hasOnly && !stringIn(k, only) {
+			continue
+		}
 		if attr, ok := r.attrs[k]; ok {
 			bzl.Walk(attr.Y, sortExprLabels)
 		}
@@ -645,9 +749,20 @@ func (r *Rule) sync() {
 	}
 	sortedAttrs := list[len(r.args):]
 	key := func(e bzl.Expr) string { return e.(*bzl.BinaryExpr).X.(*bzl.LiteralExpr).Token }
+	order := make(map[string]int, len(r.attrOrder))
+	for i, k := range r.attrOrder {
+		order[k] = i
+	}
 	sort.SliceStable(sortedAttrs, func(i, j int) bool {
 		ki := key(sortedAttrs[i])
 		kj := key(sortedAttrs[j])
+		oi, iok := order[ki]
+		oj, jok := order[kj]
+		if iok && jok {
+			return oi < oj
+		} else if iok != jok {
+			return iok
+		}
 		if cmp := bt.NamePriority[ki] - bt.NamePriority[kj]; cmp != 0 {
 			return cmp < 0
 		}
@@ -656,6 +771,15 @@ func (r *Rule) sync() {
 
 	r.call.List = list
 	r.updated = false
+
+	// Suffix comments on attributes are only printed with their attributes
+	// when the call is printed on multiple lines.
+	for _, attr := range r.attrs {
+		if len(attr.Comment().Suffix) > 0 {
+			r.call.ForceMultiLine = true
+			break
+		}
+	}
 }
 
 // ShouldKeep returns whether e is marked with a "# keep" comment. Kept
@@ -102,6 +102,70 @@ x_library(name = "bar")
 	}
 }
 
+func TestAttrOrder(t *testing.T) {
+	old := []byte(`
+x_library(
+    name = "foo",
+    deps = [":bar"],
+    visibility = ["//visibility:public"],
+    importpath = "example.com/foo",
+    srcs = ["foo.x"],
+)
+`)
+	f, err := LoadData("old", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := f.Rules[0]
+	r.SetAttrOrder([]string{"name", "srcs", "importpath", "deps"})
+	r.SetAttr("data", []string{"foo.txt"})
+
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+x_library(
+    name = "foo",
+    srcs = ["foo.x"],
+    importpath = "example.com/foo",
+    deps = [":bar"],
+    data = ["foo.txt"],
+    visibility = ["//visibility:public"],
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLoadMergeAndSort(t *testing.T) {
+	f, err := LoadData("old", []byte(`
+load("a.bzl", "y", z = "z_impl")
+load("a.bzl", "x", b = "b_impl")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Loads[0].Merge(f.Loads[1])
+	f.Loads[1].Delete()
+	f.Loads[0].Sort()
+
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+load(
+    "a.bzl",
+    "x",
+    "y",
+    b = "b_impl",
+    z = "z_impl",
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !f.Loads[0].IsAlias("b") || f.Loads[0].IsAlias("x") {
+		t.Errorf("IsAlias: got %v, %v; want true, false", f.Loads[0].IsAlias("b"), f.Loads[0].IsAlias("x"))
+	}
+}
+
 func TestSymbolsReturnsKeys(t *testing.T) {
 	f, err := LoadData("load", []byte(`load("a.bzl", "y", z = "a")`))
 	if err != nil {
@@ -114,6 +178,47 @@ func TestSymbolsReturnsKeys(t *testing.T) {
 	}
 }
 
+func TestHasDynamicRules(t *testing.T) {
+	for _, tc := range []struct {
+		desc, content string
+		want          bool
+	}{
+		{
+			desc:    "calls",
+			content: `go_library(name = "a")`,
+		}, {
+			desc:    "comprehension",
+			content: `[go_library(name = n) for n in ["a", "b"]]`,
+			want:    true,
+		}, {
+			desc:    "assigned_comprehension",
+			content: `libs = [go_library(name = n) for n in ["a", "b"]]`,
+			want:    true,
+		}, {
+			desc: "loop",
+			content: `for n in ["a", "b"]:
+    go_library(name = n)
+`,
+			want: true,
+		}, {
+			desc: "def",
+			content: `def f():
+    pass
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := LoadData("BUILD.bazel", []byte(tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.HasDynamicRules(); got != tc.want {
+				t.Errorf("got %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestKeepRule(t *testing.T) {
 	for _, tc := range []struct {
 		desc, src string
@@ -232,3 +337,88 @@ func TestShouldKeepExpr(t *testing.T) {
 		})
 	}
 }
+
+func TestAnnotateAndMergeResolveComments(t *testing.T) {
+	f, err := LoadData("old", []byte(`
+go_library(
+    name = "go_default_library",
+    deps = [
+        "//a:go_default_library",  # resolved via prefix
+        "//b:go_default_library",  # resolved via index
+        "//c:go_default_library",  # keep
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen := NewRule("go_library", "go_default_library")
+	gen.SetAttr("deps", []string{"//a:go_default_library", "//b:go_default_library", "@x//d:go_default_library"})
+	AnnotateExprStrings(gen.Attr("deps"), map[string]string{
+		"//a:go_default_library":   "index",
+		"@x//d:go_default_library": "remote cache",
+	})
+	MergeRules(gen, f.Rules[0], map[string]bool{"deps": true}, "old")
+	f.Sync()
+
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_library(
+    name = "go_default_library",
+    deps = [
+        "//a:go_default_library",  # resolved via index
+        "//b:go_default_library",
+        "//c:go_default_library",  # keep
+        "@x//d:go_default_library",  # resolved via remote cache
+    ],
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMergeShorthandLabels(t *testing.T) {
+	f, err := LoadData("old", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["//s:s"],
+    deps = [
+        "//vendor/b/vendor/a:a",  # comment
+        "//x:x",
+        "@r//y:y",
+        ":w",
+        "//pkg:w",
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen := NewRule("go_library", "go_default_library")
+	gen.SetAttr("srcs", []string{"//s"})
+	gen.SetAttr("deps", []string{"//vendor/b/vendor/a", "@r//y", "//z:z", "//pkg:w"})
+	gen.SetPrivateAttr(LabelAttrsKey, []string{"deps"})
+	gen.SetPrivateAttr(LabelPkgKey, "pkg")
+	MergeRules(gen, f.Rules[0], map[string]bool{"srcs": true, "deps": true}, "old")
+	f.Sync()
+
+	got := strings.TrimSpace(string(f.Format()))
+	want := strings.TrimSpace(`
+go_library(
+    name = "go_default_library",
+    srcs = ["//s"],
+    deps = [
+        ":w",
+        "//vendor/b/vendor/a:a",  # comment
+        "//z:z",
+        "@r//y:y",
+    ],
+)
+`)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -60,4 +60,17 @@ type KindInfo struct {
 	// ResolveAttrs is a set of attributes that should be merged after
 	// dependency resolution. See rule.Merge.
 	ResolveAttrs map[string]bool
+
+	// AttrOrder is the conventional order of attributes for rules of this
+	// kind. Listed attributes are written first, in this order, when a rule
+	// is updated. Other attributes follow in the default order. See
+	// Rule.SetAttrOrder.
+	AttrOrder []string
+
+	// PreservedAttrs is a set of attributes that are carried over from an
+	// existing rule to the generated rule it's merged with, even if they're
+	// mergeable. This is also done when the existing rule is deleted because
+	// it's empty, and a rule with the same name and kind is generated. Users
+	// may preserve more attributes with # gazelle:preserve_attrs.
+	PreservedAttrs map[string]bool
 }
@@ -85,7 +85,7 @@ func ExprFromValue(val interface{}) bzl.Expr {
 		sort.Sort(byString(rkeys))
 		args := make([]bzl.Expr, len(rkeys))
 		for i, rk := range rkeys {
-			label := fmt.Sprintf("@io_bazel_rules_go//go/platform:%s", mapKeyString(rk))
+			label := platformConditionPrefix + mapKeyString(rk)
 			k := &bzl.StringExpr{Value: label}
 			v := ExprFromValue(rv.MapIndex(rk).Interface())
 			if l, ok := v.(*bzl.ListExpr); ok {
@@ -110,9 +110,10 @@ func ExprFromValue(val interface{}) bzl.Expr {
 			globArgs := []bzl.Expr{patternsValue}
 			if len(val.Excludes) > 0 {
 				excludesValue := ExprFromValue(val.Excludes)
-				globArgs = append(globArgs, &bzl.KeyValueExpr{
-					Key:   &bzl.StringExpr{Value: "excludes"},
-					Value: excludesValue,
+				globArgs = append(globArgs, &bzl.BinaryExpr{
+					X:  &bzl.LiteralExpr{Token: "exclude"},
+					Op: "=",
+					Y:  excludesValue,
 				})
 			}
 			return &bzl.CallExpr{
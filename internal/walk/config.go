@@ -44,6 +44,18 @@ func (wc *walkConfig) isExcluded(base string) bool {
 	return false
 }
 
+// Excluded returns the slash-separated paths, relative to the repository
+// root, of files and directories excluded with # gazelle:exclude directives
+// that apply in the directory rel. c must be the configuration for rel.
+func Excluded(c *config.Config, rel string) []string {
+	wc := getWalkConfig(c)
+	paths := make([]string, len(wc.excludes))
+	for i, x := range wc.excludes {
+		paths[i] = path.Join(rel, x)
+	}
+	return paths
+}
+
 type walkConfigurer struct{}
 
 func (_ *walkConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {}
@@ -16,13 +16,15 @@ limitations under the License.
 package walk
 
 import (
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/pathtools"
@@ -39,7 +41,11 @@ import (
 // c is the configuration for the current directory. This may have been
 // modified by directives in the directory's build file.
 //
-// update is true when the build file may be updated.
+// update is true when the build file may be updated. It's false for
+// directories outside c.Dirs, ignored directories, and, when
+// c.ChangedSince is set, directories where nothing changed since then.
+// When c.CreateOnly is set, it's also false for directories that already
+// have a build file.
 //
 // f is the existing build file in the directory. Will be nil if there
 // was no file.
@@ -60,8 +66,26 @@ type WalkFunc func(dir, rel string, c *config.Config, update bool, f *rule.File,
 // in each directory in pre-order, whether a build file is present in the
 // directory or not.
 //
+// In the repository root, directives in the .gazelle file are passed to
+// Configure with those in the root build file, as if they were written at
+// the top of it.
+//
 // Walk calls the callback wf in post-order.
 func Walk(c *config.Config, cexts []config.Configurer, wf WalkFunc) {
+	WalkParallel(c, cexts, 1, wf)
+}
+
+// WalkParallel is like Walk, but it calls wf concurrently in up to workers
+// goroutines. Configuration is computed for every directory before wf is
+// called for any directory, so wf sees the same configuration it would
+// see with Walk. wf is called for a directory only after it has returned
+// for all of the directory's subdirectories, but calls for directories in
+// different subtrees may happen in any order or at the same time. wf must
+// be safe to call concurrently.
+//
+// If workers is less than 2, WalkParallel is equivalent to Walk, and wf is
+// called serially in post-order.
+func WalkParallel(c *config.Config, cexts []config.Configurer, workers int, wf WalkFunc) {
 	cexts = append(cexts, &walkConfigurer{})
 	knownDirectives := make(map[string]bool)
 	for _, cext := range cexts {
@@ -72,9 +96,11 @@ func Walk(c *config.Config, cexts []config.Configurer, wf WalkFunc) {
 
 	updateRels := buildUpdateRels(c.RepoRoot, c.Dirs)
 	symlinks := symlinkResolver{root: c.RepoRoot, visited: []string{c.RepoRoot}}
+	parallel := workers > 1
+	var visits []*dirVisit
 
-	var visit func(*config.Config, string, string, bool)
-	visit = func(c *config.Config, dir, rel string, isUpdateDir bool) {
+	var visit func(*config.Config, string, string, bool, bool, *dirVisit)
+	visit = func(c *config.Config, dir, rel string, isUpdateDir, isChangedDir bool, parent *dirVisit) {
 		haveError := false
 
 		if !isUpdateDir {
@@ -99,30 +125,205 @@ func Walk(c *config.Config, cexts []config.Configurer, wf WalkFunc) {
 		c = configure(cexts, knownDirectives, c, rel, f)
 		wc := getWalkConfig(c)
 
-		var subdirs, regularFiles []string
-		for _, fi := range files {
-			base := fi.Name()
-			switch {
-			case base == "" || base[0] == '.' || base[0] == '_' || wc.isExcluded(base):
-				continue
-
-			case fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 && symlinks.follow(dir, base):
-				subdirs = append(subdirs, base)
+		subdirs, regularFiles, lastModified := listFiles(&wc, &symlinks, dir, files, c.IncrementalMarker)
+		var isChangedSubtree bool
+		isChangedDir, isChangedSubtree = checkChanged(c.ChangedSince, dir, f, files, lastModified, isChangedDir)
 
-			default:
-				regularFiles = append(regularFiles, base)
+		var dv *dirVisit
+		if parallel {
+			dv = &dirVisit{parent: parent}
+			if parent != nil {
+				parent.pending++
 			}
+			visits = append(visits, dv)
 		}
 
 		for _, sub := range subdirs {
-			visit(c, filepath.Join(dir, sub), path.Join(rel, sub), isUpdateDir)
+			visit(c, filepath.Join(dir, sub), path.Join(rel, sub), isUpdateDir, isChangedSubtree, dv)
 		}
 
 		genFiles := findGenFiles(wc, f)
-		update := !haveError && isUpdateDir && !wc.ignore
-		wf(dir, rel, c, update, f, subdirs, regularFiles, genFiles)
+		update := !haveError && isUpdateDir && isChangedDir && !wc.ignore && !(c.CreateOnly && f != nil)
+		call := func() {
+			wf(dir, rel, c, update, f, subdirs, regularFiles, genFiles)
+		}
+		if parallel {
+			dv.call = call
+		} else {
+			call()
+		}
+	}
+	visit(c, c.RepoRoot, "", false, false, nil)
+
+	if parallel {
+		runParallel(visits, workers)
+	}
+}
+
+// WalkDir calls wf for the single directory rel, a slash-separated path
+// relative to c.RepoRoot. Configure is called on each configuration extension
+// in cexts for the repository root and each directory between it and rel, so
+// wf sees the same configuration and update flag it would see with Walk.
+// Subdirectories of rel are not visited, and other directories are only read
+// to load their build files.
+//
+// wf is not called if rel can't be read or if Walk wouldn't visit it, for
+// example, because it's excluded.
+func WalkDir(c *config.Config, cexts []config.Configurer, rel string, wf WalkFunc) {
+	cexts = append(cexts, &walkConfigurer{})
+	knownDirectives := make(map[string]bool)
+	for _, cext := range cexts {
+		for _, d := range cext.KnownDirectives() {
+			knownDirectives[d] = true
+		}
+	}
+
+	updateRels := buildUpdateRels(c.RepoRoot, c.Dirs)
+	symlinks := symlinkResolver{root: c.RepoRoot, visited: []string{c.RepoRoot}}
+	rel = path.Clean(rel)
+	var bases []string
+	if rel != "." && rel != "/" {
+		bases = strings.Split(strings.Trim(rel, "/"), "/")
+	}
+
+	dir := c.RepoRoot
+	rel = ""
+	isUpdateDir, isChangedDir := false, false
+	for i := 0; ; i++ {
+		if !isUpdateDir {
+			isUpdateDir = shouldUpdateDir(rel, updateRels)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		f, err := loadBuildFile(dir, files, c.ValidBuildFileNames)
+		if err != nil {
+			log.Print(err)
+		}
+		haveError := err != nil
+		c = configure(cexts, knownDirectives, c, rel, f)
+		wc := getWalkConfig(c)
+
+		if i == len(bases) {
+			subdirs, regularFiles, lastModified := listFiles(&wc, &symlinks, dir, files, c.IncrementalMarker)
+			isChangedDir, _ = checkChanged(c.ChangedSince, dir, f, files, lastModified, isChangedDir)
+			genFiles := findGenFiles(wc, f)
+			update := !haveError && isUpdateDir && isChangedDir && !wc.ignore && !(c.CreateOnly && f != nil)
+			wf(dir, rel, c, update, f, subdirs, regularFiles, genFiles)
+			return
+		}
+
+		// Only build files in ancestors can affect whether rel is changed.
+		_, isChangedDir = checkChanged(c.ChangedSince, dir, f, files, time.Time{}, isChangedDir)
+		base := bases[i]
+		if base == ".." || base[0] == '.' || base[0] == '_' || wc.isExcluded(base) {
+			return
+		}
+		dir, rel = filepath.Join(dir, base), path.Join(rel, base)
+	}
+}
+
+// listFiles returns the base names of subdirectories and regular files in
+// files, which were read from dir, without excluded files. The latest
+// modification time of the regular files is also returned. The incremental
+// marker file at the path marker doesn't count as a modification.
+func listFiles(wc *walkConfig, symlinks *symlinkResolver, dir string, files []os.FileInfo, marker string) (subdirs, regularFiles []string, lastModified time.Time) {
+	for _, fi := range files {
+		base := fi.Name()
+		switch {
+		case base == "" || base[0] == '.' || base[0] == '_' || wc.isExcluded(base):
+			continue
+
+		case fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 && symlinks.follow(dir, base):
+			subdirs = append(subdirs, base)
+
+		default:
+			regularFiles = append(regularFiles, base)
+			if fi.ModTime().After(lastModified) && filepath.Join(dir, base) != marker {
+				lastModified = fi.ModTime()
+			}
+		}
+	}
+	return subdirs, regularFiles, lastModified
+}
+
+// checkChanged returns whether dir and the tree rooted at dir should be
+// treated as changed since the time since. isChangedDir is true when the
+// parent's subtree is changed.
+//
+// In incremental mode, a directory is only updated if it was modified
+// (for example, because files were added or removed) or if any of its
+// regular files were modified. Directives in a modified build file
+// may affect subdirectories, so they're updated, too.
+func checkChanged(since time.Time, dir string, f *rule.File, files []os.FileInfo, lastModified time.Time, isChangedDir bool) (changedDir, changedSubtree bool) {
+	if since.IsZero() || isChangedDir {
+		return true, true
+	}
+	if f != nil && isModifiedAfter(files, filepath.Base(f.Path), since) {
+		return true, true
+	}
+	if lastModified.After(since) {
+		return true, false
+	}
+	if st, err := os.Stat(dir); err != nil || st.ModTime().After(since) {
+		return true, false
+	}
+	return false, false
+}
+
+// isModifiedAfter returns whether the file named base in files was modified
+// after t.
+func isModifiedAfter(files []os.FileInfo, base string, t time.Time) bool {
+	for _, fi := range files {
+		if fi.Name() == base {
+			return fi.ModTime().After(t)
+		}
+	}
+	return false
+}
+
+// dirVisit is a pending callback for a directory, used by WalkParallel.
+type dirVisit struct {
+	// call invokes the WalkFunc for the directory.
+	call func()
+
+	// parent is the visit for the parent directory, which may not be called
+	// until pending reaches zero. nil for the root directory.
+	parent *dirVisit
+
+	// pending is the number of subdirectories whose callbacks have not
+	// returned yet.
+	pending int32
+}
+
+// runParallel calls the callbacks in visits using up to workers goroutines.
+// A callback is started only after the callbacks for all subdirectories
+// have returned.
+func runParallel(visits []*dirVisit, workers int) {
+	// The channel is large enough to hold every visit, so sends never block.
+	ready := make(chan *dirVisit, len(visits))
+	var wg sync.WaitGroup
+	wg.Add(len(visits))
+	for _, dv := range visits {
+		if dv.pending == 0 {
+			ready <- dv
+		}
 	}
-	visit(c, c.RepoRoot, "", false)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for dv := range ready {
+				dv.call()
+				if p := dv.parent; p != nil && atomic.AddInt32(&p.pending, -1) == 0 {
+					ready <- p
+				}
+				wg.Done()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ready)
 }
 
 // buildUpdateRels builds a list of relative paths from the repository root
@@ -155,30 +356,30 @@ func shouldUpdateDir(rel string, updateRels []string) bool {
 	return false
 }
 
+// loadBuildFile loads the build file in dir. If there are several files
+// with valid build file names, the one that appears first in
+// buildFileNames is loaded. The loaded file keeps its original name, so
+// it will be written back to the same path when updated.
 func loadBuildFile(dir string, files []os.FileInfo, buildFileNames []string) (*rule.File, error) {
-	var f *rule.File
+	present := make(map[string]bool)
+	for _, fi := range files {
+		if !fi.IsDir() {
+			present[fi.Name()] = true
+		}
+	}
 	for _, base := range buildFileNames {
-		for _, fi := range files {
-			if fi.Name() != base || fi.IsDir() {
-				continue
-			}
-			if f != nil {
-				return f, fmt.Errorf("in directory %s, multiple Bazel files are present: %s, %s", dir, filepath.Base(f.Path), base)
-			}
-			var err error
-			f, err = rule.LoadFile(filepath.Join(dir, base))
-			if err != nil {
-				return nil, err
-			}
-			return f, nil
+		if present[base] {
+			return rule.LoadFile(filepath.Join(dir, base))
 		}
 	}
-	return f, nil
+	return nil, nil
 }
 
 func configure(cexts []config.Configurer, knownDirectives map[string]bool, c *config.Config, rel string, f *rule.File) *config.Config {
 	if rel != "" {
 		c = c.Clone()
+	} else {
+		f = withConfigFileDirectives(c.RepoRoot, f)
 	}
 	if f != nil {
 		for _, d := range f.Directives {
@@ -193,6 +394,33 @@ func configure(cexts []config.Configurer, knownDirectives map[string]bool, c *co
 	return c
 }
 
+// configFileName is the name of a file in the repository root with
+// directives that apply to the whole repository, as if they were at the top
+// of the root build file. Each line is a directive with the same syntax as in
+// build files, like "# gazelle:prefix example.com/repo". Directives in build
+// files, including the root build file, override these.
+const configFileName = ".gazelle"
+
+// withConfigFileDirectives returns the file Configure is called with in the
+// repository root: f, with the directives in configFileName inserted before
+// its own. If there's no such file, f is returned unchanged. If f is nil,
+// the parsed config file is returned, so its directives still apply.
+func withConfigFileDirectives(repoRoot string, f *rule.File) *rule.File {
+	cf, err := rule.LoadFile(filepath.Join(repoRoot, configFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+		return f
+	}
+	if f == nil {
+		return cf
+	}
+	fCopy := *f
+	fCopy.Directives = append(cf.Directives, f.Directives...)
+	return &fCopy
+}
+
 func findGenFiles(wc walkConfig, f *rule.File) []string {
 	if f == nil {
 		return nil
@@ -22,8 +22,11 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/bazel-gazelle/internal/config"
 	"github.com/bazelbuild/bazel-gazelle/internal/rule"
@@ -51,6 +54,48 @@ func TestConfigureCallbackOrder(t *testing.T) {
 	}
 }
 
+func TestWalkParallel(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "a/b/c/"},
+		{path: "a/d/"},
+		{path: "e/f/"},
+		{path: "g/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, cexts := testConfig(dir)
+	var configureRels []string
+	cexts = append(cexts, &testConfigurer{func(_ *config.Config, rel string, _ *rule.File) {
+		configureRels = append(configureRels, rel)
+	}})
+
+	var mu sync.Mutex
+	var callbackRels []string
+	done := make(map[string]bool)
+	WalkParallel(c, cexts, 4, func(_ string, rel string, _ *config.Config, _ bool, _ *rule.File, subdirs, _, _ []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, sub := range subdirs {
+			if subRel := path.Join(rel, sub); !done[subRel] {
+				t.Errorf("callback for %q called before callback for %q", rel, subRel)
+			}
+		}
+		done[rel] = true
+		callbackRels = append(callbackRels, rel)
+	})
+
+	want := []string{"", "a", "a/b", "a/b/c", "a/d", "e", "e/f", "g"}
+	if !reflect.DeepEqual(configureRels, want) {
+		t.Errorf("configure order: got %#v; want %#v", configureRels, want)
+	}
+	sort.Strings(callbackRels)
+	if !reflect.DeepEqual(callbackRels, want) {
+		t.Errorf("callbacks: got %#v; want %#v", callbackRels, want)
+	}
+}
+
 func TestUpdateDirs(t *testing.T) {
 	dir, err := createFiles([]fileSpec{
 		{path: "update/sub/"},
@@ -93,6 +138,197 @@ func TestUpdateDirs(t *testing.T) {
 	}
 }
 
+func TestChangedSince(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "old/a.go"},
+		{path: "new/a.go"},
+		{path: "build/BUILD.bazel"},
+		{path: "build/sub/a.go"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	since := time.Now().Add(-time.Hour)
+	old := since.Add(-time.Hour)
+	for _, p := range []string{"", "old", "old/a.go", "new", "build", "build/sub", "build/sub/a.go"} {
+		if err := os.Chtimes(filepath.Join(dir, p), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, cexts := testConfig(dir)
+	c.Dirs = []string{dir}
+	c.ChangedSince = since
+	updates := make(map[string]bool)
+	Walk(c, cexts, func(_ string, rel string, _ *config.Config, update bool, _ *rule.File, _, _, _ []string) {
+		updates[rel] = update
+	})
+	want := map[string]bool{
+		"":          false,
+		"old":       false,
+		"new":       true,
+		"build":     true,
+		"build/sub": true,
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("got %#v; want %#v", updates, want)
+	}
+}
+
+func TestChangedSinceIgnoresMarker(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "a.go"},
+		{path: "gazelle_marker"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	since := time.Now().Add(-time.Hour)
+	old := since.Add(-time.Hour)
+	for _, p := range []string{"", "a.go"} {
+		if err := os.Chtimes(filepath.Join(dir, p), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, cexts := testConfig(dir)
+	c.Dirs = []string{dir}
+	c.ChangedSince = since
+	c.IncrementalMarker = filepath.Join(dir, "gazelle_marker")
+	Walk(c, cexts, func(_ string, rel string, _ *config.Config, update bool, _ *rule.File, _, _, _ []string) {
+		if update {
+			t.Errorf("%q: got update; want no update, since only the marker changed", rel)
+		}
+	})
+}
+
+func TestCreateOnly(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: "BUILD.bazel"},
+		{path: "old/BUILD.bazel"},
+		{path: "old/a.go"},
+		{path: "new/a.go"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, cexts := testConfig(dir)
+	c.Dirs = []string{dir}
+	c.CreateOnly = true
+	updates := make(map[string]bool)
+	Walk(c, cexts, func(_ string, rel string, _ *config.Config, update bool, _ *rule.File, _, _, _ []string) {
+		updates[rel] = update
+	})
+	want := map[string]bool{
+		"":    false,
+		"old": false,
+		"new": true,
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("got %#v; want %#v", updates, want)
+	}
+}
+
+func TestConfigFileDirectives(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{path: ".gazelle", content: "# gazelle:exclude x\n# gazelle:a b\n"},
+		{path: "BUILD.bazel", content: "# gazelle:exclude y\n"},
+		{path: "sub/BUILD.bazel", content: "# gazelle:exclude z\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := make(map[string][]rule.Directive)
+	c, cexts := testConfig(dir)
+	cexts = append(cexts, &testConfigurer{func(_ *config.Config, rel string, f *rule.File) {
+		if f != nil {
+			got[rel] = f.Directives
+		}
+	}})
+	var rootFile *rule.File
+	Walk(c, cexts, func(_ string, rel string, _ *config.Config, _ bool, f *rule.File, _, _, _ []string) {
+		if rel == "" {
+			rootFile = f
+		}
+	})
+
+	want := map[string][]rule.Directive{
+		"":    {{Key: "exclude", Value: "x"}, {Key: "a", Value: "b"}, {Key: "exclude", Value: "y"}},
+		"sub": {{Key: "exclude", Value: "z"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got directives %#v; want %#v", got, want)
+	}
+	if want := []rule.Directive{{Key: "exclude", Value: "y"}}; !reflect.DeepEqual(rootFile.Directives, want) {
+		t.Errorf("got root file directives %#v; want %#v", rootFile.Directives, want)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	dir, err := createFiles([]fileSpec{
+		{
+			path: "BUILD.bazel",
+			content: `# gazelle:build_file_name BUILD
+# gazelle:exclude a/excluded
+`,
+		},
+		{path: "a/BUILD", content: `genrule(name = "gen", outs = ["gen.go"])`},
+		{path: "a/a.go"},
+		{path: "a/b/b.go"},
+		{path: "a/excluded/x.go"},
+		{path: "ignored/BUILD", content: "# gazelle:ignore"},
+		{path: "ignored/sub/c.go"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type visit struct {
+		dir, rel                        string
+		update                          bool
+		buildFileNames                  []string
+		subdirs, regularFiles, genFiles []string
+	}
+	record := func(visits map[string]visit) WalkFunc {
+		return func(dir, rel string, c *config.Config, update bool, _ *rule.File, subdirs, regularFiles, genFiles []string) {
+			visits[rel] = visit{dir, rel, update, c.ValidBuildFileNames, subdirs, regularFiles, genFiles}
+		}
+	}
+
+	c, cexts := testConfig(dir)
+	c.Dirs = []string{filepath.Join(dir, "a")}
+	want := make(map[string]visit)
+	Walk(c, cexts, record(want))
+
+	for _, rel := range []string{"", "a", "a/b", "ignored", "ignored/sub", "a/excluded", "missing"} {
+		t.Run(rel, func(t *testing.T) {
+			c, cexts := testConfig(dir)
+			c.Dirs = []string{filepath.Join(dir, "a")}
+			got := make(map[string]visit)
+			WalkDir(c, cexts, rel, record(got))
+			w, ok := want[rel]
+			if !ok {
+				if len(got) > 0 {
+					t.Errorf("got visits %#v; want none", got)
+				}
+				return
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[rel], w) {
+				t.Errorf("got visits %#v; want %#v", got, w)
+			}
+		})
+	}
+}
+
 func TestCustomBuildName(t *testing.T) {
 	dir, err := createFiles([]fileSpec{
 		{